@@ -40,6 +40,16 @@ func initConfigFileInputSourceFunc(configFlag string, flags []cli.Flag, next cli
 // This function also maps aliases, so a .yml file can contain short options, or options with underscores
 // instead of dashes. See https://github.com/binwiederhier/ntfy/issues/255.
 func newYamlSourceFromFile(file string, flags []cli.Flag) (altsrc.InputSourceContext, error) {
+	rawConfig, err := readYamlConfigFile(file, flags)
+	if err != nil {
+		return nil, err
+	}
+	return altsrc.NewMapInputSource(file, rawConfig), nil
+}
+
+// readYamlConfigFile reads the .yml file into a map, with all aliases mapped to the flag names, see newYamlSourceFromFile.
+// Unlike the InputSourceContext, the map can be used to check if an option is set in the file at all.
+func readYamlConfigFile(file string, flags []cli.Flag) (map[any]any, error) {
 	var rawConfig map[any]any
 	b, err := os.ReadFile(file)
 	if err != nil {
@@ -56,5 +66,5 @@ func newYamlSourceFromFile(file string, flags []cli.Flag) (altsrc.InputSourceCon
 			}
 		}
 	}
-	return altsrc.NewMapInputSource(file, rawConfig), nil
+	return rawConfig, nil
 }
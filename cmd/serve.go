@@ -19,6 +19,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -51,6 +52,7 @@ var flagsServe = append(
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-file", Aliases: []string{"auth_file", "H"}, EnvVars: []string{"NTFY_AUTH_FILE"}, Usage: "auth database file used for access control"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-startup-queries", Aliases: []string{"auth_startup_queries"}, EnvVars: []string{"NTFY_AUTH_STARTUP_QUERIES"}, Usage: "queries run when the auth database is initialized"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-default-access", Aliases: []string{"auth_default_access", "p"}, EnvVars: []string{"NTFY_AUTH_DEFAULT_ACCESS"}, Value: "read-write", Usage: "default permissions if no matching entries in the auth database are found"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-default-admin-tier", Aliases: []string{"auth_default_admin_tier"}, EnvVars: []string{"NTFY_AUTH_DEFAULT_ADMIN_TIER"}, Usage: "tier code used to report limits of admins without a tier"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-cache-dir", Aliases: []string{"attachment_cache_dir"}, EnvVars: []string{"NTFY_ATTACHMENT_CACHE_DIR"}, Usage: "cache directory for attached files"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-total-size-limit", Aliases: []string{"attachment_total_size_limit", "A"}, EnvVars: []string{"NTFY_ATTACHMENT_TOTAL_SIZE_LIMIT"}, Value: util.FormatSize(server.DefaultAttachmentTotalSizeLimit), Usage: "limit of the on-disk attachment cache"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-file-size-limit", Aliases: []string{"attachment_file_size_limit", "Y"}, EnvVars: []string{"NTFY_ATTACHMENT_FILE_SIZE_LIMIT"}, Value: util.FormatSize(server.DefaultAttachmentFileSizeLimit), Usage: "per-file attachment size limit (e.g. 300k, 2M, 100M)"}),
@@ -59,9 +61,11 @@ var flagsServe = append(
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "manager-interval", Aliases: []string{"manager_interval", "m"}, EnvVars: []string{"NTFY_MANAGER_INTERVAL"}, Value: util.FormatDuration(server.DefaultManagerInterval), Usage: "interval of for message pruning and stats printing"}),
 	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "disallowed-topics", Aliases: []string{"disallowed_topics"}, EnvVars: []string{"NTFY_DISALLOWED_TOPICS"}, Usage: "topics that are not allowed to be used"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "web-root", Aliases: []string{"web_root"}, EnvVars: []string{"NTFY_WEB_ROOT"}, Value: "/", Usage: "sets root of the web app (e.g. /, or /app), or disables it (disable)"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "disable-anonymous-publish", Aliases: []string{"disable_anonymous_publish"}, EnvVars: []string{"NTFY_DISABLE_ANONYMOUS_PUBLISH"}, Value: false, Usage: "disallows publishing for anonymous users (can be toggled at runtime via the admin API)"}),
 	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "enable-signup", Aliases: []string{"enable_signup"}, EnvVars: []string{"NTFY_ENABLE_SIGNUP"}, Value: false, Usage: "allows users to sign up via the web app, or API"}),
 	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "enable-login", Aliases: []string{"enable_login"}, EnvVars: []string{"NTFY_ENABLE_LOGIN"}, Value: false, Usage: "allows users to log in via the web app, or API"}),
 	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "enable-reservations", Aliases: []string{"enable_reservations"}, EnvVars: []string{"NTFY_ENABLE_RESERVATIONS"}, Value: false, Usage: "allows users to reserve topics (if their tier allows it)"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "strict-account-info", Aliases: []string{"strict_account_info"}, EnvVars: []string{"NTFY_STRICT_ACCOUNT_INFO"}, Value: false, Usage: "fail account info requests if the attachment usage cannot be determined, instead of reporting it as unknown (-1)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "upstream-base-url", Aliases: []string{"upstream_base_url"}, EnvVars: []string{"NTFY_UPSTREAM_BASE_URL"}, Value: "", Usage: "forward poll request to an upstream server, this is needed for iOS push notifications for self-hosted servers"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "upstream-access-token", Aliases: []string{"upstream_access_token"}, EnvVars: []string{"NTFY_UPSTREAM_ACCESS_TOKEN"}, Value: "", Usage: "access token to use for the upstream server; needed only if upstream rate limits are exceeded or upstream server requires auth"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "smtp-sender-addr", Aliases: []string{"smtp_sender_addr"}, EnvVars: []string{"NTFY_SMTP_SENDER_ADDR"}, Usage: "SMTP server address (host:port) for outgoing emails"}),
@@ -78,20 +82,79 @@ var flagsServe = append(
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "message-size-limit", Aliases: []string{"message_size_limit"}, EnvVars: []string{"NTFY_MESSAGE_SIZE_LIMIT"}, Value: util.FormatSize(server.DefaultMessageSizeLimit), Usage: "size limit for the message (see docs for limitations)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "message-delay-limit", Aliases: []string{"message_delay_limit"}, EnvVars: []string{"NTFY_MESSAGE_DELAY_LIMIT"}, Value: util.FormatDuration(server.DefaultMessageDelayMax), Usage: "max duration a message can be scheduled into the future"}),
 	altsrc.NewIntFlag(&cli.IntFlag{Name: "global-topic-limit", Aliases: []string{"global_topic_limit", "T"}, EnvVars: []string{"NTFY_GLOBAL_TOPIC_LIMIT"}, Value: server.DefaultTotalTopicLimit, Usage: "total number of topics allowed"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "topic-message-limit-burst", Aliases: []string{"topic_message_limit_burst"}, EnvVars: []string{"NTFY_TOPIC_MESSAGE_LIMIT_BURST"}, Value: server.DefaultTopicMessageLimitBurst, Usage: "initial limit of messages per topic (regardless of visitor), not limited if unset"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "topic-message-limit-replenish", Aliases: []string{"topic_message_limit_replenish"}, EnvVars: []string{"NTFY_TOPIC_MESSAGE_LIMIT_REPLENISH"}, Value: util.FormatDuration(server.DefaultTopicMessageLimitReplenish), Usage: "interval at which topic message burst limit is replenished (one per x)"}),
 	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-subscription-limit", Aliases: []string{"visitor_subscription_limit"}, EnvVars: []string{"NTFY_VISITOR_SUBSCRIPTION_LIMIT"}, Value: server.DefaultVisitorSubscriptionLimit, Usage: "number of subscriptions per visitor"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-subscription-attempt-limit-burst", Aliases: []string{"visitor_subscription_attempt_limit_burst"}, EnvVars: []string{"NTFY_VISITOR_SUBSCRIPTION_ATTEMPT_LIMIT_BURST"}, Value: server.DefaultVisitorSubscriptionAttemptLimitBurst, Usage: "initial limit of new subscriptions (connection attempts) per visitor, not limited if unset"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-subscription-attempt-limit-replenish", Aliases: []string{"visitor_subscription_attempt_limit_replenish"}, EnvVars: []string{"NTFY_VISITOR_SUBSCRIPTION_ATTEMPT_LIMIT_REPLENISH"}, Value: util.FormatDuration(server.DefaultVisitorSubscriptionAttemptLimitReplenish), Usage: "interval at which subscription attempt burst limit is replenished (one per x)"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-attachment-download-concurrency", Aliases: []string{"visitor_attachment_download_concurrency"}, EnvVars: []string{"NTFY_VISITOR_ATTACHMENT_DOWNLOAD_CONCURRENCY"}, Value: server.DefaultVisitorAttachmentDownloadConcurrency, Usage: "max number of simultaneous attachment downloads per visitor (0 = unlimited)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-attachment-total-size-limit", Aliases: []string{"visitor_attachment_total_size_limit"}, EnvVars: []string{"NTFY_VISITOR_ATTACHMENT_TOTAL_SIZE_LIMIT"}, Value: util.FormatSize(server.DefaultVisitorAttachmentTotalSizeLimit), Usage: "total storage limit used for attachments per visitor"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-attachment-daily-bandwidth-limit", Aliases: []string{"visitor_attachment_daily_bandwidth_limit"}, EnvVars: []string{"NTFY_VISITOR_ATTACHMENT_DAILY_BANDWIDTH_LIMIT"}, Value: "500M", Usage: "total daily attachment download/upload bandwidth limit per visitor"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-ingress-daily-bandwidth-limit", Aliases: []string{"visitor_ingress_daily_bandwidth_limit"}, EnvVars: []string{"NTFY_VISITOR_INGRESS_DAILY_BANDWIDTH_LIMIT"}, Value: util.FormatSize(server.DefaultVisitorIngressDailyBandwidthLimit), Usage: "total daily limit of published request body bytes per visitor (0 = no limit)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-attachment-bandwidth-reset-mode", Aliases: []string{"visitor_attachment_bandwidth_reset_mode"}, EnvVars: []string{"NTFY_VISITOR_ATTACHMENT_BANDWIDTH_RESET_MODE"}, Value: server.DefaultVisitorAttachmentBandwidthResetMode, Usage: "how the daily bandwidth limit is replenished, 'rolling' (continuously) or 'calendar' (at the daily reset)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-attachment-bandwidth-mode", Aliases: []string{"visitor_attachment_bandwidth_mode"}, EnvVars: []string{"NTFY_VISITOR_ATTACHMENT_BANDWIDTH_MODE"}, Value: server.DefaultVisitorAttachmentBandwidthMode, Usage: "behavior of downloads if the daily bandwidth limit is reached, 'deny' (reject) or 'throttle' (serve at a reduced rate)"}),
 	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-request-limit-burst", Aliases: []string{"visitor_request_limit_burst"}, EnvVars: []string{"NTFY_VISITOR_REQUEST_LIMIT_BURST"}, Value: server.DefaultVisitorRequestLimitBurst, Usage: "initial limit of requests per visitor"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-request-limit-replenish", Aliases: []string{"visitor_request_limit_replenish"}, EnvVars: []string{"NTFY_VISITOR_REQUEST_LIMIT_REPLENISH"}, Value: util.FormatDuration(server.DefaultVisitorRequestLimitReplenish), Usage: "interval at which burst limit is replenished (one per x)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-request-limit-exempt-hosts", Aliases: []string{"visitor_request_limit_exempt_hosts"}, EnvVars: []string{"NTFY_VISITOR_REQUEST_LIMIT_EXEMPT_HOSTS"}, Value: "", Usage: "hostnames and/or IP addresses of hosts that will be exempt from the visitor request limit"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "visitor-request-limit-exempt-loopback", Aliases: []string{"visitor_request_limit_exempt_loopback"}, EnvVars: []string{"NTFY_VISITOR_REQUEST_LIMIT_EXEMPT_LOOPBACK"}, Value: false, Usage: "if set, visitors connecting from localhost (loopback) are exempt from the visitor request limit"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-request-limit-ipv6-prefix", Aliases: []string{"visitor_request_limit_ipv6_prefix"}, EnvVars: []string{"NTFY_VISITOR_REQUEST_LIMIT_IPV6_PREFIX"}, Value: server.DefaultVisitorRequestLimitIPv6Prefix, Usage: "prefix length used to group IPv6 addresses into one visitor, e.g. 64 for a /64 network (128 = per address)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-request-max-wait", Aliases: []string{"visitor_request_max_wait"}, EnvVars: []string{"NTFY_VISITOR_REQUEST_MAX_WAIT"}, Value: util.FormatDuration(server.DefaultVisitorRequestMaxWait), Usage: "max duration publishers may wait for the request limiter if they send 'X-Backpressure: wait', disabled if unset"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-read-request-limit-burst", Aliases: []string{"visitor_read_request_limit_burst"}, EnvVars: []string{"NTFY_VISITOR_READ_REQUEST_LIMIT_BURST"}, Value: server.DefaultVisitorReadRequestLimitBurst, Usage: "initial limit of read requests (subscribe/poll) per visitor, counted towards request limit if unset"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-read-request-limit-replenish", Aliases: []string{"visitor_read_request_limit_replenish"}, EnvVars: []string{"NTFY_VISITOR_READ_REQUEST_LIMIT_REPLENISH"}, Value: util.FormatDuration(server.DefaultVisitorReadRequestLimitReplenish), Usage: "interval at which read request burst limit is replenished (one per x)"}),
 	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-message-daily-limit", Aliases: []string{"visitor_message_daily_limit"}, EnvVars: []string{"NTFY_VISITOR_MESSAGE_DAILY_LIMIT"}, Value: server.DefaultVisitorMessageDailyLimit, Usage: "max messages per visitor per day, derived from request limit if unset"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-distinct-topics-daily-limit", Aliases: []string{"visitor_distinct_topics_daily_limit"}, EnvVars: []string{"NTFY_VISITOR_DISTINCT_TOPICS_DAILY_LIMIT"}, Value: server.DefaultVisitorDistinctTopicsDailyLimit, Usage: "max number of different topics an anonymous visitor can publish to per day (0 = unlimited)"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-message-soft-limit-percent", Aliases: []string{"visitor_message_soft_limit_percent"}, EnvVars: []string{"NTFY_VISITOR_MESSAGE_SOFT_LIMIT_PERCENT"}, Value: server.DefaultVisitorMessageSoftLimitPercent, Usage: "if set, publishers get an X-RateLimit-Warning header once a day when they reach this percentage of their daily message limit"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-min-message-interval", Aliases: []string{"visitor_min_message_interval"}, EnvVars: []string{"NTFY_VISITOR_MIN_MESSAGE_INTERVAL"}, Value: util.FormatDuration(server.DefaultVisitorMinMessageInterval), Usage: "min interval between two messages of the same visitor, e.g. 100ms (0 = disabled)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-dedup-window", Aliases: []string{"visitor_dedup_window"}, EnvVars: []string{"NTFY_VISITOR_DEDUP_WINDOW"}, Value: util.FormatDuration(server.DefaultVisitorDedupWindow), Usage: "window in which a message identical to the visitor's previous message is a duplicate, e.g. 5m (0 = disabled)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-dedup-mode", Aliases: []string{"visitor_dedup_mode"}, EnvVars: []string{"NTFY_VISITOR_DEDUP_MODE"}, Value: server.DefaultVisitorDedupMode, Usage: "what happens to duplicate messages, 'reject' (with an error) or 'drop' (silently)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-message-limiter-mode", Aliases: []string{"visitor_message_limiter_mode"}, EnvVars: []string{"NTFY_VISITOR_MESSAGE_LIMITER_MODE"}, Value: server.DefaultVisitorMessageLimiterMode, Usage: "daily message limit mode per visitor, 'fixed' (reset daily), 'sliding' (rolling 24h window) or 'decay' (continuous decay)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-limit-reset-mode", Aliases: []string{"visitor_limit_reset_mode"}, EnvVars: []string{"NTFY_VISITOR_LIMIT_RESET_MODE"}, Value: server.DefaultVisitorLimitResetMode, Usage: "when daily visitor limits are reset, 'continuous' (default) or 'calendar' (at midnight in visitor-limit-reset-timezone)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-limit-reset-timezone", Aliases: []string{"visitor_limit_reset_timezone"}, EnvVars: []string{"NTFY_VISITOR_LIMIT_RESET_TIMEZONE"}, Value: "UTC", Usage: "timezone of the calendar day if visitor-limit-reset-mode is 'calendar', e.g. 'Europe/Berlin'"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-limit-reset-jitter", Aliases: []string{"visitor_limit_reset_jitter"}, EnvVars: []string{"NTFY_VISITOR_LIMIT_RESET_JITTER"}, Value: util.FormatDuration(server.DefaultVisitorLimitResetJitter), Usage: "if set, the daily reset of each visitor is offset by up to +/- this duration, to spread out traffic"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "health-check-paths", Aliases: []string{"health_check_paths"}, EnvVars: []string{"NTFY_HEALTH_CHECK_PATHS"}, Value: strings.Join(server.DefaultHealthCheckPaths, ","), Usage: "comma-separated list of paths answered as health probes, without counting towards any limits (e.g. for load balancers)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "rate-limit-exempt-topics", Aliases: []string{"rate_limit_exempt_topics"}, EnvVars: []string{"NTFY_RATE_LIMIT_EXEMPT_TOPICS"}, Value: "", Usage: "comma-separated list of topics whose messages do not count towards the message limits (e.g. heartbeats)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-message-cost-size", Aliases: []string{"visitor_message_cost_size"}, EnvVars: []string{"NTFY_VISITOR_MESSAGE_COST_SIZE"}, Value: util.FormatSize(server.DefaultVisitorMessageCostSize), Usage: "if set, messages count as one message per x bytes towards the message limit (e.g. 4k)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-scheduled-message-mode", Aliases: []string{"visitor_scheduled_message_mode"}, EnvVars: []string{"NTFY_VISITOR_SCHEDULED_MESSAGE_MODE"}, Value: server.DefaultVisitorScheduledMessageMode, Usage: "when scheduled messages count towards the daily message limit, 'publish' or 'delivery'"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-scheduled-message-daily-limit", Aliases: []string{"visitor_scheduled_message_daily_limit"}, EnvVars: []string{"NTFY_VISITOR_SCHEDULED_MESSAGE_DAILY_LIMIT"}, Value: server.DefaultVisitorScheduledMessageDailyLimit, Usage: "max scheduled messages per visitor per day in 'delivery' mode, same as the daily message limit if unset"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-attachment-message-daily-limit", Aliases: []string{"visitor_attachment_message_daily_limit"}, EnvVars: []string{"NTFY_VISITOR_ATTACHMENT_MESSAGE_DAILY_LIMIT"}, Value: server.DefaultVisitorAttachmentMessageDailyLimit, Usage: "max messages with attachments per visitor per day, in addition to the daily message limit (0 = no separate limit)"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-gateway-message-daily-limit", Aliases: []string{"visitor_gateway_message_daily_limit"}, EnvVars: []string{"NTFY_VISITOR_GATEWAY_MESSAGE_DAILY_LIMIT"}, Value: server.DefaultVisitorGatewayMessageDailyLimit, Usage: "max UnifiedPush/Matrix gateway messages per visitor per day, instead of the daily message limit (0 = no separate limit)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-tier-downgrade-mode", Aliases: []string{"visitor_tier_downgrade_mode"}, EnvVars: []string{"NTFY_VISITOR_TIER_DOWNGRADE_MODE"}, Value: server.DefaultVisitorTierDowngradeMode, Usage: "when a lower message limit applies after a tier downgrade, 'immediate' or 'nextday' (after the next daily reset)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-limits-reload-mode", Aliases: []string{"visitor_limits_reload_mode"}, EnvVars: []string{"NTFY_VISITOR_LIMITS_RELOAD_MODE"}, Value: server.DefaultVisitorLimitsReloadMode, Usage: "what happens to existing visitors if the visitor limits are reloaded (SIGHUP), 'new' (apply to new visitors only) or 'rebuild'"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-limiter-store", Aliases: []string{"visitor_limiter_store"}, EnvVars: []string{"NTFY_VISITOR_LIMITER_STORE"}, Value: server.DefaultVisitorLimiterStore, Usage: "where to keep the daily message limiter state, 'memory' (per process) or 'redis' (shared across processes)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-limiter-redis-addr", Aliases: []string{"visitor_limiter_redis_addr"}, EnvVars: []string{"NTFY_VISITOR_LIMITER_REDIS_ADDR"}, Usage: "Redis address (host:port) for visitor-limiter-store: redis"}),
 	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-email-limit-burst", Aliases: []string{"visitor_email_limit_burst"}, EnvVars: []string{"NTFY_VISITOR_EMAIL_LIMIT_BURST"}, Value: server.DefaultVisitorEmailLimitBurst, Usage: "initial limit of e-mails per visitor"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "visitor-email-limit-persist", Aliases: []string{"visitor_email_limit_persist"}, EnvVars: []string{"NTFY_VISITOR_EMAIL_LIMIT_PERSIST"}, Value: false, Usage: "persist the daily e-mail count of anonymous visitors in the cache database, so that it survives a restart"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-email-limit-replenish", Aliases: []string{"visitor_email_limit_replenish"}, EnvVars: []string{"NTFY_VISITOR_EMAIL_LIMIT_REPLENISH"}, Value: util.FormatDuration(server.DefaultVisitorEmailLimitReplenish), Usage: "interval at which burst limit is replenished (one per x)"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-inbound-email-limit-burst", Aliases: []string{"visitor_inbound_email_limit_burst"}, EnvVars: []string{"NTFY_VISITOR_INBOUND_EMAIL_LIMIT_BURST"}, Value: server.DefaultVisitorInboundEmailLimitBurst, Usage: "initial limit of inbound e-mails per sender (0 = disabled)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-inbound-email-limit-replenish", Aliases: []string{"visitor_inbound_email_limit_replenish"}, EnvVars: []string{"NTFY_VISITOR_INBOUND_EMAIL_LIMIT_REPLENISH"}, Value: util.FormatDuration(server.DefaultVisitorInboundEmailLimitReplenish), Usage: "interval at which the inbound e-mail burst limit is replenished (one per x)"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-email-failure-threshold", Aliases: []string{"visitor_email_failure_threshold"}, EnvVars: []string{"NTFY_VISITOR_EMAIL_FAILURE_THRESHOLD"}, Value: server.DefaultVisitorEmailFailureThreshold, Usage: "number of consecutive failed e-mails after which a visitor's e-mails are rejected for the cooldown (0 = disabled)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-email-failure-cooldown", Aliases: []string{"visitor_email_failure_cooldown"}, EnvVars: []string{"NTFY_VISITOR_EMAIL_FAILURE_COOLDOWN"}, Value: util.FormatDuration(server.DefaultVisitorEmailFailureCooldown), Usage: "duration for which e-mails are rejected after visitor-email-failure-threshold consecutive failures"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-firebase-limit-burst", Aliases: []string{"visitor_firebase_limit_burst"}, EnvVars: []string{"NTFY_VISITOR_FIREBASE_LIMIT_BURST"}, Value: server.DefaultVisitorFirebaseLimitBurst, Usage: "initial limit of messages forwarded to Firebase per visitor, not limited if unset"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-firebase-limit-replenish", Aliases: []string{"visitor_firebase_limit_replenish"}, EnvVars: []string{"NTFY_VISITOR_FIREBASE_LIMIT_REPLENISH"}, Value: util.FormatDuration(server.DefaultVisitorFirebaseLimitReplenish), Usage: "interval at which Firebase burst limit is replenished (one per x)"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-firebase-daily-limit", Aliases: []string{"visitor_firebase_daily_limit"}, EnvVars: []string{"NTFY_VISITOR_FIREBASE_DAILY_LIMIT"}, Value: server.DefaultVisitorFirebaseDailyLimit, Usage: "max messages forwarded to Firebase per visitor per day, not limited if unset"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-auth-failure-limit-burst", Aliases: []string{"visitor_auth_failure_limit_burst"}, EnvVars: []string{"NTFY_VISITOR_AUTH_FAILURE_LIMIT_BURST"}, Value: server.DefaultVisitorAuthFailureLimitBurst, Usage: "initial limit of failed login attempts per visitor"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-auth-failure-limit-replenish", Aliases: []string{"visitor_auth_failure_limit_replenish"}, EnvVars: []string{"NTFY_VISITOR_AUTH_FAILURE_LIMIT_REPLENISH"}, Value: util.FormatDuration(server.DefaultVisitorAuthFailureLimitReplenish), Usage: "interval at which failed login burst limit is replenished (one per x)"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-penalty-box-threshold", Aliases: []string{"visitor_penalty_box_threshold"}, EnvVars: []string{"NTFY_VISITOR_PENALTY_BOX_THRESHOLD"}, Value: server.DefaultVisitorPenaltyBoxThreshold, Usage: "number of consecutive limit hits within visitor-penalty-box-window after which a visitor is blocked, disabled if unset"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-penalty-box-window", Aliases: []string{"visitor_penalty_box_window"}, EnvVars: []string{"NTFY_VISITOR_PENALTY_BOX_WINDOW"}, Value: util.FormatDuration(server.DefaultVisitorPenaltyBoxWindow), Usage: "window in which consecutive limit hits are counted for the penalty box"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-penalty-box-duration", Aliases: []string{"visitor_penalty_box_duration"}, EnvVars: []string{"NTFY_VISITOR_PENALTY_BOX_DURATION"}, Value: util.FormatDuration(server.DefaultVisitorPenaltyBoxDuration), Usage: "duration for which a visitor in the penalty box is blocked"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-account-creation-limit-ipv4-prefix", Aliases: []string{"visitor_account_creation_limit_ipv4_prefix"}, EnvVars: []string{"NTFY_VISITOR_ACCOUNT_CREATION_LIMIT_IPV4_PREFIX"}, Value: server.DefaultVisitorAccountCreationLimitIPv4Prefix, Usage: "prefix length used to limit account creation per IPv4 subnet, e.g. 24 for a /24 network (per visitor if unset)"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-account-creation-limit-ipv6-prefix", Aliases: []string{"visitor_account_creation_limit_ipv6_prefix"}, EnvVars: []string{"NTFY_VISITOR_ACCOUNT_CREATION_LIMIT_IPV6_PREFIX"}, Value: server.DefaultVisitorAccountCreationLimitIPv6Prefix, Usage: "prefix length used to limit account creation per IPv6 subnet, e.g. 48 for a /48 network (per visitor if unset)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "new-account-grace-duration", Aliases: []string{"new_account_grace_duration"}, EnvVars: []string{"NTFY_NEW_ACCOUNT_GRACE_DURATION"}, Value: util.FormatDuration(server.DefaultNewAccountGraceDuration), Usage: "duration after account creation during which the request limit burst is boosted, disabled if unset"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "new-account-grace-multiplier", Aliases: []string{"new_account_grace_multiplier"}, EnvVars: []string{"NTFY_NEW_ACCOUNT_GRACE_MULTIPLIER"}, Value: server.DefaultNewAccountGraceMultiplier, Usage: "multiplier for the request limit burst of new accounts, see new-account-grace-duration"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "geoip-database", Aliases: []string{"geoip_database"}, EnvVars: []string{"NTFY_GEOIP_DATABASE"}, Usage: "MaxMind DB file (e.g. GeoLite2-Country.mmdb) used to resolve the country of visitors"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "geo-restricted-countries", Aliases: []string{"geo_restricted_countries"}, EnvVars: []string{"NTFY_GEO_RESTRICTED_COUNTRIES"}, Usage: "ISO country codes (e.g. XX,YY) of visitors that get stricter limits, requires geoip-database"}),
+	altsrc.NewFloat64Flag(&cli.Float64Flag{Name: "geo-restricted-limit-multiplier", Aliases: []string{"geo_restricted_limit_multiplier"}, EnvVars: []string{"NTFY_GEO_RESTRICTED_LIMIT_MULTIPLIER"}, Value: server.DefaultGeoRestrictedLimitMultiplier, Usage: "multiplier (between 0 and 1) for the limits of visitors from geo-restricted-countries"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "visitor-limit-profiles", Aliases: []string{"visitor_limit_profiles"}, EnvVars: []string{"NTFY_VISITOR_LIMIT_PROFILES"}, Usage: "named limit presets for tokens, e.g. 'ci: message-limit=5000 request-limit-burst=100'"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-expunge-after", Aliases: []string{"visitor_expunge_after"}, EnvVars: []string{"NTFY_VISITOR_EXPUNGE_AFTER"}, Value: util.FormatDuration(server.DefaultVisitorExpungeAfter), Usage: "duration after which inactive visitors are removed from memory"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "visitor-expunge-log", Aliases: []string{"visitor_expunge_log"}, EnvVars: []string{"NTFY_VISITOR_EXPUNGE_LOG"}, Value: false, Usage: "log every visitor that is removed from memory (at info level)"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "visitor-request-stats", Aliases: []string{"visitor_request_stats"}, EnvVars: []string{"NTFY_VISITOR_REQUEST_STATS"}, Value: false, Usage: "count requests and their average processing time per visitor (see /v1/admin/visitors)"}),
 	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "visitor-subscriber-rate-limiting", Aliases: []string{"visitor_subscriber_rate_limiting"}, EnvVars: []string{"NTFY_VISITOR_SUBSCRIBER_RATE_LIMITING"}, Value: false, Usage: "enables subscriber-based rate limiting"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-tenant-header", Aliases: []string{"visitor_tenant_header"}, EnvVars: []string{"NTFY_VISITOR_TENANT_HEADER"}, Usage: "if set, header (set by a trusted proxy) from which a visitor's tenant is read, e.g. X-Tenant"}),
 	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "behind-proxy", Aliases: []string{"behind_proxy", "P"}, EnvVars: []string{"NTFY_BEHIND_PROXY"}, Value: false, Usage: "if set, use X-Forwarded-For header to determine visitor IP address (for rate limiting)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "stripe-secret-key", Aliases: []string{"stripe_secret_key"}, EnvVars: []string{"NTFY_STRIPE_SECRET_KEY"}, Value: "", Usage: "key used for the Stripe API communication, this enables payments"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "stripe-webhook-key", Aliases: []string{"stripe_webhook_key"}, EnvVars: []string{"NTFY_STRIPE_WEBHOOK_KEY"}, Value: "", Usage: "key required to validate the authenticity of incoming webhooks from Stripe"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "billing-contact", Aliases: []string{"billing_contact"}, EnvVars: []string{"NTFY_BILLING_CONTACT"}, Value: "", Usage: "e-mail or website to display in upgrade dialog (only if payments are enabled)"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "use-payment-required-for-tier-limits", Aliases: []string{"use_payment_required_for_tier_limits"}, EnvVars: []string{"NTFY_USE_PAYMENT_REQUIRED_FOR_TIER_LIMITS"}, Value: false, Usage: "respond with 402 Payment Required instead of 429 when users with a tier hit a limit"}),
 	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "enable-metrics", Aliases: []string{"enable_metrics"}, EnvVars: []string{"NTFY_ENABLE_METRICS"}, Value: false, Usage: "if set, Prometheus metrics are exposed via the /metrics endpoint"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "metrics-listen-http", Aliases: []string{"metrics_listen_http"}, EnvVars: []string{"NTFY_METRICS_LISTEN_HTTP"}, Usage: "ip:port used to expose the metrics endpoint (implicitly enables metrics)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "profile-listen-http", Aliases: []string{"profile_listen_http"}, EnvVars: []string{"NTFY_PROFILE_LISTEN_HTTP"}, Usage: "ip:port used to expose the profiling endpoints (implicitly enables profiling)"}),
@@ -148,6 +211,7 @@ func execServe(c *cli.Context) error {
 	authFile := c.String("auth-file")
 	authStartupQueries := c.String("auth-startup-queries")
 	authDefaultAccess := c.String("auth-default-access")
+	authDefaultAdminTier := c.String("auth-default-admin-tier")
 	attachmentCacheDir := c.String("attachment-cache-dir")
 	attachmentTotalSizeLimitStr := c.String("attachment-total-size-limit")
 	attachmentFileSizeLimitStr := c.String("attachment-file-size-limit")
@@ -156,9 +220,11 @@ func execServe(c *cli.Context) error {
 	managerIntervalStr := c.String("manager-interval")
 	disallowedTopics := c.StringSlice("disallowed-topics")
 	webRoot := c.String("web-root")
+	disableAnonymousPublish := c.Bool("disable-anonymous-publish")
 	enableSignup := c.Bool("enable-signup")
 	enableLogin := c.Bool("enable-login")
 	enableReservations := c.Bool("enable-reservations")
+	strictAccountInfo := c.Bool("strict-account-info")
 	upstreamBaseURL := c.String("upstream-base-url")
 	upstreamAccessToken := c.String("upstream-access-token")
 	smtpSenderAddr := c.String("smtp-sender-addr")
@@ -175,20 +241,79 @@ func execServe(c *cli.Context) error {
 	messageSizeLimitStr := c.String("message-size-limit")
 	messageDelayLimitStr := c.String("message-delay-limit")
 	totalTopicLimit := c.Int("global-topic-limit")
+	topicMessageLimitBurst := c.Int("topic-message-limit-burst")
+	topicMessageLimitReplenishStr := c.String("topic-message-limit-replenish")
 	visitorSubscriptionLimit := c.Int("visitor-subscription-limit")
+	visitorSubscriptionAttemptLimitBurst := c.Int("visitor-subscription-attempt-limit-burst")
+	visitorSubscriptionAttemptLimitReplenishStr := c.String("visitor-subscription-attempt-limit-replenish")
+	visitorAttachmentDownloadConcurrency := c.Int("visitor-attachment-download-concurrency")
 	visitorSubscriberRateLimiting := c.Bool("visitor-subscriber-rate-limiting")
 	visitorAttachmentTotalSizeLimitStr := c.String("visitor-attachment-total-size-limit")
 	visitorAttachmentDailyBandwidthLimitStr := c.String("visitor-attachment-daily-bandwidth-limit")
+	visitorAttachmentBandwidthMode := c.String("visitor-attachment-bandwidth-mode")
+	visitorAttachmentBandwidthResetMode := c.String("visitor-attachment-bandwidth-reset-mode")
+	visitorIngressDailyBandwidthLimitStr := c.String("visitor-ingress-daily-bandwidth-limit")
 	visitorRequestLimitBurst := c.Int("visitor-request-limit-burst")
 	visitorRequestLimitReplenishStr := c.String("visitor-request-limit-replenish")
 	visitorRequestLimitExemptHosts := util.SplitNoEmpty(c.String("visitor-request-limit-exempt-hosts"), ",")
+	visitorRequestLimitExemptLoopback := c.Bool("visitor-request-limit-exempt-loopback")
+	visitorRequestLimitIPv6Prefix := c.Int("visitor-request-limit-ipv6-prefix")
+	visitorRequestMaxWaitStr := c.String("visitor-request-max-wait")
+	visitorReadRequestLimitBurst := c.Int("visitor-read-request-limit-burst")
+	visitorReadRequestLimitReplenishStr := c.String("visitor-read-request-limit-replenish")
 	visitorMessageDailyLimit := c.Int("visitor-message-daily-limit")
+	visitorMessageSoftLimitPercent := c.Int("visitor-message-soft-limit-percent")
+	visitorMinMessageIntervalStr := c.String("visitor-min-message-interval")
+	visitorDedupWindowStr := c.String("visitor-dedup-window")
+	visitorDedupMode := c.String("visitor-dedup-mode")
+	visitorDistinctTopicsDailyLimit := c.Int("visitor-distinct-topics-daily-limit")
+	visitorMessageLimiterMode := c.String("visitor-message-limiter-mode")
+	visitorLimitResetMode := c.String("visitor-limit-reset-mode")
+	visitorLimitResetTimezoneStr := c.String("visitor-limit-reset-timezone")
+	visitorLimitResetJitterStr := c.String("visitor-limit-reset-jitter")
+	visitorMessageCostSizeStr := c.String("visitor-message-cost-size")
+	rateLimitExemptTopics := util.SplitNoEmpty(c.String("rate-limit-exempt-topics"), ",")
+	healthCheckPaths := util.SplitNoEmpty(c.String("health-check-paths"), ",")
+	visitorLimiterStore := c.String("visitor-limiter-store")
+	visitorTierDowngradeMode := c.String("visitor-tier-downgrade-mode")
+	visitorLimitsReloadMode := c.String("visitor-limits-reload-mode")
+	visitorScheduledMessageMode := c.String("visitor-scheduled-message-mode")
+	visitorScheduledMessageDailyLimit := c.Int("visitor-scheduled-message-daily-limit")
+	visitorAttachmentMessageDailyLimit := c.Int("visitor-attachment-message-daily-limit")
+	visitorGatewayMessageDailyLimit := c.Int("visitor-gateway-message-daily-limit")
+	visitorLimiterRedisAddr := c.String("visitor-limiter-redis-addr")
 	visitorEmailLimitBurst := c.Int("visitor-email-limit-burst")
 	visitorEmailLimitReplenishStr := c.String("visitor-email-limit-replenish")
+	visitorInboundEmailLimitBurst := c.Int("visitor-inbound-email-limit-burst")
+	visitorInboundEmailLimitReplenishStr := c.String("visitor-inbound-email-limit-replenish")
+	visitorEmailLimitPersist := c.Bool("visitor-email-limit-persist")
+	visitorEmailFailureThreshold := c.Int("visitor-email-failure-threshold")
+	visitorEmailFailureCooldownStr := c.String("visitor-email-failure-cooldown")
+	visitorFirebaseLimitBurst := c.Int("visitor-firebase-limit-burst")
+	visitorFirebaseLimitReplenishStr := c.String("visitor-firebase-limit-replenish")
+	visitorFirebaseDailyLimit := c.Int("visitor-firebase-daily-limit")
+	visitorAuthFailureLimitBurst := c.Int("visitor-auth-failure-limit-burst")
+	visitorAuthFailureLimitReplenishStr := c.String("visitor-auth-failure-limit-replenish")
+	visitorPenaltyBoxThreshold := c.Int("visitor-penalty-box-threshold")
+	visitorPenaltyBoxWindowStr := c.String("visitor-penalty-box-window")
+	visitorPenaltyBoxDurationStr := c.String("visitor-penalty-box-duration")
+	visitorAccountCreationLimitIPv4Prefix := c.Int("visitor-account-creation-limit-ipv4-prefix")
+	visitorAccountCreationLimitIPv6Prefix := c.Int("visitor-account-creation-limit-ipv6-prefix")
+	newAccountGraceDurationStr := c.String("new-account-grace-duration")
+	newAccountGraceMultiplier := c.Int("new-account-grace-multiplier")
+	geoIPDatabase := c.String("geoip-database")
+	geoRestrictedCountries := c.StringSlice("geo-restricted-countries")
+	geoRestrictedLimitMultiplier := c.Float64("geo-restricted-limit-multiplier")
+	visitorLimitProfilesRaw := c.StringSlice("visitor-limit-profiles")
+	visitorExpungeAfterStr := c.String("visitor-expunge-after")
+	visitorExpungeLog := c.Bool("visitor-expunge-log")
+	visitorRequestStats := c.Bool("visitor-request-stats")
 	behindProxy := c.Bool("behind-proxy")
+	visitorTenantHeader := c.String("visitor-tenant-header")
 	stripeSecretKey := c.String("stripe-secret-key")
 	stripeWebhookKey := c.String("stripe-webhook-key")
 	billingContact := c.String("billing-contact")
+	usePaymentRequiredForTierLimits := c.Bool("use-payment-required-for-tier-limits")
 	metricsListenHTTP := c.String("metrics-listen-http")
 	enableMetrics := c.Bool("enable-metrics") || metricsListenHTTP != ""
 	profileListenHTTP := c.String("profile-listen-http")
@@ -222,10 +347,74 @@ func execServe(c *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("invalid visitor request limit replenish: %s", visitorRequestLimitReplenishStr)
 	}
+	visitorRequestMaxWait, err := util.ParseDuration(visitorRequestMaxWaitStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor request max wait: %s", visitorRequestMaxWaitStr)
+	}
+	visitorReadRequestLimitReplenish, err := util.ParseDuration(visitorReadRequestLimitReplenishStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor read request limit replenish: %s", visitorReadRequestLimitReplenishStr)
+	}
 	visitorEmailLimitReplenish, err := util.ParseDuration(visitorEmailLimitReplenishStr)
 	if err != nil {
 		return fmt.Errorf("invalid visitor email limit replenish: %s", visitorEmailLimitReplenishStr)
 	}
+	visitorInboundEmailLimitReplenish, err := util.ParseDuration(visitorInboundEmailLimitReplenishStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor inbound email limit replenish: %s", visitorInboundEmailLimitReplenishStr)
+	}
+	visitorEmailFailureCooldown, err := util.ParseDuration(visitorEmailFailureCooldownStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor email failure cooldown: %s", visitorEmailFailureCooldownStr)
+	}
+	visitorMinMessageInterval, err := util.ParseDuration(visitorMinMessageIntervalStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor min message interval: %s", visitorMinMessageIntervalStr)
+	}
+	visitorDedupWindow, err := util.ParseDuration(visitorDedupWindowStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor dedup window: %s", visitorDedupWindowStr)
+	}
+	visitorSubscriptionAttemptLimitReplenish, err := util.ParseDuration(visitorSubscriptionAttemptLimitReplenishStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor subscription attempt limit replenish: %s", visitorSubscriptionAttemptLimitReplenishStr)
+	}
+	visitorFirebaseLimitReplenish, err := util.ParseDuration(visitorFirebaseLimitReplenishStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor firebase limit replenish: %s", visitorFirebaseLimitReplenishStr)
+	}
+	visitorAuthFailureLimitReplenish, err := util.ParseDuration(visitorAuthFailureLimitReplenishStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor auth failure limit replenish: %s", visitorAuthFailureLimitReplenishStr)
+	}
+	visitorPenaltyBoxWindow, err := util.ParseDuration(visitorPenaltyBoxWindowStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor penalty box window: %s", visitorPenaltyBoxWindowStr)
+	}
+	visitorPenaltyBoxDuration, err := util.ParseDuration(visitorPenaltyBoxDurationStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor penalty box duration: %s", visitorPenaltyBoxDurationStr)
+	}
+	newAccountGraceDuration, err := util.ParseDuration(newAccountGraceDurationStr)
+	if err != nil {
+		return fmt.Errorf("invalid new account grace duration: %s", newAccountGraceDurationStr)
+	}
+	topicMessageLimitReplenish, err := util.ParseDuration(topicMessageLimitReplenishStr)
+	if err != nil {
+		return fmt.Errorf("invalid topic message limit replenish: %s", topicMessageLimitReplenishStr)
+	}
+	visitorExpungeAfter, err := util.ParseDuration(visitorExpungeAfterStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor expunge after duration: %s", visitorExpungeAfterStr)
+	}
+	visitorLimitResetTimezone, err := time.LoadLocation(visitorLimitResetTimezoneStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor limit reset timezone: %s", visitorLimitResetTimezoneStr)
+	}
+	visitorLimitResetJitter, err := util.ParseDuration(visitorLimitResetJitterStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor limit reset jitter: %s", visitorLimitResetJitterStr)
+	}
 
 	// Convert sizes to bytes
 	messageSizeLimit, err := util.ParseSize(messageSizeLimitStr)
@@ -250,6 +439,16 @@ func execServe(c *cli.Context) error {
 	} else if visitorAttachmentDailyBandwidthLimit > math.MaxInt {
 		return fmt.Errorf("config option visitor-attachment-daily-bandwidth-limit must be lower than %d", math.MaxInt)
 	}
+	visitorIngressDailyBandwidthLimit, err := util.ParseSize(visitorIngressDailyBandwidthLimitStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor ingress daily bandwidth limit: %s", visitorIngressDailyBandwidthLimitStr)
+	} else if visitorIngressDailyBandwidthLimit > math.MaxInt {
+		return fmt.Errorf("config option visitor-ingress-daily-bandwidth-limit must be lower than %d", math.MaxInt)
+	}
+	visitorMessageCostSize, err := util.ParseSize(visitorMessageCostSizeStr)
+	if err != nil {
+		return fmt.Errorf("invalid visitor message cost size: %s", visitorMessageCostSizeStr)
+	}
 
 	// Check values
 	if firebaseKeyFile != "" && !util.FileExists(firebaseKeyFile) {
@@ -262,6 +461,8 @@ func execServe(c *cli.Context) error {
 		return errors.New("manager interval cannot be lower than five seconds")
 	} else if cacheDuration > 0 && cacheDuration < managerInterval {
 		return errors.New("cache duration cannot be lower than manager interval")
+	} else if visitorExpungeAfter < cacheDuration {
+		return errors.New("visitor-expunge-after cannot be lower than cache duration")
 	} else if keyFile != "" && !util.FileExists(keyFile) {
 		return errors.New("if set, key file must exist")
 	} else if certFile != "" && !util.FileExists(certFile) {
@@ -293,12 +494,100 @@ func execServe(c *cli.Context) error {
 		return errors.New("base-url and upstream-base-url cannot be identical, you'll likely want to set upstream-base-url to https://ntfy.sh, see https://ntfy.sh/docs/config/#ios-instant-notifications")
 	} else if authFile == "" && (enableSignup || enableLogin || enableReservations || stripeSecretKey != "") {
 		return errors.New("cannot set enable-signup, enable-login, enable-reserve-topics, or stripe-secret-key if auth-file is not set")
+	} else if authFile == "" && authDefaultAdminTier != "" {
+		return errors.New("cannot set auth-default-admin-tier if auth-file is not set")
+	} else if authFile == "" && usePaymentRequiredForTierLimits {
+		return errors.New("cannot set use-payment-required-for-tier-limits if auth-file is not set")
 	} else if enableSignup && !enableLogin {
 		return errors.New("cannot set enable-signup without also setting enable-login")
 	} else if stripeSecretKey != "" && (stripeWebhookKey == "" || baseURL == "") {
 		return errors.New("if stripe-secret-key is set, stripe-webhook-key and base-url must also be set")
 	} else if twilioAccount != "" && (twilioAuthToken == "" || twilioPhoneNumber == "" || twilioVerifyService == "" || baseURL == "" || authFile == "") {
 		return errors.New("if twilio-account is set, twilio-auth-token, twilio-phone-number, twilio-verify-service, base-url, and auth-file must also be set")
+	} else if visitorRequestLimitIPv6Prefix < 1 || visitorRequestLimitIPv6Prefix > 128 {
+		return errors.New("visitor-request-limit-ipv6-prefix must be between 1 and 128")
+	} else if visitorRequestLimitReplenish <= 0 {
+		return errors.New("visitor-request-limit-replenish must be greater than zero")
+	} else if visitorReadRequestLimitReplenish <= 0 {
+		return errors.New("visitor-read-request-limit-replenish must be greater than zero")
+	} else if visitorEmailLimitReplenish <= 0 {
+		return errors.New("visitor-email-limit-replenish must be greater than zero")
+	} else if visitorInboundEmailLimitBurst < 0 {
+		return errors.New("visitor-inbound-email-limit-burst must be zero or positive")
+	} else if visitorInboundEmailLimitReplenish <= 0 {
+		return errors.New("visitor-inbound-email-limit-replenish must be greater than zero")
+	} else if visitorEmailFailureThreshold < 0 {
+		return errors.New("visitor-email-failure-threshold must be zero or positive")
+	} else if visitorEmailFailureThreshold > 0 && visitorEmailFailureCooldown <= 0 {
+		return errors.New("visitor-email-failure-cooldown must be greater than zero")
+	} else if visitorSubscriptionAttemptLimitBurst < 0 {
+		return errors.New("visitor-subscription-attempt-limit-burst must be zero or positive")
+	} else if visitorSubscriptionAttemptLimitReplenish <= 0 {
+		return errors.New("visitor-subscription-attempt-limit-replenish must be greater than zero")
+	} else if visitorFirebaseLimitReplenish <= 0 {
+		return errors.New("visitor-firebase-limit-replenish must be greater than zero")
+	} else if visitorFirebaseDailyLimit < 0 {
+		return errors.New("visitor-firebase-daily-limit must be zero or positive")
+	} else if visitorAuthFailureLimitReplenish <= 0 {
+		return errors.New("visitor-auth-failure-limit-replenish must be greater than zero")
+	} else if visitorPenaltyBoxThreshold < 0 {
+		return errors.New("visitor-penalty-box-threshold must be zero or positive")
+	} else if visitorPenaltyBoxThreshold > 0 && (visitorPenaltyBoxWindow <= 0 || visitorPenaltyBoxDuration <= 0) {
+		return errors.New("if visitor-penalty-box-threshold is set, visitor-penalty-box-window and visitor-penalty-box-duration must be greater than zero")
+	} else if visitorAccountCreationLimitIPv4Prefix < 0 || visitorAccountCreationLimitIPv4Prefix > 32 {
+		return errors.New("visitor-account-creation-limit-ipv4-prefix must be between 0 and 32")
+	} else if visitorAccountCreationLimitIPv6Prefix < 0 || visitorAccountCreationLimitIPv6Prefix > 128 {
+		return errors.New("visitor-account-creation-limit-ipv6-prefix must be between 0 and 128")
+	} else if newAccountGraceMultiplier < 1 {
+		return errors.New("new-account-grace-multiplier must be at least 1")
+	} else if len(geoRestrictedCountries) > 0 && geoIPDatabase == "" {
+		return errors.New("if geo-restricted-countries is set, geoip-database must also be set")
+	} else if geoRestrictedLimitMultiplier <= 0 || geoRestrictedLimitMultiplier > 1 {
+		return errors.New("geo-restricted-limit-multiplier must be greater than 0 and at most 1")
+	} else if topicMessageLimitReplenish <= 0 {
+		return errors.New("topic-message-limit-replenish must be greater than zero")
+	} else if visitorMessageLimiterMode != server.VisitorMessageLimiterModeFixed && visitorMessageLimiterMode != server.VisitorMessageLimiterModeSliding && visitorMessageLimiterMode != server.VisitorMessageLimiterModeDecay {
+		return errors.New("if set, visitor-message-limiter-mode must be 'fixed', 'sliding' or 'decay'")
+	} else if visitorLimitResetMode != server.VisitorLimitResetModeContinuous && visitorLimitResetMode != server.VisitorLimitResetModeCalendar {
+		return errors.New("if set, visitor-limit-reset-mode must be 'continuous' or 'calendar'")
+	} else if visitorLimitResetMode == server.VisitorLimitResetModeCalendar && visitorMessageLimiterMode != server.VisitorMessageLimiterModeFixed {
+		return errors.New("visitor-limit-reset-mode 'calendar' can only be combined with visitor-message-limiter-mode 'fixed'")
+	} else if visitorLimitResetJitter < 0 || visitorLimitResetJitter > 12*time.Hour {
+		return errors.New("visitor-limit-reset-jitter must be between 0 and 12h")
+	} else if visitorMessageSoftLimitPercent < 0 || visitorMessageSoftLimitPercent > 100 {
+		return errors.New("visitor-message-soft-limit-percent must be between 0 and 100")
+	} else if visitorMinMessageInterval < 0 {
+		return errors.New("visitor-min-message-interval must be zero or positive")
+	} else if visitorDedupWindow < 0 {
+		return errors.New("visitor-dedup-window must be zero or positive")
+	} else if visitorDedupMode != server.VisitorDedupModeReject && visitorDedupMode != server.VisitorDedupModeDrop {
+		return errors.New("if set, visitor-dedup-mode must be 'reject' or 'drop'")
+	} else if visitorDistinctTopicsDailyLimit < 0 {
+		return errors.New("visitor-distinct-topics-daily-limit must be zero or positive")
+	} else if visitorAttachmentDownloadConcurrency < 0 {
+		return errors.New("visitor-attachment-download-concurrency must be zero or positive")
+	} else if visitorLimiterStore != server.VisitorLimiterStoreMemory && visitorLimiterStore != server.VisitorLimiterStoreRedis {
+		return errors.New("if set, visitor-limiter-store must be 'memory' or 'redis'")
+	} else if visitorTierDowngradeMode != server.VisitorTierDowngradeModeImmediate && visitorTierDowngradeMode != server.VisitorTierDowngradeModeNextDay {
+		return errors.New("if set, visitor-tier-downgrade-mode must be 'immediate' or 'nextday'")
+	} else if visitorLimitsReloadMode != server.VisitorLimitsReloadModeNew && visitorLimitsReloadMode != server.VisitorLimitsReloadModeRebuild {
+		return errors.New("if set, visitor-limits-reload-mode must be 'new' or 'rebuild'")
+	} else if visitorScheduledMessageMode != server.VisitorScheduledMessageModePublish && visitorScheduledMessageMode != server.VisitorScheduledMessageModeDelivery {
+		return errors.New("if set, visitor-scheduled-message-mode must be 'publish' or 'delivery'")
+	} else if visitorScheduledMessageDailyLimit < 0 {
+		return errors.New("visitor-scheduled-message-daily-limit must be zero or positive")
+	} else if visitorAttachmentMessageDailyLimit < 0 {
+		return errors.New("visitor-attachment-message-daily-limit must be zero or positive")
+	} else if visitorGatewayMessageDailyLimit < 0 {
+		return errors.New("visitor-gateway-message-daily-limit must be zero or positive")
+	} else if visitorLimiterStore == server.VisitorLimiterStoreRedis && visitorLimiterRedisAddr == "" {
+		return errors.New("if visitor-limiter-store is 'redis', visitor-limiter-redis-addr must be set")
+	} else if visitorAttachmentBandwidthMode != server.VisitorAttachmentBandwidthModeDeny && visitorAttachmentBandwidthMode != server.VisitorAttachmentBandwidthModeThrottle {
+		return errors.New("if set, visitor-attachment-bandwidth-mode must be 'deny' or 'throttle'")
+	} else if visitorAttachmentBandwidthResetMode != server.VisitorAttachmentBandwidthResetModeRolling && visitorAttachmentBandwidthResetMode != server.VisitorAttachmentBandwidthResetModeCalendar {
+		return errors.New("if set, visitor-attachment-bandwidth-reset-mode must be 'rolling' or 'calendar'")
+	} else if visitorTenantHeader != "" && !behindProxy {
+		return errors.New("if visitor-tenant-header is set, behind-proxy must be set, since the header can otherwise be set by any client")
 	} else if messageSizeLimit > server.DefaultMessageSizeLimit {
 		log.Warn("message-size-limit is greater than 4K, this is not recommended and largely untested, and may lead to issues with some clients")
 		if messageSizeLimit > 5*1024*1024 {
@@ -338,6 +627,11 @@ func execServe(c *cli.Context) error {
 		}
 		visitorRequestLimitExemptIPs = append(visitorRequestLimitExemptIPs, ips...)
 	}
+	for _, path := range healthCheckPaths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("health-check-paths must only contain paths starting with '/', got %s", path)
+		}
+	}
 
 	// Stripe things
 	if stripeSecretKey != "" {
@@ -348,6 +642,23 @@ func execServe(c *cli.Context) error {
 	// Add default forbidden topics
 	disallowedTopics = append(disallowedTopics, server.DefaultDisallowedTopics...)
 
+	// Parse limit profiles
+	visitorLimitProfiles := make(map[string]*server.VisitorLimitProfile)
+	for _, s := range visitorLimitProfilesRaw {
+		name, profile, err := parseVisitorLimitProfile(s)
+		if err != nil {
+			return err
+		} else if _, exists := visitorLimitProfiles[name]; exists {
+			return fmt.Errorf("invalid visitor-limit-profiles: profile %s defined more than once", name)
+		}
+		visitorLimitProfiles[name] = profile
+	}
+
+	// Country codes are matched against the GeoIP database, which uses upper case
+	for i, country := range geoRestrictedCountries {
+		geoRestrictedCountries[i] = strings.ToUpper(strings.TrimSpace(country))
+	}
+
 	// Run server
 	conf := server.NewConfig()
 	conf.File = config
@@ -367,6 +678,7 @@ func execServe(c *cli.Context) error {
 	conf.AuthFile = authFile
 	conf.AuthStartupQueries = authStartupQueries
 	conf.AuthDefault = authDefault
+	conf.DefaultAdminTier = authDefaultAdminTier
 	conf.AttachmentCacheDir = attachmentCacheDir
 	conf.AttachmentTotalSizeLimit = attachmentTotalSizeLimit
 	conf.AttachmentFileSizeLimit = attachmentFileSizeLimit
@@ -391,23 +703,84 @@ func execServe(c *cli.Context) error {
 	conf.MessageSizeLimit = int(messageSizeLimit)
 	conf.MessageDelayMax = messageDelayLimit
 	conf.TotalTopicLimit = totalTopicLimit
+	conf.TopicMessageLimitBurst = topicMessageLimitBurst
+	conf.TopicMessageLimitReplenish = topicMessageLimitReplenish
 	conf.VisitorSubscriptionLimit = visitorSubscriptionLimit
+	conf.VisitorSubscriptionAttemptLimitBurst = visitorSubscriptionAttemptLimitBurst
+	conf.VisitorSubscriptionAttemptLimitReplenish = visitorSubscriptionAttemptLimitReplenish
+	conf.VisitorAttachmentDownloadConcurrency = visitorAttachmentDownloadConcurrency
 	conf.VisitorAttachmentTotalSizeLimit = visitorAttachmentTotalSizeLimit
 	conf.VisitorAttachmentDailyBandwidthLimit = visitorAttachmentDailyBandwidthLimit
+	conf.VisitorAttachmentBandwidthMode = visitorAttachmentBandwidthMode
+	conf.VisitorAttachmentBandwidthResetMode = visitorAttachmentBandwidthResetMode
+	conf.VisitorIngressDailyBandwidthLimit = visitorIngressDailyBandwidthLimit
 	conf.VisitorRequestLimitBurst = visitorRequestLimitBurst
 	conf.VisitorRequestLimitReplenish = visitorRequestLimitReplenish
 	conf.VisitorRequestExemptIPAddrs = visitorRequestLimitExemptIPs
+	conf.VisitorRequestLimitExemptLoopback = visitorRequestLimitExemptLoopback
+	conf.VisitorRequestLimitIPv6Prefix = visitorRequestLimitIPv6Prefix
+	conf.VisitorRequestMaxWait = visitorRequestMaxWait
+	conf.VisitorReadRequestLimitBurst = visitorReadRequestLimitBurst
+	conf.VisitorReadRequestLimitReplenish = visitorReadRequestLimitReplenish
 	conf.VisitorMessageDailyLimit = visitorMessageDailyLimit
+	conf.VisitorMessageSoftLimitPercent = visitorMessageSoftLimitPercent
+	conf.VisitorMinMessageInterval = visitorMinMessageInterval
+	conf.VisitorDedupWindow = visitorDedupWindow
+	conf.VisitorDedupMode = visitorDedupMode
+	conf.VisitorDistinctTopicsDailyLimit = visitorDistinctTopicsDailyLimit
+	conf.VisitorMessageLimiterMode = visitorMessageLimiterMode
+	conf.VisitorLimitResetMode = visitorLimitResetMode
+	conf.VisitorLimitResetTimezone = visitorLimitResetTimezone
+	conf.VisitorLimitResetJitter = visitorLimitResetJitter
+	conf.VisitorLimiterStore = visitorLimiterStore
+	conf.VisitorTierDowngradeMode = visitorTierDowngradeMode
+	conf.VisitorLimitsReloadMode = visitorLimitsReloadMode
+	conf.VisitorScheduledMessageMode = visitorScheduledMessageMode
+	conf.VisitorScheduledMessageDailyLimit = visitorScheduledMessageDailyLimit
+	conf.VisitorAttachmentMessageDailyLimit = visitorAttachmentMessageDailyLimit
+	conf.VisitorGatewayMessageDailyLimit = visitorGatewayMessageDailyLimit
+	conf.VisitorLimiterRedisAddr = visitorLimiterRedisAddr
+	conf.VisitorMessageCostSize = int(visitorMessageCostSize)
+	conf.RateLimitExemptTopics = rateLimitExemptTopics
+	conf.HealthCheckPaths = healthCheckPaths
 	conf.VisitorEmailLimitBurst = visitorEmailLimitBurst
 	conf.VisitorEmailLimitReplenish = visitorEmailLimitReplenish
+	conf.VisitorInboundEmailLimitBurst = visitorInboundEmailLimitBurst
+	conf.VisitorInboundEmailLimitReplenish = visitorInboundEmailLimitReplenish
+	conf.VisitorEmailLimitPersist = visitorEmailLimitPersist
+	conf.VisitorEmailFailureThreshold = visitorEmailFailureThreshold
+	conf.VisitorEmailFailureCooldown = visitorEmailFailureCooldown
+	conf.VisitorFirebaseLimitBurst = visitorFirebaseLimitBurst
+	conf.VisitorFirebaseLimitReplenish = visitorFirebaseLimitReplenish
+	conf.VisitorFirebaseDailyLimit = visitorFirebaseDailyLimit
+	conf.VisitorAuthFailureLimitBurst = visitorAuthFailureLimitBurst
+	conf.VisitorAuthFailureLimitReplenish = visitorAuthFailureLimitReplenish
+	conf.VisitorPenaltyBoxThreshold = visitorPenaltyBoxThreshold
+	conf.VisitorPenaltyBoxWindow = visitorPenaltyBoxWindow
+	conf.VisitorPenaltyBoxDuration = visitorPenaltyBoxDuration
+	conf.NewAccountGraceDuration = newAccountGraceDuration
+	conf.NewAccountGraceMultiplier = newAccountGraceMultiplier
+	conf.GeoIPDatabase = geoIPDatabase
+	conf.GeoRestrictedCountries = geoRestrictedCountries
+	conf.GeoRestrictedLimitMultiplier = geoRestrictedLimitMultiplier
+	conf.VisitorLimitProfiles = visitorLimitProfiles
+	conf.VisitorAccountCreationLimitIPv4Prefix = visitorAccountCreationLimitIPv4Prefix
+	conf.VisitorAccountCreationLimitIPv6Prefix = visitorAccountCreationLimitIPv6Prefix
 	conf.VisitorSubscriberRateLimiting = visitorSubscriberRateLimiting
+	conf.VisitorExpungeAfter = visitorExpungeAfter
+	conf.VisitorExpungeLog = visitorExpungeLog
+	conf.VisitorRequestStats = visitorRequestStats
 	conf.BehindProxy = behindProxy
+	conf.VisitorTenantHeader = visitorTenantHeader
 	conf.StripeSecretKey = stripeSecretKey
 	conf.StripeWebhookKey = stripeWebhookKey
 	conf.BillingContact = billingContact
+	conf.UsePaymentRequiredForTierLimits = usePaymentRequiredForTierLimits
+	conf.AnonymousPublishDisabled.Store(disableAnonymousPublish)
 	conf.EnableSignup = enableSignup
 	conf.EnableLogin = enableLogin
 	conf.EnableReservations = enableReservations
+	conf.StrictAccountInfo = strictAccountInfo
 	conf.EnableMetrics = enableMetrics
 	conf.MetricsListenHTTP = metricsListenHTTP
 	conf.ProfileListenHTTP = profileListenHTTP
@@ -418,33 +791,38 @@ func execServe(c *cli.Context) error {
 	conf.WebPushEmailAddress = webPushEmailAddress
 	conf.WebPushStartupQueries = webPushStartupQueries
 
-	// Set up hot-reloading of config
-	go sigHandlerConfigReload(config)
+	// Set up hot-reloading of config (before the server is created, so that an early SIGHUP does not kill the process)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
 
 	// Run server
 	s, err := server.New(conf)
 	if err != nil {
 		log.Fatal(err.Error())
-	} else if err := s.Run(); err != nil {
+	}
+	go sigHandlerConfigReload(sigs, config, s)
+	if err := s.Run(); err != nil {
 		log.Fatal(err.Error())
 	}
 	log.Info("Exiting.")
 	return nil
 }
 
-func sigHandlerConfigReload(config string) {
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGHUP)
+func sigHandlerConfigReload(sigs chan os.Signal, config string, s *server.Server) {
 	for range sigs {
 		log.Info("Partially hot reloading configuration ...")
-		inputSource, err := newYamlSourceFromFile(config, flagsServe)
+		rawConfig, err := readYamlConfigFile(config, flagsServe)
 		if err != nil {
 			log.Warn("Hot reload failed: %s", err.Error())
 			continue
 		}
+		inputSource := altsrc.NewMapInputSource(config, rawConfig)
 		if err := reloadLogLevel(inputSource); err != nil {
 			log.Warn("Reloading log level failed: %s", err.Error())
 		}
+		if err := reloadVisitorLimits(s, rawConfig, inputSource); err != nil {
+			log.Warn("Reloading visitor limits failed: %s", err.Error())
+		}
 	}
 }
 
@@ -473,6 +851,133 @@ func parseIPHostPrefix(host string) (prefixes []netip.Prefix, err error) {
 	return
 }
 
+// parseVisitorLimitProfile parses a limit profile definition of the form "<name>: <option>=<value> ...", e.g.
+// "ci: message-limit=5000 request-limit-burst=100 request-limit-replenish=1s", see server.VisitorLimitProfile
+func parseVisitorLimitProfile(s string) (string, *server.VisitorLimitProfile, error) {
+	name, options, found := strings.Cut(s, ":")
+	name = strings.TrimSpace(name)
+	if !found || name == "" {
+		return "", nil, fmt.Errorf("invalid visitor-limit-profiles: %s, expected format '<name>: <option>=<value> ...'", s)
+	}
+	profile := &server.VisitorLimitProfile{}
+	for _, option := range strings.Fields(options) {
+		key, value, found := strings.Cut(option, "=")
+		if !found {
+			return "", nil, fmt.Errorf("invalid visitor-limit-profiles option %s of profile %s, expected <option>=<value>", option, name)
+		}
+		var err error
+		switch key {
+		case "message-limit":
+			profile.MessageLimit, err = strconv.ParseInt(value, 10, 64)
+		case "email-limit":
+			profile.EmailLimit, err = strconv.ParseInt(value, 10, 64)
+		case "request-limit-burst":
+			profile.RequestLimitBurst, err = strconv.Atoi(value)
+		case "request-limit-replenish":
+			profile.RequestLimitReplenish, err = util.ParseDuration(value)
+		case "subscription-limit":
+			profile.SubscriptionLimit, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return "", nil, fmt.Errorf("invalid visitor-limit-profiles option %s of profile %s, unknown option", key, name)
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid visitor-limit-profiles option %s of profile %s: %s", key, name, err.Error())
+		}
+	}
+	return name, profile, nil
+}
+
+// reloadVisitorLimits re-reads the visitor limits that can be changed at runtime from the config file, and applies them
+// to the server (see server.ReloadVisitorLimits). Only options that are set in the config file are changed, all others
+// (including options passed as command line flags or environment variables) keep their current value. If any of the
+// options is invalid, none of them are applied.
+func reloadVisitorLimits(s *server.Server, rawConfig map[any]any, inputSource altsrc.InputSourceContext) error {
+	isSet := func(name string) bool {
+		_, ok := rawConfig[name]
+		return ok
+	}
+	updates := make([]func(conf *server.Config), 0)
+	intOptions := map[string]func(conf *server.Config) *int{
+		"visitor-subscription-limit":  func(conf *server.Config) *int { return &conf.VisitorSubscriptionLimit },
+		"visitor-request-limit-burst": func(conf *server.Config) *int { return &conf.VisitorRequestLimitBurst },
+		"visitor-message-daily-limit": func(conf *server.Config) *int { return &conf.VisitorMessageDailyLimit },
+		"visitor-email-limit-burst":   func(conf *server.Config) *int { return &conf.VisitorEmailLimitBurst },
+	}
+	for name, field := range intOptions {
+		if !isSet(name) {
+			continue
+		}
+		value, err := inputSource.Int(name)
+		if err != nil {
+			return fmt.Errorf("cannot load %s: %s", name, err.Error())
+		} else if value < 0 {
+			return fmt.Errorf("%s must be zero or positive", name)
+		}
+		field := field
+		updates = append(updates, func(conf *server.Config) { *field(conf) = value })
+	}
+	durationOptions := map[string]func(conf *server.Config) *time.Duration{
+		"visitor-request-limit-replenish": func(conf *server.Config) *time.Duration { return &conf.VisitorRequestLimitReplenish },
+		"visitor-email-limit-replenish":   func(conf *server.Config) *time.Duration { return &conf.VisitorEmailLimitReplenish },
+	}
+	for name, field := range durationOptions {
+		if !isSet(name) {
+			continue
+		}
+		valueStr, err := inputSource.String(name)
+		if err != nil {
+			return fmt.Errorf("cannot load %s: %s", name, err.Error())
+		}
+		value, err := util.ParseDuration(valueStr)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", name, valueStr)
+		} else if value <= 0 {
+			return fmt.Errorf("%s must be greater than zero", name)
+		}
+		field := field
+		updates = append(updates, func(conf *server.Config) { *field(conf) = value })
+	}
+	sizeOptions := map[string]func(conf *server.Config) *int64{
+		"visitor-attachment-total-size-limit":      func(conf *server.Config) *int64 { return &conf.VisitorAttachmentTotalSizeLimit },
+		"visitor-attachment-daily-bandwidth-limit": func(conf *server.Config) *int64 { return &conf.VisitorAttachmentDailyBandwidthLimit },
+	}
+	for name, field := range sizeOptions {
+		if !isSet(name) {
+			continue
+		}
+		valueStr, err := inputSource.String(name)
+		if err != nil {
+			return fmt.Errorf("cannot load %s: %s", name, err.Error())
+		}
+		value, err := util.ParseSize(valueStr)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", name, valueStr)
+		} else if value > math.MaxInt {
+			return fmt.Errorf("config option %s must be lower than %d", name, math.MaxInt)
+		}
+		field := field
+		updates = append(updates, func(conf *server.Config) { *field(conf) = value })
+	}
+	if isSet("visitor-limits-reload-mode") {
+		mode, err := inputSource.String("visitor-limits-reload-mode")
+		if err != nil {
+			return fmt.Errorf("cannot load visitor-limits-reload-mode: %s", err.Error())
+		} else if mode != server.VisitorLimitsReloadModeNew && mode != server.VisitorLimitsReloadModeRebuild {
+			return errors.New("if set, visitor-limits-reload-mode must be 'new' or 'rebuild'")
+		}
+		updates = append(updates, func(conf *server.Config) { conf.VisitorLimitsReloadMode = mode })
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	s.ReloadVisitorLimits(func(conf *server.Config) {
+		for _, update := range updates {
+			update(conf)
+		}
+	})
+	return nil
+}
+
 func reloadLogLevel(inputSource altsrc.InputSourceContext) error {
 	newLevelStr, err := inputSource.String("log-level")
 	if err != nil {
@@ -12,7 +12,9 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2/altsrc"
 	"heckel.io/ntfy/v2/client"
+	"heckel.io/ntfy/v2/server"
 	"heckel.io/ntfy/v2/test"
 	"heckel.io/ntfy/v2/util"
 )
@@ -84,6 +86,55 @@ func TestIP_Host_Parsing(t *testing.T) {
 	}
 }
 
+func TestParseVisitorLimitProfile(t *testing.T) {
+	name, profile, err := parseVisitorLimitProfile("ci: message-limit=5000 email-limit=10 request-limit-burst=100 request-limit-replenish=1s subscription-limit=5")
+	require.Nil(t, err)
+	require.Equal(t, "ci", name)
+	require.Equal(t, &server.VisitorLimitProfile{
+		MessageLimit:          5000,
+		EmailLimit:            10,
+		RequestLimitBurst:     100,
+		RequestLimitReplenish: time.Second,
+		SubscriptionLimit:     5,
+	}, profile)
+
+	name, profile, err = parseVisitorLimitProfile("empty:")
+	require.Nil(t, err)
+	require.Equal(t, "empty", name)
+	require.Equal(t, &server.VisitorLimitProfile{}, profile)
+
+	for _, s := range []string{"ci", ": message-limit=1", "ci: message-limit", "ci: message-limit=abc", "ci: unknown=1", "ci: request-limit-replenish=x"} {
+		_, _, err := parseVisitorLimitProfile(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestReloadVisitorLimits(t *testing.T) {
+	conf := server.NewConfig()
+	s, err := server.New(conf)
+	require.Nil(t, err)
+
+	filename := filepath.Join(t.TempDir(), "server.yml")
+	contents := `
+visitor_request_limit_burst: 10
+visitor-request-limit-replenish: "1m"
+visitor-attachment-total-size-limit: "1G"
+visitor-limits-reload-mode: rebuild
+`
+	require.Nil(t, os.WriteFile(filename, []byte(contents), 0600))
+	rawConfig, err := readYamlConfigFile(filename, flagsServe)
+	require.Nil(t, err)
+	require.Nil(t, reloadVisitorLimits(s, rawConfig, altsrc.NewMapInputSource(filename, rawConfig)))
+
+	contents = `
+visitor-email-limit-replenish: "0s"
+`
+	require.Nil(t, os.WriteFile(filename, []byte(contents), 0600))
+	rawConfig, err = readYamlConfigFile(filename, flagsServe)
+	require.Nil(t, err)
+	require.Equal(t, "visitor-email-limit-replenish must be greater than zero", reloadVisitorLimits(s, rawConfig, altsrc.NewMapInputSource(filename, rawConfig)).Error())
+}
+
 func newEmptyFile(t *testing.T) string {
 	filename := filepath.Join(t.TempDir(), "empty")
 	require.Nil(t, os.WriteFile(filename, []byte{}, 0600))
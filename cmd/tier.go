@@ -46,15 +46,23 @@ var cmdTier = &cli.Command{
 			Action:    execTierAdd,
 			Flags: []cli.Flag{
 				&cli.StringFlag{Name: "name", Usage: "tier name"},
-				&cli.Int64Flag{Name: "message-limit", Value: defaultMessageLimit, Usage: "daily message limit"},
+				&cli.Int64Flag{Name: "message-limit", Value: defaultMessageLimit, Usage: "daily message limit (0 = unlimited)"},
 				&cli.StringFlag{Name: "message-expiry-duration", Value: defaultMessageExpiryDuration, Usage: "duration after which messages are deleted"},
-				&cli.Int64Flag{Name: "email-limit", Value: defaultEmailLimit, Usage: "daily email limit"},
+				&cli.Int64Flag{Name: "email-limit", Value: defaultEmailLimit, Usage: "daily email limit (0 = unlimited)"},
 				&cli.Int64Flag{Name: "call-limit", Value: defaultCallLimit, Usage: "daily phone call limit"},
 				&cli.Int64Flag{Name: "reservation-limit", Value: defaultReservationLimit, Usage: "topic reservation limit"},
 				&cli.StringFlag{Name: "attachment-file-size-limit", Value: defaultAttachmentFileSizeLimit, Usage: "per-attachment file size limit"},
 				&cli.StringFlag{Name: "attachment-total-size-limit", Value: defaultAttachmentTotalSizeLimit, Usage: "total size limit of attachments for the user"},
 				&cli.StringFlag{Name: "attachment-expiry-duration", Value: defaultAttachmentExpiryDuration, Usage: "duration after which attachments are deleted"},
 				&cli.StringFlag{Name: "attachment-bandwidth-limit", Value: defaultAttachmentBandwidthLimit, Usage: "daily bandwidth limit for attachment uploads/downloads"},
+				&cli.Int64Flag{Name: "request-limit-burst", Usage: "request limiter burst size (0 = use default)"},
+				&cli.Int64Flag{Name: "subscription-limit", Usage: "concurrent subscription limit (0 = use default)"},
+				&cli.Int64Flag{Name: "email-limit-burst", Usage: "email limiter burst size (0 = use default)"},
+				&cli.Int64Flag{Name: "message-monthly-limit", Usage: "monthly message limit (0 = no monthly limit)"},
+				&cli.BoolFlag{Name: "firebase-disabled", Usage: "do not forward messages of users of this tier to Firebase"},
+				&cli.Int64Flag{Name: "attachment-message-limit", Usage: "daily limit for messages with attachments (0 = no separate limit)"},
+				&cli.Int64Flag{Name: "gateway-message-limit", Usage: "daily limit for UnifiedPush/Matrix gateway messages (0 = no separate limit)"},
+				&cli.Int64Flag{Name: "urgent-message-limit", Usage: "daily limit for urgent (priority 5) messages (0 = no separate limit)"},
 				&cli.StringFlag{Name: "stripe-monthly-price-id", Usage: "Monthly Stripe price ID for paid tiers (e.g. price_12345)"},
 				&cli.StringFlag{Name: "stripe-yearly-price-id", Usage: "Yearly Stripe price ID for paid tiers (e.g. price_12345)"},
 				&cli.BoolFlag{Name: "ignore-exists", Usage: "if the tier already exists, perform no action and exit"},
@@ -90,15 +98,23 @@ Examples:
 			Action:    execTierChange,
 			Flags: []cli.Flag{
 				&cli.StringFlag{Name: "name", Usage: "tier name"},
-				&cli.Int64Flag{Name: "message-limit", Usage: "daily message limit"},
+				&cli.Int64Flag{Name: "message-limit", Usage: "daily message limit (0 = unlimited)"},
 				&cli.StringFlag{Name: "message-expiry-duration", Usage: "duration after which messages are deleted"},
-				&cli.Int64Flag{Name: "email-limit", Usage: "daily email limit"},
+				&cli.Int64Flag{Name: "email-limit", Usage: "daily email limit (0 = unlimited)"},
 				&cli.Int64Flag{Name: "call-limit", Usage: "daily phone call limit"},
 				&cli.Int64Flag{Name: "reservation-limit", Usage: "topic reservation limit"},
 				&cli.StringFlag{Name: "attachment-file-size-limit", Usage: "per-attachment file size limit"},
 				&cli.StringFlag{Name: "attachment-total-size-limit", Usage: "total size limit of attachments for the user"},
 				&cli.StringFlag{Name: "attachment-expiry-duration", Usage: "duration after which attachments are deleted"},
 				&cli.StringFlag{Name: "attachment-bandwidth-limit", Usage: "daily bandwidth limit for attachment uploads/downloads"},
+				&cli.Int64Flag{Name: "request-limit-burst", Usage: "request limiter burst size (0 = use default)"},
+				&cli.Int64Flag{Name: "subscription-limit", Usage: "concurrent subscription limit (0 = use default)"},
+				&cli.Int64Flag{Name: "email-limit-burst", Usage: "email limiter burst size (0 = use default)"},
+				&cli.Int64Flag{Name: "message-monthly-limit", Usage: "monthly message limit (0 = no monthly limit)"},
+				&cli.BoolFlag{Name: "firebase-disabled", Usage: "do not forward messages of users of this tier to Firebase"},
+				&cli.Int64Flag{Name: "attachment-message-limit", Usage: "daily limit for messages with attachments (0 = no separate limit)"},
+				&cli.Int64Flag{Name: "gateway-message-limit", Usage: "daily limit for UnifiedPush/Matrix gateway messages (0 = no separate limit)"},
+				&cli.Int64Flag{Name: "urgent-message-limit", Usage: "daily limit for urgent (priority 5) messages (0 = no separate limit)"},
 				&cli.StringFlag{Name: "stripe-monthly-price-id", Usage: "Monthly Stripe price ID for paid tiers (e.g. price_12345)"},
 				&cli.StringFlag{Name: "stripe-yearly-price-id", Usage: "Yearly Stripe price ID for paid tiers (e.g. price_12345)"},
 			},
@@ -224,6 +240,14 @@ func execTierAdd(c *cli.Context) error {
 		AttachmentTotalSizeLimit: attachmentTotalSizeLimit,
 		AttachmentExpiryDuration: attachmentExpiryDuration,
 		AttachmentBandwidthLimit: attachmentBandwidthLimit,
+		RequestLimitBurst:        c.Int64("request-limit-burst"),
+		SubscriptionLimit:        c.Int64("subscription-limit"),
+		EmailLimitBurst:          c.Int64("email-limit-burst"),
+		MessageMonthlyLimit:      c.Int64("message-monthly-limit"),
+		FirebaseDisabled:         c.Bool("firebase-disabled"),
+		AttachmentMessagesLimit:  c.Int64("attachment-message-limit"),
+		GatewayMessagesLimit:     c.Int64("gateway-message-limit"),
+		UrgentMessagesLimit:      c.Int64("urgent-message-limit"),
 		StripeMonthlyPriceID:     c.String("stripe-monthly-price-id"),
 		StripeYearlyPriceID:      c.String("stripe-yearly-price-id"),
 	}
@@ -301,6 +325,30 @@ func execTierChange(c *cli.Context) error {
 			return err
 		}
 	}
+	if c.IsSet("request-limit-burst") {
+		tier.RequestLimitBurst = c.Int64("request-limit-burst")
+	}
+	if c.IsSet("subscription-limit") {
+		tier.SubscriptionLimit = c.Int64("subscription-limit")
+	}
+	if c.IsSet("email-limit-burst") {
+		tier.EmailLimitBurst = c.Int64("email-limit-burst")
+	}
+	if c.IsSet("message-monthly-limit") {
+		tier.MessageMonthlyLimit = c.Int64("message-monthly-limit")
+	}
+	if c.IsSet("firebase-disabled") {
+		tier.FirebaseDisabled = c.Bool("firebase-disabled")
+	}
+	if c.IsSet("attachment-message-limit") {
+		tier.AttachmentMessagesLimit = c.Int64("attachment-message-limit")
+	}
+	if c.IsSet("gateway-message-limit") {
+		tier.GatewayMessagesLimit = c.Int64("gateway-message-limit")
+	}
+	if c.IsSet("urgent-message-limit") {
+		tier.UrgentMessagesLimit = c.Int64("urgent-message-limit")
+	}
 	if c.IsSet("stripe-monthly-price-id") {
 		tier.StripeMonthlyPriceID = c.String("stripe-monthly-price-id")
 	}
@@ -370,5 +418,13 @@ func printTier(c *cli.Context, tier *user.Tier) {
 	fmt.Fprintf(c.App.ErrWriter, "- Attachment total size limit: %s\n", util.FormatSizeHuman(tier.AttachmentTotalSizeLimit))
 	fmt.Fprintf(c.App.ErrWriter, "- Attachment expiry duration: %s (%d seconds)\n", tier.AttachmentExpiryDuration.String(), int64(tier.AttachmentExpiryDuration.Seconds()))
 	fmt.Fprintf(c.App.ErrWriter, "- Attachment daily bandwidth limit: %s\n", util.FormatSizeHuman(tier.AttachmentBandwidthLimit))
+	fmt.Fprintf(c.App.ErrWriter, "- Request limit burst: %d\n", tier.RequestLimitBurst)
+	fmt.Fprintf(c.App.ErrWriter, "- Subscription limit: %d\n", tier.SubscriptionLimit)
+	fmt.Fprintf(c.App.ErrWriter, "- Email limit burst: %d\n", tier.EmailLimitBurst)
+	fmt.Fprintf(c.App.ErrWriter, "- Monthly message limit: %d\n", tier.MessageMonthlyLimit)
+	fmt.Fprintf(c.App.ErrWriter, "- Firebase disabled: %t\n", tier.FirebaseDisabled)
+	fmt.Fprintf(c.App.ErrWriter, "- Attachment message limit: %d\n", tier.AttachmentMessagesLimit)
+	fmt.Fprintf(c.App.ErrWriter, "- Gateway message limit: %d\n", tier.GatewayMessagesLimit)
+	fmt.Fprintf(c.App.ErrWriter, "- Urgent message limit: %d\n", tier.UrgentMessagesLimit)
 	fmt.Fprintf(c.App.ErrWriter, "- Stripe prices (monthly/yearly): %s\n", prices)
 }
@@ -30,11 +30,13 @@ var cmdToken = &cli.Command{
 			Name:      "add",
 			Aliases:   []string{"a"},
 			Usage:     "Create a new token",
-			UsageText: "ntfy token add [--expires=<duration>] [--label=..] USERNAME",
+			UsageText: "ntfy token add [--expires=<duration>] [--label=..] [--profile=..] [--exempt] USERNAME",
 			Action:    execTokenAdd,
 			Flags: []cli.Flag{
 				&cli.StringFlag{Name: "expires", Aliases: []string{"e"}, Value: "", Usage: "token expires after"},
 				&cli.StringFlag{Name: "label", Aliases: []string{"l"}, Value: "", Usage: "token label"},
+				&cli.StringFlag{Name: "profile", Aliases: []string{"p"}, Value: "", Usage: "limit profile (as defined in server.yml)"},
+				&cli.BoolFlag{Name: "exempt", Value: false, Usage: "service token, exempt from all limits (for internal automation)"},
 			},
 			Description: `Create a new user access token.
 
@@ -42,6 +44,13 @@ User access tokens can be used to publish, subscribe, or perform any other user-
 Tokens have full access, and can perform any task a user can do. They are meant to be used to 
 avoid spreading the password to various places.
 
+If a limit profile is given (see 'visitor-limit-profiles' in server.yml), requests authenticated with
+the token are limited by the profile instead of the user's tier.
+
+If --exempt is given, the token is a service token: requests authenticated with it are exempt from
+all limits. This does not give the token any other privileges, i.e. it is not an admin token. Only 
+use this for trusted internal services.
+
 This is a server-only command. It directly reads from user.db as defined in the server config
 file server.yml. The command only works if 'auth-file' is properly defined.
 
@@ -49,7 +58,9 @@ Examples:
   ntfy token add phil                   # Create token for user phil which never expires
   ntfy token add --expires=2d phil      # Create token for user phil which expires in 2 days
   ntfy token add -e "tuesday, 8pm" phil # Create token for user phil which expires next Tuesday
-  ntfy token add -l backups phil        # Create token for user phil with label "backups"`,
+  ntfy token add -l backups phil        # Create token for user phil with label "backups"
+  ntfy token add -p ci phil             # Create token for user phil with limit profile "ci"
+  ntfy token add --exempt backups       # Create service token for user backups, exempt from limits`,
 		},
 		{
 			Name:      "remove",
@@ -94,6 +105,8 @@ func execTokenAdd(c *cli.Context) error {
 	username := c.Args().Get(0)
 	expiresStr := c.String("expires")
 	label := c.String("label")
+	profile := c.String("profile")
+	exempt := c.Bool("exempt")
 	if username == "" {
 		return errors.New("username expected, type 'ntfy token add --help' for help")
 	} else if username == userEveryone || username == user.Everyone {
@@ -121,6 +134,17 @@ func execTokenAdd(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	if profile != "" {
+		if err := manager.ChangeTokenLimitProfile(u.ID, token.Value, profile); err != nil {
+			return err
+		}
+	}
+	if exempt {
+		if err := manager.ChangeTokenExempt(u.ID, token.Value, true); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.ErrWriter, "token %s is a service token, exempt from all limits\n", token.Value)
+	}
 	if expires.Unix() == 0 {
 		fmt.Fprintf(c.App.ErrWriter, "token %s created for user %s, never expires\n", token.Value, u.Name)
 	} else {
@@ -191,16 +215,22 @@ func execTokenList(c *cli.Context) error {
 		usersWithTokens++
 		fmt.Fprintf(c.App.ErrWriter, "user %s\n", u.Name)
 		for _, t := range tokens {
-			var label, expires string
+			var label, expires, profile string
 			if t.Label != "" {
 				label = fmt.Sprintf(" (%s)", t.Label)
 			}
+			if t.LimitProfile != "" {
+				profile = fmt.Sprintf(", limit profile %s", t.LimitProfile)
+			}
+			if t.Exempt {
+				profile += ", exempt from limits"
+			}
 			if t.Expires.Unix() == 0 {
 				expires = "never expires"
 			} else {
 				expires = fmt.Sprintf("expires %s", t.Expires.Format(time.RFC822))
 			}
-			fmt.Fprintf(c.App.ErrWriter, "- %s%s, %s, accessed from %s at %s\n", t.Value, label, expires, t.LastOrigin.String(), t.LastAccess.Format(time.RFC822))
+			fmt.Fprintf(c.App.ErrWriter, "- %s%s, %s%s, accessed from %s at %s\n", t.Value, label, expires, profile, t.LastOrigin.String(), t.LastAccess.Format(time.RFC822))
 		}
 	}
 	if usersWithTokens == 0 {
@@ -36,6 +36,22 @@ func TestCLI_Token_AddListRemove(t *testing.T) {
 	app, _, _, stderr = newTestApp()
 	require.Nil(t, runTokenCommand(app, conf, "list"))
 	require.Equal(t, "no users with tokens\n", stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "add", "--profile=ci", "phil"))
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "list", "phil"))
+	require.Regexp(t, `user phil\n- tk_.+, never expires, limit profile ci, accessed from 0.0.0.0 at .+`, stderr.String())
+	token = re.FindString(stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "remove", "phil", token))
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "add", "--exempt", "phil"))
+	require.Contains(t, stderr.String(), "is a service token, exempt from all limits")
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "list", "phil"))
+	require.Regexp(t, `user phil\n- tk_.+, never expires, exempt from limits, accessed from 0.0.0.0 at .+`, stderr.String())
 }
 
 func runTokenCommand(app *cli.App, conf *server.Config, args ...string) error {
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"heckel.io/ntfy/v2/user"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/urfave/cli/v2"
@@ -131,6 +132,45 @@ as messages per day, attachment file sizes, etc.
 Example:
   ntfy user change-tier phil pro   # Change tier to "pro" for user "phil"  
   ntfy user change-tier phil -     # Remove tier from user "phil" entirely 
+`,
+		},
+		{
+			Name:      "change-limits",
+			Usage:     "Changes the per-user limit overrides of a user",
+			UsageText: "ntfy user change-limits [--message-limit=(N|-)] [--email-limit=(N|-)] [--call-limit=(N|-)] [--attachment-total-size-limit=(SIZE|-)] USERNAME",
+			Action:    execUserChangeLimits,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "message-limit", Usage: "daily message limit, or - to use the tier limit"},
+				&cli.StringFlag{Name: "email-limit", Usage: "daily email limit, or - to use the tier limit"},
+				&cli.StringFlag{Name: "call-limit", Usage: "daily phone call limit, or - to use the tier limit"},
+				&cli.StringFlag{Name: "attachment-total-size-limit", Usage: "total size of all attachments (e.g. 5G), or - to use the tier limit"},
+			},
+			Description: `Change the per-user limit overrides for the given user.
+
+Overrides take precedence over the limits of the user's tier (or the server config, if the user
+has no tier). This is useful to grant custom limits to individual users, without having to create
+a whole tier. Limits that are not passed are not changed. Pass - to remove an override.
+
+Examples:
+  ntfy user change-limits --message-limit=5000 phil   # Allow user "phil" 5,000 messages per day
+  ntfy user change-limits --message-limit=- phil      # Use the tier's message limit again
+  ntfy user change-limits --attachment-total-size-limit=5G phil  # Grant user "phil" 5 GB of attachment storage
+`,
+		},
+		{
+			Name:      "change-billing-account",
+			Usage:     "Changes the billing account of a user",
+			UsageText: "ntfy user change-billing-account USERNAME (ACCOUNT|-)",
+			Action:    execUserChangeBillingAccount,
+			Description: `Change the billing account for the given user.
+
+Users with the same billing account (e.g. the members of a team) share one pool of daily
+messages, instead of each having their own. The pool's limit is the message limit of the
+users' tier, so all members should be on the same tier.
+
+Example:
+  ntfy user change-billing-account phil team-a   # Add user "phil" to billing account "team-a"
+  ntfy user change-billing-account phil -        # Remove user "phil" from its billing account
 `,
 		},
 		{
@@ -309,6 +349,124 @@ func execUserChangeTier(c *cli.Context) error {
 	return nil
 }
 
+func execUserChangeBillingAccount(c *cli.Context) error {
+	username := c.Args().Get(0)
+	account := c.Args().Get(1)
+	if username == "" || account == "" {
+		return errors.New("username and billing account expected, type 'ntfy user change-billing-account --help' for help")
+	} else if username == userEveryone || username == user.Everyone {
+		return errors.New("username not allowed")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.User(username); err == user.ErrUserNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	if account == tierReset {
+		if err := manager.ChangeBillingAccount(username, ""); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.ErrWriter, "removed billing account from user %s\n", username)
+	} else {
+		if err := manager.ChangeBillingAccount(username, account); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.ErrWriter, "changed billing account for user %s to %s\n", username, account)
+	}
+	return nil
+}
+
+func execUserChangeLimits(c *cli.Context) error {
+	username := c.Args().Get(0)
+	if username == "" {
+		return errors.New("username expected, type 'ntfy user change-limits --help' for help")
+	} else if username == userEveryone || username == user.Everyone {
+		return errors.New("username not allowed")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	u, err := manager.User(username)
+	if err == user.ErrUserNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	} else if err != nil {
+		return err
+	}
+	messagesLimit, err := parseLimitOverride(c, "message-limit", u.MessagesLimitOverride)
+	if err != nil {
+		return err
+	}
+	emailsLimit, err := parseLimitOverride(c, "email-limit", u.EmailsLimitOverride)
+	if err != nil {
+		return err
+	}
+	callsLimit, err := parseLimitOverride(c, "call-limit", u.CallsLimitOverride)
+	if err != nil {
+		return err
+	}
+	attachmentTotalSizeLimit, err := parseSizeLimitOverride(c, "attachment-total-size-limit", u.AttachmentTotalSizeLimitOverride)
+	if err != nil {
+		return err
+	}
+	if err := manager.ChangeLimitOverrides(username, messagesLimit, emailsLimit, callsLimit, attachmentTotalSizeLimit); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "changed limit overrides for user %s (messages: %s, emails: %s, calls: %s, attachment total size: %s)\n", username, formatLimitOverride(messagesLimit), formatLimitOverride(emailsLimit), formatLimitOverride(callsLimit), formatSizeLimitOverride(attachmentTotalSizeLimit))
+	return nil
+}
+
+// parseLimitOverride parses a limit override flag, returning the current value if the flag is not set,
+// and nil if it is set to "-" (reset)
+func parseLimitOverride(c *cli.Context, flag string, current *int64) (*int64, error) {
+	if !c.IsSet(flag) {
+		return current, nil
+	}
+	value := c.String(flag)
+	if value == tierReset {
+		return nil, nil
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit < 0 {
+		return nil, fmt.Errorf("invalid %s, must be a positive number, or - to reset", flag)
+	}
+	return &limit, nil
+}
+
+// parseSizeLimitOverride is like parseLimitOverride, but for sizes (e.g. 5G). A zero size removes the override.
+func parseSizeLimitOverride(c *cli.Context, flag string, current *int64) (*int64, error) {
+	if !c.IsSet(flag) {
+		return current, nil
+	}
+	value := c.String(flag)
+	if value == tierReset {
+		return nil, nil
+	}
+	limit, err := util.ParseSize(value)
+	if err != nil || limit < 0 {
+		return nil, fmt.Errorf("invalid %s, must be a size (e.g. 5G), or - to reset", flag)
+	} else if limit == 0 {
+		return nil, nil
+	}
+	return &limit, nil
+}
+
+func formatSizeLimitOverride(limit *int64) string {
+	if limit == nil {
+		return "tier"
+	}
+	return util.FormatSize(*limit)
+}
+
+func formatLimitOverride(limit *int64) string {
+	if limit == nil {
+		return "tier"
+	}
+	return strconv.FormatInt(*limit, 10)
+}
+
 func execUserList(c *cli.Context) error {
 	manager, err := createUserManager(c)
 	if err != nil {
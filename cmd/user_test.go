@@ -91,6 +91,59 @@ func TestCLI_User_ChangeRole(t *testing.T) {
 	require.Contains(t, stderr.String(), "changed role for user phil to admin")
 }
 
+func TestCLI_User_ChangeLimits(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	// Add user
+	app, stdin, _, stderr := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+	require.Contains(t, stderr.String(), "user phil added with role user")
+
+	// Change limits
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "change-limits", "--message-limit=5000", "--call-limit=0", "phil"))
+	require.Contains(t, stderr.String(), "changed limit overrides for user phil (messages: 5000, emails: tier, calls: 0, attachment total size: tier)")
+
+	// Reset one, others are kept
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "change-limits", "--message-limit=-", "phil"))
+	require.Contains(t, stderr.String(), "changed limit overrides for user phil (messages: tier, emails: tier, calls: 0, attachment total size: tier)")
+
+	// Attachment storage
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "change-limits", "--attachment-total-size-limit=5G", "phil"))
+	require.Contains(t, stderr.String(), "changed limit overrides for user phil (messages: tier, emails: tier, calls: 0, attachment total size: 5G)")
+
+	// Invalid value
+	app, _, _, _ = newTestApp()
+	require.Error(t, runUserCommand(app, conf, "change-limits", "--email-limit=lots", "phil"))
+}
+
+func TestCLI_User_ChangeBillingAccount(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	// Add user
+	app, stdin, _, stderr := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+	require.Contains(t, stderr.String(), "user phil added with role user")
+
+	// Change and remove billing account
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "change-billing-account", "phil", "team-a"))
+	require.Contains(t, stderr.String(), "changed billing account for user phil to team-a")
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "change-billing-account", "phil", "-"))
+	require.Contains(t, stderr.String(), "removed billing account from user phil")
+
+	// Missing account
+	app, _, _, _ = newTestApp()
+	require.Error(t, runUserCommand(app, conf, "change-billing-account", "phil"))
+}
+
 func TestCLI_User_Delete(t *testing.T) {
 	s, conf, port := newTestServerWithAuth(t)
 	defer test.StopServer(t, s, port)
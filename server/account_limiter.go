@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// accountCreationLimiter limits the rate of account creations per subnet, rather than per visitor. This makes it
+// harder for spammers rotating through the addresses of a subnet to create many accounts. It is independent of
+// how visitors are keyed, so only account creation is subnet-scoped. See Config.VisitorAccountCreationLimitIPv4Prefix.
+type accountCreationLimiter struct {
+	limit      rate.Limit
+	burst      int
+	ipv4Prefix int                            // Prefix length for IPv4 addresses, zero means per address
+	ipv6Prefix int                            // Prefix length for IPv6 addresses, zero means per address
+	limiters   map[netip.Prefix]*rate.Limiter // Subnet -> limiter
+	mu         sync.Mutex
+}
+
+// newAccountCreationLimiter creates a new account creation limiter with the given rate and burst for each subnet
+func newAccountCreationLimiter(limit rate.Limit, burst, ipv4Prefix, ipv6Prefix int) *accountCreationLimiter {
+	return &accountCreationLimiter{
+		limit:      limit,
+		burst:      burst,
+		ipv4Prefix: ipv4Prefix,
+		ipv6Prefix: ipv6Prefix,
+		limiters:   make(map[netip.Prefix]*rate.Limiter),
+	}
+}
+
+// Reserve counts an account towards the subnet of the given IP address, and returns false if no other account may
+// be created from the subnet. The account is counted right away, so that concurrent signups cannot exceed the burst.
+// If the account is not created after all (e.g. because the username is taken), cancel must be called to give it back.
+func (l *accountCreationLimiter) Reserve(ip netip.Addr) (cancel func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter := l.limiterNoLock(ip)
+	if !limiter.Allow() {
+		return nil, false
+	}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		limiter.AllowN(time.Now(), -1) // Negative n gives back the token (capped at the burst)
+	}, true
+}
+
+// Prune removes the limiters of idle subnets, and returns the number of removed limiters. A subnet is idle if its
+// bucket is entirely refilled, so removing it does not lose any state.
+func (l *accountCreationLimiter) Prune() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pruned := 0
+	for subnet, limiter := range l.limiters {
+		if limiter.Tokens() >= float64(l.burst) {
+			delete(l.limiters, subnet)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// Len returns the number of subnets that are currently tracked
+func (l *accountCreationLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.limiters)
+}
+
+func (l *accountCreationLimiter) limiterNoLock(ip netip.Addr) *rate.Limiter {
+	subnet := l.subnet(ip)
+	limiter, ok := l.limiters[subnet]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[subnet] = limiter
+	}
+	return limiter
+}
+
+func (l *accountCreationLimiter) subnet(ip netip.Addr) netip.Prefix {
+	ip = ip.Unmap()
+	bits := l.ipv6Prefix
+	if ip.Is4() {
+		bits = l.ipv4Prefix
+	}
+	if bits <= 0 || bits > ip.BitLen() {
+		bits = ip.BitLen()
+	}
+	subnet, err := ip.Prefix(bits)
+	if err != nil {
+		return netip.PrefixFrom(ip, ip.BitLen())
+	}
+	return subnet
+}
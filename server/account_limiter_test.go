@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestAccountCreationLimiter_SharedBySubnet(t *testing.T) {
+	l := newAccountCreationLimiter(rate.Every(time.Hour), 2, 24, 48)
+	require.True(t, reserved(l, "1.2.3.4"))
+	require.True(t, reserved(l, "1.2.3.5"))
+	require.False(t, reserved(l, "1.2.3.200"))
+	require.False(t, reserved(l, "::ffff:1.2.3.6")) // IPv4-mapped addresses are treated as IPv4
+	require.True(t, reserved(l, "1.2.4.1"))
+
+	require.True(t, reserved(l, "2001:db8:1:2::1"))
+	require.True(t, reserved(l, "2001:db8:1:3::1"))
+	require.False(t, reserved(l, "2001:db8:1:ffff::1"))
+	require.True(t, reserved(l, "2001:db8:2::1"))
+	require.Equal(t, 4, l.Len())
+}
+
+func TestAccountCreationLimiter_Cancel(t *testing.T) {
+	l := newAccountCreationLimiter(rate.Every(time.Hour), 1, 24, 48)
+	cancel, ok := l.Reserve(netip.MustParseAddr("1.2.3.4"))
+	require.True(t, ok)
+	require.False(t, reserved(l, "1.2.3.5")) // Reserved right away, before the account is created
+	cancel()
+	require.True(t, reserved(l, "1.2.3.5"))
+	require.False(t, reserved(l, "1.2.3.6"))
+}
+
+func TestAccountCreationLimiter_PerAddressIfNoPrefix(t *testing.T) {
+	l := newAccountCreationLimiter(rate.Every(time.Hour), 1, 24, 0)
+	require.True(t, reserved(l, "2001:db8::1"))
+	require.False(t, reserved(l, "2001:db8::1"))
+	require.True(t, reserved(l, "2001:db8::2"))
+}
+
+func TestAccountCreationLimiter_PruneIdle(t *testing.T) {
+	l := newAccountCreationLimiter(rate.Every(50*time.Millisecond), 1, 24, 64)
+	require.True(t, reserved(l, "1.2.3.4"))
+	require.Equal(t, 0, l.Prune())
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, l.Prune())
+	require.Equal(t, 0, l.Len())
+}
+
+func reserved(l *accountCreationLimiter, ip string) bool {
+	_, ok := l.Reserve(netip.MustParseAddr(ip))
+	return ok
+}
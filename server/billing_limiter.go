@@ -0,0 +1,61 @@
+package server
+
+import (
+	"sync"
+
+	"heckel.io/ntfy/v2/util"
+)
+
+// billingAccountLimiters is a registry of message limiters that are shared by all users with the same billing
+// account (see user.User.BillingAccount), e.g. the members of a team. Each visitor of such a user uses the shared
+// limiter as its messages limiter, so that all members draw from (and Info reports) one pool of messages.
+type billingAccountLimiters struct {
+	limiters map[string]*util.FixedLimiter // Billing account -> shared messages limiter
+	mu       sync.Mutex
+}
+
+// newBillingAccountLimiters creates a new, empty registry of shared billing account limiters
+func newBillingAccountLimiters() *billingAccountLimiters {
+	return &billingAccountLimiters{
+		limiters: make(map[string]*util.FixedLimiter),
+	}
+}
+
+// MessagesLimiter returns the shared messages limiter for the given billing account. If there is none yet, it is
+// created with the given value, e.g. the persisted message count of the first member. Otherwise, the existing
+// pool is kept, and only its limit is updated, so that a tier change of one member applies to the whole pool.
+func (l *billingAccountLimiters) MessagesLimiter(account string, limit, value int64) util.RemainingLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter, ok := l.limiters[account]
+	if !ok {
+		limiter = util.NewFixedLimiterWithValue(limit, value)
+		l.limiters[account] = limiter
+	} else {
+		limiter.SetLimit(limit)
+	}
+	return limiter
+}
+
+// Prune removes the limiters of idle billing accounts, and returns the number of removed limiters. A billing account
+// is idle if none of the given active accounts (i.e. the billing accounts of the current visitors) matches it. Its
+// members' message counts are persisted with their stats, so the pool is restored from them when it is needed again.
+func (l *billingAccountLimiters) Prune(active map[string]bool) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pruned := 0
+	for account := range l.limiters {
+		if !active[account] {
+			delete(l.limiters, account)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// Len returns the number of billing accounts that are currently tracked
+func (l *billingAccountLimiters) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.limiters)
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBillingAccountLimiters_MessagesLimiter(t *testing.T) {
+	l := newBillingAccountLimiters()
+	phil := l.MessagesLimiter("team-a", 10, 3)
+	ben := l.MessagesLimiter("team-a", 10, 7) // Existing pool keeps its value
+	other := l.MessagesLimiter("team-b", 10, 0)
+	require.Equal(t, 2, l.Len())
+
+	require.True(t, phil.AllowN(5))
+	require.Equal(t, int64(8), ben.Value())
+	require.Equal(t, int64(2), ben.Remaining())
+	require.Equal(t, int64(10), other.Remaining())
+
+	// Limit is updated for all members
+	l.MessagesLimiter("team-a", 20, 0)
+	require.Equal(t, int64(12), phil.Remaining())
+}
+
+func TestBillingAccountLimiters_Prune(t *testing.T) {
+	l := newBillingAccountLimiters()
+	phil := l.MessagesLimiter("team-a", 10, 0)
+	l.MessagesLimiter("team-b", 10, 0)
+	require.True(t, phil.AllowN(4))
+
+	require.Equal(t, 1, l.Prune(map[string]bool{"team-a": true}))
+	require.Equal(t, 1, l.Len())
+	require.Equal(t, int64(4), l.MessagesLimiter("team-a", 10, 0).Value()) // Active pool is kept
+	require.Equal(t, 1, l.Prune(map[string]bool{}))
+	require.Equal(t, 0, l.Len())
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"io/fs"
 	"net/netip"
+	"sync/atomic"
 	"time"
 
 	"heckel.io/ntfy/v2/user"
@@ -35,11 +36,13 @@ const (
 // - total topic limit: max number of topics overall
 // - various attachment limits
 const (
-	DefaultMessageSizeLimit         = 4096 // Bytes; note that FCM/APNS have a limit of ~4 KB for the entire message
-	DefaultTotalTopicLimit          = 15000
-	DefaultAttachmentTotalSizeLimit = int64(5 * 1024 * 1024 * 1024) // 5 GB
-	DefaultAttachmentFileSizeLimit  = int64(15 * 1024 * 1024)       // 15 MB
-	DefaultAttachmentExpiryDuration = 3 * time.Hour
+	DefaultMessageSizeLimit           = 4096 // Bytes; note that FCM/APNS have a limit of ~4 KB for the entire message
+	DefaultTotalTopicLimit            = 15000
+	DefaultTopicMessageLimitBurst     = 0 // Disabled: messages are only limited per visitor
+	DefaultTopicMessageLimitReplenish = time.Second
+	DefaultAttachmentTotalSizeLimit   = int64(5 * 1024 * 1024 * 1024) // 5 GB
+	DefaultAttachmentFileSizeLimit    = int64(15 * 1024 * 1024)       // 15 MB
+	DefaultAttachmentExpiryDuration   = 3 * time.Hour
 )
 
 // Defines all per-visitor limits
@@ -49,18 +52,139 @@ const (
 // - per visitor attachment size limit: total per-visitor attachment size in bytes to be stored on the server
 // - per visitor attachment daily bandwidth limit: number of bytes that can be transferred to/from the server
 const (
-	DefaultVisitorSubscriptionLimit             = 30
-	DefaultVisitorRequestLimitBurst             = 60
-	DefaultVisitorRequestLimitReplenish         = 5 * time.Second
-	DefaultVisitorMessageDailyLimit             = 0
-	DefaultVisitorEmailLimitBurst               = 16
-	DefaultVisitorEmailLimitReplenish           = time.Hour
-	DefaultVisitorAccountCreationLimitBurst     = 3
-	DefaultVisitorAccountCreationLimitReplenish = 24 * time.Hour
-	DefaultVisitorAuthFailureLimitBurst         = 30
-	DefaultVisitorAuthFailureLimitReplenish     = time.Minute
-	DefaultVisitorAttachmentTotalSizeLimit      = 100 * 1024 * 1024 // 100 MB
-	DefaultVisitorAttachmentDailyBandwidthLimit = 500 * 1024 * 1024 // 500 MB
+	DefaultVisitorSubscriptionLimit                 = 30
+	DefaultVisitorSubscriptionAttemptLimitBurst     = 0 // Disabled: only the number of concurrent subscriptions is limited
+	DefaultVisitorSubscriptionAttemptLimitReplenish = 5 * time.Second
+	DefaultVisitorAttachmentDownloadConcurrency     = 0 // Disabled
+	DefaultVisitorRequestLimitBurst                 = 60
+	DefaultVisitorRequestLimitReplenish             = 5 * time.Second
+	DefaultVisitorRequestLimitIPv6Prefix            = 64 // IPv6 addresses in the same /64 network share one visitor
+	DefaultVisitorRequestMaxWait                    = 0  // Disabled: requests are rejected right away if the limit is reached
+	DefaultVisitorReadRequestLimitBurst             = 0  // Disabled: read requests count towards the request limit
+	DefaultVisitorReadRequestLimitReplenish         = 5 * time.Second
+	DefaultVisitorMessageDailyLimit                 = 0
+	DefaultVisitorMessageSoftLimitPercent           = 0 // Disabled
+	DefaultVisitorMinMessageInterval                = 0 // Disabled
+	DefaultVisitorDedupWindow                       = 0 // Disabled
+	DefaultVisitorDedupMode                         = VisitorDedupModeReject
+	DefaultVisitorDistinctTopicsDailyLimit          = 0 // Disabled
+	DefaultVisitorScheduledMessageMode              = VisitorScheduledMessageModePublish
+	DefaultVisitorScheduledMessageDailyLimit        = 0 // Same as the daily message limit
+	DefaultVisitorAttachmentMessageDailyLimit       = 0 // No separate limit for messages with attachments
+	DefaultVisitorGatewayMessageDailyLimit          = 0 // Gateway messages count towards the daily message limit
+	DefaultVisitorEmailLimitBurst                   = 16
+	DefaultVisitorEmailLimitReplenish               = time.Hour
+	DefaultVisitorInboundEmailLimitBurst            = 0 // Disabled: inbound e-mails only count towards the message limit
+	DefaultVisitorInboundEmailLimitReplenish        = time.Minute
+	DefaultVisitorEmailFailureThreshold             = 0 // Disabled: failed e-mails never open the circuit breaker
+	DefaultVisitorEmailFailureCooldown              = time.Minute
+	DefaultVisitorFirebaseLimitBurst                = 0 // Disabled: only the Firebase quota penalty applies
+	DefaultVisitorFirebaseLimitReplenish            = time.Second
+	DefaultVisitorFirebaseDailyLimit                = 0 // Disabled: Firebase messages are not capped per day
+	DefaultVisitorAccountCreationLimitBurst         = 3
+	DefaultVisitorAccountCreationLimitReplenish     = 24 * time.Hour
+	DefaultVisitorAccountCreationLimitIPv4Prefix    = 0 // Disabled: accounts are limited per visitor
+	DefaultVisitorAccountCreationLimitIPv6Prefix    = 0
+	DefaultVisitorAuthFailureLimitBurst             = 30
+	DefaultVisitorAuthFailureLimitReplenish         = time.Minute
+	DefaultVisitorPenaltyBoxThreshold               = 0 // Disabled: visitors are never put in the penalty box
+	DefaultVisitorPenaltyBoxWindow                  = time.Minute
+	DefaultVisitorPenaltyBoxDuration                = 5 * time.Minute
+	DefaultNewAccountGraceDuration                  = 0 // Disabled: new accounts get the regular limits right away
+	DefaultNewAccountGraceMultiplier                = 1
+	DefaultGeoRestrictedLimitMultiplier             = 0.5
+	DefaultVisitorAttachmentTotalSizeLimit          = 100 * 1024 * 1024 // 100 MB
+	DefaultVisitorAttachmentDailyBandwidthLimit     = 500 * 1024 * 1024 // 500 MB
+	DefaultVisitorAttachmentBandwidthMode           = VisitorAttachmentBandwidthModeDeny
+	DefaultVisitorAttachmentBandwidthResetMode      = VisitorAttachmentBandwidthResetModeRolling
+	DefaultVisitorIngressDailyBandwidthLimit        = 0 // Disabled
+	DefaultVisitorMessageLimiterMode                = VisitorMessageLimiterModeFixed
+	DefaultVisitorLimitResetMode                    = VisitorLimitResetModeContinuous
+	DefaultVisitorLimitResetJitter                  = time.Duration(0) // Disabled: all visitors are reset at the same time
+	DefaultVisitorMessageCostSize                   = 0                // Bytes; if zero, every message counts as one message
+	DefaultVisitorLimiterStore                      = VisitorLimiterStoreMemory
+	DefaultVisitorTierDowngradeMode                 = VisitorTierDowngradeModeImmediate
+	DefaultVisitorLimitsReloadMode                  = VisitorLimitsReloadModeNew
+
+	// DefaultVisitorExpungeAfter defines how long a visitor is active before it is removed from memory. This number
+	// has to be very high to prevent e-mail abuse, but it doesn't really affect the other limits anyway, since
+	// they are replenished faster (typically).
+	DefaultVisitorExpungeAfter = 24 * time.Hour
+)
+
+// Defines the modes of the per-visitor message limiter
+// - fixed: messages are counted up to the daily limit, and the counter is reset daily (see VisitorStatsResetTime)
+// - sliding: messages are counted within a rolling 24h window, and expire gradually instead of all at once
+// - decay: the message counter decays continuously at a rate of the daily limit per 24h
+const (
+	VisitorMessageLimiterModeFixed   = "fixed"
+	VisitorMessageLimiterModeSliding = "sliding"
+	VisitorMessageLimiterModeDecay   = "decay"
+)
+
+// Defines what happens to duplicate messages, see VisitorDedupWindow
+// - reject: duplicates are rejected with an error, and do not count towards any limits
+// - drop: duplicates are silently dropped, i.e. the previous message is returned, as if it was published again
+const (
+	VisitorDedupModeReject = "reject"
+	VisitorDedupModeDrop   = "drop"
+)
+
+// Defines when the per-visitor daily limits (messages, emails, calls) are reset
+// - continuous: the counters are reset at VisitorStatsResetTime (UTC); in sliding mode, messages expire gradually
+// - calendar: the counters are reset at midnight in VisitorLimitResetTimezone, i.e. aligned to the calendar day
+const (
+	VisitorLimitResetModeContinuous = "continuous"
+	VisitorLimitResetModeCalendar   = "calendar"
+)
+
+// Defines where the per-visitor daily message limiter keeps its state
+// - memory: in memory, i.e. every ntfy process has its own limits
+// - redis: in Redis, so that multiple ntfy processes (e.g. replicas behind a load balancer) share the same limits
+const (
+	VisitorLimiterStoreMemory = "memory"
+	VisitorLimiterStoreRedis  = "redis"
+)
+
+// Defines when scheduled (delayed) messages count towards the daily message limit
+//   - publish: they are counted when they are published, like any other message
+//   - delivery: they are counted when they are delivered; when published, they only count towards a separate
+//     scheduled messages limit, see VisitorScheduledMessageDailyLimit
+const (
+	VisitorScheduledMessageModePublish  = "publish"
+	VisitorScheduledMessageModeDelivery = "delivery"
+)
+
+// Defines when a lower daily message limit applies after a user's tier was downgraded
+// - immediate: the new limit applies right away; messages sent today still count, so the user may be over the limit
+// - nextday: the previous (higher) limit applies until the next daily reset, after which the new limit applies
+const (
+	VisitorTierDowngradeModeImmediate = "immediate"
+	VisitorTierDowngradeModeNextDay   = "nextday"
+)
+
+// Defines what happens to existing visitors if the visitor limits are changed at runtime (see Server.ReloadVisitorLimits)
+// - new: the new limiter settings only apply to new visitors, i.e. after existing visitors are expunged
+// - rebuild: the limiters of existing visitors are rebuilt right away, keeping the messages, emails and calls used so far
+const (
+	VisitorLimitsReloadModeNew     = "new"
+	VisitorLimitsReloadModeRebuild = "rebuild"
+)
+
+// Defines what happens to attachment downloads once the per-visitor daily bandwidth limit is reached
+// - deny: downloads are rejected with a 429 error
+// - throttle: downloads are still served, but at a reduced rate (see visitor.ThrottledReader)
+const (
+	VisitorAttachmentBandwidthModeDeny     = "deny"
+	VisitorAttachmentBandwidthModeThrottle = "throttle"
+)
+
+// Defines how the per-visitor daily attachment bandwidth limit is replenished
+// - rolling: the allowance is refilled continuously, so that the full limit is available again 24h after it was used up
+// - calendar: the allowance is refilled entirely at the daily stats reset, like the daily message limit
+const (
+	VisitorAttachmentBandwidthResetModeRolling  = "rolling"
+	VisitorAttachmentBandwidthResetModeCalendar = "calendar"
 )
 
 var (
@@ -70,183 +194,324 @@ var (
 	// DefaultDisallowedTopics defines the topics that are forbidden, because they are used elsewhere. This array can be
 	// extended using the server.yml config. If updated, also update in Android and web app.
 	DefaultDisallowedTopics = []string{"docs", "static", "file", "app", "metrics", "account", "settings", "signup", "login", "v1"}
+
+	// DefaultHealthCheckPaths defines the paths that are answered as health probes, see Config.HealthCheckPaths
+	DefaultHealthCheckPaths = []string{"/v1/health"}
 )
 
 // Config is the main config struct for the application. Use New to instantiate a default config struct.
 type Config struct {
-	File                                 string // Config file, only used for testing
-	BaseURL                              string
-	ListenHTTP                           string
-	ListenHTTPS                          string
-	ListenUnix                           string
-	ListenUnixMode                       fs.FileMode
-	KeyFile                              string
-	CertFile                             string
-	FirebaseKeyFile                      string
-	CacheFile                            string
-	CacheDuration                        time.Duration
-	CacheStartupQueries                  string
-	CacheBatchSize                       int
-	CacheBatchTimeout                    time.Duration
-	AuthFile                             string
-	AuthStartupQueries                   string
-	AuthDefault                          user.Permission
-	AuthBcryptCost                       int
-	AuthStatsQueueWriterInterval         time.Duration
-	AttachmentCacheDir                   string
-	AttachmentTotalSizeLimit             int64
-	AttachmentFileSizeLimit              int64
-	AttachmentExpiryDuration             time.Duration
-	KeepaliveInterval                    time.Duration
-	ManagerInterval                      time.Duration
-	DisallowedTopics                     []string
-	WebRoot                              string // empty to disable
-	DelayedSenderInterval                time.Duration
-	FirebaseKeepaliveInterval            time.Duration
-	FirebasePollInterval                 time.Duration
-	FirebaseQuotaExceededPenaltyDuration time.Duration
-	UpstreamBaseURL                      string
-	UpstreamAccessToken                  string
-	SMTPSenderAddr                       string
-	SMTPSenderUser                       string
-	SMTPSenderPass                       string
-	SMTPSenderFrom                       string
-	SMTPServerListen                     string
-	SMTPServerDomain                     string
-	SMTPServerAddrPrefix                 string
-	TwilioAccount                        string
-	TwilioAuthToken                      string
-	TwilioPhoneNumber                    string
-	TwilioCallsBaseURL                   string
-	TwilioVerifyBaseURL                  string
-	TwilioVerifyService                  string
-	MetricsEnable                        bool
-	MetricsListenHTTP                    string
-	ProfileListenHTTP                    string
-	MessageDelayMin                      time.Duration
-	MessageDelayMax                      time.Duration
-	MessageSizeLimit                     int
-	TotalTopicLimit                      int
-	TotalAttachmentSizeLimit             int64
-	VisitorSubscriptionLimit             int
-	VisitorAttachmentTotalSizeLimit      int64
-	VisitorAttachmentDailyBandwidthLimit int64
-	VisitorRequestLimitBurst             int
-	VisitorRequestLimitReplenish         time.Duration
-	VisitorRequestExemptIPAddrs          []netip.Prefix
-	VisitorMessageDailyLimit             int
-	VisitorEmailLimitBurst               int
-	VisitorEmailLimitReplenish           time.Duration
-	VisitorAccountCreationLimitBurst     int
-	VisitorAccountCreationLimitReplenish time.Duration
-	VisitorAuthFailureLimitBurst         int
-	VisitorAuthFailureLimitReplenish     time.Duration
-	VisitorStatsResetTime                time.Time // Time of the day at which to reset visitor stats
-	VisitorSubscriberRateLimiting        bool      // Enable subscriber-based rate limiting for UnifiedPush topics
-	BehindProxy                          bool
-	StripeSecretKey                      string
-	StripeWebhookKey                     string
-	StripePriceCacheDuration             time.Duration
-	BillingContact                       string
-	EnableSignup                         bool // Enable creation of accounts via API and UI
-	EnableLogin                          bool
-	EnableReservations                   bool // Allow users with role "user" to own/reserve topics
-	EnableMetrics                        bool
-	AccessControlAllowOrigin             string // CORS header field to restrict access from web clients
-	Version                              string // injected by App
-	WebPushPrivateKey                    string
-	WebPushPublicKey                     string
-	WebPushFile                          string
-	WebPushEmailAddress                  string
-	WebPushStartupQueries                string
-	WebPushExpiryDuration                time.Duration
-	WebPushExpiryWarningDuration         time.Duration
+	File                                     string // Config file, only used for testing
+	BaseURL                                  string
+	ListenHTTP                               string
+	ListenHTTPS                              string
+	ListenUnix                               string
+	ListenUnixMode                           fs.FileMode
+	KeyFile                                  string
+	CertFile                                 string
+	FirebaseKeyFile                          string
+	CacheFile                                string
+	CacheDuration                            time.Duration
+	CacheStartupQueries                      string
+	CacheBatchSize                           int
+	CacheBatchTimeout                        time.Duration
+	AuthFile                                 string
+	AuthStartupQueries                       string
+	AuthDefault                              user.Permission
+	DefaultAdminTier                         string // Tier code; if set, admins without a tier report the message/attachment expiry and reservation limits of this tier
+	AuthBcryptCost                           int
+	AuthStatsQueueWriterInterval             time.Duration
+	AttachmentCacheDir                       string
+	AttachmentTotalSizeLimit                 int64
+	AttachmentFileSizeLimit                  int64
+	AttachmentExpiryDuration                 time.Duration
+	KeepaliveInterval                        time.Duration
+	ManagerInterval                          time.Duration
+	DisallowedTopics                         []string
+	WebRoot                                  string // empty to disable
+	DelayedSenderInterval                    time.Duration
+	FirebaseKeepaliveInterval                time.Duration
+	FirebasePollInterval                     time.Duration
+	FirebaseQuotaExceededPenaltyDuration     time.Duration
+	UpstreamBaseURL                          string
+	UpstreamAccessToken                      string
+	SMTPSenderAddr                           string
+	SMTPSenderUser                           string
+	SMTPSenderPass                           string
+	SMTPSenderFrom                           string
+	SMTPServerListen                         string
+	SMTPServerDomain                         string
+	SMTPServerAddrPrefix                     string
+	TwilioAccount                            string
+	TwilioAuthToken                          string
+	TwilioPhoneNumber                        string
+	TwilioCallsBaseURL                       string
+	TwilioVerifyBaseURL                      string
+	TwilioVerifyService                      string
+	MetricsEnable                            bool
+	MetricsListenHTTP                        string
+	ProfileListenHTTP                        string
+	MessageDelayMin                          time.Duration
+	MessageDelayMax                          time.Duration
+	MessageSizeLimit                         int
+	TotalTopicLimit                          int
+	TopicMessageLimitBurst                   int // If zero, messages are not limited per topic (only per visitor)
+	TopicMessageLimitReplenish               time.Duration
+	TotalAttachmentSizeLimit                 int64
+	VisitorSubscriptionLimit                 int
+	VisitorSubscriptionAttemptLimitBurst     int // If non-zero, new subscriptions (connection attempts) are rate limited, in addition to VisitorSubscriptionLimit
+	VisitorSubscriptionAttemptLimitReplenish time.Duration
+	VisitorAttachmentDownloadConcurrency     int // If non-zero, max number of attachment downloads a visitor can have in progress at the same time
+	VisitorAttachmentTotalSizeLimit          int64
+	VisitorAttachmentDailyBandwidthLimit     int64
+	VisitorAttachmentBandwidthMode           string // "deny" or "throttle", see VisitorAttachmentBandwidthModeDeny
+	VisitorAttachmentBandwidthResetMode      string // "rolling" or "calendar", see VisitorAttachmentBandwidthResetModeRolling
+	VisitorIngressDailyBandwidthLimit        int64  // Daily limit of published request body bytes per visitor, 0 = disabled
+	VisitorRequestLimitBurst                 int
+	VisitorRequestLimitReplenish             time.Duration
+	VisitorRequestExemptIPAddrs              []netip.Prefix
+	VisitorRequestLimitExemptLoopback        bool          // If true, visitors connecting from a loopback address (e.g. 127.0.0.1) have no request limit
+	VisitorRequestLimitIPv6Prefix            int           // Prefix length (bits) used to group IPv6 addresses into visitors, 128 means per address
+	VisitorTenantHeader                      string        // If set, header (set by a trusted proxy) from which a visitor's tenant is read, see visitor.Tenant
+	VisitorRequestMaxWait                    time.Duration // If non-zero, publishers may ask to wait up to this long for the request limiter (X-Backpressure: wait)
+	VisitorReadRequestLimitBurst             int           // If zero, read requests count towards the regular request limiter
+	VisitorReadRequestLimitReplenish         time.Duration
+	VisitorMessageDailyLimit                 int
+	VisitorMessageSoftLimitPercent           int            // If non-zero, publishers are warned once a day when they use this share (%) of their message limit
+	VisitorMinMessageInterval                time.Duration  // If non-zero, messages published by the same visitor within this interval are rejected
+	VisitorDedupWindow                       time.Duration  // If non-zero, a visitor's message identical to its previous one within this window is a duplicate
+	VisitorDedupMode                         string         // "reject" or "drop", see VisitorDedupModeReject
+	VisitorDistinctTopicsDailyLimit          int            // If non-zero, anonymous visitors may only publish to this many different topics per day
+	VisitorMessageLimiterMode                string         // "fixed", "sliding" or "decay", see VisitorMessageLimiterModeFixed
+	VisitorTierDowngradeMode                 string         // "immediate" or "nextday", see VisitorTierDowngradeModeImmediate
+	VisitorLimitsReloadMode                  string         // "new" or "rebuild", see VisitorLimitsReloadModeNew
+	VisitorScheduledMessageMode              string         // "publish" or "delivery", see VisitorScheduledMessageModePublish
+	VisitorScheduledMessageDailyLimit        int            // Max. scheduled messages per day in "delivery" mode, 0 = same as the daily message limit
+	VisitorAttachmentMessageDailyLimit       int            // Max. messages with attachments per day, 0 = only the daily message limit applies
+	VisitorGatewayMessageDailyLimit          int            // Max. UnifiedPush/Matrix gateway messages per day (instead of the message limit), 0 = no separate limit
+	VisitorLimitResetMode                    string         // "continuous" or "calendar", see VisitorLimitResetModeContinuous
+	VisitorLimitResetTimezone                *time.Location // Timezone of the calendar day, only used if VisitorLimitResetMode is "calendar"
+	VisitorLimitResetJitter                  time.Duration  // If non-zero, the daily reset of each visitor is offset by up to +/- this much
+	VisitorMessageCostSize                   int            // If non-zero, a message counts as one message per x bytes (rounded up)
+	RateLimitExemptTopics                    []string       // Messages published to these topics do not count towards the message limits
+	HealthCheckPaths                         []string       // Health probes to these paths are answered without a visitor, so they are never rate limited
+	VisitorLimiterStore                      string         // "memory" or "redis", see VisitorLimiterStoreMemory
+	VisitorLimiterRedisAddr                  string         // Redis address (host:port), only used if VisitorLimiterStore is "redis"
+	VisitorEmailLimitBurst                   int
+	VisitorEmailLimitReplenish               time.Duration
+	VisitorEmailLimitPersist                 bool // If true, the daily email count of anonymous visitors is persisted in the cache database
+	VisitorInboundEmailLimitBurst            int  // If non-zero, inbound e-mails (see SMTPServerListen) are limited per sender address (or IP address)
+	VisitorInboundEmailLimitReplenish        time.Duration
+	VisitorEmailFailureThreshold             int // If non-zero, e-mails are rejected for VisitorEmailFailureCooldown after this many consecutive send failures
+	VisitorEmailFailureCooldown              time.Duration
+	VisitorFirebaseLimitBurst                int // If zero, Firebase messages are not limited per visitor (other than the quota penalty)
+	VisitorFirebaseLimitReplenish            time.Duration
+	VisitorFirebaseDailyLimit                int // If non-zero, max. messages forwarded to Firebase per visitor per day
+	VisitorAccountCreationLimitBurst         int
+	VisitorAccountCreationLimitReplenish     time.Duration
+	VisitorAccountCreationLimitIPv4Prefix    int // If set (with the IPv6 prefix), account creation is limited per subnet instead of per visitor
+	VisitorAccountCreationLimitIPv6Prefix    int
+	VisitorAuthFailureLimitBurst             int
+	VisitorAuthFailureLimitReplenish         time.Duration
+	VisitorPenaltyBoxThreshold               int           // If non-zero, visitors hitting a limit this many times within VisitorPenaltyBoxWindow are blocked
+	VisitorPenaltyBoxWindow                  time.Duration // Window in which consecutive limit hits are counted
+	VisitorPenaltyBoxDuration                time.Duration // Duration for which visitors in the penalty box are blocked
+	NewAccountGraceDuration                  time.Duration // If non-zero, accounts younger than this get a boosted request limit burst
+	NewAccountGraceMultiplier                int           // Multiplier for the request limit burst during NewAccountGraceDuration
+	GeoIPDatabase                            string        // MaxMind DB file (e.g. GeoLite2-Country.mmdb) used to resolve the country of visitors
+	GeoRestrictedCountries                   []string      // ISO country codes of visitors that get stricter limits, only if GeoIPDatabase is set
+	GeoRestrictedLimitMultiplier             float64       // Multiplier (0..1) for the limits of visitors from GeoRestrictedCountries
+	VisitorStatsResetTime                    time.Time     // Time of the day at which to reset visitor stats
+	VisitorExpungeAfter                      time.Duration // Duration after which inactive visitors are removed from memory
+	VisitorExpungeLog                        bool          // Log every removed (stale) visitor at info level, instead of trace
+	VisitorRequestStats                      bool          // Count requests and their average processing time per visitor, see visitor.RecordRequest
+	VisitorSubscriberRateLimiting            bool          // Enable subscriber-based rate limiting for UnifiedPush topics
+	VisitorLimitProfiles                     map[string]*VisitorLimitProfile
+	BehindProxy                              bool
+	StripeSecretKey                          string
+	StripeWebhookKey                         string
+	StripePriceCacheDuration                 time.Duration
+	BillingContact                           string
+	UsePaymentRequiredForTierLimits          bool // If true, tier users get a 402 with an upgrade link instead of a 429 when they hit a limit
+	EnableSignup                             bool // Enable creation of accounts via API and UI
+	EnableLogin                              bool
+	EnableReservations                       bool         // Allow users with role "user" to own/reserve topics
+	StrictAccountInfo                        bool         // If true, fail account info requests if the attachment usage cannot be determined
+	AnonymousPublishDisabled                 *atomic.Bool // Disallow publishing for anonymous users, can be toggled at runtime via the admin API
+	EnableMetrics                            bool
+	AccessControlAllowOrigin                 string // CORS header field to restrict access from web clients
+	Version                                  string // injected by App
+	WebPushPrivateKey                        string
+	WebPushPublicKey                         string
+	WebPushFile                              string
+	WebPushEmailAddress                      string
+	WebPushStartupQueries                    string
+	WebPushExpiryDuration                    time.Duration
+	WebPushExpiryWarningDuration             time.Duration
+	OnSubscriptionLimitReached               func(info *visitorInfo) // If set, called when a visitor hits the subscription limit, e.g. for alerting; must return quickly
 }
 
 // NewConfig instantiates a default new server config
 func NewConfig() *Config {
 	return &Config{
-		File:                                 "", // Only used for testing
-		BaseURL:                              "",
-		ListenHTTP:                           DefaultListenHTTP,
-		ListenHTTPS:                          "",
-		ListenUnix:                           "",
-		ListenUnixMode:                       0,
-		KeyFile:                              "",
-		CertFile:                             "",
-		FirebaseKeyFile:                      "",
-		CacheFile:                            "",
-		CacheDuration:                        DefaultCacheDuration,
-		CacheStartupQueries:                  "",
-		CacheBatchSize:                       0,
-		CacheBatchTimeout:                    0,
-		AuthFile:                             "",
-		AuthStartupQueries:                   "",
-		AuthDefault:                          user.PermissionReadWrite,
-		AuthBcryptCost:                       user.DefaultUserPasswordBcryptCost,
-		AuthStatsQueueWriterInterval:         user.DefaultUserStatsQueueWriterInterval,
-		AttachmentCacheDir:                   "",
-		AttachmentTotalSizeLimit:             DefaultAttachmentTotalSizeLimit,
-		AttachmentFileSizeLimit:              DefaultAttachmentFileSizeLimit,
-		AttachmentExpiryDuration:             DefaultAttachmentExpiryDuration,
-		KeepaliveInterval:                    DefaultKeepaliveInterval,
-		ManagerInterval:                      DefaultManagerInterval,
-		DisallowedTopics:                     DefaultDisallowedTopics,
-		WebRoot:                              "/",
-		DelayedSenderInterval:                DefaultDelayedSenderInterval,
-		FirebaseKeepaliveInterval:            DefaultFirebaseKeepaliveInterval,
-		FirebasePollInterval:                 DefaultFirebasePollInterval,
-		FirebaseQuotaExceededPenaltyDuration: DefaultFirebaseQuotaExceededPenaltyDuration,
-		UpstreamBaseURL:                      "",
-		UpstreamAccessToken:                  "",
-		SMTPSenderAddr:                       "",
-		SMTPSenderUser:                       "",
-		SMTPSenderPass:                       "",
-		SMTPSenderFrom:                       "",
-		SMTPServerListen:                     "",
-		SMTPServerDomain:                     "",
-		SMTPServerAddrPrefix:                 "",
-		TwilioCallsBaseURL:                   "https://api.twilio.com", // Override for tests
-		TwilioAccount:                        "",
-		TwilioAuthToken:                      "",
-		TwilioPhoneNumber:                    "",
-		TwilioVerifyBaseURL:                  "https://verify.twilio.com", // Override for tests
-		TwilioVerifyService:                  "",
-		MessageSizeLimit:                     DefaultMessageSizeLimit,
-		MessageDelayMin:                      DefaultMessageDelayMin,
-		MessageDelayMax:                      DefaultMessageDelayMax,
-		TotalTopicLimit:                      DefaultTotalTopicLimit,
-		TotalAttachmentSizeLimit:             0,
-		VisitorSubscriptionLimit:             DefaultVisitorSubscriptionLimit,
-		VisitorAttachmentTotalSizeLimit:      DefaultVisitorAttachmentTotalSizeLimit,
-		VisitorAttachmentDailyBandwidthLimit: DefaultVisitorAttachmentDailyBandwidthLimit,
-		VisitorRequestLimitBurst:             DefaultVisitorRequestLimitBurst,
-		VisitorRequestLimitReplenish:         DefaultVisitorRequestLimitReplenish,
-		VisitorRequestExemptIPAddrs:          make([]netip.Prefix, 0),
-		VisitorMessageDailyLimit:             DefaultVisitorMessageDailyLimit,
-		VisitorEmailLimitBurst:               DefaultVisitorEmailLimitBurst,
-		VisitorEmailLimitReplenish:           DefaultVisitorEmailLimitReplenish,
-		VisitorAccountCreationLimitBurst:     DefaultVisitorAccountCreationLimitBurst,
-		VisitorAccountCreationLimitReplenish: DefaultVisitorAccountCreationLimitReplenish,
-		VisitorAuthFailureLimitBurst:         DefaultVisitorAuthFailureLimitBurst,
-		VisitorAuthFailureLimitReplenish:     DefaultVisitorAuthFailureLimitReplenish,
-		VisitorStatsResetTime:                DefaultVisitorStatsResetTime,
-		VisitorSubscriberRateLimiting:        false,
-		BehindProxy:                          false,
-		StripeSecretKey:                      "",
-		StripeWebhookKey:                     "",
-		StripePriceCacheDuration:             DefaultStripePriceCacheDuration,
-		BillingContact:                       "",
-		EnableSignup:                         false,
-		EnableLogin:                          false,
-		EnableReservations:                   false,
-		AccessControlAllowOrigin:             "*",
-		Version:                              "",
-		WebPushPrivateKey:                    "",
-		WebPushPublicKey:                     "",
-		WebPushFile:                          "",
-		WebPushEmailAddress:                  "",
-		WebPushExpiryDuration:                DefaultWebPushExpiryDuration,
-		WebPushExpiryWarningDuration:         DefaultWebPushExpiryWarningDuration,
+		File:                                     "", // Only used for testing
+		BaseURL:                                  "",
+		ListenHTTP:                               DefaultListenHTTP,
+		ListenHTTPS:                              "",
+		ListenUnix:                               "",
+		ListenUnixMode:                           0,
+		KeyFile:                                  "",
+		CertFile:                                 "",
+		FirebaseKeyFile:                          "",
+		CacheFile:                                "",
+		CacheDuration:                            DefaultCacheDuration,
+		CacheStartupQueries:                      "",
+		CacheBatchSize:                           0,
+		CacheBatchTimeout:                        0,
+		AuthFile:                                 "",
+		AuthStartupQueries:                       "",
+		AuthDefault:                              user.PermissionReadWrite,
+		AuthBcryptCost:                           user.DefaultUserPasswordBcryptCost,
+		AuthStatsQueueWriterInterval:             user.DefaultUserStatsQueueWriterInterval,
+		AttachmentCacheDir:                       "",
+		AttachmentTotalSizeLimit:                 DefaultAttachmentTotalSizeLimit,
+		AttachmentFileSizeLimit:                  DefaultAttachmentFileSizeLimit,
+		AttachmentExpiryDuration:                 DefaultAttachmentExpiryDuration,
+		KeepaliveInterval:                        DefaultKeepaliveInterval,
+		ManagerInterval:                          DefaultManagerInterval,
+		DisallowedTopics:                         DefaultDisallowedTopics,
+		WebRoot:                                  "/",
+		DelayedSenderInterval:                    DefaultDelayedSenderInterval,
+		FirebaseKeepaliveInterval:                DefaultFirebaseKeepaliveInterval,
+		FirebasePollInterval:                     DefaultFirebasePollInterval,
+		FirebaseQuotaExceededPenaltyDuration:     DefaultFirebaseQuotaExceededPenaltyDuration,
+		UpstreamBaseURL:                          "",
+		UpstreamAccessToken:                      "",
+		SMTPSenderAddr:                           "",
+		SMTPSenderUser:                           "",
+		SMTPSenderPass:                           "",
+		SMTPSenderFrom:                           "",
+		SMTPServerListen:                         "",
+		SMTPServerDomain:                         "",
+		SMTPServerAddrPrefix:                     "",
+		TwilioCallsBaseURL:                       "https://api.twilio.com", // Override for tests
+		TwilioAccount:                            "",
+		TwilioAuthToken:                          "",
+		TwilioPhoneNumber:                        "",
+		TwilioVerifyBaseURL:                      "https://verify.twilio.com", // Override for tests
+		TwilioVerifyService:                      "",
+		MessageSizeLimit:                         DefaultMessageSizeLimit,
+		MessageDelayMin:                          DefaultMessageDelayMin,
+		MessageDelayMax:                          DefaultMessageDelayMax,
+		TotalTopicLimit:                          DefaultTotalTopicLimit,
+		TopicMessageLimitBurst:                   DefaultTopicMessageLimitBurst,
+		TopicMessageLimitReplenish:               DefaultTopicMessageLimitReplenish,
+		TotalAttachmentSizeLimit:                 0,
+		VisitorSubscriptionLimit:                 DefaultVisitorSubscriptionLimit,
+		VisitorSubscriptionAttemptLimitBurst:     DefaultVisitorSubscriptionAttemptLimitBurst,
+		VisitorSubscriptionAttemptLimitReplenish: DefaultVisitorSubscriptionAttemptLimitReplenish,
+		VisitorAttachmentDownloadConcurrency:     DefaultVisitorAttachmentDownloadConcurrency,
+		VisitorAttachmentTotalSizeLimit:          DefaultVisitorAttachmentTotalSizeLimit,
+		VisitorAttachmentDailyBandwidthLimit:     DefaultVisitorAttachmentDailyBandwidthLimit,
+		VisitorAttachmentBandwidthMode:           DefaultVisitorAttachmentBandwidthMode,
+		VisitorAttachmentBandwidthResetMode:      DefaultVisitorAttachmentBandwidthResetMode,
+		VisitorIngressDailyBandwidthLimit:        DefaultVisitorIngressDailyBandwidthLimit,
+		VisitorRequestLimitBurst:                 DefaultVisitorRequestLimitBurst,
+		VisitorRequestLimitReplenish:             DefaultVisitorRequestLimitReplenish,
+		VisitorRequestExemptIPAddrs:              make([]netip.Prefix, 0),
+		VisitorRequestLimitExemptLoopback:        false,
+		VisitorRequestLimitIPv6Prefix:            DefaultVisitorRequestLimitIPv6Prefix,
+		VisitorRequestMaxWait:                    DefaultVisitorRequestMaxWait,
+		VisitorReadRequestLimitBurst:             DefaultVisitorReadRequestLimitBurst,
+		VisitorReadRequestLimitReplenish:         DefaultVisitorReadRequestLimitReplenish,
+		VisitorMessageDailyLimit:                 DefaultVisitorMessageDailyLimit,
+		VisitorMessageSoftLimitPercent:           DefaultVisitorMessageSoftLimitPercent,
+		VisitorMinMessageInterval:                DefaultVisitorMinMessageInterval,
+		VisitorDedupWindow:                       DefaultVisitorDedupWindow,
+		VisitorDedupMode:                         DefaultVisitorDedupMode,
+		VisitorDistinctTopicsDailyLimit:          DefaultVisitorDistinctTopicsDailyLimit,
+		VisitorMessageLimiterMode:                DefaultVisitorMessageLimiterMode,
+		VisitorTierDowngradeMode:                 DefaultVisitorTierDowngradeMode,
+		VisitorLimitsReloadMode:                  DefaultVisitorLimitsReloadMode,
+		VisitorScheduledMessageMode:              DefaultVisitorScheduledMessageMode,
+		VisitorScheduledMessageDailyLimit:        DefaultVisitorScheduledMessageDailyLimit,
+		VisitorAttachmentMessageDailyLimit:       DefaultVisitorAttachmentMessageDailyLimit,
+		VisitorGatewayMessageDailyLimit:          DefaultVisitorGatewayMessageDailyLimit,
+		VisitorLimitResetMode:                    DefaultVisitorLimitResetMode,
+		VisitorLimitResetTimezone:                time.UTC,
+		VisitorLimitResetJitter:                  DefaultVisitorLimitResetJitter,
+		VisitorMessageCostSize:                   DefaultVisitorMessageCostSize,
+		RateLimitExemptTopics:                    make([]string, 0),
+		HealthCheckPaths:                         DefaultHealthCheckPaths,
+		VisitorLimiterStore:                      DefaultVisitorLimiterStore,
+		VisitorLimiterRedisAddr:                  "",
+		VisitorEmailLimitBurst:                   DefaultVisitorEmailLimitBurst,
+		VisitorEmailLimitReplenish:               DefaultVisitorEmailLimitReplenish,
+		VisitorInboundEmailLimitBurst:            DefaultVisitorInboundEmailLimitBurst,
+		VisitorInboundEmailLimitReplenish:        DefaultVisitorInboundEmailLimitReplenish,
+		VisitorEmailFailureThreshold:             DefaultVisitorEmailFailureThreshold,
+		VisitorEmailFailureCooldown:              DefaultVisitorEmailFailureCooldown,
+		VisitorEmailLimitPersist:                 false,
+		VisitorFirebaseLimitBurst:                DefaultVisitorFirebaseLimitBurst,
+		VisitorFirebaseLimitReplenish:            DefaultVisitorFirebaseLimitReplenish,
+		VisitorFirebaseDailyLimit:                DefaultVisitorFirebaseDailyLimit,
+		VisitorAccountCreationLimitBurst:         DefaultVisitorAccountCreationLimitBurst,
+		VisitorAccountCreationLimitReplenish:     DefaultVisitorAccountCreationLimitReplenish,
+		VisitorAccountCreationLimitIPv4Prefix:    DefaultVisitorAccountCreationLimitIPv4Prefix,
+		VisitorAccountCreationLimitIPv6Prefix:    DefaultVisitorAccountCreationLimitIPv6Prefix,
+		VisitorAuthFailureLimitBurst:             DefaultVisitorAuthFailureLimitBurst,
+		VisitorAuthFailureLimitReplenish:         DefaultVisitorAuthFailureLimitReplenish,
+		VisitorPenaltyBoxThreshold:               DefaultVisitorPenaltyBoxThreshold,
+		VisitorPenaltyBoxWindow:                  DefaultVisitorPenaltyBoxWindow,
+		VisitorPenaltyBoxDuration:                DefaultVisitorPenaltyBoxDuration,
+		NewAccountGraceDuration:                  DefaultNewAccountGraceDuration,
+		NewAccountGraceMultiplier:                DefaultNewAccountGraceMultiplier,
+		GeoIPDatabase:                            "",
+		GeoRestrictedCountries:                   make([]string, 0),
+		GeoRestrictedLimitMultiplier:             DefaultGeoRestrictedLimitMultiplier,
+		VisitorStatsResetTime:                    DefaultVisitorStatsResetTime,
+		VisitorExpungeAfter:                      DefaultVisitorExpungeAfter,
+		VisitorExpungeLog:                        false,
+		VisitorRequestStats:                      false,
+		VisitorSubscriberRateLimiting:            false,
+		VisitorLimitProfiles:                     make(map[string]*VisitorLimitProfile),
+		BehindProxy:                              false,
+		StripeSecretKey:                          "",
+		StripeWebhookKey:                         "",
+		StripePriceCacheDuration:                 DefaultStripePriceCacheDuration,
+		BillingContact:                           "",
+		UsePaymentRequiredForTierLimits:          false,
+		EnableSignup:                             false,
+		EnableLogin:                              false,
+		EnableReservations:                       false,
+		StrictAccountInfo:                        false,
+		AnonymousPublishDisabled:                 &atomic.Bool{},
+		AccessControlAllowOrigin:                 "*",
+		Version:                                  "",
+		WebPushPrivateKey:                        "",
+		WebPushPublicKey:                         "",
+		WebPushFile:                              "",
+		WebPushEmailAddress:                      "",
+		WebPushExpiryDuration:                    DefaultWebPushExpiryDuration,
+		WebPushExpiryWarningDuration:             DefaultWebPushExpiryWarningDuration,
 	}
 }
+
+// clone returns a shallow copy of the config, e.g. to change the visitor limits at runtime (see
+// Server.ReloadVisitorLimits). Slices and maps are shared with the original, and must not be modified.
+// AnonymousPublishDisabled is shared as well, so that toggling it affects both configs.
+func (c *Config) clone() *Config {
+	conf := *c
+	return &conf
+}
+
+// VisitorLimitProfile is a named limit preset (see Config.VisitorLimitProfiles), e.g. for API tokens that are handed
+// out to integrations. Requests authenticated with a token referencing a profile (see user.Token.LimitProfile) are
+// limited by the profile instead of the user's tier. Zero values are not overridden, i.e. the tier (or config) limit applies.
+type VisitorLimitProfile struct {
+	MessageLimit          int64         // Daily message limit
+	EmailLimit            int64         // Daily email limit
+	RequestLimitBurst     int           // Bucket size of the request limiter
+	RequestLimitReplenish time.Duration // Duration after which one request is replenished
+	SubscriptionLimit     int64         // Max. number of active subscriptions
+}
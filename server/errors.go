@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"heckel.io/ntfy/v2/log"
 	"net/http"
@@ -14,6 +15,7 @@ type errHTTP struct {
 	Message  string `json:"error"`
 	Link     string `json:"link,omitempty"`
 	context  log.Context
+	limit    *limitErrorResponse // Limit object of the visitor whose limits were checked, see WithLimit
 }
 
 func (e errHTTP) Error() string {
@@ -25,6 +27,15 @@ func (e errHTTP) JSON() string {
 	return string(b)
 }
 
+// JSONWithLimit is like JSON, but includes the given machine-readable limit object, see visitor.LimitError
+func (e errHTTP) JSONWithLimit(limit *limitErrorResponse) string {
+	b, _ := json.Marshal(&struct {
+		errHTTP
+		Limit *limitErrorResponse `json:"limit,omitempty"`
+	}{e, limit})
+	return string(b)
+}
+
 func (e errHTTP) Context() log.Context {
 	context := log.Context{
 		"error":       e.Message,
@@ -54,6 +65,17 @@ func (e errHTTP) With(contexters ...log.Contexter) *errHTTP {
 	return &c
 }
 
+// WithLimit attaches the machine-readable limit object of the given visitor (see visitor.LimitError) to the error,
+// if the error is caused by one of the limiters in errHTTPLimiters. This must be the visitor whose limits were checked,
+// which is not necessarily the requesting visitor, e.g. for subscriber-based rate limiting (see contextRateVisitor).
+func (e errHTTP) WithLimit(v *visitor) *errHTTP {
+	c := e.clone()
+	if limiter, ok := errHTTPLimiters[c.Code]; ok && c.HTTPCode == http.StatusTooManyRequests {
+		c.limit = v.LimitError(limiter)
+	}
+	return &c
+}
+
 func (e errHTTP) Fields(context log.Context) *errHTTP {
 	c := e.clone()
 	if c.context == nil {
@@ -74,79 +96,181 @@ func (e errHTTP) clone() errHTTP {
 		Message:  e.Message,
 		Link:     e.Link,
 		context:  context,
+		limit:    e.limit,
 	}
 }
 
 var (
-	errHTTPBadRequest                                = &errHTTP{40000, http.StatusBadRequest, "invalid request", "", nil}
-	errHTTPBadRequestEmailDisabled                   = &errHTTP{40001, http.StatusBadRequest, "e-mail notifications are not enabled", "https://ntfy.sh/docs/config/#e-mail-notifications", nil}
-	errHTTPBadRequestDelayNoCache                    = &errHTTP{40002, http.StatusBadRequest, "cannot disable cache for delayed message", "", nil}
-	errHTTPBadRequestDelayNoEmail                    = &errHTTP{40003, http.StatusBadRequest, "delayed e-mail notifications are not supported", "", nil}
-	errHTTPBadRequestDelayCannotParse                = &errHTTP{40004, http.StatusBadRequest, "invalid delay parameter: unable to parse delay", "https://ntfy.sh/docs/publish/#scheduled-delivery", nil}
-	errHTTPBadRequestDelayTooSmall                   = &errHTTP{40005, http.StatusBadRequest, "invalid delay parameter: too small, please refer to the docs", "https://ntfy.sh/docs/publish/#scheduled-delivery", nil}
-	errHTTPBadRequestDelayTooLarge                   = &errHTTP{40006, http.StatusBadRequest, "invalid delay parameter: too large, please refer to the docs", "https://ntfy.sh/docs/publish/#scheduled-delivery", nil}
-	errHTTPBadRequestPriorityInvalid                 = &errHTTP{40007, http.StatusBadRequest, "invalid priority parameter", "https://ntfy.sh/docs/publish/#message-priority", nil}
-	errHTTPBadRequestSinceInvalid                    = &errHTTP{40008, http.StatusBadRequest, "invalid since parameter", "https://ntfy.sh/docs/subscribe/api/#fetch-cached-messages", nil}
-	errHTTPBadRequestTopicInvalid                    = &errHTTP{40009, http.StatusBadRequest, "invalid request: topic invalid", "", nil}
-	errHTTPBadRequestTopicDisallowed                 = &errHTTP{40010, http.StatusBadRequest, "invalid request: topic name is not allowed", "", nil}
-	errHTTPBadRequestMessageNotUTF8                  = &errHTTP{40011, http.StatusBadRequest, "invalid request: message must be UTF-8 encoded", "", nil}
-	errHTTPBadRequestAttachmentURLInvalid            = &errHTTP{40013, http.StatusBadRequest, "invalid request: attachment URL is invalid", "https://ntfy.sh/docs/publish/#attachments", nil}
-	errHTTPBadRequestAttachmentsDisallowed           = &errHTTP{40014, http.StatusBadRequest, "invalid request: attachments not allowed", "https://ntfy.sh/docs/config/#attachments", nil}
-	errHTTPBadRequestAttachmentsExpiryBeforeDelivery = &errHTTP{40015, http.StatusBadRequest, "invalid request: attachment expiry before delayed delivery date", "https://ntfy.sh/docs/publish/#scheduled-delivery", nil}
-	errHTTPBadRequestWebSocketsUpgradeHeaderMissing  = &errHTTP{40016, http.StatusBadRequest, "invalid request: client not using the websocket protocol", "https://ntfy.sh/docs/subscribe/api/#websockets", nil}
-	errHTTPBadRequestMessageJSONInvalid              = &errHTTP{40017, http.StatusBadRequest, "invalid request: request body must be message JSON", "https://ntfy.sh/docs/publish/#publish-as-json", nil}
-	errHTTPBadRequestActionsInvalid                  = &errHTTP{40018, http.StatusBadRequest, "invalid request: actions invalid", "https://ntfy.sh/docs/publish/#action-buttons", nil}
-	errHTTPBadRequestMatrixMessageInvalid            = &errHTTP{40019, http.StatusBadRequest, "invalid request: Matrix JSON invalid", "https://ntfy.sh/docs/publish/#matrix-gateway", nil}
-	errHTTPBadRequestIconURLInvalid                  = &errHTTP{40021, http.StatusBadRequest, "invalid request: icon URL is invalid", "https://ntfy.sh/docs/publish/#icons", nil}
-	errHTTPBadRequestSignupNotEnabled                = &errHTTP{40022, http.StatusBadRequest, "invalid request: signup not enabled", "https://ntfy.sh/docs/config", nil}
-	errHTTPBadRequestNoTokenProvided                 = &errHTTP{40023, http.StatusBadRequest, "invalid request: no token provided", "", nil}
-	errHTTPBadRequestJSONInvalid                     = &errHTTP{40024, http.StatusBadRequest, "invalid request: request body must be valid JSON", "", nil}
-	errHTTPBadRequestPermissionInvalid               = &errHTTP{40025, http.StatusBadRequest, "invalid request: incorrect permission string", "", nil}
-	errHTTPBadRequestIncorrectPasswordConfirmation   = &errHTTP{40026, http.StatusBadRequest, "invalid request: password confirmation is not correct", "", nil}
-	errHTTPBadRequestNotAPaidUser                    = &errHTTP{40027, http.StatusBadRequest, "invalid request: not a paid user", "", nil}
-	errHTTPBadRequestBillingRequestInvalid           = &errHTTP{40028, http.StatusBadRequest, "invalid request: not a valid billing request", "", nil}
-	errHTTPBadRequestBillingSubscriptionExists       = &errHTTP{40029, http.StatusBadRequest, "invalid request: billing subscription already exists", "", nil}
-	errHTTPBadRequestTierInvalid                     = &errHTTP{40030, http.StatusBadRequest, "invalid request: tier does not exist", "", nil}
-	errHTTPBadRequestUserNotFound                    = &errHTTP{40031, http.StatusBadRequest, "invalid request: user does not exist", "", nil}
-	errHTTPBadRequestPhoneCallsDisabled              = &errHTTP{40032, http.StatusBadRequest, "invalid request: calling is disabled", "https://ntfy.sh/docs/config/#phone-calls", nil}
-	errHTTPBadRequestPhoneNumberInvalid              = &errHTTP{40033, http.StatusBadRequest, "invalid request: phone number invalid", "https://ntfy.sh/docs/publish/#phone-calls", nil}
-	errHTTPBadRequestPhoneNumberNotVerified          = &errHTTP{40034, http.StatusBadRequest, "invalid request: phone number not verified, or no matching verified numbers found", "https://ntfy.sh/docs/publish/#phone-calls", nil}
-	errHTTPBadRequestAnonymousCallsNotAllowed        = &errHTTP{40035, http.StatusBadRequest, "invalid request: anonymous phone calls are not allowed", "https://ntfy.sh/docs/publish/#phone-calls", nil}
-	errHTTPBadRequestPhoneNumberVerifyChannelInvalid = &errHTTP{40036, http.StatusBadRequest, "invalid request: verification channel must be 'sms' or 'call'", "https://ntfy.sh/docs/publish/#phone-calls", nil}
-	errHTTPBadRequestDelayNoCall                     = &errHTTP{40037, http.StatusBadRequest, "invalid request: delayed call notifications are not supported", "", nil}
-	errHTTPBadRequestWebPushSubscriptionInvalid      = &errHTTP{40038, http.StatusBadRequest, "invalid request: web push payload malformed", "", nil}
-	errHTTPBadRequestWebPushEndpointUnknown          = &errHTTP{40039, http.StatusBadRequest, "invalid request: web push endpoint unknown", "", nil}
-	errHTTPBadRequestWebPushTopicCountTooHigh        = &errHTTP{40040, http.StatusBadRequest, "invalid request: too many web push topic subscriptions", "", nil}
-	errHTTPBadRequestTemplateMessageTooLarge         = &errHTTP{40041, http.StatusBadRequest, "invalid request: message or title is too large after replacing template", "https://ntfy.sh/docs/publish/#message-templating", nil}
-	errHTTPBadRequestTemplateMessageNotJSON          = &errHTTP{40042, http.StatusBadRequest, "invalid request: message body must be JSON if templating is enabled", "https://ntfy.sh/docs/publish/#message-templating", nil}
-	errHTTPBadRequestTemplateInvalid                 = &errHTTP{40043, http.StatusBadRequest, "invalid request: could not parse template", "https://ntfy.sh/docs/publish/#message-templating", nil}
-	errHTTPBadRequestTemplateDisallowedFunctionCalls = &errHTTP{40044, http.StatusBadRequest, "invalid request: template contains disallowed function calls, e.g. template, call, or define", "https://ntfy.sh/docs/publish/#message-templating", nil}
-	errHTTPBadRequestTemplateExecuteFailed           = &errHTTP{40045, http.StatusBadRequest, "invalid request: template execution failed", "https://ntfy.sh/docs/publish/#message-templating", nil}
-	errHTTPBadRequestInvalidUsername                 = &errHTTP{40046, http.StatusBadRequest, "invalid request: invalid username", "", nil}
-	errHTTPNotFound                                  = &errHTTP{40401, http.StatusNotFound, "page not found", "", nil}
-	errHTTPUnauthorized                              = &errHTTP{40101, http.StatusUnauthorized, "unauthorized", "https://ntfy.sh/docs/publish/#authentication", nil}
-	errHTTPForbidden                                 = &errHTTP{40301, http.StatusForbidden, "forbidden", "https://ntfy.sh/docs/publish/#authentication", nil}
-	errHTTPConflictUserExists                        = &errHTTP{40901, http.StatusConflict, "conflict: user already exists", "", nil}
-	errHTTPConflictTopicReserved                     = &errHTTP{40902, http.StatusConflict, "conflict: access control entry for topic or topic pattern already exists", "", nil}
-	errHTTPConflictSubscriptionExists                = &errHTTP{40903, http.StatusConflict, "conflict: topic subscription already exists", "", nil}
-	errHTTPConflictPhoneNumberExists                 = &errHTTP{40904, http.StatusConflict, "conflict: phone number already exists", "", nil}
-	errHTTPGonePhoneVerificationExpired              = &errHTTP{41001, http.StatusGone, "phone number verification expired or does not exist", "", nil}
-	errHTTPEntityTooLargeAttachment                  = &errHTTP{41301, http.StatusRequestEntityTooLarge, "attachment too large, or bandwidth limit reached", "https://ntfy.sh/docs/publish/#limitations", nil}
-	errHTTPEntityTooLargeMatrixRequest               = &errHTTP{41302, http.StatusRequestEntityTooLarge, "Matrix request is larger than the max allowed length", "", nil}
-	errHTTPEntityTooLargeJSONBody                    = &errHTTP{41303, http.StatusRequestEntityTooLarge, "JSON body too large", "", nil}
-	errHTTPTooManyRequestsLimitRequests              = &errHTTP{42901, http.StatusTooManyRequests, "limit reached: too many requests", "https://ntfy.sh/docs/publish/#limitations", nil}
-	errHTTPTooManyRequestsLimitEmails                = &errHTTP{42902, http.StatusTooManyRequests, "limit reached: too many emails", "https://ntfy.sh/docs/publish/#limitations", nil}
-	errHTTPTooManyRequestsLimitSubscriptions         = &errHTTP{42903, http.StatusTooManyRequests, "limit reached: too many active subscriptions", "https://ntfy.sh/docs/publish/#limitations", nil}
-	errHTTPTooManyRequestsLimitTotalTopics           = &errHTTP{42904, http.StatusTooManyRequests, "limit reached: the total number of topics on the server has been reached, please contact the admin", "https://ntfy.sh/docs/publish/#limitations", nil}
-	errHTTPTooManyRequestsLimitAttachmentBandwidth   = &errHTTP{42905, http.StatusTooManyRequests, "limit reached: daily bandwidth reached", "https://ntfy.sh/docs/publish/#limitations", nil}
-	errHTTPTooManyRequestsLimitAccountCreation       = &errHTTP{42906, http.StatusTooManyRequests, "limit reached: too many accounts created", "https://ntfy.sh/docs/publish/#limitations", nil} // FIXME document limit
-	errHTTPTooManyRequestsLimitReservations          = &errHTTP{42907, http.StatusTooManyRequests, "limit reached: too many topic reservations for this user", "", nil}
-	errHTTPTooManyRequestsLimitMessages              = &errHTTP{42908, http.StatusTooManyRequests, "limit reached: daily message quota reached", "https://ntfy.sh/docs/publish/#limitations", nil}
-	errHTTPTooManyRequestsLimitAuthFailure           = &errHTTP{42909, http.StatusTooManyRequests, "limit reached: too many auth failures", "https://ntfy.sh/docs/publish/#limitations", nil} // FIXME document limit
-	errHTTPTooManyRequestsLimitCalls                 = &errHTTP{42910, http.StatusTooManyRequests, "limit reached: daily phone call quota reached", "https://ntfy.sh/docs/publish/#limitations", nil}
-	errHTTPInternalError                             = &errHTTP{50001, http.StatusInternalServerError, "internal server error", "", nil}
-	errHTTPInternalErrorInvalidPath                  = &errHTTP{50002, http.StatusInternalServerError, "internal server error: invalid path", "", nil}
-	errHTTPInternalErrorMissingBaseURL               = &errHTTP{50003, http.StatusInternalServerError, "internal server error: base-url must be be configured for this feature", "https://ntfy.sh/docs/config/", nil}
-	errHTTPInternalErrorWebPushUnableToPublish       = &errHTTP{50004, http.StatusInternalServerError, "internal server error: unable to publish web push message", "", nil}
-	errHTTPInsufficientStorageUnifiedPush            = &errHTTP{50701, http.StatusInsufficientStorage, "cannot publish to UnifiedPush topic without previously active subscriber", "", nil}
+	errHTTPBadRequest                                = &errHTTP{40000, http.StatusBadRequest, "invalid request", "", nil, nil}
+	errHTTPBadRequestEmailDisabled                   = &errHTTP{40001, http.StatusBadRequest, "e-mail notifications are not enabled", "https://ntfy.sh/docs/config/#e-mail-notifications", nil, nil}
+	errHTTPBadRequestDelayNoCache                    = &errHTTP{40002, http.StatusBadRequest, "cannot disable cache for delayed message", "", nil, nil}
+	errHTTPBadRequestDelayNoEmail                    = &errHTTP{40003, http.StatusBadRequest, "delayed e-mail notifications are not supported", "", nil, nil}
+	errHTTPBadRequestDelayCannotParse                = &errHTTP{40004, http.StatusBadRequest, "invalid delay parameter: unable to parse delay", "https://ntfy.sh/docs/publish/#scheduled-delivery", nil, nil}
+	errHTTPBadRequestDelayTooSmall                   = &errHTTP{40005, http.StatusBadRequest, "invalid delay parameter: too small, please refer to the docs", "https://ntfy.sh/docs/publish/#scheduled-delivery", nil, nil}
+	errHTTPBadRequestDelayTooLarge                   = &errHTTP{40006, http.StatusBadRequest, "invalid delay parameter: too large, please refer to the docs", "https://ntfy.sh/docs/publish/#scheduled-delivery", nil, nil}
+	errHTTPBadRequestPriorityInvalid                 = &errHTTP{40007, http.StatusBadRequest, "invalid priority parameter", "https://ntfy.sh/docs/publish/#message-priority", nil, nil}
+	errHTTPBadRequestSinceInvalid                    = &errHTTP{40008, http.StatusBadRequest, "invalid since parameter", "https://ntfy.sh/docs/subscribe/api/#fetch-cached-messages", nil, nil}
+	errHTTPBadRequestTopicInvalid                    = &errHTTP{40009, http.StatusBadRequest, "invalid request: topic invalid", "", nil, nil}
+	errHTTPBadRequestTopicDisallowed                 = &errHTTP{40010, http.StatusBadRequest, "invalid request: topic name is not allowed", "", nil, nil}
+	errHTTPBadRequestMessageNotUTF8                  = &errHTTP{40011, http.StatusBadRequest, "invalid request: message must be UTF-8 encoded", "", nil, nil}
+	errHTTPBadRequestAttachmentURLInvalid            = &errHTTP{40013, http.StatusBadRequest, "invalid request: attachment URL is invalid", "https://ntfy.sh/docs/publish/#attachments", nil, nil}
+	errHTTPBadRequestAttachmentsDisallowed           = &errHTTP{40014, http.StatusBadRequest, "invalid request: attachments not allowed", "https://ntfy.sh/docs/config/#attachments", nil, nil}
+	errHTTPBadRequestAttachmentsExpiryBeforeDelivery = &errHTTP{40015, http.StatusBadRequest, "invalid request: attachment expiry before delayed delivery date", "https://ntfy.sh/docs/publish/#scheduled-delivery", nil, nil}
+	errHTTPBadRequestWebSocketsUpgradeHeaderMissing  = &errHTTP{40016, http.StatusBadRequest, "invalid request: client not using the websocket protocol", "https://ntfy.sh/docs/subscribe/api/#websockets", nil, nil}
+	errHTTPBadRequestMessageJSONInvalid              = &errHTTP{40017, http.StatusBadRequest, "invalid request: request body must be message JSON", "https://ntfy.sh/docs/publish/#publish-as-json", nil, nil}
+	errHTTPBadRequestActionsInvalid                  = &errHTTP{40018, http.StatusBadRequest, "invalid request: actions invalid", "https://ntfy.sh/docs/publish/#action-buttons", nil, nil}
+	errHTTPBadRequestMatrixMessageInvalid            = &errHTTP{40019, http.StatusBadRequest, "invalid request: Matrix JSON invalid", "https://ntfy.sh/docs/publish/#matrix-gateway", nil, nil}
+	errHTTPBadRequestIconURLInvalid                  = &errHTTP{40021, http.StatusBadRequest, "invalid request: icon URL is invalid", "https://ntfy.sh/docs/publish/#icons", nil, nil}
+	errHTTPBadRequestSignupNotEnabled                = &errHTTP{40022, http.StatusBadRequest, "invalid request: signup not enabled", "https://ntfy.sh/docs/config", nil, nil}
+	errHTTPBadRequestNoTokenProvided                 = &errHTTP{40023, http.StatusBadRequest, "invalid request: no token provided", "", nil, nil}
+	errHTTPBadRequestJSONInvalid                     = &errHTTP{40024, http.StatusBadRequest, "invalid request: request body must be valid JSON", "", nil, nil}
+	errHTTPBadRequestPermissionInvalid               = &errHTTP{40025, http.StatusBadRequest, "invalid request: incorrect permission string", "", nil, nil}
+	errHTTPBadRequestIncorrectPasswordConfirmation   = &errHTTP{40026, http.StatusBadRequest, "invalid request: password confirmation is not correct", "", nil, nil}
+	errHTTPBadRequestNotAPaidUser                    = &errHTTP{40027, http.StatusBadRequest, "invalid request: not a paid user", "", nil, nil}
+	errHTTPBadRequestBillingRequestInvalid           = &errHTTP{40028, http.StatusBadRequest, "invalid request: not a valid billing request", "", nil, nil}
+	errHTTPBadRequestBillingSubscriptionExists       = &errHTTP{40029, http.StatusBadRequest, "invalid request: billing subscription already exists", "", nil, nil}
+	errHTTPBadRequestTierInvalid                     = &errHTTP{40030, http.StatusBadRequest, "invalid request: tier does not exist", "", nil, nil}
+	errHTTPBadRequestUserNotFound                    = &errHTTP{40031, http.StatusBadRequest, "invalid request: user does not exist", "", nil, nil}
+	errHTTPBadRequestPhoneCallsDisabled              = &errHTTP{40032, http.StatusBadRequest, "invalid request: calling is disabled", "https://ntfy.sh/docs/config/#phone-calls", nil, nil}
+	errHTTPBadRequestPhoneNumberInvalid              = &errHTTP{40033, http.StatusBadRequest, "invalid request: phone number invalid", "https://ntfy.sh/docs/publish/#phone-calls", nil, nil}
+	errHTTPBadRequestPhoneNumberNotVerified          = &errHTTP{40034, http.StatusBadRequest, "invalid request: phone number not verified, or no matching verified numbers found", "https://ntfy.sh/docs/publish/#phone-calls", nil, nil}
+	errHTTPBadRequestAnonymousCallsNotAllowed        = &errHTTP{40035, http.StatusBadRequest, "invalid request: anonymous phone calls are not allowed", "https://ntfy.sh/docs/publish/#phone-calls", nil, nil}
+	errHTTPBadRequestPhoneNumberVerifyChannelInvalid = &errHTTP{40036, http.StatusBadRequest, "invalid request: verification channel must be 'sms' or 'call'", "https://ntfy.sh/docs/publish/#phone-calls", nil, nil}
+	errHTTPBadRequestDelayNoCall                     = &errHTTP{40037, http.StatusBadRequest, "invalid request: delayed call notifications are not supported", "", nil, nil}
+	errHTTPBadRequestWebPushSubscriptionInvalid      = &errHTTP{40038, http.StatusBadRequest, "invalid request: web push payload malformed", "", nil, nil}
+	errHTTPBadRequestWebPushEndpointUnknown          = &errHTTP{40039, http.StatusBadRequest, "invalid request: web push endpoint unknown", "", nil, nil}
+	errHTTPBadRequestWebPushTopicCountTooHigh        = &errHTTP{40040, http.StatusBadRequest, "invalid request: too many web push topic subscriptions", "", nil, nil}
+	errHTTPBadRequestTemplateMessageTooLarge         = &errHTTP{40041, http.StatusBadRequest, "invalid request: message or title is too large after replacing template", "https://ntfy.sh/docs/publish/#message-templating", nil, nil}
+	errHTTPBadRequestTemplateMessageNotJSON          = &errHTTP{40042, http.StatusBadRequest, "invalid request: message body must be JSON if templating is enabled", "https://ntfy.sh/docs/publish/#message-templating", nil, nil}
+	errHTTPBadRequestTemplateInvalid                 = &errHTTP{40043, http.StatusBadRequest, "invalid request: could not parse template", "https://ntfy.sh/docs/publish/#message-templating", nil, nil}
+	errHTTPBadRequestTemplateDisallowedFunctionCalls = &errHTTP{40044, http.StatusBadRequest, "invalid request: template contains disallowed function calls, e.g. template, call, or define", "https://ntfy.sh/docs/publish/#message-templating", nil, nil}
+	errHTTPBadRequestTemplateExecuteFailed           = &errHTTP{40045, http.StatusBadRequest, "invalid request: template execution failed", "https://ntfy.sh/docs/publish/#message-templating", nil, nil}
+	errHTTPBadRequestInvalidUsername                 = &errHTTP{40046, http.StatusBadRequest, "invalid request: invalid username", "", nil, nil}
+	errHTTPBadRequestAttachmentExpiresInvalid        = &errHTTP{40047, http.StatusBadRequest, "invalid request: attachment expiry invalid, must be a positive duration, e.g. 30m or 2h", "https://ntfy.sh/docs/publish/#attach-local-file", nil, nil}
+	errHTTPBadRequestPausedUntilInvalid              = &errHTTP{40048, http.StatusBadRequest, "invalid request: paused until must be a Unix timestamp in the future", "", nil, nil}
+	errHTTPBadRequestPublishBatchInvalid             = &errHTTP{40049, http.StatusBadRequest, "invalid request: batch must contain between 1 and 100 messages", "https://ntfy.sh/docs/publish/#publish-multiple-messages", nil, nil}
+	errHTTPBadRequestBoostInvalid                    = &errHTTP{40050, http.StatusBadRequest, "invalid request: boost multiplier must be greater than 1, and expires must be a Unix timestamp in the future", "", nil, nil}
+	errHTTPNotFound                                  = &errHTTP{40401, http.StatusNotFound, "page not found", "", nil, nil}
+	errHTTPPaymentRequiredLimitReached               = &errHTTP{40201, http.StatusPaymentRequired, "limit reached: please upgrade your plan for higher limits", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPUnauthorized                              = &errHTTP{40101, http.StatusUnauthorized, "unauthorized", "https://ntfy.sh/docs/publish/#authentication", nil, nil}
+	errHTTPForbidden                                 = &errHTTP{40301, http.StatusForbidden, "forbidden", "https://ntfy.sh/docs/publish/#authentication", nil, nil}
+	errHTTPForbiddenAnonymousPublishDisabled         = &errHTTP{40302, http.StatusForbidden, "forbidden: publishing is temporarily disabled for anonymous users, please log in", "https://ntfy.sh/docs/publish/#authentication", nil, nil}
+	errHTTPForbiddenVisitorPaused                    = &errHTTP{40303, http.StatusForbidden, "forbidden: account is temporarily paused by an administrator", "", nil, nil}
+	errHTTPConflictUserExists                        = &errHTTP{40901, http.StatusConflict, "conflict: user already exists", "", nil, nil}
+	errHTTPConflictTopicReserved                     = &errHTTP{40902, http.StatusConflict, "conflict: access control entry for topic or topic pattern already exists", "", nil, nil}
+	errHTTPConflictSubscriptionExists                = &errHTTP{40903, http.StatusConflict, "conflict: topic subscription already exists", "", nil, nil}
+	errHTTPConflictPhoneNumberExists                 = &errHTTP{40904, http.StatusConflict, "conflict: phone number already exists", "", nil, nil}
+	errHTTPConflictDuplicateMessage                  = &errHTTP{40905, http.StatusConflict, "conflict: message is identical to the previous message", "https://ntfy.sh/docs/config/#rate-limiting", nil, nil}
+	errHTTPGonePhoneVerificationExpired              = &errHTTP{41001, http.StatusGone, "phone number verification expired or does not exist", "", nil, nil}
+	errHTTPEntityTooLargeAttachment                  = &errHTTP{41301, http.StatusRequestEntityTooLarge, "attachment too large, or bandwidth limit reached", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPEntityTooLargeMatrixRequest               = &errHTTP{41302, http.StatusRequestEntityTooLarge, "Matrix request is larger than the max allowed length", "", nil, nil}
+	errHTTPEntityTooLargeJSONBody                    = &errHTTP{41303, http.StatusRequestEntityTooLarge, "JSON body too large", "", nil, nil}
+	errHTTPTooManyRequestsLimitRequests              = &errHTTP{42901, http.StatusTooManyRequests, "limit reached: too many requests", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitEmails                = &errHTTP{42902, http.StatusTooManyRequests, "limit reached: too many emails", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitSubscriptions         = &errHTTP{42903, http.StatusTooManyRequests, "limit reached: too many active subscriptions", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitTotalTopics           = &errHTTP{42904, http.StatusTooManyRequests, "limit reached: the total number of topics on the server has been reached, please contact the admin", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitAttachmentBandwidth   = &errHTTP{42905, http.StatusTooManyRequests, "limit reached: daily bandwidth reached", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitAccountCreation       = &errHTTP{42906, http.StatusTooManyRequests, "limit reached: too many accounts created", "https://ntfy.sh/docs/publish/#limitations", nil, nil} // FIXME document limit
+	errHTTPTooManyRequestsLimitReservations          = &errHTTP{42907, http.StatusTooManyRequests, "limit reached: too many topic reservations for this user", "", nil, nil}
+	errHTTPTooManyRequestsLimitMessages              = &errHTTP{42908, http.StatusTooManyRequests, "limit reached: daily message quota reached", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitAuthFailure           = &errHTTP{42909, http.StatusTooManyRequests, "limit reached: too many auth failures", "https://ntfy.sh/docs/publish/#limitations", nil, nil} // FIXME document limit
+	errHTTPTooManyRequestsLimitCalls                 = &errHTTP{42910, http.StatusTooManyRequests, "limit reached: daily phone call quota reached", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitTopicMessages         = &errHTTP{42911, http.StatusTooManyRequests, "limit reached: too many messages on this topic, please slow down", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsPenaltyBox                 = &errHTTP{42912, http.StatusTooManyRequests, "limit reached: too many requests after hitting limits repeatedly, temporarily blocked", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitIngressBandwidth      = &errHTTP{42913, http.StatusTooManyRequests, "limit reached: daily publishing bandwidth reached", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitDistinctTopics        = &errHTTP{42914, http.StatusTooManyRequests, "limit reached: too many different topics published to today", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitDownloads             = &errHTTP{42915, http.StatusTooManyRequests, "limit reached: too many concurrent attachment downloads", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitScheduledMessages     = &errHTTP{42916, http.StatusTooManyRequests, "limit reached: daily scheduled messages limit reached", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitAttachmentMessages    = &errHTTP{42917, http.StatusTooManyRequests, "limit reached: daily limit for messages with attachments reached", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitSubscriptionAttempts  = &errHTTP{42918, http.StatusTooManyRequests, "limit reached: too many subscription attempts, please slow down", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitGatewayMessages       = &errHTTP{42919, http.StatusTooManyRequests, "limit reached: daily limit for UnifiedPush/Matrix gateway messages reached", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitMessageInterval       = &errHTTP{42920, http.StatusTooManyRequests, "limit reached: messages published too quickly, please slow down", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPTooManyRequestsLimitInboundEmails         = &errHTTP{42921, http.StatusTooManyRequests, "limit reached: too many inbound e-mails from this sender, please slow down", "https://ntfy.sh/docs/config/#e-mail-publishing", nil, nil}
+	errHTTPTooManyRequestsLimitUrgentMessages        = &errHTTP{42922, http.StatusTooManyRequests, "limit reached: daily limit for urgent messages reached", "https://ntfy.sh/docs/publish/#limitations", nil, nil}
+	errHTTPInternalError                             = &errHTTP{50001, http.StatusInternalServerError, "internal server error", "", nil, nil}
+	errHTTPInternalErrorInvalidPath                  = &errHTTP{50002, http.StatusInternalServerError, "internal server error: invalid path", "", nil, nil}
+	errHTTPInternalErrorMissingBaseURL               = &errHTTP{50003, http.StatusInternalServerError, "internal server error: base-url must be be configured for this feature", "https://ntfy.sh/docs/config/", nil, nil}
+	errHTTPInternalErrorWebPushUnableToPublish       = &errHTTP{50004, http.StatusInternalServerError, "internal server error: unable to publish web push message", "", nil, nil}
+	errHTTPServiceUnavailableEmail                   = &errHTTP{50301, http.StatusServiceUnavailable, "service unavailable: e-mail notifications are temporarily unavailable, please try again later", "https://ntfy.sh/docs/publish/#e-mail-notifications", nil, nil}
+	errHTTPInsufficientStorageUnifiedPush            = &errHTTP{50701, http.StatusInsufficientStorage, "cannot publish to UnifiedPush topic without previously active subscriber", "", nil, nil}
 )
+
+// errHTTPFromLimitError maps a limit error returned by one of the visitor's *Allowed methods (see errVisitorLimitReached)
+// or errVisitorPaused to the matching HTTP error, or returns nil if err is not a limit error. If the limit of a tier user
+// was reached and Config.UsePaymentRequiredForTierLimits is set (see visitorLimitError), a 402 with an upgrade link is
+// returned instead.
+func errHTTPFromLimitError(err error) *errHTTP {
+	httpErr := errHTTPFromLimitErrorBasic(err)
+	var limitErr *visitorLimitError
+	if httpErr != nil && errors.As(err, &limitErr) && limitErr.basis == visitorLimitBasisTier {
+		paymentErr := errHTTPPaymentRequiredLimitReached.Wrap("%s", httpErr.Message)
+		if limitErr.upgradeURL != "" {
+			paymentErr.Link = limitErr.upgradeURL
+		}
+		return paymentErr
+	}
+	return httpErr
+}
+
+// errHTTPLimiters maps the codes of 429 errors to the name of the limiter that caused them (see visitorLimiters),
+// so that the error response can include the visitor's limit object, see visitor.LimitError
+var errHTTPLimiters = map[int]string{
+	errHTTPTooManyRequestsLimitRequests.Code:             visitorLimiterRequest,
+	errHTTPTooManyRequestsLimitEmails.Code:               visitorLimiterEmails,
+	errHTTPTooManyRequestsLimitSubscriptions.Code:        visitorLimiterSubscriptions,
+	errHTTPTooManyRequestsLimitAttachmentBandwidth.Code:  visitorLimiterBandwidth,
+	errHTTPTooManyRequestsLimitAccountCreation.Code:      visitorLimiterAccountCreation,
+	errHTTPTooManyRequestsLimitMessages.Code:             visitorLimiterMessages,
+	errHTTPTooManyRequestsLimitAuthFailure.Code:          visitorLimiterAuth,
+	errHTTPTooManyRequestsLimitCalls.Code:                visitorLimiterCalls,
+	errHTTPTooManyRequestsLimitIngressBandwidth.Code:     visitorLimiterIngress,
+	errHTTPTooManyRequestsLimitDistinctTopics.Code:       visitorLimiterTopics,
+	errHTTPTooManyRequestsLimitDownloads.Code:            visitorLimiterDownloads,
+	errHTTPTooManyRequestsLimitScheduledMessages.Code:    visitorLimiterScheduled,
+	errHTTPTooManyRequestsLimitAttachmentMessages.Code:   visitorLimiterAttachments,
+	errHTTPTooManyRequestsLimitSubscriptionAttempts.Code: visitorLimiterSubscriptionAttempts,
+	errHTTPTooManyRequestsLimitGatewayMessages.Code:      visitorLimiterGateway,
+	errHTTPTooManyRequestsLimitMessageInterval.Code:      visitorLimiterMessageInterval,
+	errHTTPTooManyRequestsLimitInboundEmails.Code:        visitorLimiterInboundEmails,
+	errHTTPTooManyRequestsLimitUrgentMessages.Code:       visitorLimiterUrgent,
+}
+
+func errHTTPFromLimitErrorBasic(err error) *errHTTP {
+	switch {
+	case errors.Is(err, errVisitorPaused):
+		return errHTTPForbiddenVisitorPaused
+	case errors.Is(err, errMessageLimitReached):
+		return errHTTPTooManyRequestsLimitMessages
+	case errors.Is(err, errEmailLimitReached):
+		return errHTTPTooManyRequestsLimitEmails
+	case errors.Is(err, errSubscriptionLimitReached):
+		return errHTTPTooManyRequestsLimitSubscriptions
+	case errors.Is(err, errSubscriptionAttemptLimitReached):
+		return errHTTPTooManyRequestsLimitSubscriptionAttempts
+	case errors.Is(err, errBandwidthLimitReached):
+		return errHTTPTooManyRequestsLimitAttachmentBandwidth
+	case errors.Is(err, errIngressLimitReached):
+		return errHTTPTooManyRequestsLimitIngressBandwidth
+	case errors.Is(err, errTopicsLimitReached):
+		return errHTTPTooManyRequestsLimitDistinctTopics
+	case errors.Is(err, errDownloadLimitReached):
+		return errHTTPTooManyRequestsLimitDownloads
+	case errors.Is(err, errScheduledLimitReached):
+		return errHTTPTooManyRequestsLimitScheduledMessages
+	case errors.Is(err, errAccountCreateLimitReached):
+		return errHTTPTooManyRequestsLimitAccountCreation
+	case errors.Is(err, errAttachmentLimitReached):
+		return errHTTPTooManyRequestsLimitAttachmentMessages
+	case errors.Is(err, errGatewayLimitReached):
+		return errHTTPTooManyRequestsLimitGatewayMessages
+	case errors.Is(err, errUrgentLimitReached):
+		return errHTTPTooManyRequestsLimitUrgentMessages
+	case errors.Is(err, errMessageIntervalReached):
+		return errHTTPTooManyRequestsLimitMessageInterval
+	case errors.Is(err, errInboundEmailLimitReached):
+		return errHTTPTooManyRequestsLimitInboundEmails
+	case errors.Is(err, errVisitorLimitReached):
+		return errHTTPTooManyRequestsLimitRequests
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+
+	"heckel.io/ntfy/v2/log"
+)
+
+const (
+	tagGeoIP = "geoip"
+
+	// geoIPCacheSize is the max number of cached lookups; the cache is cleared when it is full
+	geoIPCacheSize = 10000
+)
+
+// geoIPResolver resolves the country of visitor IP addresses (see Config.GeoIPDatabase), and caches the results,
+// since visitors are expunged and re-created for the same addresses over and over again. A nil geoIPResolver is
+// valid, and resolves all addresses to an empty country, so the feature is a no-op if no database is configured.
+type geoIPResolver struct {
+	lookup func(ip netip.Addr) (string, error) // Likely util.GeoIPReader.Country
+	cache  map[netip.Addr]string               // IP address -> country code, may be empty
+	mu     sync.Mutex
+}
+
+func newGeoIPResolver(lookup func(ip netip.Addr) (string, error)) *geoIPResolver {
+	return &geoIPResolver{
+		lookup: lookup,
+		cache:  make(map[netip.Addr]string),
+	}
+}
+
+// Country returns the ISO country code (e.g. "DE") of the given IP address, or an empty string if it is unknown
+func (g *geoIPResolver) Country(ip netip.Addr) string {
+	if g == nil {
+		return ""
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if country, ok := g.cache[ip]; ok {
+		return country
+	}
+	country, err := g.lookup(ip)
+	if err != nil {
+		log.Tag(tagGeoIP).Err(err).Debug("Unable to look up country of IP address %s", ip.String())
+		return "" // Not cached, may be a temporary error
+	}
+	if len(g.cache) >= geoIPCacheSize {
+		g.cache = make(map[netip.Addr]string)
+	}
+	country = strings.ToUpper(country)
+	g.cache[ip] = country
+	return country
+}
+
+// geoRestricted returns true if the given country is in the list of restricted countries, see Config.GeoRestrictedCountries
+func geoRestricted(conf *Config, country string) bool {
+	if country == "" {
+		return false
+	}
+	for _, c := range conf.GeoRestrictedCountries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
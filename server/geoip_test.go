@@ -0,0 +1,33 @@
+package server
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeoIPResolver_CountryCached(t *testing.T) {
+	lookups := 0
+	g := newGeoIPResolver(func(ip netip.Addr) (string, error) {
+		lookups++
+		if ip == netip.MustParseAddr("9.9.9.9") {
+			return "", errors.New("lookup failed")
+		}
+		return "de", nil
+	})
+	require.Equal(t, "DE", g.Country(netip.MustParseAddr("1.2.3.4")))
+	require.Equal(t, "DE", g.Country(netip.MustParseAddr("1.2.3.4")))
+	require.Equal(t, 1, lookups)
+
+	// Errors are not cached
+	require.Equal(t, "", g.Country(netip.MustParseAddr("9.9.9.9")))
+	require.Equal(t, "", g.Country(netip.MustParseAddr("9.9.9.9")))
+	require.Equal(t, 3, lookups)
+}
+
+func TestGeoIPResolver_Nil(t *testing.T) {
+	var g *geoIPResolver
+	require.Equal(t, "", g.Country(netip.MustParseAddr("1.2.3.4")))
+}
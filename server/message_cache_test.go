@@ -669,6 +669,39 @@ func testSender(t *testing.T, c *messageCache) {
 	require.Equal(t, messages[1].Sender, netip.Addr{})
 }
 
+func TestSqliteCache_VisitorEmails(t *testing.T) {
+	testVisitorEmails(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_VisitorEmails(t *testing.T) {
+	testVisitorEmails(t, newMemTestCache(t))
+}
+
+func testVisitorEmails(t *testing.T, c *messageCache) {
+	emails, reset, err := c.VisitorEmails("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), emails)
+	require.True(t, reset.IsZero())
+
+	yesterday := time.Unix(1700000000, 0)
+	today := yesterday.Add(24 * time.Hour)
+	require.Nil(t, c.UpdateVisitorEmails("1.2.3.4", 3, yesterday))
+	require.Nil(t, c.UpdateVisitorEmails("1.2.3.4", 5, today))
+	require.Nil(t, c.UpdateVisitorEmails("5.6.7.8", 1, yesterday))
+	emails, reset, err = c.VisitorEmails("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(5), emails)
+	require.Equal(t, today, reset)
+
+	require.Nil(t, c.DeleteExpiredVisitorStats(today))
+	emails, _, err = c.VisitorEmails("5.6.7.8")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), emails)
+	emails, _, err = c.VisitorEmails("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(5), emails)
+}
+
 func checkSchemaVersion(t *testing.T, db *sql.DB) {
 	rows, err := db.Query(`SELECT version FROM schemaVersion`)
 	require.Nil(t, err)
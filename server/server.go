@@ -39,6 +39,7 @@ import (
 // Server is the main server, providing the UI and API for ntfy
 type Server struct {
 	config            *Config
+	visitorConfig     *Config // Config of new visitors, replaced by ReloadVisitorLimits (protected by mu)
 	httpServer        *http.Server
 	httpsServer       *http.Server
 	httpMetricsServer *http.Server
@@ -48,15 +49,21 @@ type Server struct {
 	smtpServerBackend *smtpBackend
 	smtpSender        mailer
 	topics            map[string]*topic
-	visitors          map[string]*visitor // ip:<ip> or user:<user>
+	visitors          map[string]*visitor     // ip:<ip> or user:<user>
+	topicLimiter      *topicLimiter           // Per-topic message limiter, may be nil
+	accountLimiter    *accountCreationLimiter // Per-subnet account creation limiter, may be nil (then limited per visitor)
+	geoIP             *geoIPResolver          // Resolves the country of visitors, may be nil, see Config.GeoIPDatabase
 	firebaseClient    *firebaseClient
 	messages          int64                               // Total number of messages (persisted if messageCache enabled)
 	messagesHistory   []int64                             // Last n values of the messages counter, used to determine rate
 	userManager       *user.Manager                       // Might be nil!
 	messageCache      *messageCache                       // Database that stores the messages
+	limiterStore      *util.RedisClient                   // Shared store for visitor limiters, may be nil, see Config.VisitorLimiterStore
+	billingLimiters   *billingAccountLimiters             // Messages limiters shared by users with the same billing account
 	webPush           *webPushStore                       // Database that stores web push subscriptions
 	fileCache         *fileCache                          // File system based cache that stores attachments
 	stripe            stripeAPI                           // Stripe API, can be replaced with a mock
+	limiterFor        func(v *visitor) visitorLimiter     // Returns the limit checks of a visitor, can be replaced with a fake
 	priceCache        *util.LookupCache[map[string]int64] // Stripe price ID -> price as cents (USD implied!)
 	metricsHandler    http.Handler                        // Handles /metrics if enable-metrics set, and listen-metrics-http not set
 	closeChan         chan bool
@@ -89,8 +96,13 @@ var (
 	apiStatsPath                                         = "/v1/stats"
 	apiWebPushPath                                       = "/v1/webpush"
 	apiTiersPath                                         = "/v1/tiers"
+	apiPublishBatchPath                                  = "/v1/publish/batch"
 	apiUsersPath                                         = "/v1/users"
 	apiUsersAccessPath                                   = "/v1/users/access"
+	apiAdminAnonymousPublishPath                         = "/v1/admin/anonymous-publish"
+	apiAdminVisitorsPath                                 = "/v1/admin/visitors"
+	apiAdminTenantsPath                                  = "/v1/admin/tenants"
+	apiAdminFirebasePenaltyPath                          = "/v1/admin/firebase-penalty"
 	apiAccountPath                                       = "/v1/account"
 	apiAccountTokenPath                                  = "/v1/account/token"
 	apiAccountPasswordPath                               = "/v1/account/password"
@@ -105,6 +117,12 @@ var (
 	apiAccountBillingSubscriptionCheckoutSuccessTemplate = "/v1/account/billing/subscription/success/{CHECKOUT_SESSION_ID}"
 	apiAccountBillingSubscriptionCheckoutSuccessRegex    = regexp.MustCompile(`/v1/account/billing/subscription/success/(.+)$`)
 	apiAccountReservationSingleRegex                     = regexp.MustCompile(`/v1/account/reservation/([-_A-Za-z0-9]{1,64})$`)
+	apiUsersResetLimitsRegex                             = regexp.MustCompile(`^/v1/users/([^/]+)/reset-limits$`)
+	apiUsersPauseRegex                                   = regexp.MustCompile(`^/v1/users/([^/]+)/pause$`)
+	apiUsersBoostRegex                                   = regexp.MustCompile(`^/v1/users/([^/]+)/boost$`)
+	apiAdminLimitsRegex                                  = regexp.MustCompile(`^/v1/admin/limits/([^/]+)$`)
+	apiAdminLimitsExplainRegex                           = regexp.MustCompile(`^/v1/admin/limits/([^/]+)/explain$`)
+	apiAdminFirebasePenaltyRegex                         = regexp.MustCompile(`^/v1/admin/firebase-penalty/([^/]+)$`)
 	staticRegex                                          = regexp.MustCompile(`^/static/.+`)
 	docsRegex                                            = regexp.MustCompile(`^/docs(|/.*)$`)
 	fileRegex                                            = regexp.MustCompile(`^/file/([-_A-Za-z0-9]{1,64})(?:\.[A-Za-z0-9]{1,16})?$`)
@@ -134,6 +152,7 @@ const (
 	unifiedPushTopicLength   = 14                        // Length of UnifiedPush topics, including the "up" part
 	messagesHistoryMax       = 10                        // Number of message count values to keep in memory
 	templateMaxExecutionTime = 100 * time.Millisecond
+	publishBatchMessagesMax  = 100 // Max number of messages per batch, see handlePublishBatch
 )
 
 var (
@@ -210,6 +229,7 @@ func New(conf *Config) (*Server, error) {
 	}
 	s := &Server{
 		config:          conf,
+		visitorConfig:   conf,
 		messageCache:    messageCache,
 		webPush:         webPush,
 		fileCache:       fileCache,
@@ -221,7 +241,28 @@ func New(conf *Config) (*Server, error) {
 		messagesHistory: []int64{messages},
 		visitors:        make(map[string]*visitor),
 		stripe:          stripe,
+		limiterFor:      func(v *visitor) visitorLimiter { return v },
 	}
+	if conf.TopicMessageLimitBurst > 0 {
+		s.topicLimiter = newTopicLimiter(safeEvery(conf.TopicMessageLimitReplenish), conf.TopicMessageLimitBurst)
+	}
+	if conf.VisitorAccountCreationLimitIPv4Prefix > 0 || conf.VisitorAccountCreationLimitIPv6Prefix > 0 {
+		s.accountLimiter = newAccountCreationLimiter(safeEvery(conf.VisitorAccountCreationLimitReplenish), conf.VisitorAccountCreationLimitBurst, conf.VisitorAccountCreationLimitIPv4Prefix, conf.VisitorAccountCreationLimitIPv6Prefix)
+	}
+	if conf.VisitorLimiterStore == VisitorLimiterStoreRedis {
+		s.limiterStore = util.NewRedisClient(conf.VisitorLimiterRedisAddr)
+		if err := s.limiterStore.Ping(); err != nil {
+			log.Tag(tagStartup).Warn("Cannot reach Redis limiter store at %s, using in-memory limiters until it is reachable: %s", conf.VisitorLimiterRedisAddr, err.Error())
+		}
+	}
+	if conf.GeoIPDatabase != "" {
+		geoIPReader, err := util.NewGeoIPReader(conf.GeoIPDatabase)
+		if err != nil {
+			return nil, err
+		}
+		s.geoIP = newGeoIPResolver(geoIPReader.Country)
+	}
+	s.billingLimiters = newBillingAccountLimiters()
 	s.priceCache = util.NewLookupCache(s.fetchStripePrices, conf.StripePriceCacheDuration)
 	return s, nil
 }
@@ -367,14 +408,35 @@ func (s *Server) closeDatabases() {
 	if s.webPush != nil {
 		s.webPush.Close()
 	}
+	if s.limiterStore != nil {
+		s.limiterStore.Close()
+	}
 }
 
 // handle is the main entry point for all HTTP requests
 func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if s.isHealthCheck(r) {
+		// Health probes (e.g. from a load balancer) are answered before the visitor is looked up, so that they
+		// never count towards the request limit, and do not add visitors to the visitor map
+		if err := s.handleHealth(w, r, nil); err != nil {
+			logr(r).Err(err).Debug("Unable to write health check response")
+		} else if metricHTTPRequests != nil {
+			metricHTTPRequests.WithLabelValues("200", "20000", r.Method).Inc()
+		}
+		return
+	}
 	v, err := s.maybeAuthenticate(r) // Note: Always returns v, even when error is returned
+	if s.config.VisitorTenantHeader != "" {
+		v.SetTenant(r.Header.Get(s.config.VisitorTenantHeader))
+	}
+	setRateLimitHeaders(w, v)
 	if err != nil {
 		s.handleError(w, r, v, err)
 		return
+	} else if delay := v.PenaltyBoxRemaining(); delay > 0 {
+		setRetryAfterHeader(w, delay)
+		s.handleError(w, r, v, errHTTPTooManyRequestsPenaltyBox)
+		return
 	}
 	ev := logvr(v, r)
 	if ev.IsTrace() {
@@ -384,7 +446,13 @@ func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
 	}
 	logvr(v, r).
 		Timing(func() {
-			if err := s.handleInternal(w, r, v); err != nil {
+			start := time.Now()
+			err := s.handleInternal(w, r, v)
+			if !isSubscribeStream(r) {
+				v.RecordRequest(time.Since(start))
+			}
+			v.RecordLimitResult(isLimitReachedError(err))
+			if err != nil {
 				s.handleError(w, r, v, err)
 				return
 			}
@@ -395,10 +463,36 @@ func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
 		Debug("HTTP request finished")
 }
 
+// isHealthCheck returns true if the request is a health probe, see Config.HealthCheckPaths
+func (s *Server) isHealthCheck(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && util.Contains(s.config.HealthCheckPaths, r.URL.Path)
+}
+
+// isSubscribeStream returns true if the request is a long-lived subscription (JSON, SSE, raw or WebSocket stream),
+// as opposed to a poll request, see visitor.RecordRequest
+func isSubscribeStream(r *http.Request) bool {
+	if r.Method != http.MethodGet || readBoolParam(r, false, "x-poll", "poll", "po") {
+		return false
+	}
+	return jsonPathRegex.MatchString(r.URL.Path) || ssePathRegex.MatchString(r.URL.Path) || rawPathRegex.MatchString(r.URL.Path) || wsPathRegex.MatchString(r.URL.Path)
+}
+
+// isLimitReachedError returns true if the given error is a 429 (or 402, see Config.UsePaymentRequiredForTierLimits)
+// error, i.e. the visitor hit a rate limit
+func isLimitReachedError(err error) bool {
+	if errors.Is(err, errVisitorLimitReached) {
+		return true
+	}
+	var httpErr *errHTTP
+	return errors.As(err, &httpErr) && (httpErr.HTTPCode == http.StatusTooManyRequests || httpErr.HTTPCode == http.StatusPaymentRequired)
+}
+
 func (s *Server) handleError(w http.ResponseWriter, r *http.Request, v *visitor, err error) {
 	httpErr, ok := err.(*errHTTP)
 	if !ok {
-		httpErr = errHTTPInternalError
+		if httpErr = errHTTPFromLimitError(err); httpErr == nil {
+			httpErr = errHTTPInternalError
+		}
 	}
 	if metricHTTPRequests != nil {
 		metricHTTPRequests.WithLabelValues(fmt.Sprintf("%d", httpErr.HTTPCode), fmt.Sprintf("%d", httpErr.Code), r.Method).Inc()
@@ -429,6 +523,13 @@ func (s *Server) handleError(w http.ResponseWriter, r *http.Request, v *visitor,
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
 	w.WriteHeader(httpErr.HTTPCode)
+	if httpErr.limit != nil {
+		io.WriteString(w, httpErr.JSONWithLimit(httpErr.limit)+"\n") // Limit of the rate visitor, see errHTTP.WithLimit
+		return
+	} else if limiter, ok := errHTTPLimiters[httpErr.Code]; ok && httpErr.HTTPCode == http.StatusTooManyRequests && v != nil {
+		io.WriteString(w, httpErr.JSONWithLimit(v.LimitError(limiter))+"\n")
+		return
+	}
 	io.WriteString(w, httpErr.JSON()+"\n")
 }
 
@@ -453,6 +554,26 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureAdmin(s.handleAccessAllow)(w, r, v)
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiUsersAccessPath {
 		return s.ensureAdmin(s.handleAccessReset)(w, r, v)
+	} else if r.Method == http.MethodPost && apiUsersResetLimitsRegex.MatchString(r.URL.Path) {
+		return s.ensureAdmin(s.handleUsersResetLimits)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodDelete) && apiUsersPauseRegex.MatchString(r.URL.Path) {
+		return s.ensureAdmin(s.handleUsersPause)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodDelete) && apiUsersBoostRegex.MatchString(r.URL.Path) {
+		return s.ensureAdmin(s.handleUsersBoost)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminAnonymousPublishPath {
+		return s.ensureAdmin(s.handleAdminAnonymousPublishGet)(w, r, v)
+	} else if r.Method == http.MethodPut && r.URL.Path == apiAdminAnonymousPublishPath {
+		return s.ensureAdmin(s.handleAdminAnonymousPublishChange)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminVisitorsPath {
+		return s.ensureAdmin(s.handleAdminVisitorsGet)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminTenantsPath {
+		return s.ensureAdmin(s.handleAdminTenantsGet)(w, r, v)
+	} else if r.Method == http.MethodDelete && (r.URL.Path == apiAdminFirebasePenaltyPath || apiAdminFirebasePenaltyRegex.MatchString(r.URL.Path)) {
+		return s.ensureAdmin(s.handleAdminFirebasePenaltyDelete)(w, r, v)
+	} else if r.Method == http.MethodGet && apiAdminLimitsRegex.MatchString(r.URL.Path) {
+		return s.ensureAdmin(s.handleAdminLimitsGet)(w, r, v)
+	} else if r.Method == http.MethodGet && apiAdminLimitsExplainRegex.MatchString(r.URL.Path) {
+		return s.ensureAdmin(s.handleAdminLimitsExplainGet)(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountPath {
 		return s.ensureUserManager(s.handleAccountCreate)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiAccountPath {
@@ -514,9 +635,11 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 	} else if r.Method == http.MethodGet && docsRegex.MatchString(r.URL.Path) {
 		return s.ensureWebEnabled(s.handleDocs)(w, r, v)
 	} else if (r.Method == http.MethodGet || r.Method == http.MethodHead) && fileRegex.MatchString(r.URL.Path) && s.config.AttachmentCacheDir != "" {
-		return s.limitRequests(s.handleFile)(w, r, v)
+		return s.limitReadRequests(s.handleFile)(w, r, v)
 	} else if r.Method == http.MethodOptions {
 		return s.limitRequests(s.handleOptions)(w, r, v) // Should work even if the web app is not enabled, see #598
+	} else if r.Method == http.MethodPost && r.URL.Path == apiPublishBatchPath {
+		return s.limitRequests(s.handlePublishBatch)(w, r, v)
 	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == "/" {
 		return s.transformBodyJSON(s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handlePublish)))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == matrixPushPath {
@@ -526,15 +649,15 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 	} else if r.Method == http.MethodGet && publishPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handlePublish))(w, r, v)
 	} else if r.Method == http.MethodGet && jsonPathRegex.MatchString(r.URL.Path) {
-		return s.limitRequests(s.authorizeTopicRead(s.handleSubscribeJSON))(w, r, v)
+		return s.limitReadRequests(s.authorizeTopicRead(s.handleSubscribeJSON))(w, r, v)
 	} else if r.Method == http.MethodGet && ssePathRegex.MatchString(r.URL.Path) {
-		return s.limitRequests(s.authorizeTopicRead(s.handleSubscribeSSE))(w, r, v)
+		return s.limitReadRequests(s.authorizeTopicRead(s.handleSubscribeSSE))(w, r, v)
 	} else if r.Method == http.MethodGet && rawPathRegex.MatchString(r.URL.Path) {
-		return s.limitRequests(s.authorizeTopicRead(s.handleSubscribeRaw))(w, r, v)
+		return s.limitReadRequests(s.authorizeTopicRead(s.handleSubscribeRaw))(w, r, v)
 	} else if r.Method == http.MethodGet && wsPathRegex.MatchString(r.URL.Path) {
-		return s.limitRequests(s.authorizeTopicRead(s.handleSubscribeWS))(w, r, v)
+		return s.limitReadRequests(s.authorizeTopicRead(s.handleSubscribeWS))(w, r, v)
 	} else if r.Method == http.MethodGet && authPathRegex.MatchString(r.URL.Path) {
-		return s.limitRequests(s.authorizeTopicRead(s.handleTopicAuth))(w, r, v)
+		return s.limitReadRequests(s.authorizeTopicRead(s.handleTopicAuth))(w, r, v)
 	} else if r.Method == http.MethodGet && (topicPathRegex.MatchString(r.URL.Path) || externalTopicPathRegex.MatchString(r.URL.Path)) {
 		return s.ensureWebEnabled(s.handleTopic)(w, r, v)
 	}
@@ -677,6 +800,10 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 	if r.Method == http.MethodHead {
 		return nil
 	}
+	if err := v.AcquireDownload(); err != nil {
+		return errHTTPFromLimitError(err)
+	}
+	defer v.ReleaseDownload()
 	// Find message in database, and associate bandwidth to the uploader user
 	// This is an easy way to
 	//   - avoid abuse (e.g. 1 uploader, 1k downloaders)
@@ -709,8 +836,12 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 	} else if m.Sender.IsValid() {
 		bandwidthVisitor = s.visitor(m.Sender, nil)
 	}
-	if !bandwidthVisitor.BandwidthAllowed(stat.Size()) {
-		return errHTTPTooManyRequestsLimitAttachmentBandwidth.With(m)
+	throttled := false
+	if err := s.limiterFor(bandwidthVisitor).BandwidthAllowed(stat.Size()); err != nil {
+		if s.config.VisitorAttachmentBandwidthMode != VisitorAttachmentBandwidthModeThrottle {
+			return errHTTPFromLimitError(err).With(m)
+		}
+		throttled = true
 	}
 	// Actually send file
 	f, err := os.Open(file)
@@ -721,7 +852,12 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 	if m.Attachment.Name != "" {
 		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(m.Attachment.Name))
 	}
-	_, err = io.Copy(util.NewContentTypeWriter(w, r.URL.Path), f)
+	var reader io.Reader = f
+	if throttled {
+		logvr(v, r).With(m).Tag(tagFileCache).Debug("Bandwidth limit reached, serving attachment at reduced rate")
+		reader = bandwidthVisitor.ThrottledReader(f)
+	}
+	_, err = io.Copy(util.NewContentTypeWriter(w, r.URL.Path), reader)
 	return err
 }
 
@@ -732,7 +868,31 @@ func (s *Server) handleMatrixDiscovery(w http.ResponseWriter) error {
 	return writeMatrixDiscoveryResponse(w)
 }
 
-func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, error) {
+// messageCost returns the number of messages a published message counts as towards the visitor's message limit.
+// If visitor-message-cost-size is set, large messages (or attachments) count as one message per x bytes.
+func (s *Server) messageCost(r *http.Request, body *util.PeekedReadCloser) int64 {
+	return s.messageCostForSize(publishBodySize(r, body))
+}
+
+func (s *Server) messageCostForSize(size int64) int64 {
+	if s.config.VisitorMessageCostSize <= 0 {
+		return 1
+	}
+	costSize := int64(s.config.VisitorMessageCostSize)
+	return util.Max((size+costSize-1)/costSize, 1)
+}
+
+// publishBodySize returns the size of the published request body. Attachments are not fully read at this point,
+// so their size is taken from the Content-Length header, if available.
+func publishBodySize(r *http.Request, body *util.PeekedReadCloser) int64 {
+	size := int64(len(body.PeekedBytes))
+	if body.LimitReached && r.ContentLength > size {
+		size = r.ContentLength // Attachment, the body has not been fully read yet
+	}
+	return size
+}
+
+func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (_ *message, err error) {
 	start := time.Now()
 	t, err := fromContext[*topic](r, contextTopic)
 	if err != nil {
@@ -757,17 +917,140 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 		// the subscription as invalid if any 400-499 code (except 429/408) is returned.
 		// See https://github.com/mastodon/mastodon/blob/730bb3e211a84a2f30e3e2bbeae3f77149824a68/app/workers/web/push_notification_worker.rb#L35-L46
 		return nil, errHTTPInsufficientStorageUnifiedPush.With(t)
-	} else if !util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.ip) && !vrate.MessageAllowed() {
-		return nil, errHTTPTooManyRequestsLimitMessages.With(t)
-	} else if email != "" && !vrate.EmailAllowed() {
-		return nil, errHTTPTooManyRequestsLimitEmails.With(t)
-	} else if call != "" {
+	}
+	cost := s.messageCost(r, body)
+	counted, _ := fromContext[bool](r, contextMessageCounted) // Already counted with the rest of the batch, see handlePublishBatch
+	if sender, err := fromContext[string](r, contextInboundEmailSender); err == nil && !v.RequestLimitExempt() {
+		if err := s.limiterFor(v).InboundEmailAllowed(sender); errors.Is(err, errInboundEmailLimitReached) {
+			minc(metricEmailsReceivedRateLimited)
+			return nil, errHTTPFromLimitError(err).With(t)
+		} else if err != nil {
+			return nil, errHTTPFromLimitError(err).With(t)
+		}
+	}
+	var hash string
+	if s.config.VisitorDedupWindow > 0 && !counted && !v.RequestLimitExempt() {
+		hash = messageHash(t.ID, m, body)
+		if previous := v.DuplicateMessage(hash); hash != "" && previous != nil {
+			if s.config.VisitorDedupMode == VisitorDedupModeDrop {
+				logvrm(v, r, previous).Tag(tagPublish).Debug("Dropping duplicate message")
+				return previous, nil
+			}
+			return nil, errHTTPConflictDuplicateMessage.With(t)
+		}
+	}
+	countMessage := !v.RequestLimitExempt() && vrate.ShouldCountMessage(t.ID)
+	checkInterval := countMessage && !counted
+	if checkInterval {
+		if err := v.MessageIntervalAllowed(); err != nil { // Publisher, not the rate visitor: this is about misbehaving clients
+			return nil, errHTTPFromLimitError(err).With(t)
+		}
+	}
+	countScheduled := countMessage && s.config.VisitorScheduledMessageMode == VisitorScheduledMessageModeDelivery && m.Time > time.Now().Unix()
+	if countScheduled {
+		if err := s.limiterFor(vrate).ScheduledMessageAllowed(); errors.Is(err, errAnonymousPublishDisabled) {
+			return nil, errHTTPForbiddenAnonymousPublishDisabled.With(t)
+		} else if err != nil {
+			return nil, errHTTPFromLimitError(err).With(t).WithLimit(vrate)
+		}
+		countMessage = false // Counted towards the daily message limit once it is delivered, see sendDelayedMessages
+	}
+	defer func() {
+		if err != nil && countScheduled {
+			vrate.RefundScheduledMessage()
+		}
+	}()
+	countGateway := countMessage && !counted && isGatewayMessage(r, unifiedpush)
+	if countGateway {
+		if err := s.limiterFor(vrate).GatewayMessageAllowed(); err != nil {
+			return nil, errHTTPFromLimitError(err).With(t).WithLimit(vrate)
+		}
+		if vrate.GatewayMessagesLimited() {
+			countMessage = false // Counted towards the gateway messages limit instead
+		}
+	}
+	defer func() {
+		if err != nil && countGateway {
+			vrate.RefundGatewayMessage()
+		}
+	}()
+	if countMessage && !counted {
+		if err := s.limiterFor(vrate).MessageAllowedN(cost); errors.Is(err, errAnonymousPublishDisabled) {
+			return nil, errHTTPForbiddenAnonymousPublishDisabled.With(t)
+		} else if err != nil {
+			if exceeded := vrate.ExceededLimits(); len(exceeded) > 0 {
+				return nil, errHTTPFromLimitError(err).Wrap("%s limits exceeded", strings.Join(exceeded, " and ")).With(t).WithLimit(vrate)
+			}
+			return nil, errHTTPFromLimitError(err).With(t).WithLimit(vrate)
+		}
+	}
+	defer func() {
+		if err != nil && countMessage && !counted {
+			vrate.RefundMessageN(cost) // Message was counted above, but never published
+		}
+	}()
+	countAttachment := countMessage && hasAttachment(m, body, template, unifiedpush)
+	if countAttachment {
+		if err := s.limiterFor(vrate).AttachmentMessageAllowed(); err != nil {
+			return nil, errHTTPFromLimitError(err).With(t).WithLimit(vrate)
+		}
+	}
+	defer func() {
+		if err != nil && countAttachment {
+			vrate.RefundAttachmentMessage()
+		}
+	}()
+	countUrgent := countMessage && m.Priority >= 5
+	if countUrgent {
+		if err := s.limiterFor(vrate).UrgentMessageAllowed(); err != nil {
+			return nil, errHTTPFromLimitError(err).With(t).WithLimit(vrate)
+		}
+	}
+	defer func() {
+		if err != nil && countUrgent {
+			vrate.RefundUrgentMessage()
+		}
+	}()
+	var ingress int64
+	if !v.RequestLimitExempt() {
+		ingress = publishBodySize(r, body)
+		if err := s.limiterFor(vrate).IngressAllowed(ingress); err != nil {
+			return nil, errHTTPFromLimitError(err).With(t).WithLimit(vrate)
+		}
+	}
+	defer func() {
+		if err != nil && ingress > 0 {
+			vrate.RefundIngress(ingress)
+		}
+	}()
+	newTopic := !v.RequestLimitExempt() && !vrate.KnownTopic(t.ID)
+	if !v.RequestLimitExempt() {
+		if err := s.limiterFor(vrate).NewTopicAllowed(t.ID); err != nil {
+			return nil, errHTTPFromLimitError(err).With(t).WithLimit(vrate)
+		}
+	}
+	defer func() {
+		if err != nil && newTopic {
+			vrate.RefundNewTopic(t.ID)
+		}
+	}()
+	if s.topicLimiter != nil && !v.RequestLimitExempt() && !s.topicLimiter.Allow(t.ID) {
+		return nil, errHTTPTooManyRequestsLimitTopicMessages.With(t)
+	}
+	if email != "" {
+		if err := s.limiterFor(vrate).EmailAllowed(); errors.Is(err, errEmailUnavailable) {
+			return nil, errHTTPServiceUnavailableEmail.With(t)
+		} else if err != nil {
+			return nil, errHTTPFromLimitError(err).With(t).WithLimit(vrate)
+		}
+	}
+	if call != "" {
 		var httpErr *errHTTP
 		call, httpErr = s.convertPhoneNumber(v.User(), call)
 		if httpErr != nil {
 			return nil, httpErr.With(t)
-		} else if !vrate.CallAllowed() {
-			return nil, errHTTPTooManyRequestsLimitCalls.With(t)
+		} else if !s.limiterFor(vrate).CallAllowed() {
+			return nil, errHTTPTooManyRequestsLimitCalls.With(t).WithLimit(vrate)
 		}
 	}
 	if m.PollID != "" {
@@ -775,6 +1058,9 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 	}
 	m.Sender = v.IP()
 	m.User = v.MaybeUserID()
+	if countScheduled {
+		m.RateVisitor = vrate.ID() // Charged for the message once it is delivered, see sendDelayedMessages
+	}
 	if cache {
 		m.Expires = time.Unix(m.Time, 0).Add(v.Limits().MessageExpiryDuration).Unix()
 	}
@@ -828,10 +1114,13 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 			return nil, err
 		}
 	}
-	u := v.User()
-	if s.userManager != nil && u != nil && u.Tier != nil {
-		go s.userManager.EnqueueUserStats(u.ID, v.Stats())
+	if hash != "" {
+		v.SetLastMessage(hash, m)
 	}
+	if checkInterval {
+		v.StartMessageInterval()
+	}
+	s.enqueueUserStats(v)
 	s.mu.Lock()
 	s.messages++
 	s.mu.Unlock()
@@ -842,16 +1131,142 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 	return m, nil
 }
 
+// messageHash returns a hash of the topic, title, body and priority of the given message, to detect duplicate
+// messages (see Config.VisitorDedupWindow). The body is the raw request body, i.e. before templates are applied.
+// Bodies beyond the message size limit (i.e. attachments) are only partially read, so they are never considered
+// duplicates, and an empty string is returned.
+func messageHash(topic string, m *message, body *util.PeekedReadCloser) string {
+	if body.LimitReached {
+		return ""
+	}
+	h := sha256.New()
+	for _, s := range []string{topic, m.Title, strconv.Itoa(m.Priority)} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	h.Write(body.PeekedBytes)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
 func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	if vrate, err := fromContext[*visitor](r, contextRateVisitor); err == nil {
+		w.Header().Set("X-RateLimit-Basis", string(vrate.Basis())) // Visitor whose limits apply, for client debugging
+	}
 	m, err := s.handlePublishInternal(r, v)
 	if err != nil {
 		minc(metricMessagesPublishedFailure)
 		return err
 	}
 	minc(metricMessagesPublishedSuccess)
+	if tenant := v.Tenant(); tenant != "" {
+		mincTenantMessagesPublished(tenant)
+	}
+	if vrate, err := fromContext[*visitor](r, contextRateVisitor); err == nil {
+		setRateLimitHeaders(w, vrate) // Refresh, now that the message was counted
+		if readBoolParam(r, false, "x-ratelimit-info") {
+			setRateLimitInfoHeaders(w, vrate)
+		}
+		if vrate.MessageSoftLimitWarning() {
+			logvr(vrate, r).Tag(tagPublish).Info("Visitor reached %d%% of the daily message limit", s.config.VisitorMessageSoftLimitPercent)
+			w.Header().Set("X-RateLimit-Warning", "true")
+		}
+	}
 	return s.writeJSON(w, m)
 }
 
+// handlePublishBatch publishes multiple messages (possibly to different topics) in one request. All messages are
+// checked up front (topic, access, size), and the message limit is checked once for the entire batch, so that either
+// all messages are counted or none (see visitor.MessagesAllowed). If "partial" is set, as many messages as the
+// message limit allows are published instead, and the rest is reported as rejected. The batch counts as one request
+// towards the request limit. Subscriber-based rate limiting does not apply to batches; all messages are counted
+// towards the publishing visitor's limits.
+//
+// If publishing one of the messages fails (e.g. because of an invalid delay), the messages before it remain
+// published, the remaining messages are not published (and not counted), and the error is returned.
+func (s *Server) handlePublishBatch(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiPublishBatchRequest](r.Body, s.config.MessageSizeLimit*2*publishBatchMessagesMax, false) // 2x to account for JSON format overhead
+	if err != nil {
+		return err
+	} else if len(req.Messages) == 0 || len(req.Messages) > publishBatchMessagesMax {
+		return errHTTPBadRequestPublishBatchInvalid
+	}
+	topics := make([]*topic, len(req.Messages))
+	for i, m := range req.Messages {
+		if !topicRegex.MatchString(m.Topic) {
+			return errHTTPBadRequestTopicInvalid
+		} else if len(m.Message) > s.config.MessageSizeLimit {
+			return errHTTPEntityTooLargeJSONBody
+		}
+		if topics[i], err = s.topicFromID(m.Topic); err != nil {
+			return err
+		}
+		if s.userManager != nil {
+			if err := s.userManager.Authorize(v.User(), m.Topic, user.PermissionWrite); err != nil {
+				logvr(v, r).With(topics[i]).Err(err).Debug("Access to topic %s not authorized", m.Topic)
+				return errHTTPForbidden.With(topics[i])
+			}
+		}
+	}
+	// Count the batch towards the message limit at once. Messages that are not counted right away (scheduled messages
+	// in "delivery" mode, exempt topics) have no cost here, and are handled like any other message in handlePublishInternal.
+	costs := make([]int64, len(req.Messages))
+	for i, m := range req.Messages {
+		scheduled := m.Delay != "" && s.config.VisitorScheduledMessageMode == VisitorScheduledMessageModeDelivery
+		if !v.RequestLimitExempt() && !scheduled && v.ShouldCountMessage(m.Topic) {
+			costs[i] = s.messageCostForSize(int64(len(m.Message)))
+		}
+	}
+	accepted := len(req.Messages)
+	if !v.RequestLimitExempt() {
+		if accepted, err = s.limiterFor(v).MessagesAllowed(costs, req.Partial); errors.Is(err, errAnonymousPublishDisabled) {
+			return errHTTPForbiddenAnonymousPublishDisabled
+		} else if err != nil {
+			minc(metricMessagesPublishedFailure)
+			return errHTTPFromLimitError(err)
+		}
+	}
+	messages := make([]*message, 0, accepted)
+	for i, m := range req.Messages[:accepted] {
+		mr := r.Clone(r.Context())
+		mr.Header = make(http.Header) // Only the JSON fields apply, not the headers or query params of the batch request
+		mr.URL.RawQuery = ""
+		if m.Message == "" {
+			m.Message = emptyMessageBody
+		}
+		mr = withContext(mr, map[contextKey]any{
+			contextRateVisitor:    v,
+			contextTopic:          topics[i],
+			contextMessageCounted: costs[i] > 0,
+		})
+		var published *message
+		if err = applyPublishMessage(mr, m); err == nil {
+			published, err = s.handlePublishInternal(mr, v)
+		}
+		if err != nil {
+			var refund int64
+			for _, cost := range costs[i:accepted] {
+				refund += cost
+			}
+			v.RefundMessageN(refund) // Counted above, but not published
+			minc(metricMessagesPublishedFailure)
+			return err
+		}
+		minc(metricMessagesPublishedSuccess)
+		if tenant := v.Tenant(); tenant != "" {
+			mincTenantMessagesPublished(tenant)
+		}
+		messages = append(messages, published)
+	}
+	setRateLimitHeaders(w, v)
+	if readBoolParam(r, false, "x-ratelimit-info") {
+		setRateLimitInfoHeaders(w, v)
+	}
+	return s.writeJSON(w, &apiPublishBatchResponse{
+		Messages: messages,
+		Rejected: len(req.Messages) - accepted,
+	})
+}
+
 func (s *Server) handlePublishMatrix(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	_, err := s.handlePublishInternal(r, v)
 	if err != nil {
@@ -879,7 +1294,10 @@ func (s *Server) handlePublishMatrix(w http.ResponseWriter, r *http.Request, v *
 
 func (s *Server) sendToFirebase(v *visitor, m *message) {
 	logvm(v, m).Tag(tagFirebase).Debug("Publishing to Firebase")
-	if err := s.firebaseClient.Send(v, m); err != nil {
+	if err := s.firebaseClient.Send(v, m); errors.Is(err, errFirebaseDisabledForTier) {
+		logvm(v, m).Tag(tagFirebase).Debug("Not publishing to Firebase: %v", err.Error())
+		return
+	} else if err != nil {
 		minc(metricFirebasePublishedFailure)
 		if errors.Is(err, errFirebaseTemporarilyBanned) {
 			logvm(v, m).Tag(tagFirebase).Err(err).Debug("Unable to publish to Firebase: %v", err.Error())
@@ -896,9 +1314,11 @@ func (s *Server) sendEmail(v *visitor, m *message, email string) {
 	if err := s.smtpSender.Send(v, m, email); err != nil {
 		logvm(v, m).Tag(tagEmail).Field("email", email).Err(err).Warn("Unable to send email to %s: %v", email, err.Error())
 		minc(metricEmailsPublishedFailure)
+		v.EmailSendFailed()
 		return
 	}
 	minc(metricEmailsPublishedSuccess)
+	v.EmailSendSucceeded()
 }
 
 func (s *Server) forwardPollRequest(v *visitor, m *message) {
@@ -1071,6 +1491,27 @@ func (s *Server) handlePublishBody(r *http.Request, v *visitor, m *message, body
 	return s.handleBodyAsAttachment(r, v, m, body) // Case 7
 }
 
+// isGatewayMessage returns true if the message was published via the UnifiedPush Matrix gateway, or by a UnifiedPush
+// app server (X-UnifiedPush header, or "up" query parameter), see GatewayMessageAllowed
+func isGatewayMessage(r *http.Request, unifiedpush bool) bool {
+	if unifiedpush {
+		return true
+	}
+	_, err := fromContext[string](r, contextMatrixPushKey)
+	return err == nil
+}
+
+// hasAttachment returns true if the message will carry an attachment, either an external URL (X-Attach), or
+// an uploaded file. This must match the cases in handlePublishBody that end up with an attachment.
+func hasAttachment(m *message, body *util.PeekedReadCloser, template, unifiedpush bool) bool {
+	if m.Event == pollRequestEvent || unifiedpush {
+		return false
+	} else if m.Attachment != nil {
+		return true
+	}
+	return !template && (body.LimitReached || !utf8.Valid(body.PeekedBytes))
+}
+
 func (s *Server) handleBodyDiscard(body *util.PeekedReadCloser) error {
 	_, err := io.Copy(io.Discard, body)
 	_ = body.Close()
@@ -1139,26 +1580,48 @@ func replaceTemplate(tpl string, source string) (string, error) {
 	return buf.String(), nil
 }
 
+// parseAttachmentExpires reads the optional X-Attachment-Expires header, which lets the publisher shorten the
+// retention of an uploaded attachment. The visitor's attachment expiry duration is the ceiling; longer durations
+// are clamped to it rather than rejected.
+func parseAttachmentExpires(r *http.Request, maxDuration time.Duration) (time.Duration, *errHTTP) {
+	expiresStr := readParam(r, "x-attachment-expires", "attachment-expires")
+	if expiresStr == "" {
+		return maxDuration, nil
+	}
+	expires, err := util.ParseDuration(expiresStr)
+	if err != nil || expires <= 0 {
+		return 0, errHTTPBadRequestAttachmentExpiresInvalid
+	} else if maxDuration > 0 && expires > maxDuration {
+		return maxDuration, nil
+	}
+	return expires, nil
+}
+
 func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message, body *util.PeekedReadCloser) error {
 	if s.fileCache == nil || s.config.BaseURL == "" || s.config.AttachmentCacheDir == "" {
 		return errHTTPBadRequestAttachmentsDisallowed.With(m)
 	}
-	vinfo, err := v.Info()
-	if err != nil {
-		return err
+	attachmentExpiryDuration, e := parseAttachmentExpires(r, v.Limits().AttachmentExpiryDuration)
+	if e != nil {
+		return e.With(m)
 	}
-	attachmentExpiry := time.Now().Add(vinfo.Limits.AttachmentExpiryDuration).Unix()
+	attachmentExpiry := time.Now().Add(attachmentExpiryDuration).Unix()
 	if m.Time > attachmentExpiry {
 		return errHTTPBadRequestAttachmentsExpiryBeforeDelivery.With(m)
 	}
+	fileSizeLimit := v.AttachmentFileSizeLimit()
+	_, totalSizeRemaining, err := v.AttachmentTotalSizeUsage()
+	if err != nil {
+		return err
+	}
 	contentLengthStr := r.Header.Get("Content-Length")
 	if contentLengthStr != "" { // Early "do-not-trust" check, hard limit see below
 		contentLength, err := strconv.ParseInt(contentLengthStr, 10, 64)
-		if err == nil && (contentLength > vinfo.Stats.AttachmentTotalSizeRemaining || contentLength > vinfo.Limits.AttachmentFileSizeLimit) {
+		if err == nil && (contentLength > totalSizeRemaining || contentLength > fileSizeLimit) {
 			return errHTTPEntityTooLargeAttachment.With(m).Fields(log.Context{
 				"message_content_length":          contentLength,
-				"attachment_total_size_remaining": vinfo.Stats.AttachmentTotalSizeRemaining,
-				"attachment_file_size_limit":      vinfo.Limits.AttachmentFileSizeLimit,
+				"attachment_total_size_remaining": totalSizeRemaining,
+				"attachment_file_size_limit":      fileSizeLimit,
 			})
 		}
 	}
@@ -1177,8 +1640,8 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 	}
 	limiters := []util.Limiter{
 		v.BandwidthLimiter(),
-		util.NewFixedLimiter(vinfo.Limits.AttachmentFileSizeLimit),
-		util.NewFixedLimiter(vinfo.Stats.AttachmentTotalSizeRemaining),
+		util.NewFixedLimiter(fileSizeLimit),
+		util.NewFixedLimiter(totalSizeRemaining),
 	}
 	m.Attachment.Size, err = s.fileCache.Write(m.ID, body, limiters...)
 	if errors.Is(err, util.ErrLimitReached) {
@@ -1227,10 +1690,11 @@ func (s *Server) handleSubscribeRaw(w http.ResponseWriter, r *http.Request, v *v
 func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *visitor, contentType string, encoder messageEncoder) error {
 	logvr(v, r).Tag(tagSubscribe).Debug("HTTP stream connection opened")
 	defer logvr(v, r).Tag(tagSubscribe).Debug("HTTP stream connection closed")
-	if !v.SubscriptionAllowed() {
-		return errHTTPTooManyRequestsLimitSubscriptions
+	releaseSubscription, err := s.reserveSubscriptionSlot(r, v)
+	if err != nil {
+		return errHTTPFromLimitError(err)
 	}
-	defer v.RemoveSubscription()
+	defer releaseSubscription()
 	topics, topicsStr, err := s.topicsFromPath(r.URL.Path)
 	if err != nil {
 		return err
@@ -1317,14 +1781,56 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	}
 }
 
+// reserveSubscriptionSlot reserves a subscription slot for the visitor (see visitor.ReserveSubscriptionSlot). If the
+// subscription limit is reached, the OnSubscriptionLimitReached hook is called, outside the visitor lock. Subscriptions
+// to topics that the user owns do not take up a slot, see subscriptionTopicsOwned.
+func (s *Server) reserveSubscriptionSlot(r *http.Request, v *visitor) (release func(), err error) {
+	if s.subscriptionTopicsOwned(r, v) {
+		if err := s.limiterFor(v).OwnedSubscriptionAllowed(); err != nil {
+			return nil, err
+		}
+		return func() {}, nil // Nothing to release, see visitor.OwnedSubscriptionAllowed
+	}
+	release, err = s.limiterFor(v).ReserveSubscriptionSlot(readParam(r, "x-connection-id", "connection-id"))
+	if errors.Is(err, errSubscriptionLimitReached) && s.config.OnSubscriptionLimitReached != nil {
+		s.config.OnSubscriptionLimitReached(v.InfoLight())
+	}
+	return release, err
+}
+
+// subscriptionTopicsOwned returns true if all topics of the subscription request are reserved by the visitor's user
+// (see user.Manager.HasReservation), so that e.g. a dashboard subscribed to its own topics is not limited by the
+// subscription limit. Anonymous visitors do not own any topics.
+func (s *Server) subscriptionTopicsOwned(r *http.Request, v *visitor) bool {
+	u := v.User()
+	if s.userManager == nil || u == nil {
+		return false
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 2 {
+		return false
+	}
+	topicIDs := util.SplitNoEmpty(parts[1], ",")
+	if len(topicIDs) == 0 {
+		return false
+	}
+	for _, id := range topicIDs {
+		if owned, err := s.userManager.HasReservation(u.Name, id); err != nil || !owned {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	if strings.ToLower(r.Header.Get("Upgrade")) != "websocket" {
 		return errHTTPBadRequestWebSocketsUpgradeHeaderMissing
 	}
-	if !v.SubscriptionAllowed() {
-		return errHTTPTooManyRequestsLimitSubscriptions
+	releaseSubscription, err := s.reserveSubscriptionSlot(r, v)
+	if err != nil {
+		return errHTTPFromLimitError(err)
 	}
-	defer v.RemoveSubscription()
+	defer releaseSubscription()
 	logvr(v, r).Tag(tagWebsocket).Debug("WebSocket connection opened")
 	defer logvr(v, r).Tag(tagWebsocket).Debug("WebSocket connection closed")
 	topics, topicsStr, err := s.topicsFromPath(r.URL.Path)
@@ -1687,11 +2193,12 @@ func (s *Server) runManager() {
 	}
 }
 
-// runStatsResetter runs once a day (usually midnight UTC) to reset all the visitor's message and
-// email counters. The stats are used to display the counters in the web app, as well as for rate limiting.
+// runStatsResetter runs once a day (usually midnight UTC, or midnight in VisitorLimitResetTimezone in calendar
+// mode) to reset all the visitor's message and email counters. The stats are used to display the counters in the
+// web app, as well as for rate limiting.
 func (s *Server) runStatsResetter() {
 	for {
-		runAt := util.NextOccurrenceUTC(s.config.VisitorStatsResetTime, time.Now())
+		runAt := nextStatsReset(s.config, time.Now())
 		timer := time.NewTimer(time.Until(runAt))
 		log.Tag(tagResetter).Debug("Waiting until %v to reset visitor stats", runAt)
 		select {
@@ -1710,21 +2217,40 @@ func (s *Server) resetStats() {
 	log.Info("Resetting all visitor stats (daily task)")
 	s.mu.Lock()
 	defer s.mu.Unlock() // Includes the database query to avoid races with other processes
+	resetMonthly := time.Now().In(s.statsResetLocation()).Day() == 1
 	for _, v := range s.visitors {
-		v.ResetStats()
+		if s.config.VisitorLimitResetJitter == 0 {
+			v.ResetStats() // If jittered, visitors reset themselves, see visitor.Keepalive
+		}
+		if resetMonthly {
+			v.ResetMonthlyStats()
+		}
 	}
 	if s.userManager != nil {
 		if err := s.userManager.ResetStats(); err != nil {
 			log.Tag(tagResetter).Warn("Failed to write to database: %s", err.Error())
 		}
+		if resetMonthly {
+			if err := s.userManager.ResetMonthlyStats(); err != nil {
+				log.Tag(tagResetter).Warn("Failed to write to database: %s", err.Error())
+			}
+		}
+	}
+}
+
+// statsResetLocation returns the timezone in which the daily (and monthly) stats are reset
+func (s *Server) statsResetLocation() *time.Location {
+	if s.config.VisitorLimitResetMode == VisitorLimitResetModeCalendar {
+		return s.config.VisitorLimitResetTimezone
 	}
+	return time.UTC
 }
 
 func (s *Server) runFirebaseKeepaliver() {
 	if s.firebaseClient == nil {
 		return
 	}
-	v := newVisitor(s.config, s.messageCache, s.userManager, netip.IPv4Unspecified(), nil) // Background process, not a real visitor, uses IP 0.0.0.0
+	v := newVisitor(s.config, s.messageCache, s.userManager, nil, nil, nil, netip.IPv4Unspecified(), nil) // Background process, not a real visitor, uses IP 0.0.0.0
 	for {
 		select {
 		case <-time.After(s.config.FirebaseKeepaliveInterval):
@@ -1771,6 +2297,20 @@ func (s *Server) sendDelayedMessages() error {
 			}
 		}
 		v := s.visitor(m.Sender, u)
+		if vrate := s.scheduledRateVisitor(v, m); vrate != nil {
+			// Scheduled messages are counted when they are delivered (see handlePublishInternal), towards the same visitor
+			// that was charged when they were published. If they are not allowed (e.g. the limit is reached, or the visitor
+			// is paused), the message stays queued, and is delivered once the visitor is allowed to publish again (e.g. after
+			// the daily reset). The message is only counted if the peek succeeds, so that postponed messages do not count
+			// as limit hits over and over again.
+			if err := vrate.MessageAllowedPeek(); err != nil {
+				logvm(vrate, m).Err(err).Debug("Message not allowed, postponing delivery of scheduled message")
+				continue
+			} else if err := vrate.MessageAllowed(); err != nil {
+				logvm(vrate, m).Err(err).Debug("Message not allowed, postponing delivery of scheduled message")
+				continue
+			}
+		}
 		if err := s.sendDelayedMessage(v, m); err != nil {
 			logvm(v, m).Err(err).Warn("Error sending delayed message")
 		}
@@ -1778,6 +2318,25 @@ func (s *Server) sendDelayedMessages() error {
 	return nil
 }
 
+// scheduledRateVisitor returns the visitor that a scheduled message is counted towards when it is delivered (see
+// VisitorScheduledMessageModeDelivery), or nil if it is not counted. This is the rate visitor that was charged when
+// the message was published (e.g. the subscriber, see contextRateVisitor), or the sender if that one is gone.
+func (s *Server) scheduledRateVisitor(v *visitor, m *message) *visitor {
+	if s.config.VisitorScheduledMessageMode != VisitorScheduledMessageModeDelivery || m.RateVisitor == "" || v.RequestLimitExempt() {
+		return nil
+	}
+	s.mu.RLock()
+	vrate, ok := s.visitors[m.RateVisitor]
+	s.mu.RUnlock()
+	if !ok {
+		vrate = v
+	}
+	if !vrate.ShouldCountMessage(m.Topic) {
+		return nil
+	}
+	return vrate
+}
+
 func (s *Server) sendDelayedMessage(v *visitor, m *message) error {
 	logvm(v, m).Debug("Sending delayed message")
 	s.mu.RLock()
@@ -1785,7 +2344,8 @@ func (s *Server) sendDelayedMessage(v *visitor, m *message) error {
 	s.mu.RUnlock()
 	if ok {
 		go func() {
-			// We do not rate-limit messages here, since we've rate limited them in the PUT/POST handler
+			// We do not rate-limit messages here, since we've rate limited them in the PUT/POST handler,
+			// or in sendDelayedMessages (see VisitorScheduledMessageMode)
 			if err := t.Publish(v, m); err != nil {
 				logvm(v, m).Err(err).Warn("Unable to publish message")
 			}
@@ -1820,52 +2380,61 @@ func (s *Server) transformBodyJSON(next handleFunc) handleFunc {
 		if m.Message == "" {
 			m.Message = emptyMessageBody
 		}
-		r.URL.Path = "/" + m.Topic
-		r.Body = io.NopCloser(strings.NewReader(m.Message))
-		if m.Title != "" {
-			r.Header.Set("X-Title", m.Title)
-		}
-		if m.Priority != 0 {
-			r.Header.Set("X-Priority", fmt.Sprintf("%d", m.Priority))
-		}
-		if m.Tags != nil && len(m.Tags) > 0 {
-			r.Header.Set("X-Tags", strings.Join(m.Tags, ","))
-		}
-		if m.Attach != "" {
-			r.Header.Set("X-Attach", m.Attach)
-		}
-		if m.Filename != "" {
-			r.Header.Set("X-Filename", m.Filename)
-		}
-		if m.Click != "" {
-			r.Header.Set("X-Click", m.Click)
-		}
-		if m.Icon != "" {
-			r.Header.Set("X-Icon", m.Icon)
-		}
-		if m.Markdown {
-			r.Header.Set("X-Markdown", "yes")
-		}
-		if len(m.Actions) > 0 {
-			actionsStr, err := json.Marshal(m.Actions)
-			if err != nil {
-				return errHTTPBadRequestMessageJSONInvalid
-			}
-			r.Header.Set("X-Actions", string(actionsStr))
-		}
-		if m.Email != "" {
-			r.Header.Set("X-Email", m.Email)
-		}
-		if m.Delay != "" {
-			r.Header.Set("X-Delay", m.Delay)
-		}
-		if m.Call != "" {
-			r.Header.Set("X-Call", m.Call)
+		if err := applyPublishMessage(r, m); err != nil {
+			return err
 		}
 		return next(w, r, v)
 	}
 }
 
+// applyPublishMessage converts a JSON message (see publishMessage) to the request path, body and headers that
+// handlePublish expects, as if the message had been published via PUT/POST
+func applyPublishMessage(r *http.Request, m *publishMessage) error {
+	r.URL.Path = "/" + m.Topic
+	r.Body = io.NopCloser(strings.NewReader(m.Message))
+	if m.Title != "" {
+		r.Header.Set("X-Title", m.Title)
+	}
+	if m.Priority != 0 {
+		r.Header.Set("X-Priority", fmt.Sprintf("%d", m.Priority))
+	}
+	if m.Tags != nil && len(m.Tags) > 0 {
+		r.Header.Set("X-Tags", strings.Join(m.Tags, ","))
+	}
+	if m.Attach != "" {
+		r.Header.Set("X-Attach", m.Attach)
+	}
+	if m.Filename != "" {
+		r.Header.Set("X-Filename", m.Filename)
+	}
+	if m.Click != "" {
+		r.Header.Set("X-Click", m.Click)
+	}
+	if m.Icon != "" {
+		r.Header.Set("X-Icon", m.Icon)
+	}
+	if m.Markdown {
+		r.Header.Set("X-Markdown", "yes")
+	}
+	if len(m.Actions) > 0 {
+		actionsStr, err := json.Marshal(m.Actions)
+		if err != nil {
+			return errHTTPBadRequestMessageJSONInvalid
+		}
+		r.Header.Set("X-Actions", string(actionsStr))
+	}
+	if m.Email != "" {
+		r.Header.Set("X-Email", m.Email)
+	}
+	if m.Delay != "" {
+		r.Header.Set("X-Delay", m.Delay)
+	}
+	if m.Call != "" {
+		r.Header.Set("X-Call", m.Call)
+	}
+	return nil
+}
+
 func (s *Server) transformMatrixJSON(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
 		newRequest, err := newRequestFromMatrixJSON(r, s.config.BaseURL, s.config.MessageSizeLimit)
@@ -1937,7 +2506,7 @@ func (s *Server) maybeAuthenticate(r *http.Request) (*visitor, error) {
 		return vip, nil
 	}
 	// If we're trying to auth, check the rate limiter first
-	if !vip.AuthAllowed() {
+	if !s.limiterFor(vip).AuthAllowed() {
 		return vip, errHTTPTooManyRequestsLimitAuthFailure // Always return visitor, even when error occurs!
 	}
 	u, err := s.authenticate(r, header)
@@ -1947,6 +2516,7 @@ func (s *Server) maybeAuthenticate(r *http.Request) (*visitor, error) {
 		return vip, errHTTPUnauthorized // Always return visitor, even when error occurs!
 	}
 	// Authentication with user was successful
+	vip.AuthSucceeded()
 	return s.visitor(ip, u), nil
 }
 
@@ -2011,17 +2581,77 @@ func (s *Server) authenticateBearerAuth(r *http.Request, token string) (*user.Us
 func (s *Server) visitor(ip netip.Addr, user *user.User) *visitor {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	ip = visitorIP(s.config, ip)
 	id := visitorID(ip, user)
 	v, exists := s.visitors[id]
 	if !exists {
-		s.visitors[id] = newVisitor(s.config, s.messageCache, s.userManager, ip, user)
+		s.visitors[id] = newVisitor(s.visitorConfig, s.messageCache, s.userManager, s.limiterStore, s.billingLimiters, s.geoIP, ip, user)
+		mset(metricVisitors, len(s.visitors))
 		return s.visitors[id]
 	}
 	v.Keepalive()
 	v.SetUser(user) // Always update with the latest user, may be nil!
+	v.UpdateIP(ip)  // Users with their own limits are keyed by user, and may roam between networks
 	return v
 }
 
+// updateVisitorTier applies the given tier to the visitor of the given user, if the user has its own visitor
+// (see hasUserLimits). This is called after a tier change, so that new limits take effect without waiting for
+// the visitor to be expunged. Users without their own visitor get one with the new tier on their next request.
+func (s *Server) updateVisitorTier(u *user.User, tier *user.Tier) {
+	s.mu.Lock()
+	v, exists := s.visitors[visitorID(netip.IPv4Unspecified(), u)]
+	s.mu.Unlock()
+	if exists && v.MaybeUserID() == u.ID {
+		v.SetTier(tier)
+	}
+}
+
+// ReloadVisitorLimits changes the visitor limits at runtime, e.g. when the config file is reloaded via SIGHUP, without
+// dropping the visitors. The update function is called with a copy of the current visitor config, and may only change
+// the visitor limit options (see reloadVisitorLimits in cmd/serve.go). Visitors created afterward use the new config.
+// Existing visitors are switched over as well (see visitor.SetConfig), and their limiters are rebuilt right away if the
+// new VisitorLimitsReloadMode is "rebuild". All other options of the server's config are not affected.
+func (s *Server) ReloadVisitorLimits(update func(conf *Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conf := s.visitorConfig.clone()
+	update(conf)
+	s.visitorConfig = conf
+	rebuild := conf.VisitorLimitsReloadMode == VisitorLimitsReloadModeRebuild
+	for _, v := range s.visitors {
+		v.SetConfig(conf, rebuild)
+	}
+	log.Tag(tagManager).Info("Visitor limits reloaded, applied to %d visitor(s), limiters rebuilt: %t", len(s.visitors), rebuild)
+}
+
+// setRateLimitHeaders sets the X-RateLimit-* headers for the given visitor, see visitor.RateLimitHeaders
+func setRateLimitHeaders(w http.ResponseWriter, v *visitor) {
+	for name, value := range v.RateLimitHeaders() {
+		w.Header().Set(name, value)
+	}
+}
+
+// setRateLimitInfoHeaders sets the X-RateLimit-Messages-* headers for the given visitor. They are only set
+// if requested by the client (X-RateLimit-Info: true), see visitor.MessagesRemaining
+func setRateLimitInfoHeaders(w http.ResponseWriter, v *visitor) {
+	remaining, resetAt, ok := v.MessagesRemaining()
+	if !ok {
+		return
+	}
+	w.Header().Set("X-RateLimit-Messages-Remaining", strconv.FormatInt(remaining, 10))
+	w.Header().Set("X-RateLimit-Messages-Reset", strconv.FormatInt(resetAt.Unix(), 10))
+}
+
+// enqueueUserStats asynchronously persists the stats (and request limiter state) of the visitor's user,
+// if it is a user with its own limits (see hasUserLimits). Other users share the visitor of their IP address.
+func (s *Server) enqueueUserStats(v *visitor) {
+	u := v.User()
+	if s.userManager != nil && hasUserLimits(u) {
+		go s.userManager.EnqueueUserStats(u.ID, v.Stats())
+	}
+}
+
 func (s *Server) writeJSON(w http.ResponseWriter, v any) error {
 	return s.writeJSONWithContentType(w, v, "application/json")
 }
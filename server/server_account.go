@@ -18,6 +18,7 @@ const (
 )
 
 func (s *Server) handleAccountCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	var created bool
 	u := v.User()
 	if !u.IsAdmin() { // u may be nil, but that's fine
 		if !s.config.EnableSignup {
@@ -25,9 +26,15 @@ func (s *Server) handleAccountCreate(w http.ResponseWriter, r *http.Request, v *
 		} else if u != nil {
 			return errHTTPUnauthorized // Cannot create account from user context
 		}
-		if !v.AccountCreationAllowed() {
-			return errHTTPTooManyRequestsLimitAccountCreation
+		cancel, err := s.accountCreationAllowed(v)
+		if err != nil {
+			return errHTTPFromLimitError(err)
 		}
+		defer func() {
+			if !created {
+				cancel() // Give back the reserved account, see accountCreationLimiter.Reserve
+			}
+		}()
 	}
 	newAccount, err := readJSONWithLimit[apiAccountCreateRequest](r.Body, jsonBodyBytesLimit, false)
 	if err != nil {
@@ -43,42 +50,34 @@ func (s *Server) handleAccountCreate(w http.ResponseWriter, r *http.Request, v *
 		}
 		return err
 	}
-	v.AccountCreated()
+	created = true
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+// accountCreationAllowed checks the account creation limit, either for the visitor's subnet (if
+// VisitorAccountCreationLimitIPv4Prefix or VisitorAccountCreationLimitIPv6Prefix is set), or for the visitor itself.
+// Both count the account right away. The subnet limit gives it back if cancel is called, i.e. if the account was
+// not created after all.
+func (s *Server) accountCreationAllowed(v *visitor) (cancel func(), err error) {
+	if s.accountLimiter != nil {
+		cancel, ok := s.accountLimiter.Reserve(v.IP())
+		if !mallowed(visitorLimiterAccountCreation, ok) {
+			return nil, errAccountCreateLimitReached
+		}
+		return cancel, nil
+	}
+	return func() {}, s.limiterFor(v).AccountCreateAllowed()
+}
+
 func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	info, err := v.Info()
 	if err != nil {
 		return err
 	}
 	logvr(v, r).Tag(tagAccount).Fields(visitorExtendedInfoContext(info)).Debug("Retrieving account stats")
-	limits, stats := info.Limits, info.Stats
 	response := &apiAccountResponse{
-		Limits: &apiAccountLimits{
-			Basis:                    string(limits.Basis),
-			Messages:                 limits.MessageLimit,
-			MessagesExpiryDuration:   int64(limits.MessageExpiryDuration.Seconds()),
-			Emails:                   limits.EmailLimit,
-			Calls:                    limits.CallLimit,
-			Reservations:             limits.ReservationsLimit,
-			AttachmentTotalSize:      limits.AttachmentTotalSizeLimit,
-			AttachmentFileSize:       limits.AttachmentFileSizeLimit,
-			AttachmentExpiryDuration: int64(limits.AttachmentExpiryDuration.Seconds()),
-			AttachmentBandwidth:      limits.AttachmentBandwidthLimit,
-		},
-		Stats: &apiAccountStats{
-			Messages:                     stats.Messages,
-			MessagesRemaining:            stats.MessagesRemaining,
-			Emails:                       stats.Emails,
-			EmailsRemaining:              stats.EmailsRemaining,
-			Calls:                        stats.Calls,
-			CallsRemaining:               stats.CallsRemaining,
-			Reservations:                 stats.Reservations,
-			ReservationsRemaining:        stats.ReservationsRemaining,
-			AttachmentTotalSize:          stats.AttachmentTotalSize,
-			AttachmentTotalSizeRemaining: stats.AttachmentTotalSizeRemaining,
-		},
+		Limits: newAPIAccountLimits(info.Limits),
+		Stats:  newAPIAccountStats(info.Stats),
 	}
 	u := v.User()
 	if u != nil {
@@ -462,6 +461,7 @@ func (s *Server) handleAccountReservationAdd(w http.ResponseWriter, r *http.Requ
 	if err := s.userManager.AddReservation(u.Name, req.Topic, everyone); err != nil {
 		return err
 	}
+	v.InvalidateReservationsCache()
 	// Kill existing subscribers
 	t, err := s.topicFromID(req.Topic)
 	if err != nil {
@@ -499,6 +499,7 @@ func (s *Server) handleAccountReservationDelete(w http.ResponseWriter, r *http.R
 	if err := s.userManager.RemoveReservations(u.Name, topic); err != nil {
 		return err
 	}
+	v.InvalidateReservationsCache()
 	if deleteMessages {
 		if err := s.messageCache.ExpireMessages(topic); err != nil {
 			return err
@@ -527,6 +528,7 @@ func (s *Server) maybeRemoveMessagesAndExcessReservations(r *http.Request, v *vi
 	if err := s.userManager.RemoveReservations(u.Name, topics...); err != nil {
 		return err
 	}
+	v.InvalidateReservationsCache()
 	if err := s.messageCache.ExpireMessages(topics...); err != nil {
 		return err
 	}
@@ -630,3 +632,65 @@ func (s *Server) publishSyncEvent(v *visitor) error {
 	}
 	return nil
 }
+
+func newAPIAccountLimits(limits *visitorLimits) *apiAccountLimits {
+	var graceUntil int64
+	if !limits.GraceUntil.IsZero() {
+		graceUntil = limits.GraceUntil.Unix()
+	}
+	var boostExpires int64
+	if !limits.BoostExpires.IsZero() {
+		boostExpires = limits.BoostExpires.Unix()
+	}
+	return &apiAccountLimits{
+		Basis:                    string(limits.Basis),
+		Profile:                  limits.Profile,
+		Messages:                 limits.MessageLimit,
+		MessagesMonthly:          limits.MessageMonthlyLimit,
+		MessagesExpiryDuration:   int64(limits.MessageExpiryDuration.Seconds()),
+		Emails:                   limits.EmailLimit,
+		EmailsBurst:              int64(limits.EmailLimitBurst),
+		Calls:                    limits.CallLimit,
+		Reservations:             limits.ReservationsLimit,
+		Subscriptions:            limits.SubscriptionLimit,
+		AttachmentTotalSize:      limits.AttachmentTotalSizeLimit,
+		AttachmentFileSize:       limits.AttachmentFileSizeLimit,
+		AttachmentExpiryDuration: int64(limits.AttachmentExpiryDuration.Seconds()),
+		AttachmentBandwidth:      limits.AttachmentBandwidthLimit,
+		AttachmentMessages:       limits.AttachmentMessagesLimit,
+		GatewayMessages:          limits.GatewayMessagesLimit,
+		UrgentMessages:           limits.UrgentMessagesLimit,
+		GraceUntil:               graceUntil,
+		Boost:                    limits.BoostMultiplier,
+		BoostExpires:             boostExpires,
+	}
+}
+
+func newAPIAccountStats(stats *visitorStats) *apiAccountStats {
+	return &apiAccountStats{
+		Messages:                     stats.Messages,
+		MessagesRemaining:            stats.MessagesRemaining,
+		MessagesResetAt:              stats.MessagesResetAt,
+		MessagesMonthly:              stats.MessagesMonthly,
+		MessagesMonthlyRemaining:     stats.MessagesMonthlyRemaining,
+		Emails:                       stats.Emails,
+		EmailsRemaining:              stats.EmailsRemaining,
+		Calls:                        stats.Calls,
+		CallsRemaining:               stats.CallsRemaining,
+		Reservations:                 stats.Reservations,
+		ReservationsRemaining:        stats.ReservationsRemaining,
+		AttachmentTotalSize:          stats.AttachmentTotalSize,
+		AttachmentTotalSizeRemaining: stats.AttachmentTotalSizeRemaining,
+		AttachmentBandwidth:          stats.AttachmentBandwidth,
+		AttachmentBandwidthRemaining: stats.AttachmentBandwidthRemaining,
+		AttachmentBandwidthResetAt:   stats.AttachmentBandwidthResetAt,
+		AttachmentMessages:           stats.AttachmentMessages,
+		AttachmentMessagesRemaining:  stats.AttachmentMessagesRemaining,
+		GatewayMessages:              stats.GatewayMessages,
+		GatewayMessagesRemaining:     stats.GatewayMessagesRemaining,
+		UrgentMessages:               stats.UrgentMessages,
+		UrgentMessagesRemaining:      stats.UrgentMessagesRemaining,
+		RequestLimitTokens:           stats.RequestLimitTokens,
+		RequestLimitBurst:            stats.RequestLimitBurst,
+	}
+}
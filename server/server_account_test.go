@@ -7,9 +7,12 @@ import (
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
 	"io"
+	"net/http"
 	"net/netip"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -80,6 +83,66 @@ func TestAccount_Signup_LimitReached(t *testing.T) {
 	require.Equal(t, 42906, toHTTPError(t, rr.Body.String()).Code)
 }
 
+func TestAccount_Signup_LimitReached_Subnet(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.EnableSignup = true
+	conf.VisitorAccountCreationLimitIPv4Prefix = 24
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+
+	for i := 0; i < 3; i++ {
+		rr := request(t, s, "POST", "/v1/account", fmt.Sprintf(`{"username":"phil%d", "password":"mypass"}`, i), nil, func(r *http.Request) {
+			r.RemoteAddr = fmt.Sprintf("1.2.3.%d:1234", i+1)
+		})
+		require.Equal(t, 200, rr.Code)
+	}
+	rr := request(t, s, "POST", "/v1/account", `{"username":"thiswontwork", "password":"mypass"}`, nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.99:1234"
+	})
+	require.Equal(t, 429, rr.Code)
+	require.Equal(t, 42906, toHTTPError(t, rr.Body.String()).Code)
+
+	// Other subnets are not affected
+	rr = request(t, s, "POST", "/v1/account", `{"username":"otherphil", "password":"mypass"}`, nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.4.1:1234"
+	})
+	require.Equal(t, 200, rr.Code)
+}
+
+func TestAccount_Signup_LimitReached_Subnet_Concurrent(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.EnableSignup = true
+	conf.VisitorAccountCreationLimitBurst = 3
+	conf.VisitorAccountCreationLimitIPv4Prefix = 24
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+
+	// Failed signups do not count towards the limit
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	rr := request(t, s, "POST", "/v1/account", `{"username":"phil", "password":"mypass"}`, nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.1:1234"
+	})
+	require.Equal(t, 409, rr.Code)
+
+	// Concurrent signups cannot exceed the burst
+	var wg sync.WaitGroup
+	var created atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rr := request(t, s, "POST", "/v1/account", fmt.Sprintf(`{"username":"ben%d", "password":"mypass"}`, i), nil, func(r *http.Request) {
+				r.RemoteAddr = fmt.Sprintf("1.2.3.%d:1234", i+1)
+			})
+			if rr.Code == 200 {
+				created.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, int32(3), created.Load())
+}
+
 func TestAccount_Signup_AsUser(t *testing.T) {
 	conf := newTestConfigWithAuthFile(t)
 	conf.EnableSignup = true
@@ -145,8 +208,10 @@ func TestAccount_Get_Anonymous(t *testing.T) {
 	require.Equal(t, "ip", account.Limits.Basis)
 	require.Equal(t, int64(1004), account.Limits.Messages) // I hate this
 	require.Equal(t, int64(24), account.Limits.Emails)     // I hate this
+	require.Equal(t, int64(16), account.Limits.EmailsBurst)
 	require.Equal(t, int64(5123), account.Limits.AttachmentTotalSize)
 	require.Equal(t, int64(512), account.Limits.AttachmentFileSize)
+	require.Equal(t, int64(30), account.Limits.Subscriptions)
 	require.Equal(t, int64(0), account.Stats.Messages)
 	require.Equal(t, int64(1004), account.Stats.MessagesRemaining)
 	require.Equal(t, int64(0), account.Stats.Emails)
@@ -168,6 +233,47 @@ func TestAccount_Get_Anonymous(t *testing.T) {
 	require.Equal(t, int64(1002), account.Stats.MessagesRemaining)
 	require.Equal(t, int64(1), account.Stats.Emails)
 	require.Equal(t, int64(23), account.Stats.EmailsRemaining)
+	require.Equal(t, 60, account.Stats.RequestLimitBurst)
+	require.InDelta(t, 58, account.Stats.RequestLimitTokens, 0.5) // 2 publishes so far
+}
+
+func TestAccount_Get_AdminDefaultTier(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.DefaultAdminTier = "admin"
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:                     "admin",
+		ReservationLimit:         100,
+		MessageExpiryDuration:    48 * time.Hour,
+		AttachmentExpiryDuration: 72 * time.Hour,
+	}))
+	require.Nil(t, s.userManager.AddReservation("phil", "mytopic", user.PermissionDenyAll))
+
+	// Admin limits are sourced from the default admin tier
+	rr := request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Nil(t, account.Tier)
+	require.Equal(t, int64(100), account.Limits.Reservations)
+	require.Equal(t, int64(48*3600), account.Limits.MessagesExpiryDuration)
+	require.Equal(t, int64(72*3600), account.Limits.AttachmentExpiryDuration)
+	require.Equal(t, int64(1), account.Stats.Reservations)
+	require.Equal(t, int64(99), account.Stats.ReservationsRemaining)
+
+	// Regular users are not affected
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+	account, _ = util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, int64(0), account.Limits.Reservations)
+	require.Equal(t, int64(conf.CacheDuration.Seconds()), account.Limits.MessagesExpiryDuration)
 }
 
 func TestAccount_ChangeSettings(t *testing.T) {
@@ -583,6 +689,47 @@ func TestAccount_Reservation_AddRemoveUserWithTierSuccess(t *testing.T) {
 	require.Equal(t, "mytopic", account.Reservations[0].Topic)
 }
 
+func TestAccount_Reservation_CountIsCached(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.EnableReservations = true
+	s := newTestServer(t, conf)
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:             "pro",
+		ReservationLimit: 5,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+	reservations := func() int64 {
+		rr := request(t, s, "GET", "/v1/account", "", headers)
+		require.Equal(t, 200, rr.Code)
+		account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+		return account.Stats.Reservations
+	}
+	require.Equal(t, int64(0), reservations())
+
+	// Reservations added behind the server's back are only picked up after the cache expires
+	require.Nil(t, s.userManager.AddReservation("phil", "othertopic", user.PermissionDenyAll))
+	require.Equal(t, int64(0), reservations())
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	v := s.visitors[visitorID(netip.MustParseAddr("9.9.9.9"), u)]
+	v.mu.Lock()
+	v.reservationsCountAt = v.reservationsCountAt.Add(-visitorReservationsCountCacheDuration)
+	v.mu.Unlock()
+	require.Equal(t, int64(1), reservations())
+
+	// Reservations added and removed via the API invalidate the cache right away
+	rr := request(t, s, "POST", "/v1/account/reservation", `{"topic": "mytopic", "everyone":"deny-all"}`, headers)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, int64(2), reservations())
+	rr = request(t, s, "DELETE", "/v1/account/reservation/mytopic", "", headers)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, int64(1), reservations())
+}
+
 func TestAccount_Reservation_PublishByAnonymousFails(t *testing.T) {
 	conf := newTestConfigWithAuthFile(t)
 	conf.AuthDefault = user.PermissionReadWrite
@@ -1,9 +1,20 @@
 package server
 
 import (
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"heckel.io/ntfy/v2/user"
 	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// adminVisitorsDefaultLimit is the default number of visitors returned by GET /v1/admin/visitors
+	adminVisitorsDefaultLimit = 100
 )
 
 func (s *Server) handleUsersGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -93,6 +104,146 @@ func (s *Server) handleUsersDelete(w http.ResponseWriter, r *http.Request, v *vi
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+// handleUsersResetLimits resets the daily limits of the given user, see visitor.ResetLimits. If the user has a billing
+// account, the shared message pool is not reset, since that would reset the messages of all members of the account.
+func (s *Server) handleUsersResetLimits(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := apiUsersResetLimitsRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	u, err := s.userManager.User(matches[1])
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	}
+	visitors := s.userVisitors(u)
+	for _, uv := range visitors {
+		uv.ResetLimits()
+	}
+	info, err := visitors[0].Info()
+	if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagAccount).Fields(visitorExtendedInfoContext(info)).Info("Admin reset limits of user %s", u.Name)
+	return s.writeJSON(w, &apiUserResetLimitsResponse{
+		Username: u.Name,
+		Limits:   newAPIAccountLimits(info.Limits),
+		Stats:    newAPIAccountStats(info.Stats),
+	})
+}
+
+// handleUsersPause pauses (PUT) or unpauses (DELETE) the given user, see visitor.SetPaused. The state is persisted
+// to the user record, and applied to the user's in-memory visitors right away.
+func (s *Server) handleUsersPause(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := apiUsersPauseRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	u, err := s.userManager.User(matches[1])
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	}
+	paused := r.Method == http.MethodPut
+	var until time.Time
+	if paused {
+		req, err := readJSONWithLimit[apiUserPauseRequest](r.Body, jsonBodyBytesLimit, true)
+		if err != nil {
+			return err
+		} else if req.Until != 0 {
+			until = time.Unix(req.Until, 0)
+			if !until.After(time.Now()) {
+				return errHTTPBadRequestPausedUntilInvalid
+			}
+		}
+	}
+	if err := s.userManager.ChangePaused(u.Name, paused, until); err != nil {
+		return err
+	}
+	for _, uv := range s.userVisitors(u) {
+		uv.SetPaused(paused, until)
+	}
+	response := &apiUserPauseResponse{
+		Username: u.Name,
+		Paused:   paused,
+	}
+	if !until.IsZero() {
+		response.PausedUntil = until.Unix()
+	}
+	if paused && !until.IsZero() {
+		logvr(v, r).Tag(tagAccount).Info("Admin paused user %s until %s", u.Name, until.String())
+	} else if paused {
+		logvr(v, r).Tag(tagAccount).Info("Admin paused user %s until unpaused", u.Name)
+	} else {
+		logvr(v, r).Tag(tagAccount).Info("Admin unpaused user %s", u.Name)
+	}
+	return s.writeJSON(w, response)
+}
+
+// userVisitors returns the in-memory visitors of the given user. Users without a tier are identified by
+// IP address, so there may be more than one. If the user has no active visitor, a visitor is created
+// (but not registered), so that the user's persisted stats can still be reset.
+func (s *Server) userVisitors(u *user.User) []*visitor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	visitors := make([]*visitor, 0)
+	for _, v := range s.visitors {
+		if v.MaybeUserID() == u.ID {
+			visitors = append(visitors, v)
+		}
+	}
+	if len(visitors) == 0 {
+		visitors = append(visitors, newVisitor(s.visitorConfig, s.messageCache, s.userManager, s.limiterStore, s.billingLimiters, s.geoIP, netip.IPv4Unspecified(), u))
+	}
+	return visitors
+}
+
+// handleUsersBoost grants (PUT) or removes (DELETE) a temporary limit boost of a user, e.g. a day of double
+// message and email limits as a promo or apology. The boost applies to the user's visitors right away.
+func (s *Server) handleUsersBoost(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := apiUsersBoostRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	u, err := s.userManager.User(matches[1])
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	}
+	var multiplier float64
+	var expires time.Time
+	if r.Method == http.MethodPut {
+		req, err := readJSONWithLimit[apiUserBoostRequest](r.Body, jsonBodyBytesLimit, false)
+		if err != nil {
+			return err
+		}
+		multiplier, expires = req.Multiplier, time.Unix(req.Expires, 0)
+		if multiplier <= 1 || !expires.After(time.Now()) {
+			return errHTTPBadRequestBoostInvalid
+		}
+	}
+	if err := s.userManager.ChangeBoost(u.Name, multiplier, expires); err != nil {
+		return err
+	}
+	for _, uv := range s.userVisitors(u) {
+		uv.SetBoost(multiplier, expires)
+	}
+	response := &apiUserBoostResponse{
+		Username: u.Name,
+	}
+	if multiplier > 0 {
+		response.Boost = multiplier
+		response.BoostExpires = expires.Unix()
+		logvr(v, r).Tag(tagAccount).Info("Admin boosted limits of user %s by %.1fx until %s", u.Name, multiplier, expires.String())
+	} else {
+		logvr(v, r).Tag(tagAccount).Info("Admin removed limit boost of user %s", u.Name)
+	}
+	return s.writeJSON(w, response)
+}
+
 func (s *Server) handleAccessAllow(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	req, err := readJSONWithLimit[apiAccessAllowRequest](r.Body, jsonBodyBytesLimit, false)
 	if err != nil {
@@ -142,3 +293,269 @@ func (s *Server) killUserSubscriber(u *user.User, topicPattern string) error {
 	}
 	return nil
 }
+
+func (s *Server) handleAdminAnonymousPublishGet(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	return s.writeJSON(w, &apiAdminAnonymousPublishResponse{
+		Disabled: s.config.AnonymousPublishDisabled.Load(),
+	})
+}
+
+func (s *Server) handleAdminAnonymousPublishChange(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAdminAnonymousPublishRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	s.config.AnonymousPublishDisabled.Store(req.Disabled)
+	logvr(v, r).Tag(tagAccount).Info("Admin changed anonymous publishing to disabled=%t", req.Disabled)
+	return s.writeJSON(w, &apiAdminAnonymousPublishResponse{
+		Disabled: req.Disabled,
+	})
+}
+
+// handleAdminVisitorsGet returns a snapshot of the rate limiting state of all visitors that are currently in memory.
+// The list is sorted by visitor ID, and can be paged through via the "limit" and "offset" query parameters. If
+// "sort=requests" is set, it is sorted by request volume instead (heaviest first, see Config.VisitorRequestStats),
+// so that "limit" returns the top N visitors. If "anonymize" is set, IP addresses and usernames are replaced by a hash.
+func (s *Server) handleAdminVisitorsGet(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	limit, offset := adminVisitorsDefaultLimit, 0
+	var err error
+	if limitStr := readQueryParam(r, "limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return errHTTPBadRequest.Wrap("invalid limit parameter")
+		}
+	}
+	if offsetStr := readQueryParam(r, "offset"); offsetStr != "" {
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return errHTTPBadRequest.Wrap("invalid offset parameter")
+		}
+	}
+	sortBy := readQueryParam(r, "sort")
+	if sortBy != "" && sortBy != "id" && sortBy != "requests" {
+		return errHTTPBadRequest.Wrap("invalid sort parameter, must be 'id' or 'requests'")
+	}
+	anonymize := readBoolParam(r, false, "anonymize")
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.visitors))
+	for id := range s.visitors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	visitors := make([]*visitor, len(ids))
+	for i, id := range ids {
+		visitors[i] = s.visitors[id]
+	}
+	s.mu.RUnlock()
+	snapshots := make([]*visitorSnapshot, 0, limit)
+	if sortBy == "requests" {
+		all := make([]*visitorSnapshot, len(visitors))
+		for i, v := range visitors {
+			all[i] = v.Snapshot()
+		}
+		sort.SliceStable(all, func(i, j int) bool {
+			return all[i].Requests > all[j].Requests // Ties stay sorted by ID
+		})
+		for i := offset; i < len(all) && len(snapshots) < limit; i++ {
+			snapshots = append(snapshots, all[i])
+		}
+	} else {
+		for i := offset; i < len(visitors) && len(snapshots) < limit; i++ {
+			snapshots = append(snapshots, visitors[i].Snapshot())
+		}
+	}
+	response := make([]*apiAdminVisitorResponse, len(snapshots))
+	for i, snapshot := range snapshots {
+		ip, username := snapshot.IP.String(), snapshot.User
+		if anonymize {
+			ip = anonymizeValue(ip)
+			if username != "" {
+				username = anonymizeValue(username)
+			}
+		}
+		response[i] = &apiAdminVisitorResponse{
+			IP:            ip,
+			User:          username,
+			Basis:         string(snapshot.Basis),
+			Messages:      snapshot.Messages,
+			Emails:        snapshot.Emails,
+			Subscriptions: snapshot.Subscriptions,
+			Stale:         snapshot.Stale,
+			Tenant:        snapshot.Tenant,
+			Requests:      snapshot.Requests,
+			RequestTimeMs: float64(snapshot.RequestTime.Microseconds()) / 1000,
+		}
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleAdminTenantsGet returns the daily messages and emails of all visitors in memory, summed up by tenant (see
+// visitor.Tenant), sorted by tenant. Visitors without a tenant are not included. Users of the same billing account
+// share one messages counter, so it is only counted once per tenant.
+func (s *Server) handleAdminTenantsGet(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	s.mu.RLock()
+	visitors := make([]*visitor, 0, len(s.visitors))
+	for _, v := range s.visitors {
+		visitors = append(visitors, v)
+	}
+	s.mu.RUnlock()
+	tenants := make(map[string]*apiAdminTenantResponse)
+	for _, v := range visitors {
+		snapshot := v.Snapshot()
+		if snapshot.Tenant == "" {
+			continue
+		}
+		t, ok := tenants[snapshot.Tenant]
+		if !ok {
+			t = &apiAdminTenantResponse{Tenant: snapshot.Tenant}
+			tenants[snapshot.Tenant] = t
+		}
+		t.Visitors++
+		t.Emails += snapshot.Emails
+		if snapshot.Shared {
+			if snapshot.Messages > t.Messages {
+				t.Messages = snapshot.Messages
+			}
+		} else {
+			t.Messages += snapshot.Messages
+		}
+	}
+	response := make([]*apiAdminTenantResponse, 0, len(tenants))
+	for _, t := range tenants {
+		response = append(response, t)
+	}
+	sort.Slice(response, func(i, j int) bool {
+		return response[i].Tenant < response[j].Tenant
+	})
+	return s.writeJSON(w, response)
+}
+
+// handleAdminFirebasePenaltyDelete lifts the Firebase penalty (see visitor.FirebaseTemporarilyDeny) of all visitors
+// in memory, or of a single visitor, identified by IP address or username. This lets operators restore Firebase
+// forwarding right away after the underlying quota issue was resolved, instead of waiting for the penalties to expire.
+func (s *Server) handleAdminFirebasePenaltyDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	var visitors []*visitor
+	if matches := apiAdminFirebasePenaltyRegex.FindStringSubmatch(r.URL.Path); len(matches) == 2 {
+		if ip, err := netip.ParseAddr(matches[1]); err == nil {
+			s.mu.RLock()
+			if lv, ok := s.visitors[visitorID(visitorIP(s.config, ip), nil)]; ok {
+				visitors = append(visitors, lv)
+			}
+			s.mu.RUnlock()
+		} else {
+			u, err := s.userManager.User(matches[1])
+			if errors.Is(err, user.ErrUserNotFound) {
+				return errHTTPBadRequestUserNotFound
+			} else if err != nil {
+				return err
+			}
+			visitors = s.userVisitors(u)
+		}
+	} else {
+		s.mu.RLock()
+		for _, lv := range s.visitors {
+			visitors = append(visitors, lv)
+		}
+		s.mu.RUnlock()
+	}
+	cleared := 0
+	for _, lv := range visitors {
+		if lv.ClearFirebasePenalty() {
+			cleared++
+		}
+	}
+	logvr(v, r).Tag(tagFirebase).Info("Admin cleared Firebase penalty of %d visitor(s)", cleared)
+	return s.writeJSON(w, &apiAdminFirebasePenaltyResponse{
+		Cleared: cleared,
+	})
+}
+
+// handleAdminLimitsGet returns the limits and the live usage of all limiters of a single visitor, identified by
+// IP address or username. If the visitor is not in memory, it is constructed from the user's persisted stats
+// (or with fresh limiters for an IP address), but not registered.
+func (s *Server) handleAdminLimitsGet(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	matches := apiAdminLimitsRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	var lv *visitor
+	if ip, err := netip.ParseAddr(matches[1]); err == nil {
+		ip = visitorIP(s.config, ip)
+		s.mu.RLock()
+		lv = s.visitors[visitorID(ip, nil)]
+		conf := s.visitorConfig
+		s.mu.RUnlock()
+		if lv == nil {
+			lv = newVisitor(conf, s.messageCache, s.userManager, s.limiterStore, s.billingLimiters, s.geoIP, ip, nil)
+		}
+	} else {
+		u, err := s.userManager.User(matches[1])
+		if errors.Is(err, user.ErrUserNotFound) {
+			return errHTTPBadRequestUserNotFound
+		} else if err != nil {
+			return err
+		}
+		lv = s.userVisitors(u)[0]
+	}
+	s.mu.RLock()
+	live := s.visitors[visitorID(lv.Snapshot().IP, lv.User())] == lv
+	s.mu.RUnlock()
+	return s.writeAdminLimits(w, lv, live)
+}
+
+// handleAdminLimitsExplainGet returns the limits and limiters a user experiences, as constructed from the user's
+// persisted stats. Unlike handleAdminLimitsGet, it never looks at (or touches) the user's real visitor, and the
+// constructed visitor does not persist anything, so this is safe to call at any time.
+func (s *Server) handleAdminLimitsExplainGet(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	matches := apiAdminLimitsExplainRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	u, err := s.userManager.User(matches[1])
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	conf := s.visitorConfig
+	s.mu.RUnlock()
+	ev := newVisitorNoPersist(conf, s.messageCache, s.userManager, s.geoIP, netip.IPv4Unspecified(), u)
+	return s.writeAdminLimits(w, ev, false)
+}
+
+func (s *Server) writeAdminLimits(w http.ResponseWriter, lv *visitor, live bool) error {
+	info, err := lv.Info()
+	if err != nil {
+		return err
+	}
+	snapshot := lv.Snapshot()
+	limiters := make(map[string]*apiAdminLimiterState)
+	for name, state := range lv.LimiterStates() {
+		limiters[name] = &apiAdminLimiterState{
+			Value:     state.Value,
+			Remaining: state.Remaining,
+			Tokens:    state.Tokens,
+			Burst:     state.Burst,
+			Rate:      state.Rate,
+		}
+	}
+	return s.writeJSON(w, &apiAdminLimitsResponse{
+		Visitor:  visitorID(snapshot.IP, lv.User()),
+		IP:       snapshot.IP.String(),
+		User:     snapshot.User,
+		Basis:    string(snapshot.Basis),
+		Live:     live,
+		Created:  info.Created,
+		LastSeen: info.LastSeen,
+		Limits:   newAPIAccountLimits(info.Limits),
+		Stats:    newAPIAccountStats(info.Stats),
+		Limiters: limiters,
+	})
+}
+
+// anonymizeValue returns a short, stable hash of the given value, so that visitors can be told apart without
+// revealing their IP address or username
+func anonymizeValue(value string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(value)))[:16]
+}
@@ -1,9 +1,14 @@
 package server
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
+	"io"
+	"net/http"
+	"net/netip"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -179,3 +184,548 @@ func TestAccess_AllowReset_KillConnection(t *testing.T) {
 		return timeTaken.Load() >= 500
 	})
 }
+
+func TestUser_ResetLimits(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	// Create admin, user with tier
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:         "tier1",
+		MessageLimit: 2,
+		EmailLimit:   1,
+	}))
+	require.Nil(t, s.userManager.ChangeTier("ben", "tier1"))
+
+	// Exhaust message limit
+	for i := 0; i < 2; i++ {
+		rr := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 200, rr.Code)
+	}
+	rr := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 429, rr.Code)
+
+	// Non-admin cannot reset limits
+	rr = request(t, s, "POST", "/v1/users/ben/reset-limits", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Unknown user
+	rr = request(t, s, "POST", "/v1/users/nobody/reset-limits", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40031, toHTTPError(t, rr.Body.String()).Code)
+
+	// Admin resets limits
+	rr = request(t, s, "POST", "/v1/users/ben/reset-limits", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	resp, err := util.UnmarshalJSON[apiUserResetLimitsResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, "ben", resp.Username)
+	require.Equal(t, int64(2), resp.Limits.Messages)
+	require.Equal(t, int64(0), resp.Stats.Messages)
+	require.Equal(t, int64(2), resp.Stats.MessagesRemaining)
+
+	// Publishing works again
+	rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+}
+
+func TestUser_Pause(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "tier1", MessageLimit: 10}))
+	require.Nil(t, s.userManager.ChangeTier("ben", "tier1"))
+	rr := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Non-admin cannot pause
+	rr = request(t, s, "PUT", "/v1/users/ben/pause", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Until must be in the future
+	rr = request(t, s, "PUT", "/v1/users/ben/pause", `{"until":1000}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40048, toHTTPError(t, rr.Body.String()).Code)
+
+	// Admin pauses user
+	until := time.Now().Add(time.Hour).Unix()
+	rr = request(t, s, "PUT", "/v1/users/ben/pause", fmt.Sprintf(`{"until":%d}`, until), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	resp, err := util.UnmarshalJSON[apiUserPauseResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.True(t, resp.Paused)
+	require.Equal(t, until, resp.PausedUntil)
+
+	rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40303, toHTTPError(t, rr.Body.String()).Code)
+
+	// Survives expunge of the visitor
+	s.mu.Lock()
+	s.visitors = make(map[string]*visitor)
+	s.mu.Unlock()
+	rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 403, rr.Code)
+
+	// Admin unpauses user
+	rr = request(t, s, "DELETE", "/v1/users/ben/pause", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+}
+
+func TestUser_Boost(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "tier1", MessageLimit: 2}))
+	require.Nil(t, s.userManager.ChangeTier("ben", "tier1"))
+	for i := 0; i < 2; i++ {
+		rr := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 200, rr.Code)
+	}
+	rr := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 429, rr.Code)
+
+	// Non-admin cannot boost
+	rr = request(t, s, "PUT", "/v1/users/ben/boost", `{"multiplier":2,"expires":4000000000}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Multiplier must be greater than 1, and expires must be in the future
+	rr = request(t, s, "PUT", "/v1/users/ben/boost", `{"multiplier":1,"expires":4000000000}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40050, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "PUT", "/v1/users/ben/boost", `{"multiplier":2,"expires":1000}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+
+	// Admin boosts user, the boost applies right away and keeps the messages sent so far
+	expires := time.Now().Add(24 * time.Hour).Unix()
+	rr = request(t, s, "PUT", "/v1/users/ben/boost", fmt.Sprintf(`{"multiplier":2,"expires":%d}`, expires), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	resp, err := util.UnmarshalJSON[apiUserBoostResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 2.0, resp.Boost)
+	require.Equal(t, expires, resp.BoostExpires)
+
+	for i := 0; i < 2; i++ {
+		rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 200, rr.Code)
+	}
+	rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 429, rr.Code)
+
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+	account, err := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, int64(4), account.Limits.Messages)
+	require.Equal(t, 2.0, account.Limits.Boost)
+	require.Equal(t, expires, account.Limits.BoostExpires)
+
+	// Admin removes boost
+	rr = request(t, s, "DELETE", "/v1/users/ben/boost", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	u, err := s.userManager.User("ben")
+	require.Nil(t, err)
+	require.False(t, u.IsBoosted(time.Now()))
+	require.Equal(t, int64(2), s.userVisitors(u)[0].Limits().MessageLimit)
+}
+
+func TestAdmin_AnonymousPublishDisabled(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "mytopic", user.PermissionReadWrite))
+
+	rr := request(t, s, "PUT", "/mytopic", "anonymous", nil)
+	require.Equal(t, 200, rr.Code)
+
+	// Non-admin cannot toggle
+	rr = request(t, s, "PUT", "/v1/admin/anonymous-publish", `{"disabled": true}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Admin disables anonymous publishing
+	rr = request(t, s, "PUT", "/v1/admin/anonymous-publish", `{"disabled": true}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/v1/admin/anonymous-publish", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	resp, err := util.UnmarshalJSON[apiAdminAnonymousPublishResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.True(t, resp.Disabled)
+
+	rr = request(t, s, "PUT", "/mytopic", "anonymous", nil)
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40302, toHTTPError(t, rr.Body.String()).Code)
+
+	// Authenticated users are unaffected
+	rr = request(t, s, "PUT", "/mytopic", "ben", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Enable again
+	rr = request(t, s, "PUT", "/v1/admin/anonymous-publish", `{"disabled": false}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "anonymous", nil)
+	require.Equal(t, 200, rr.Code)
+}
+
+func TestAdmin_VisitorsGet(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "mytopic", user.PermissionReadWrite))
+
+	rr := request(t, s, "PUT", "/mytopic", "anonymous", nil)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "anonymous", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4:1234"
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Non-admin cannot list visitors
+	rr = request(t, s, "GET", "/v1/admin/visitors", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Admin lists visitors, sorted by ID
+	rr = request(t, s, "GET", "/v1/admin/visitors", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	visitors, err := util.UnmarshalJSON[[]*apiAdminVisitorResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Len(t, *visitors, 2)
+	require.Equal(t, "1.2.3.4", (*visitors)[0].IP)
+	require.Equal(t, "ip", (*visitors)[0].Basis)
+	require.Equal(t, int64(1), (*visitors)[0].Messages)
+	require.False(t, (*visitors)[0].Stale)
+	require.Equal(t, "9.9.9.9", (*visitors)[1].IP)
+
+	// Paging and anonymization
+	rr = request(t, s, "GET", "/v1/admin/visitors?limit=1&offset=1&anonymize=true", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	visitors, err = util.UnmarshalJSON[[]*apiAdminVisitorResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Len(t, *visitors, 1)
+	require.Equal(t, anonymizeValue("9.9.9.9"), (*visitors)[0].IP)
+	require.NotContains(t, (*visitors)[0].IP, "9.9.9.9")
+
+	// Invalid limit
+	rr = request(t, s, "GET", "/v1/admin/visitors?limit=abc", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+}
+
+func TestAdmin_VisitorsGet_SortByRequests(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.VisitorRequestStats = true
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "mytopic", user.PermissionReadWrite))
+	for i := 0; i < 3; i++ {
+		rr := request(t, s, "PUT", "/mytopic", "heavy", nil, func(r *http.Request) {
+			r.RemoteAddr = "1.2.3.4:1234"
+		})
+		require.Equal(t, 200, rr.Code)
+	}
+	rr := request(t, s, "PUT", "/mytopic", "light", nil)
+	require.Equal(t, 200, rr.Code)
+
+	// Top visitor by request volume
+	rr = request(t, s, "GET", "/v1/admin/visitors?sort=requests&limit=1", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	visitors, err := util.UnmarshalJSON[[]*apiAdminVisitorResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Len(t, *visitors, 1)
+	require.Equal(t, "1.2.3.4", (*visitors)[0].IP)
+	require.Equal(t, int64(3), (*visitors)[0].Requests)
+	require.Greater(t, (*visitors)[0].RequestTimeMs, 0.0)
+
+	// Invalid sort
+	rr = request(t, s, "GET", "/v1/admin/visitors?sort=abc", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+}
+
+func TestAdmin_TenantsGet(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.VisitorTenantHeader = "X-Tenant"
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("marian", "marian", user.RoleUser))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro", MessageLimit: 100}))
+	require.Nil(t, s.userManager.ChangeTier("ben", "pro"))
+	require.Nil(t, s.userManager.ChangeTier("marian", "pro"))
+	require.Nil(t, s.userManager.ChangeBillingAccount("ben", "team-a"))
+	require.Nil(t, s.userManager.ChangeBillingAccount("marian", "team-a"))
+	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "mytopic", user.PermissionReadWrite))
+
+	// Users of a billing account share a messages counter, anonymous visitors are tagged via the header
+	for _, username := range []string{"ben", "marian"} {
+		rr := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+			"Authorization": util.BasicAuth(username, username),
+		})
+		require.Equal(t, 200, rr.Code)
+	}
+	for _, ip := range []string{"1.2.3.4", "5.6.7.8"} {
+		rr := request(t, s, "PUT", "/mytopic", "hi", map[string]string{"X-Tenant": "team-b"}, func(r *http.Request) {
+			r.RemoteAddr = ip + ":1234"
+		})
+		require.Equal(t, 200, rr.Code)
+	}
+	rr := request(t, s, "PUT", "/mytopic", "no tenant", nil)
+	require.Equal(t, 200, rr.Code)
+
+	// Non-admin cannot list tenants
+	rr = request(t, s, "GET", "/v1/admin/tenants", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	rr = request(t, s, "GET", "/v1/admin/tenants", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	tenants, err := util.UnmarshalJSON[[]*apiAdminTenantResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Len(t, *tenants, 2)
+	require.Equal(t, &apiAdminTenantResponse{Tenant: "team-a", Visitors: 2, Messages: 2}, (*tenants)[0])
+	require.Equal(t, &apiAdminTenantResponse{Tenant: "team-b", Visitors: 2, Messages: 2}, (*tenants)[1])
+}
+
+func TestAdmin_FirebasePenaltyDelete(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	v1 := s.visitor(netip.MustParseAddr("1.2.3.4"), nil)
+	v2 := s.visitor(netip.MustParseAddr("5.6.7.8"), nil)
+	v1.FirebaseTemporarilyDeny()
+	v2.FirebaseTemporarilyDeny()
+	require.Equal(t, errVisitorLimitReached, v1.FirebaseAllowed())
+
+	// Non-admin cannot clear penalties
+	rr := request(t, s, "DELETE", "/v1/admin/firebase-penalty", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Single visitor, by IP address
+	rr = request(t, s, "DELETE", "/v1/admin/firebase-penalty/1.2.3.4", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, `{"cleared":1}`+"\n", rr.Body.String())
+	require.Nil(t, v1.FirebaseAllowed())
+	require.Equal(t, 0, v1.infoLightNoLock().Stats.FirebasePenaltyCount)
+	require.Equal(t, errVisitorLimitReached, v2.FirebaseAllowed())
+
+	// All visitors
+	rr = request(t, s, "DELETE", "/v1/admin/firebase-penalty", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, `{"cleared":1}`+"\n", rr.Body.String())
+	require.Nil(t, v2.FirebaseAllowed())
+
+	// Unknown user
+	rr = request(t, s, "DELETE", "/v1/admin/firebase-penalty/doesnotexist", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+}
+
+func TestAdmin_LimitsGet(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.VisitorMessageDailyLimit = 10
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro", MessageLimit: 100, EmailLimit: 5}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("lisa", "lisa", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("lisa", "pro"))
+	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "mytopic", user.PermissionReadWrite))
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "anonymous", nil).Code)
+
+	// Non-admin cannot see limits
+	rr := request(t, s, "GET", "/v1/admin/limits/9.9.9.9", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Live IP visitor
+	rr = request(t, s, "GET", "/v1/admin/limits/9.9.9.9", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	limits, err := util.UnmarshalJSON[apiAdminLimitsResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, "ip:9.9.9.9", limits.Visitor)
+	require.Equal(t, "ip", limits.Basis)
+	require.True(t, limits.Live)
+	require.NotZero(t, limits.Created)
+	require.GreaterOrEqual(t, limits.LastSeen, limits.Created)
+	require.Equal(t, int64(10), limits.Limits.Messages)
+	require.Equal(t, int64(1), limits.Stats.Messages)
+	require.Equal(t, int64(1), limits.Limiters[visitorLimiterMessages].Value)
+	require.Equal(t, int64(9), limits.Limiters[visitorLimiterMessages].Remaining)
+	require.Equal(t, conf.VisitorRequestLimitBurst, limits.Limiters[visitorLimiterRequest].Burst)
+	require.NotNil(t, limits.Limiters[visitorLimiterAuth])
+
+	// User that is not in memory is constructed on demand
+	rr = request(t, s, "GET", "/v1/admin/limits/lisa", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	limits, err = util.UnmarshalJSON[apiAdminLimitsResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, "lisa", limits.User)
+	require.Equal(t, "tier", limits.Basis)
+	require.False(t, limits.Live)
+	require.Equal(t, int64(100), limits.Limits.Messages)
+	require.Equal(t, int64(5), limits.Limits.Emails)
+	require.Nil(t, limits.Limiters[visitorLimiterAuth])
+
+	// Unknown user
+	rr = request(t, s, "GET", "/v1/admin/limits/unknown", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+}
+
+func TestAdmin_LimitsExplainGet(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro", MessageLimit: 100, EmailLimit: 5}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("lisa", "lisa", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("lisa", "pro"))
+	require.Nil(t, s.userManager.AllowAccess("lisa", "mytopic", user.PermissionReadWrite))
+	for i := 0; i < 3; i++ {
+		rr := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+			"Authorization": util.BasicAuth("lisa", "lisa"),
+		})
+		require.Equal(t, 200, rr.Code)
+	}
+	u, err := s.userManager.User("lisa")
+	require.Nil(t, err)
+	lv := s.userVisitors(u)[0]
+	tokens := lv.LimiterStates()[visitorLimiterRequest].Tokens
+
+	// Non-admin cannot explain limits
+	rr := request(t, s, "GET", "/v1/admin/limits/lisa/explain", "", map[string]string{
+		"Authorization": util.BasicAuth("lisa", "lisa"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Limits are constructed from the persisted stats, not from the live visitor
+	rr = request(t, s, "GET", "/v1/admin/limits/lisa/explain", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	limits, err := util.UnmarshalJSON[apiAdminLimitsResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, "lisa", limits.User)
+	require.Equal(t, "tier", limits.Basis)
+	require.False(t, limits.Live)
+	require.Equal(t, int64(100), limits.Limits.Messages)
+	require.Equal(t, int64(0), limits.Stats.Messages)
+	require.Equal(t, int64(100), limits.Limiters[visitorLimiterMessages].Remaining)
+	require.Equal(t, conf.VisitorRequestLimitBurst, limits.Limiters[visitorLimiterRequest].Burst)
+	require.InDelta(t, float64(rate.Every(conf.VisitorRequestLimitReplenish)), limits.Limiters[visitorLimiterRequest].Rate, 0.0001)
+
+	// The real visitor is not affected
+	require.Same(t, lv, s.userVisitors(u)[0])
+	require.Equal(t, int64(3), lv.Stats().Messages)
+	require.InDelta(t, tokens, lv.LimiterStates()[visitorLimiterRequest].Tokens, 1)
+
+	// Unknown user
+	rr = request(t, s, "GET", "/v1/admin/limits/unknown/explain", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+}
@@ -38,7 +38,9 @@ func newFirebaseClient(sender firebaseSender, auther user.Auther) *firebaseClien
 }
 
 func (c *firebaseClient) Send(v *visitor, m *message) error {
-	if !v.FirebaseAllowed() {
+	if err := v.FirebaseAllowed(); errors.Is(err, errFirebaseDisabledForTier) {
+		return err
+	} else if err != nil {
 		return errFirebaseTemporarilyBanned
 	}
 	fbm, err := toFirebaseMessage(m, c.auther)
@@ -56,6 +58,8 @@ func (c *firebaseClient) Send(v *visitor, m *message) error {
 			Err(err).
 			Warn("Firebase quota exceeded (likely for topic), temporarily denying Firebase access to visitor")
 		v.FirebaseTemporarilyDeny()
+	} else if err == nil {
+		v.IncrFirebase()
 	}
 	return err
 }
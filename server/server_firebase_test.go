@@ -9,6 +9,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"firebase.google.com/go/v4/messaging"
 	"github.com/stretchr/testify/require"
@@ -328,7 +329,7 @@ func TestMaybeTruncateFCMMessage_NotTooLong(t *testing.T) {
 func TestToFirebaseSender_Abuse(t *testing.T) {
 	sender := &testFirebaseSender{allowed: 2}
 	client := newFirebaseClient(sender, &testAuther{})
-	visitor := newVisitor(newTestConfig(t), newMemTestCache(t), nil, netip.MustParseAddr("1.2.3.4"), nil)
+	visitor := newVisitor(newTestConfig(t), newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
 
 	require.Nil(t, client.Send(visitor, &message{Topic: "mytopic"}))
 	require.Equal(t, 1, len(sender.Messages()))
@@ -343,3 +344,87 @@ func TestToFirebaseSender_Abuse(t *testing.T) {
 	require.Equal(t, errFirebaseTemporarilyBanned, client.Send(visitor, &message{Topic: "mytopic"}))
 	require.Equal(t, 0, len(sender.Messages()))
 }
+
+func TestToFirebaseSender_Abuse_ExponentialPenalty(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.FirebaseQuotaExceededPenaltyDuration = 20 * time.Minute
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+
+	// Penalty doubles with every consecutive denial, and is capped
+	for _, expected := range []time.Duration{20 * time.Minute, 40 * time.Minute, time.Hour, time.Hour} {
+		v.FirebaseTemporarilyDeny()
+		require.Equal(t, errVisitorLimitReached, v.FirebaseAllowed())
+		require.Equal(t, expected, v.firebasePenalty)
+		require.InDelta(t, expected.Seconds(), v.infoLightNoLock().Stats.FirebaseBackoff.Seconds(), 1)
+	}
+	require.Equal(t, 4, v.infoLightNoLock().Stats.FirebasePenaltyCount)
+
+	// A full penalty window without denial resets the penalty
+	v.firebase = time.Now().Add(-2 * time.Hour)
+	require.Nil(t, v.FirebaseAllowed())
+	require.Equal(t, 0, v.infoLightNoLock().Stats.FirebasePenaltyCount)
+	require.Equal(t, time.Duration(0), v.infoLightNoLock().Stats.FirebaseBackoff)
+	v.FirebaseTemporarilyDeny()
+	require.Equal(t, 20*time.Minute, v.firebasePenalty)
+}
+
+func TestToFirebaseSender_VisitorFirebaseLimit(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorFirebaseLimitBurst = 3
+	conf.VisitorFirebaseLimitReplenish = time.Hour
+	sender := newTestFirebaseSender(10)
+	client := newFirebaseClient(sender, &testAuther{Allow: true})
+	v1 := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	v2 := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("5.6.7.8"), nil)
+
+	// Noisy visitor uses up its share, other visitor is not affected
+	for i := 0; i < 3; i++ {
+		require.Nil(t, client.Send(v1, &message{Topic: "mytopic"}))
+	}
+	require.Equal(t, errFirebaseTemporarilyBanned, client.Send(v1, &message{Topic: "mytopic"}))
+	require.Nil(t, client.Send(v2, &message{Topic: "mytopic"}))
+	require.Equal(t, 4, len(sender.Messages()))
+}
+
+func TestToFirebaseSender_VisitorFirebaseDailyLimit(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorFirebaseDailyLimit = 2
+	sender := newTestFirebaseSender(10)
+	client := newFirebaseClient(sender, &testAuther{Allow: true})
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+
+	// Only successful sends are counted
+	require.Nil(t, client.Send(v, &message{Topic: "mytopic"}))
+	require.Nil(t, client.Send(v, &message{Topic: "mytopic"}))
+	require.Equal(t, errFirebaseLimitReached, v.FirebaseAllowed())
+	require.Equal(t, errFirebaseTemporarilyBanned, client.Send(v, &message{Topic: "mytopic"}))
+	require.Equal(t, 2, len(sender.Messages()))
+	stats := v.infoLightNoLock().Stats
+	require.Equal(t, int64(2), v.infoLightNoLock().Limits.FirebaseLimit)
+	require.Equal(t, int64(2), stats.Firebase)
+	require.Equal(t, int64(0), stats.FirebaseRemaining)
+	require.Equal(t, int64(2), v.Stats().Firebase)
+
+	// Counter is reset daily
+	v.ResetStats()
+	require.Nil(t, v.FirebaseAllowed())
+	v.IncrFirebase()
+	require.Equal(t, int64(1), v.infoLightNoLock().Stats.FirebaseRemaining)
+}
+
+func TestToFirebaseSender_TierFirebaseDisabled(t *testing.T) {
+	conf := newTestConfig(t)
+	sender := newTestFirebaseSender(10)
+	client := newFirebaseClient(sender, &testAuther{Allow: true})
+	u := &user.User{ID: "u_123", Name: "phil", Tier: &user.Tier{Code: "privacy", FirebaseDisabled: true}, Stats: &user.Stats{}, Billing: &user.Billing{}}
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), u)
+	require.True(t, v.Limits().FirebaseDisabled)
+	require.Equal(t, errFirebaseDisabledForTier, client.Send(v, &message{Topic: "mytopic"}))
+	require.Equal(t, 0, len(sender.Messages()))
+
+	// Anonymous visitors are not affected
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.False(t, v.Limits().FirebaseDisabled)
+	require.Nil(t, client.Send(v, &message{Topic: "mytopic"}))
+	require.Equal(t, 1, len(sender.Messages()))
+}
@@ -4,6 +4,7 @@ import (
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/util"
 	"strings"
+	"time"
 )
 
 func (s *Server) execManager() {
@@ -12,9 +13,13 @@ func (s *Server) execManager() {
 
 	// Prune all the things
 	s.pruneVisitors()
+	s.pruneTopicLimiters()
+	s.pruneAccountLimiters()
+	s.pruneBillingLimiters()
 	s.pruneTokens()
 	s.pruneAttachments()
 	s.pruneMessages()
+	s.pruneVisitorStats()
 	s.pruneAndNotifyWebPushSubscriptions()
 
 	// Message count per topic
@@ -113,18 +118,80 @@ func (s *Server) pruneVisitors() {
 		Timing(func() {
 			s.mu.Lock()
 			defer s.mu.Unlock()
+			overLimit := make(map[string]int) // Limiter -> number of visitors over that limit
 			for ip, v := range s.visitors {
 				if v.Stale() {
-					log.Tag(tagManager).With(v).Trace("Deleting stale visitor")
+					if s.config.VisitorExpungeLog {
+						log.Tag(tagManager).Fields(v.LogFields()).Info("Deleting stale visitor")
+					} else {
+						log.Tag(tagManager).With(v).Trace("Deleting stale visitor")
+					}
+					v.Close()
 					delete(s.visitors, ip)
 					staleVisitors++
+				} else {
+					for _, limiter := range v.ExceededLimits() {
+						overLimit[limiter]++
+					}
 				}
 			}
+			mset(metricVisitors, len(s.visitors))
+			msetVisitorsOverLimit(overLimit)
 		}).
 		Field("stale_visitors", staleVisitors).
 		Debug("Deleted %d stale visitor(s)", staleVisitors)
 }
 
+func (s *Server) pruneTopicLimiters() {
+	if s.topicLimiter == nil {
+		return
+	}
+	pruned := s.topicLimiter.Prune()
+	log.
+		Tag(tagManager).
+		Field("stale_topic_limiters", pruned).
+		Debug("Deleted %d idle topic limiter(s)", pruned)
+}
+
+func (s *Server) pruneAccountLimiters() {
+	if s.accountLimiter == nil {
+		return
+	}
+	pruned := s.accountLimiter.Prune()
+	log.
+		Tag(tagManager).
+		Field("stale_account_limiters", pruned).
+		Debug("Deleted %d idle account creation limiter(s)", pruned)
+}
+
+func (s *Server) pruneBillingLimiters() {
+	if s.billingLimiters == nil {
+		return
+	}
+	s.mu.RLock()
+	active := make(map[string]bool)
+	for _, v := range s.visitors {
+		if account := v.BillingAccount(); account != "" {
+			active[account] = true
+		}
+	}
+	s.mu.RUnlock()
+	pruned := s.billingLimiters.Prune(active)
+	log.
+		Tag(tagManager).
+		Field("stale_billing_limiters", pruned).
+		Debug("Deleted %d idle billing account limiter(s)", pruned)
+}
+
+func (s *Server) pruneVisitorStats() {
+	if !s.config.VisitorEmailLimitPersist {
+		return
+	}
+	if err := s.messageCache.DeleteExpiredVisitorStats(lastStatsReset(s.config, time.Now())); err != nil {
+		log.Tag(tagManager).Err(err).Warn("Error deleting expired visitor stats")
+	}
+}
+
 func (s *Server) pruneTokens() {
 	if s.userManager != nil {
 		log.
@@ -1,8 +1,12 @@
 package server
 
 import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
+	"net/http"
 	"testing"
+	"time"
 )
 
 func TestServer_Manager_Prune_Messages_Without_Attachments_DoesNotPanic(t *testing.T) {
@@ -26,3 +30,26 @@ func TestServer_Manager_Prune_Messages_Without_Attachments_DoesNotPanic(t *testi
 	_, err := s.messageCache.Message(m.ID)
 	require.Equal(t, errMessageNotFound, err)
 }
+
+func TestServer_Manager_Prune_Visitors_Metrics(t *testing.T) {
+	metricVisitors = prometheus.NewGauge(prometheus.GaugeOpts{Name: "ntfy_visitors_total"})
+	metricVisitorsOverLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ntfy_visitors_over_limit"}, []string{"limiter"})
+	defer func() { metricVisitors, metricVisitorsOverLimit = nil, nil }()
+
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 1
+	s := newTestServer(t, c)
+
+	// Two visitors, one of which is over the message limit
+	require.Equal(t, 200, request(t, s, "POST", "/mytopic", "hi", nil).Code)
+	require.Equal(t, 200, request(t, s, "POST", "/mytopic", "hi", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4:1234"
+	}).Code)
+	require.Equal(t, float64(2), testutil.ToFloat64(metricVisitors))
+
+	s.visitors["ip:1.2.3.4"].seen = time.Now().Add(-25 * time.Hour)
+	s.pruneVisitors()
+	require.Equal(t, float64(1), testutil.ToFloat64(metricVisitors))
+	require.Equal(t, float64(1), testutil.ToFloat64(metricVisitorsOverLimit.WithLabelValues(visitorLimiterMessages)))
+	require.Equal(t, float64(0), testutil.ToFloat64(metricVisitorsOverLimit.WithLabelValues(visitorLimiterEmails)))
+}
@@ -15,6 +15,7 @@ var (
 	metricEmailsPublishedFailure       prometheus.Counter
 	metricEmailsReceivedSuccess        prometheus.Counter
 	metricEmailsReceivedFailure        prometheus.Counter
+	metricEmailsReceivedRateLimited    prometheus.Counter
 	metricCallsMadeSuccess             prometheus.Counter
 	metricCallsMadeFailure             prometheus.Counter
 	metricUnifiedPushPublishedSuccess  prometheus.Counter
@@ -26,6 +27,9 @@ var (
 	metricTopics                       prometheus.Gauge
 	metricUsers                        prometheus.Gauge
 	metricHTTPRequests                 *prometheus.CounterVec
+	metricVisitorLimitsExceeded        *prometheus.CounterVec
+	metricVisitorsOverLimit            *prometheus.GaugeVec
+	metricTenantMessagesPublished      *prometheus.CounterVec
 )
 
 func initMetrics() {
@@ -59,6 +63,9 @@ func initMetrics() {
 	metricEmailsReceivedFailure = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "ntfy_emails_received_failure",
 	})
+	metricEmailsReceivedRateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_emails_received_rate_limited",
+	})
 	metricCallsMadeSuccess = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "ntfy_calls_made_success",
 	})
@@ -92,6 +99,21 @@ func initMetrics() {
 	metricHTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "ntfy_http_requests_total",
 	}, []string{"http_code", "ntfy_code", "http_method"})
+	metricVisitorLimitsExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntfy_visitor_limits_exceeded_total",
+	}, []string{"limiter"})
+	for _, limiter := range visitorLimiters {
+		metricVisitorLimitsExceeded.WithLabelValues(limiter) // Initialize to zero, so all series exist
+	}
+	metricTenantMessagesPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntfy_tenant_messages_published_total",
+	}, []string{"tenant"})
+	metricVisitorsOverLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntfy_visitors_over_limit",
+	}, []string{"limiter"})
+	for _, limiter := range visitorLimiters {
+		metricVisitorsOverLimit.WithLabelValues(limiter)
+	}
 	prometheus.MustRegister(
 		metricMessagesPublishedSuccess,
 		metricMessagesPublishedFailure,
@@ -103,6 +125,7 @@ func initMetrics() {
 		metricEmailsPublishedFailure,
 		metricEmailsReceivedSuccess,
 		metricEmailsReceivedFailure,
+		metricEmailsReceivedRateLimited,
 		metricCallsMadeSuccess,
 		metricCallsMadeFailure,
 		metricUnifiedPushPublishedSuccess,
@@ -114,6 +137,9 @@ func initMetrics() {
 		metricSubscribers,
 		metricTopics,
 		metricHTTPRequests,
+		metricVisitorLimitsExceeded,
+		metricVisitorsOverLimit,
+		metricTenantMessagesPublished,
 	)
 }
 
@@ -130,3 +156,30 @@ func mset[T int | int64 | float64](gauge prometheus.Gauge, value T) {
 		gauge.Set(float64(value))
 	}
 }
+
+// msetVisitorsOverLimit sets the over-limit gauge for every limiter, given the number of visitors that are currently
+// over each limit (see visitor.ExceededLimits). Limiters that are not in the map are set to zero.
+func msetVisitorsOverLimit(counts map[string]int) {
+	if metricVisitorsOverLimit == nil {
+		return
+	}
+	for _, limiter := range visitorLimiters {
+		metricVisitorsOverLimit.WithLabelValues(limiter).Set(float64(counts[limiter]))
+	}
+}
+
+// mincTenantMessagesPublished increments the published messages counter of the given tenant, see visitor.Tenant
+func mincTenantMessagesPublished(tenant string) {
+	if metricTenantMessagesPublished != nil {
+		metricTenantMessagesPublished.WithLabelValues(tenant).Inc()
+	}
+}
+
+// mallowed increments the limits exceeded counter for the given limiter if the request was
+// not allowed. It returns the allowed value, so it can wrap the limiter call directly.
+func mallowed(limiter string, allowed bool) bool {
+	if !allowed && metricVisitorLimitsExceeded != nil {
+		metricVisitorLimitsExceeded.WithLabelValues(limiter).Inc()
+	}
+	return allowed
+}
@@ -1,9 +1,10 @@
 package server
 
 import (
+	"math"
 	"net/http"
-
-	"heckel.io/ntfy/v2/util"
+	"strconv"
+	"time"
 )
 
 type contextKey int
@@ -12,13 +13,32 @@ const (
 	contextRateVisitor contextKey = iota + 2586
 	contextTopic
 	contextMatrixPushKey
+	contextMessageCounted
+	contextInboundEmailSender
 )
 
 func (s *Server) limitRequests(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		if util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.ip) {
+		if v.RequestLimitExempt() {
+			return next(w, r, v)
+		} else if delay, err := s.limiterFor(v).RequestAllowedWithDelay(); err != nil {
+			s.enqueueUserStats(v) // Persist request limiter state, so it survives a restart
+			setRetryAfterHeader(w, delay)
+			return errHTTPFromLimitError(err)
+		}
+		return next(w, r, v)
+	}
+}
+
+// limitReadRequests limits read requests (e.g. subscribing, polling) using the visitor's read request limiter,
+// which falls back to the regular request limiter if no separate read request limit is configured
+func (s *Server) limitReadRequests(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if v.RequestLimitExempt() {
 			return next(w, r, v)
-		} else if !v.RequestAllowed() {
+		} else if v.Paused() {
+			return errHTTPForbiddenVisitorPaused
+		} else if !s.limiterFor(v).ReadRequestAllowed() {
 			return errHTTPTooManyRequestsLimitRequests
 		}
 		return next(w, r, v)
@@ -40,15 +60,29 @@ func (s *Server) limitRequestsWithTopic(next handleFunc) handleFunc {
 			contextRateVisitor: vrate,
 			contextTopic:       t,
 		})
-		if util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.ip) {
+		if v.RequestLimitExempt() {
 			return next(w, r, v)
-		} else if !vrate.RequestAllowed() {
-			return errHTTPTooManyRequestsLimitRequests
+		} else if s.config.VisitorRequestMaxWait > 0 && readParam(r, "x-backpressure", "backpressure") == "wait" {
+			if err := vrate.RequestWait(r.Context()); err != nil {
+				s.enqueueUserStats(vrate) // Persist request limiter state, so it survives a restart
+				return errHTTPFromLimitError(err).WithLimit(vrate)
+			}
+		} else if delay, err := s.limiterFor(vrate).RequestAllowedWithDelay(); err != nil {
+			s.enqueueUserStats(vrate) // Persist request limiter state, so it survives a restart
+			setRetryAfterHeader(w, delay)
+			return errHTTPFromLimitError(err).WithLimit(vrate)
 		}
 		return next(w, r, v)
 	}
 }
 
+// setRetryAfterHeader sets the Retry-After header (in seconds, rounded up), if the delay is known
+func setRetryAfterHeader(w http.ResponseWriter, delay time.Duration) {
+	if delay > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	}
+}
+
 func (s *Server) ensureWebEnabled(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
 		if s.config.WebRoot == "" {
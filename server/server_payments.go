@@ -448,6 +448,7 @@ func (s *Server) updateSubscriptionAndTier(r *http.Request, v *visitor, u *user.
 		if err := s.userManager.ResetTier(u.Name); err != nil {
 			return err
 		}
+		s.updateVisitorTier(u, nil)
 	} else if tier != nil && u.TierID() != tier.ID {
 		logvr(v, r).
 			Tag(tagStripe).
@@ -459,6 +460,7 @@ func (s *Server) updateSubscriptionAndTier(r *http.Request, v *visitor, u *user.
 		if err := s.userManager.ChangeTier(u.Name, tier.Code); err != nil {
 			return err
 		}
+		s.updateVisitorTier(u, tier)
 	}
 	// Update billing fields
 	billing := &user.Billing{
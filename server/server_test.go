@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
 	"heckel.io/ntfy/v2/user"
@@ -16,6 +17,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -23,6 +25,8 @@ import (
 	"time"
 
 	"github.com/SherClockHolmes/webpush-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/util"
@@ -407,6 +411,197 @@ func TestServer_PublishAt(t *testing.T) {
 	require.Equal(t, "9.9.9.9", messages[0].Sender.String()) // It's stored in the DB though!
 }
 
+func TestServer_SubscribeLimitReachedHook(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorSubscriptionLimit = 1
+	var infos []*visitorInfo
+	var mu sync.Mutex
+	c.OnSubscriptionLimitReached = func(info *visitorInfo) {
+		mu.Lock()
+		defer mu.Unlock()
+		infos = append(infos, info)
+	}
+	s := newTestServer(t, c)
+
+	v := s.visitor(netip.MustParseAddr("9.9.9.9"), nil)
+	require.Nil(t, v.SubscriptionAllowed()) // Take the only slot
+	response := request(t, s, "GET", "/mytopic/json", "", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42903, toHTTPError(t, response.Body.String()).Code)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, infos, 1)
+	require.Equal(t, int64(1), infos[0].Limits.SubscriptionLimit)
+}
+
+func TestServer_SubscribeOwnedTopicsBypassSubscriptionLimit(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.VisitorSubscriptionLimit = 1
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddReservation("phil", "mytopic", user.PermissionDenyAll))
+	require.Nil(t, s.userManager.AddReservation("phil", "othertopic", user.PermissionDenyAll))
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	v := s.visitor(netip.MustParseAddr("9.9.9.9"), u)
+	require.Nil(t, v.SubscriptionAllowed()) // Take the only slot
+
+	// Owned topics do not need a slot, and do not free one either
+	release, err := s.reserveSubscriptionSlot(httptest.NewRequest("GET", "/mytopic,othertopic/json", nil), v)
+	require.Nil(t, err)
+	release()
+	require.Equal(t, int64(0), v.subscriptionLimiter.Remaining())
+
+	// If any topic is not owned, the subscription counts
+	_, err = s.reserveSubscriptionSlot(httptest.NewRequest("GET", "/mytopic,sometopic/json", nil), v)
+	require.Equal(t, errSubscriptionLimitReached, err)
+
+	// Anonymous visitors do not own any topics
+	_, err = s.reserveSubscriptionSlot(httptest.NewRequest("GET", "/mytopic/json", nil), s.visitor(netip.MustParseAddr("1.2.3.4"), nil))
+	require.Nil(t, err)
+	_, err = s.reserveSubscriptionSlot(httptest.NewRequest("GET", "/mytopic/json", nil), s.visitor(netip.MustParseAddr("1.2.3.4"), nil))
+	require.Equal(t, errSubscriptionLimitReached, err)
+}
+
+func TestServer_HealthCheckWithoutVisitor(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorRequestLimitBurst = 1
+	c.HealthCheckPaths = []string{"/v1/health", "/healthz"}
+	s := newTestServer(t, c)
+
+	// Health probes never count towards the request limit, and do not create visitors
+	for i := 0; i < 5; i++ {
+		for _, path := range []string{"/v1/health", "/healthz"} {
+			response := request(t, s, "GET", path, "", nil)
+			require.Equal(t, 200, response.Code)
+			require.Equal(t, `{"healthy":true}`+"\n", response.Body.String())
+		}
+	}
+	s.mu.RLock()
+	require.Empty(t, s.visitors)
+	s.mu.RUnlock()
+
+	// Health probes are answered even if the visitor is rate limited
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "hi", nil).Code)
+	require.Equal(t, 429, request(t, s, "PUT", "/mytopic", "hi", nil).Code)
+	require.Equal(t, 200, request(t, s, "GET", "/v1/health", "", nil).Code)
+}
+
+func TestServer_PublishAt_CountedOnDelivery(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 2
+	c.VisitorScheduledMessageMode = VisitorScheduledMessageModeDelivery
+	c.VisitorScheduledMessageDailyLimit = 3
+	s := newTestServer(t, c)
+
+	// Scheduled messages only count towards the scheduled messages limit when published
+	for i := 0; i < 3; i++ {
+		require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "scheduled", map[string]string{"In": "1h"}).Code)
+	}
+	response := request(t, s, "PUT", "/mytopic", "scheduled", map[string]string{"In": "1h"})
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42916, toHTTPError(t, response.Body.String()).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "now", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "now", nil).Code)
+
+	// Delivery is postponed while the daily message limit is reached
+	_, err := s.messageCache.db.Exec(`UPDATE messages SET time=?`, time.Now().Add(-10*time.Second).Unix())
+	require.Nil(t, err)
+	require.Nil(t, s.sendDelayedMessages())
+	due, err := s.messageCache.MessagesDue()
+	require.Nil(t, err)
+	require.Equal(t, 3, len(due))
+
+	// After the daily reset, they count towards the daily message limit when delivered
+	s.visitor(netip.MustParseAddr("9.9.9.9"), nil).ResetStats()
+	require.Nil(t, s.sendDelayedMessages())
+	due, err = s.messageCache.MessagesDue()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(due))
+	require.Equal(t, int64(2), s.visitor(netip.MustParseAddr("9.9.9.9"), nil).Stats().Messages)
+}
+
+func TestServer_PublishAt_CountedOnDelivery_RateVisitor(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.VisitorMessageDailyLimit = 1
+	c.VisitorScheduledMessageMode = VisitorScheduledMessageModeDelivery
+	c.VisitorScheduledMessageDailyLimit = 2
+	c.VisitorSubscriberRateLimiting = true
+	s := newTestServer(t, c)
+	metricVisitorLimitsExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntfy_visitor_limits_exceeded_total",
+	}, []string{"limiter"})
+	defer func() { metricVisitorLimitsExceeded = nil }()
+
+	// Subscriber is charged for the message on delivery, like it would have been when publishing
+	rr := request(t, s, "GET", "/upAAAAAAAAAAAA/json?poll=1", "", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4"
+	})
+	require.Equal(t, 200, rr.Code)
+	for i := 0; i < 2; i++ {
+		require.Equal(t, 200, request(t, s, "PUT", "/upAAAAAAAAAAAA", "scheduled", map[string]string{"In": "1h"}).Code)
+	}
+	_, err := s.messageCache.db.Exec(`UPDATE messages SET time=?`, time.Now().Add(-10*time.Second).Unix())
+	require.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, s.sendDelayedMessages())
+	}
+	due, err := s.messageCache.MessagesDue()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(due))
+	require.Equal(t, int64(1), s.visitor(netip.MustParseAddr("1.2.3.4"), nil).Stats().Messages)
+	require.Equal(t, int64(0), s.visitor(netip.MustParseAddr("9.9.9.9"), nil).Stats().Messages)
+
+	// Postponed messages are not counted as limit hits
+	require.Equal(t, float64(0), testutil.ToFloat64(metricVisitorLimitsExceeded.WithLabelValues(visitorLimiterMessages)))
+}
+
+func TestServer_PublishAt_CountedOnDelivery_RefundScheduled(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentFileSizeLimit = 5000
+	c.VisitorScheduledMessageMode = VisitorScheduledMessageModeDelivery
+	c.VisitorScheduledMessageDailyLimit = 1
+	s := newTestServer(t, c)
+
+	// Rejected scheduled messages do not count towards the scheduled messages limit
+	response := request(t, s, "PUT", "/mytopic", util.RandomString(5001), map[string]string{"In": "1h"})
+	require.Equal(t, 413, response.Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "scheduled", map[string]string{"In": "1h"}).Code)
+	require.Equal(t, 429, request(t, s, "PUT", "/mytopic", "scheduled", map[string]string{"In": "1h"}).Code)
+}
+
+func TestServer_PublishAt_CountedOnDelivery_ExemptTopicAndDisabled(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 1
+	c.VisitorScheduledMessageMode = VisitorScheduledMessageModeDelivery
+	c.RateLimitExemptTopics = []string{"heartbeat"}
+	s := newTestServer(t, c)
+
+	require.Equal(t, 200, request(t, s, "PUT", "/heartbeat", "scheduled", map[string]string{"In": "1h"}).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "scheduled", map[string]string{"In": "1h"}).Code)
+	_, err := s.messageCache.db.Exec(`UPDATE messages SET time=?`, time.Now().Add(-10*time.Second).Unix())
+	require.Nil(t, err)
+
+	// Messages are not delivered while anonymous publishing is disabled, except to exempt topics
+	v := s.visitor(netip.MustParseAddr("9.9.9.9"), nil)
+	s.config.AnonymousPublishDisabled.Store(true)
+	require.Nil(t, s.sendDelayedMessages())
+	due, err := s.messageCache.MessagesDue()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(due))
+	require.Equal(t, "mytopic", due[0].Topic)
+	require.Equal(t, int64(0), v.Stats().Messages)
+
+	// Once it is enabled again, the message is delivered, and the exempt topic was never counted
+	s.config.AnonymousPublishDisabled.Store(false)
+	require.Nil(t, s.sendDelayedMessages())
+	due, err = s.messageCache.MessagesDue()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(due))
+	require.Equal(t, int64(1), v.Stats().Messages)
+}
+
 func TestServer_PublishAt_FromUser(t *testing.T) {
 	t.Parallel()
 	s := newTestServer(t, newTestConfigWithAuthFile(t))
@@ -901,6 +1096,37 @@ func TestServer_Auth_Fail_Rate_Limiting(t *testing.T) {
 	require.Equal(t, 42909, toHTTPError(t, response.Body.String()).Code)
 }
 
+func TestServer_Auth_Fail_Rate_Limiting_ResetOnSuccess(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.VisitorAuthFailureLimitBurst = 5
+	c.VisitorAuthFailureLimitReplenish = time.Hour
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "PUT", "/mytopic", "test", map[string]string{
+			"Authorization": util.BasicAuth("phil", "wrong"),
+		})
+		require.Equal(t, 401, response.Code)
+	}
+	response := request(t, s, "PUT", "/mytopic", "test", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+
+	// Failures before the successful login are forgotten
+	for i := 0; i < 5; i++ {
+		response := request(t, s, "PUT", "/mytopic", "test", map[string]string{
+			"Authorization": util.BasicAuth("phil", "wrong"),
+		})
+		require.Equal(t, 401, response.Code)
+	}
+	response = request(t, s, "PUT", "/mytopic", "test", map[string]string{
+		"Authorization": util.BasicAuth("phil", "wrong"),
+	})
+	require.Equal(t, 429, response.Code)
+}
+
 func TestServer_Auth_ViaQuery(t *testing.T) {
 	c := newTestConfigWithAuthFile(t)
 	c.AuthDefault = user.PermissionDenyAll
@@ -1128,6 +1354,7 @@ func TestServer_DailyMessageQuotaFromDatabase(t *testing.T) {
 
 type testMailer struct {
 	count int
+	err   error // If set, Send fails with this error
 	mu    sync.Mutex
 }
 
@@ -1135,7 +1362,7 @@ func (t *testMailer) Send(v *visitor, m *message, to string) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	t.count++
-	return nil
+	return t.err
 }
 
 func (t *testMailer) Counts() (total int64, success int64, failure int64) {
@@ -1148,6 +1375,60 @@ func (t *testMailer) Count() int {
 	return t.count
 }
 
+// testVisitorLimiter is a fake visitorLimiter that either allows or denies everything, see Server.limiterFor
+type testVisitorLimiter struct {
+	allow bool
+}
+
+func (l *testVisitorLimiter) err(err error) error {
+	if l.allow {
+		return nil
+	}
+	return err
+}
+
+func (l *testVisitorLimiter) RequestAllowed() bool { return l.allow }
+func (l *testVisitorLimiter) RequestAllowedWithDelay() (time.Duration, error) {
+	return 0, l.err(errRequestLimitReached)
+}
+func (l *testVisitorLimiter) ReadRequestAllowed() bool      { return l.allow }
+func (l *testVisitorLimiter) MessageAllowed() error         { return l.err(errMessageLimitReached) }
+func (l *testVisitorLimiter) MessageAllowedN(n int64) error { return l.err(errMessageLimitReached) }
+func (l *testVisitorLimiter) MessagesAllowed(costs []int64, partial bool) (int, error) {
+	if err := l.err(errMessageLimitReached); err != nil {
+		return 0, err
+	}
+	return len(costs), nil
+}
+func (l *testVisitorLimiter) ScheduledMessageAllowed() error { return l.err(errScheduledLimitReached) }
+func (l *testVisitorLimiter) AttachmentMessageAllowed() error {
+	return l.err(errAttachmentLimitReached)
+}
+
+func (l *testVisitorLimiter) GatewayMessageAllowed() error {
+	return l.err(errGatewayLimitReached)
+}
+func (l *testVisitorLimiter) UrgentMessageAllowed() error        { return l.err(errUrgentLimitReached) }
+func (l *testVisitorLimiter) IngressAllowed(n int64) error       { return l.err(errIngressLimitReached) }
+func (l *testVisitorLimiter) NewTopicAllowed(topic string) error { return l.err(errTopicsLimitReached) }
+func (l *testVisitorLimiter) EmailAllowed() error                { return l.err(errEmailLimitReached) }
+func (l *testVisitorLimiter) InboundEmailAllowed(sender string) error {
+	return l.err(errInboundEmailLimitReached)
+}
+func (l *testVisitorLimiter) CallAllowed() bool          { return l.allow }
+func (l *testVisitorLimiter) SubscriptionAllowed() error { return l.err(errSubscriptionLimitReached) }
+func (l *testVisitorLimiter) BandwidthAllowed(bytes int64) error {
+	return l.err(errBandwidthLimitReached)
+}
+func (l *testVisitorLimiter) AuthAllowed() bool           { return l.allow }
+func (l *testVisitorLimiter) AccountCreateAllowed() error { return l.err(errAccountCreateLimitReached) }
+func (l *testVisitorLimiter) ReserveSubscriptionSlot(id string) (func(), error) {
+	return func() {}, l.err(errSubscriptionLimitReached)
+}
+func (l *testVisitorLimiter) OwnedSubscriptionAllowed() error {
+	return l.err(errSubscriptionAttemptLimitReached)
+}
+
 func TestServer_PublishTooRequests_Defaults(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 	for i := 0; i < 60; i++ {
@@ -1199,148 +1480,429 @@ func TestServer_PublishTooRequests_ShortReplenish(t *testing.T) {
 	require.Equal(t, 200, response.Code)
 }
 
-func TestServer_PublishTooManyEmails_Defaults(t *testing.T) {
-	s := newTestServer(t, newTestConfig(t))
-	s.smtpSender = &testMailer{}
-	for i := 0; i < 16; i++ {
-		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("message %d", i), map[string]string{
-			"E-Mail": "test@example.com",
-		})
-		require.Equal(t, 200, response.Code)
-	}
-	response := request(t, s, "PUT", "/mytopic", "one too many", map[string]string{
-		"E-Mail": "test@example.com",
-	})
-	require.Equal(t, 429, response.Code)
-}
-
-func TestServer_PublishTooManyEmails_Replenish(t *testing.T) {
-	t.Parallel()
+func TestServer_PublishTooRequests_IPv6Prefix(t *testing.T) {
 	c := newTestConfig(t)
-	c.VisitorEmailLimitReplenish = 500 * time.Millisecond
+	c.VisitorRequestLimitBurst = 3
 	s := newTestServer(t, c)
-	s.smtpSender = &testMailer{}
-	for i := 0; i < 16; i++ {
-		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("message %d", i), map[string]string{
-			"E-Mail": "test@example.com",
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "PUT", "/mytopic", "message", nil, func(r *http.Request) {
+			r.RemoteAddr = fmt.Sprintf("[2001:db8:1:2::%d]:1234", i+1)
 		})
 		require.Equal(t, 200, response.Code)
 	}
-	response := request(t, s, "PUT", "/mytopic", "one too many", map[string]string{
-		"E-Mail": "test@example.com",
+
+	// Same /64 network shares the same visitor
+	response := request(t, s, "PUT", "/mytopic", "message", nil, func(r *http.Request) {
+		r.RemoteAddr = "[2001:db8:1:2:ffff::1]:1234"
 	})
 	require.Equal(t, 429, response.Code)
 
-	time.Sleep(510 * time.Millisecond)
-	response = request(t, s, "PUT", "/mytopic", "this should be okay again too many", map[string]string{
-		"E-Mail": "test@example.com",
+	// Different /64 network is a different visitor
+	response = request(t, s, "PUT", "/mytopic", "message", nil, func(r *http.Request) {
+		r.RemoteAddr = "[2001:db8:1:3::1]:1234"
 	})
 	require.Equal(t, 200, response.Code)
-
-	response = request(t, s, "PUT", "/mytopic", "and bad again", map[string]string{
-		"E-Mail": "test@example.com",
-	})
-	require.Equal(t, 429, response.Code)
 }
 
-func TestServer_PublishDelayedEmail_Fail(t *testing.T) {
-	s := newTestServer(t, newTestConfig(t))
-	s.smtpSender = &testMailer{}
-	response := request(t, s, "PUT", "/mytopic", "fail", map[string]string{
-		"E-Mail": "test@example.com",
-		"Delay":  "20 min",
-	})
-	require.Equal(t, 40003, toHTTPError(t, response.Body.String()).Code)
-}
+func TestServer_PublishRateLimitBasisHeader(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro", MessageLimit: 10}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleAdmin))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
 
-func TestServer_PublishDelayedCall_Fail(t *testing.T) {
-	c := newTestConfigWithAuthFile(t)
-	c.TwilioAccount = "AC1234567890"
-	c.TwilioAuthToken = "AAEAA1234567890"
-	c.TwilioPhoneNumber = "+1234567890"
-	s := newTestServer(t, c)
-	response := request(t, s, "PUT", "/mytopic", "fail", map[string]string{
-		"Call":  "yes",
-		"Delay": "20 min",
+	response := request(t, s, "PUT", "/mytopic", "anonymous", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "ip", response.Header().Get("X-RateLimit-Basis"))
+
+	response = request(t, s, "PUT", "/mytopic", "no tier", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
 	})
-	require.Equal(t, 40037, toHTTPError(t, response.Body.String()).Code)
-}
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "ip", response.Header().Get("X-RateLimit-Basis"))
 
-func TestServer_PublishEmailNoMailer_Fail(t *testing.T) {
-	s := newTestServer(t, newTestConfig(t))
-	response := request(t, s, "PUT", "/mytopic", "fail", map[string]string{
-		"E-Mail": "test@example.com",
+	response = request(t, s, "PUT", "/mytopic", "tier", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
 	})
-	require.Equal(t, 400, response.Code)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "tier", response.Header().Get("X-RateLimit-Basis"))
 }
 
-func TestServer_PublishAndExpungeTopicAfter16Hours(t *testing.T) {
-	t.Parallel()
-	s := newTestServer(t, newTestConfig(t))
+func TestServer_RateLimitInfoHeaders(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 5
+	s := newTestServer(t, c)
+	reset := strconv.FormatInt(util.NextOccurrenceUTC(c.VisitorStatsResetTime, time.Now()).Unix(), 10)
 
-	subFn := func(v *visitor, msg *message) error {
-		return nil
-	}
+	// Not requested
+	response := request(t, s, "PUT", "/mytopic", "hi", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "", response.Header().Get("X-RateLimit-Messages-Remaining"))
+	require.Equal(t, "", response.Header().Get("X-RateLimit-Messages-Reset"))
 
-	// Publish and check last access
-	response := request(t, s, "POST", "/mytopic", "test", map[string]string{
-		"Cache": "no",
+	// Requested
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"X-RateLimit-Info": "true",
 	})
 	require.Equal(t, 200, response.Code)
-	waitFor(t, func() bool {
-		// .lastAccess set in t.Publish() -> t.Keepalive() in Goroutine
-		s.topics["mytopic"].mu.RLock()
-		defer s.topics["mytopic"].mu.RUnlock()
-		return s.topics["mytopic"].lastAccess.Unix() >= time.Now().Unix()-2 &&
-			s.topics["mytopic"].lastAccess.Unix() <= time.Now().Unix()+2
-	})
-
-	// Topic won't get pruned
-	s.execManager()
-	require.NotNil(t, s.topics["mytopic"])
-
-	// Fudge with last access, but subscribe, and see that it won't get pruned (because of subscriber)
-	subID := s.topics["mytopic"].Subscribe(subFn, "", func() {})
-	s.topics["mytopic"].mu.Lock()
-	s.topics["mytopic"].lastAccess = time.Now().Add(-17 * time.Hour)
-	s.topics["mytopic"].mu.Unlock()
-	s.execManager()
-	require.NotNil(t, s.topics["mytopic"])
+	require.Equal(t, "3", response.Header().Get("X-RateLimit-Messages-Remaining"))
+	require.Equal(t, reset, response.Header().Get("X-RateLimit-Messages-Reset"))
 
-	// It'll finally get pruned now that there are no subscribers and last access is 17 hours ago
-	s.topics["mytopic"].Unsubscribe(subID)
-	s.execManager()
-	require.Nil(t, s.topics["mytopic"])
+	// Batch
+	response = request(t, s, "POST", "/v1/publish/batch", `{"messages":[{"topic":"mytopic","message":"a"},{"topic":"mytopic","message":"b"}]}`, map[string]string{
+		"X-RateLimit-Info": "1",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "1", response.Header().Get("X-RateLimit-Messages-Remaining"))
 }
 
-func TestServer_TopicKeepaliveOnPoll(t *testing.T) {
-	t.Parallel()
-	s := newTestServer(t, newTestConfig(t))
+func TestServer_RateLimitHeaders(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.VisitorMessageDailyLimit = 5
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro", MessageLimit: 100}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "mytopic", user.PermissionReadWrite))
+	reset := strconv.FormatInt(util.NextOccurrenceUTC(c.VisitorStatsResetTime, time.Now()).Unix(), 10)
 
-	// Create topic by polling once
+	// Anonymous visitor, IP-based limits
 	response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
-	require.Equal(t, 200, response.Code)
-
-	// Mess with last access time
-	s.topics["mytopic"].lastAccess = time.Now().Add(-17 * time.Hour)
+	require.Equal(t, "5", response.Header().Get("X-RateLimit-Limit"))
+	require.Equal(t, "5", response.Header().Get("X-RateLimit-Remaining"))
+	require.Equal(t, reset, response.Header().Get("X-RateLimit-Reset"))
 
-	// Poll again and check keepalive time
-	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	response = request(t, s, "PUT", "/mytopic", "hi", nil)
 	require.Equal(t, 200, response.Code)
-	require.True(t, s.topics["mytopic"].lastAccess.Unix() >= time.Now().Unix()-2)
-	require.True(t, s.topics["mytopic"].lastAccess.Unix() <= time.Now().Unix()+2)
-}
+	require.Equal(t, "4", response.Header().Get("X-RateLimit-Remaining"))
 
-func TestServer_UnifiedPushDiscovery(t *testing.T) {
-	s := newTestServer(t, newTestConfig(t))
-	response := request(t, s, "GET", "/mytopic?up=1", "", nil)
+	// User with tier
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
 	require.Equal(t, 200, response.Code)
-	require.Equal(t, `{"unifiedpush":{"version":1}}`+"\n", response.Body.String())
+	require.Equal(t, "100", response.Header().Get("X-RateLimit-Limit"))
+	require.Equal(t, "99", response.Header().Get("X-RateLimit-Remaining"))
 }
 
-func TestServer_PublishUnifiedPushBinary_AndPoll(t *testing.T) {
-	b := make([]byte, 12) // Max length
-	_, err := rand.Read(b)
+func TestServer_PublishTopicMessageLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.TopicMessageLimitBurst = 2
+	c.TopicMessageLimitReplenish = time.Hour
+	s := newTestServer(t, c)
+	for i := 0; i < 2; i++ {
+		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("message %d", i), nil)
+		require.Equal(t, 200, response.Code)
+	}
+
+	// Topic limit applies regardless of visitor, and is refunded to the visitor
+	response := request(t, s, "PUT", "/mytopic", "message", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4:1234"
+	})
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42911, toHTTPError(t, response.Body.String()).Code)
+	require.Equal(t, int64(0), s.visitor(netip.MustParseAddr("1.2.3.4"), nil).Stats().Messages)
+
+	// Other topics are not affected
+	response = request(t, s, "PUT", "/othertopic", "message", nil)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_PublishTooRequests_RetryAfter(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorRequestLimitBurst = 2
+	c.VisitorRequestLimitReplenish = 10 * time.Second
+	s := newTestServer(t, c)
+	for i := 0; i < 2; i++ {
+		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("message %d", i), nil)
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, "", response.Header().Get("Retry-After"))
+	}
+	response := request(t, s, "PUT", "/mytopic", "message", nil)
+	require.Equal(t, 429, response.Code)
+	retryAfter, err := strconv.Atoi(response.Header().Get("Retry-After"))
+	require.Nil(t, err)
+	require.True(t, retryAfter > 0 && retryAfter <= 10)
+
+	// Asking for the delay does not consume a token
+	v := s.visitor(netip.MustParseAddr("9.9.9.9"), nil) // see request()
+	delay, err := v.RequestAllowedWithDelay()
+	require.Equal(t, errRequestLimitReached, err)
+	require.True(t, delay > 0 && delay <= 10*time.Second)
+}
+
+func TestServer_PublishTooRequests_BackpressureWait(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorRequestLimitBurst = 1
+	c.VisitorRequestLimitReplenish = 200 * time.Millisecond
+	c.VisitorRequestMaxWait = time.Second
+	s := newTestServer(t, c)
+	response := request(t, s, "PUT", "/mytopic", "message 1", nil)
+	require.Equal(t, 200, response.Code)
+
+	// Without the header, the request is rejected right away
+	response = request(t, s, "PUT", "/mytopic", "message 2", nil)
+	require.Equal(t, 429, response.Code)
+
+	// With the header, the request waits for the next token
+	start := time.Now()
+	response = request(t, s, "PUT", "/mytopic", "message 3", map[string]string{
+		"X-Backpressure": "wait",
+	})
+	require.Equal(t, 200, response.Code)
+	require.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	// If the wait would exceed the max wait, the request is rejected right away
+	c.VisitorRequestMaxWait = 50 * time.Millisecond
+	start = time.Now()
+	response = request(t, s, "PUT", "/mytopic", "message 4", map[string]string{
+		"X-Backpressure": "wait",
+	})
+	require.Equal(t, 429, response.Code)
+	require.True(t, time.Since(start) < 50*time.Millisecond)
+}
+
+func TestServer_PublishTooRequests_SeparateReadRequestLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorRequestLimitBurst = 3
+	c.VisitorReadRequestLimitBurst = 5
+	s := newTestServer(t, c)
+
+	// Polling does not count towards the publishing budget
+	for i := 0; i < 5; i++ {
+		response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 429, response.Code)
+
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("message %d", i), nil)
+		require.Equal(t, 200, response.Code)
+	}
+	response = request(t, s, "PUT", "/mytopic", "message", nil)
+	require.Equal(t, 429, response.Code)
+}
+
+func TestServer_PublishTooRequests_SharedReadRequestLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorRequestLimitBurst = 3
+	s := newTestServer(t, c)
+
+	// Without a read request limit, polling counts towards the request limit
+	for i := 0; i < 2; i++ {
+		response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "PUT", "/mytopic", "message", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "message", nil)
+	require.Equal(t, 429, response.Code)
+}
+
+func TestServer_PublishTooRequests_TierRequestLimitBurst(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.VisitorRequestLimitBurst = 3
+	s := newTestServer(t, c)
+
+	// Tier with explicit burst of 5; without it, the burst would be derived from the message limit (50)
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:              "test",
+		MessageLimit:      1000,
+		RequestLimitBurst: 5,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "test"))
+
+	for i := 0; i < 5; i++ {
+		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("message %d", i), map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "PUT", "/mytopic", "message", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 429, response.Code)
+
+	// Tier without explicit burst falls back to the derived burst
+	ti, err := s.userManager.Tier("test")
+	require.Nil(t, err)
+	ti.RequestLimitBurst = 0
+	require.Equal(t, 50, tierBasedVisitorLimits(c, ti).RequestLimitBurst)
+}
+
+func TestServer_PublishTooManyEmails_Defaults(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	s.smtpSender = &testMailer{}
+	for i := 0; i < 16; i++ {
+		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("message %d", i), map[string]string{
+			"E-Mail": "test@example.com",
+		})
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "PUT", "/mytopic", "one too many", map[string]string{
+		"E-Mail": "test@example.com",
+	})
+	require.Equal(t, 429, response.Code)
+}
+
+func TestServer_PublishEmail_FailureCircuitBreaker(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorEmailFailureThreshold = 2
+	c.VisitorEmailFailureCooldown = time.Hour
+	s := newTestServer(t, c)
+	mailer := &testMailer{err: errors.New("smtp server down")}
+	s.smtpSender = mailer
+	for i := 0; i < 2; i++ {
+		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("message %d", i), map[string]string{
+			"E-Mail": "test@example.com",
+		})
+		require.Equal(t, 200, response.Code)
+		waitFor(t, func() bool { return mailer.Count() == i+1 }) // E-mails are sent asynchronously
+	}
+
+	// Breaker is open, e-mails are rejected without counting towards the e-mail limit
+	response := request(t, s, "PUT", "/mytopic", "rejected", map[string]string{
+		"E-Mail": "test@example.com",
+	})
+	require.Equal(t, 503, response.Code)
+	require.Equal(t, 50301, toHTTPError(t, response.Body.String()).Code)
+	require.Equal(t, 2, mailer.Count())
+	require.Equal(t, int64(2), s.visitor(netip.MustParseAddr("9.9.9.9"), nil).Stats().Emails) // see request()
+
+	// Messages without e-mail still work
+	response = request(t, s, "PUT", "/mytopic", "no email", nil)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_PublishTooManyEmails_Replenish(t *testing.T) {
+	t.Parallel()
+	c := newTestConfig(t)
+	c.VisitorEmailLimitReplenish = 500 * time.Millisecond
+	s := newTestServer(t, c)
+	s.smtpSender = &testMailer{}
+	for i := 0; i < 16; i++ {
+		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("message %d", i), map[string]string{
+			"E-Mail": "test@example.com",
+		})
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "PUT", "/mytopic", "one too many", map[string]string{
+		"E-Mail": "test@example.com",
+	})
+	require.Equal(t, 429, response.Code)
+
+	time.Sleep(510 * time.Millisecond)
+	response = request(t, s, "PUT", "/mytopic", "this should be okay again too many", map[string]string{
+		"E-Mail": "test@example.com",
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/mytopic", "and bad again", map[string]string{
+		"E-Mail": "test@example.com",
+	})
+	require.Equal(t, 429, response.Code)
+}
+
+func TestServer_PublishDelayedEmail_Fail(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	s.smtpSender = &testMailer{}
+	response := request(t, s, "PUT", "/mytopic", "fail", map[string]string{
+		"E-Mail": "test@example.com",
+		"Delay":  "20 min",
+	})
+	require.Equal(t, 40003, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishDelayedCall_Fail(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.TwilioAccount = "AC1234567890"
+	c.TwilioAuthToken = "AAEAA1234567890"
+	c.TwilioPhoneNumber = "+1234567890"
+	s := newTestServer(t, c)
+	response := request(t, s, "PUT", "/mytopic", "fail", map[string]string{
+		"Call":  "yes",
+		"Delay": "20 min",
+	})
+	require.Equal(t, 40037, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishEmailNoMailer_Fail(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "fail", map[string]string{
+		"E-Mail": "test@example.com",
+	})
+	require.Equal(t, 400, response.Code)
+}
+
+func TestServer_PublishAndExpungeTopicAfter16Hours(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+
+	subFn := func(v *visitor, msg *message) error {
+		return nil
+	}
+
+	// Publish and check last access
+	response := request(t, s, "POST", "/mytopic", "test", map[string]string{
+		"Cache": "no",
+	})
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		// .lastAccess set in t.Publish() -> t.Keepalive() in Goroutine
+		s.topics["mytopic"].mu.RLock()
+		defer s.topics["mytopic"].mu.RUnlock()
+		return s.topics["mytopic"].lastAccess.Unix() >= time.Now().Unix()-2 &&
+			s.topics["mytopic"].lastAccess.Unix() <= time.Now().Unix()+2
+	})
+
+	// Topic won't get pruned
+	s.execManager()
+	require.NotNil(t, s.topics["mytopic"])
+
+	// Fudge with last access, but subscribe, and see that it won't get pruned (because of subscriber)
+	subID := s.topics["mytopic"].Subscribe(subFn, "", func() {})
+	s.topics["mytopic"].mu.Lock()
+	s.topics["mytopic"].lastAccess = time.Now().Add(-17 * time.Hour)
+	s.topics["mytopic"].mu.Unlock()
+	s.execManager()
+	require.NotNil(t, s.topics["mytopic"])
+
+	// It'll finally get pruned now that there are no subscribers and last access is 17 hours ago
+	s.topics["mytopic"].Unsubscribe(subID)
+	s.execManager()
+	require.Nil(t, s.topics["mytopic"])
+}
+
+func TestServer_TopicKeepaliveOnPoll(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+
+	// Create topic by polling once
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+
+	// Mess with last access time
+	s.topics["mytopic"].lastAccess = time.Now().Add(-17 * time.Hour)
+
+	// Poll again and check keepalive time
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.True(t, s.topics["mytopic"].lastAccess.Unix() >= time.Now().Unix()-2)
+	require.True(t, s.topics["mytopic"].lastAccess.Unix() <= time.Now().Unix()+2)
+}
+
+func TestServer_UnifiedPushDiscovery(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/mytopic?up=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"unifiedpush":{"version":1}}`+"\n", response.Body.String())
+}
+
+func TestServer_PublishUnifiedPushBinary_AndPoll(t *testing.T) {
+	b := make([]byte, 12) // Max length
+	_, err := rand.Read(b)
 	require.Nil(t, err)
 
 	s := newTestServer(t, newTestConfig(t))
@@ -1616,13 +2178,182 @@ func TestServer_PublishAsJSON_RateLimit_MessageDailyLimit(t *testing.T) {
 	response := request(t, s, "PUT", "/", `{"topic":"mytopic","message":"A message"}`, nil)
 	require.Equal(t, 429, response.Code)
 	require.Equal(t, 42908, toHTTPError(t, response.Body.String()).Code)
+	require.Contains(t, toHTTPError(t, response.Body.String()).Message, "messages limits exceeded")
 }
 
-func TestServer_PublishAsJSON_WithEmail(t *testing.T) {
-	t.Parallel()
-	mailer := &testMailer{}
-	s := newTestServer(t, newTestConfig(t))
-	s.smtpSender = mailer
+func TestServer_Publish_RateLimit_LimitObject(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 2
+	s := newTestServer(t, c)
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "message", nil).Code)
+	}
+	response := request(t, s, "PUT", "/mytopic", "message", nil)
+	require.Equal(t, 429, response.Code)
+	var body struct {
+		Code  int                 `json:"code"`
+		Limit *limitErrorResponse `json:"limit"`
+	}
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&body))
+	require.Equal(t, 42908, body.Code)
+	require.NotNil(t, body.Limit)
+	require.Equal(t, "messages", body.Limit.Limiter)
+	require.Equal(t, "ip", body.Limit.Basis)
+	require.Equal(t, int64(2), body.Limit.Limit)
+	require.Equal(t, int64(0), body.Limit.Remaining)
+	require.Greater(t, body.Limit.ResetAt, time.Now().Unix())
+
+	// Other errors do not have a limit object
+	response = request(t, s, "PUT", "/mytopic?delay=invalid", "message", nil)
+	require.Equal(t, 400, response.Code)
+	require.NotContains(t, response.Body.String(), `"limit"`)
+}
+
+func TestServer_Publish_RateLimitExemptTopics(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 1
+	c.RateLimitExemptTopics = []string{"heartbeat"}
+	s := newTestServer(t, c)
+
+	for i := 0; i < 5; i++ {
+		response := request(t, s, "PUT", "/heartbeat", "ping", nil)
+		require.Equal(t, 200, response.Code)
+	}
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "message", nil).Code)
+	response := request(t, s, "PUT", "/mytopic", "message", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42908, toHTTPError(t, response.Body.String()).Code)
+
+	v := s.visitor(netip.MustParseAddr("9.9.9.9"), nil) // see request()
+	require.Equal(t, int64(1), v.Stats().Messages)
+	require.True(t, v.ShouldCountMessage("mytopic"))
+	require.False(t, v.ShouldCountMessage("heartbeat"))
+}
+
+func TestServer_Publish_MessageSoftLimitWarning(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 10
+	c.VisitorMessageSoftLimitPercent = 80
+	s := newTestServer(t, c)
+
+	for i := 1; i <= 10; i++ {
+		response := request(t, s, "PUT", "/mytopic", "message", nil)
+		require.Equal(t, 200, response.Code)
+		if i == 8 {
+			require.Equal(t, "true", response.Header().Get("X-RateLimit-Warning"))
+		} else {
+			require.Empty(t, response.Header().Get("X-RateLimit-Warning")) // Only warned once
+		}
+	}
+
+	// Warned again after the daily reset
+	v := s.visitor(netip.MustParseAddr("9.9.9.9"), nil) // see request()
+	v.mu.Lock()
+	v.softLimitWarned = lastStatsReset(c, time.Now()).Add(-time.Minute)
+	v.mu.Unlock()
+	v.ResetStats()
+	for i := 1; i <= 8; i++ {
+		response := request(t, s, "PUT", "/mytopic", "message", nil)
+		require.Equal(t, i == 8, response.Header().Get("X-RateLimit-Warning") == "true")
+	}
+}
+
+func TestServer_PublishTooManyRequests_PenaltyBox(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 1
+	c.VisitorPenaltyBoxThreshold = 2
+	c.VisitorPenaltyBoxDuration = time.Hour
+	s := newTestServer(t, c)
+
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "message", nil).Code)
+	for i := 0; i < 2; i++ {
+		response := request(t, s, "PUT", "/mytopic", "message", nil)
+		require.Equal(t, 429, response.Code)
+		require.Equal(t, 42908, toHTTPError(t, response.Body.String()).Code)
+	}
+
+	// Blocked right away, even for requests that are not limited otherwise
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42912, toHTTPError(t, response.Body.String()).Code)
+	require.Equal(t, "3600", response.Header().Get("Retry-After"))
+
+	// Other visitors are not affected
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4:1234"
+	})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_Publish_MessageDailyLimit_RedisStoreUnreachable(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 3
+	c.VisitorLimiterStore = VisitorLimiterStoreRedis
+	c.VisitorLimiterRedisAddr = "127.0.0.1:1" // Nothing listening here
+	s := newTestServer(t, c)
+	require.NotNil(t, s.limiterStore)
+
+	// Falls back to in-memory limits
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "PUT", "/mytopic", "A message", nil)
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "PUT", "/mytopic", "A message", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42908, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Publish_MessageDailyLimit_SlidingMode(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 3
+	c.VisitorMessageLimiterMode = VisitorMessageLimiterModeSliding
+	s := newTestServer(t, c)
+
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "PUT", "/mytopic", "A message", nil)
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "PUT", "/mytopic", "A message", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42908, toHTTPError(t, response.Body.String()).Code)
+
+	// Daily reset does not free up the quota in sliding mode
+	s.resetStats()
+	response = request(t, s, "PUT", "/mytopic", "A message", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, int64(3), s.visitor(netip.MustParseAddr("9.9.9.9"), nil).Stats().Messages)
+}
+
+func TestServer_Publish_MessageDailyLimit_DecayMode(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 3
+	c.VisitorMessageLimiterMode = VisitorMessageLimiterModeDecay
+	s := newTestServer(t, c)
+
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "PUT", "/mytopic", "A message", nil)
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "PUT", "/mytopic", "A message", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42908, toHTTPError(t, response.Body.String()).Code)
+
+	// Daily reset does not free up the quota in decay mode, the counter only decays over time
+	s.resetStats()
+	response = request(t, s, "PUT", "/mytopic", "A message", nil)
+	require.Equal(t, 429, response.Code)
+	info, err := s.visitor(netip.MustParseAddr("9.9.9.9"), nil).Info()
+	require.Nil(t, err)
+	require.Equal(t, int64(3), info.Stats.Messages)
+	require.Equal(t, int64(0), info.Stats.MessagesRemaining)
+}
+
+func TestServer_PublishAsJSON_WithEmail(t *testing.T) {
+	t.Parallel()
+	mailer := &testMailer{}
+	s := newTestServer(t, newTestConfig(t))
+	s.smtpSender = mailer
 	body := `{"topic":"mytopic","message":"A message","email":"phil@example.com"}`
 	response := request(t, s, "PUT", "/", body, nil)
 	require.Equal(t, 200, response.Code)
@@ -1676,6 +2407,176 @@ func TestServer_PublishAsJSON_Invalid(t *testing.T) {
 	require.Equal(t, 400, response.Code)
 }
 
+func TestServer_PublishBatch(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 5
+	s := newTestServer(t, c)
+	body := `{"messages":[{"topic":"mytopic","message":"first"},{"topic":"othertopic","message":"second","priority":4},{"topic":"mytopic"}]}`
+	rr := request(t, s, "POST", "/v1/publish/batch", body, nil)
+	require.Equal(t, 200, rr.Code)
+	res, err := util.UnmarshalJSON[apiPublishBatchResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 3, len(res.Messages))
+	require.Equal(t, 0, res.Rejected)
+	require.Equal(t, "first", res.Messages[0].Message)
+	require.Equal(t, "othertopic", res.Messages[1].Topic)
+	require.Equal(t, 4, res.Messages[1].Priority)
+	require.Equal(t, emptyMessageBody, res.Messages[2].Message)
+
+	messages, err := s.messageCache.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	v := s.visitor(netip.MustParseAddr("9.9.9.9"), nil)
+	require.Equal(t, int64(3), v.Stats().Messages)
+
+	// Whole batch is rejected if the remaining quota is not sufficient
+	rr = request(t, s, "POST", "/v1/publish/batch", body, nil)
+	require.Equal(t, 429, rr.Code)
+	require.Equal(t, 42908, toHTTPError(t, rr.Body.String()).Code)
+	require.Equal(t, int64(3), v.Stats().Messages)
+
+	// Partial batch publishes as many messages as possible
+	rr = request(t, s, "POST", "/v1/publish/batch", strings.Replace(body, `"messages"`, `"partial":true,"messages"`, 1), nil)
+	require.Equal(t, 200, rr.Code)
+	res, err = util.UnmarshalJSON[apiPublishBatchResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(res.Messages))
+	require.Equal(t, 1, res.Rejected)
+	require.Equal(t, int64(5), v.Stats().Messages)
+}
+
+func TestServer_PublishBatch_FailedMessageIsRefunded(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 5
+	s := newTestServer(t, c)
+	body := `{"messages":[{"topic":"mytopic","message":"first"},{"topic":"mytopic","delay":"invalid"},{"topic":"mytopic"}]}`
+	rr := request(t, s, "POST", "/v1/publish/batch", body, nil)
+	require.Equal(t, 400, rr.Code)
+	messages, err := s.messageCache.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, int64(1), s.visitor(netip.MustParseAddr("9.9.9.9"), nil).Stats().Messages)
+}
+
+func TestServer_PublishBatch_Invalid(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "secret", user.PermissionDenyAll))
+
+	rr := request(t, s, "POST", "/v1/publish/batch", `{"messages":[]}`, nil)
+	require.Equal(t, 40049, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/publish/batch", `{"messages":[{"topic":"my/topic"}]}`, nil)
+	require.Equal(t, 40009, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/publish/batch", `{"messages":[{"topic":"mytopic"},{"topic":"secret"}]}`, nil)
+	require.Equal(t, 403, rr.Code)
+	messages, err := s.messageCache.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(messages)) // Nothing is published if any of the topics is not allowed
+}
+
+func TestServer_TokenLimitProfile(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.VisitorLimitProfiles = map[string]*VisitorLimitProfile{
+		"ci": {MessageLimit: 2, RequestLimitBurst: 50},
+	}
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:         "pro",
+		MessageLimit: 100,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	token, err := s.userManager.CreateToken(u.ID, "ci", time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+	require.Nil(t, s.userManager.ChangeTokenLimitProfile(u.ID, token.Value, "ci"))
+	other, err := s.userManager.CreateToken(u.ID, "unknown", time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+	require.Nil(t, s.userManager.ChangeTokenLimitProfile(u.ID, other.Value, "doesnotexist"))
+
+	// Token with profile has its own limits
+	tokenAuth := map[string]string{"Authorization": util.BearerAuth(token.Value)}
+	rr := request(t, s, "GET", "/v1/account", "", tokenAuth)
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "profile", account.Limits.Basis)
+	require.Equal(t, "ci", account.Limits.Profile)
+	require.Equal(t, int64(2), account.Limits.Messages)
+	require.Equal(t, 50, account.Stats.RequestLimitBurst)
+	for i := 0; i < 2; i++ {
+		rr = request(t, s, "PUT", "/mytopic", "this is a message", tokenAuth)
+		require.Equal(t, 200, rr.Code)
+	}
+	rr = request(t, s, "PUT", "/mytopic", "this is a message", tokenAuth)
+	require.Equal(t, 429, rr.Code)
+
+	// Password-based requests of the same user are limited by the tier, and not counted towards the profile
+	rr = request(t, s, "PUT", "/mytopic", "this is a message", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	account, _ = util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "tier", account.Limits.Basis)
+	require.Equal(t, "", account.Limits.Profile)
+	require.Equal(t, int64(100), account.Limits.Messages)
+	require.Equal(t, int64(1), account.Stats.Messages)
+
+	// Unknown profiles fall back to the tier limits
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{"Authorization": util.BearerAuth(other.Value)})
+	account, _ = util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "", account.Limits.Profile)
+	require.Equal(t, int64(100), account.Limits.Messages)
+}
+
+func TestServer_TokenExempt(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:         "test",
+		MessageLimit: 2,
+	}))
+	require.Nil(t, s.userManager.AddUser("backups", "backups", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("backups", "test"))
+	require.Nil(t, s.userManager.AllowAccess("backups", "mytopic", user.PermissionReadWrite))
+	u, err := s.userManager.User("backups")
+	require.Nil(t, err)
+	token, err := s.userManager.CreateToken(u.ID, "service", time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+	require.Nil(t, s.userManager.ChangeTokenExempt(u.ID, token.Value, true))
+
+	// Service token is not limited by the tier
+	tokenAuth := map[string]string{"Authorization": util.BearerAuth(token.Value)}
+	for i := 0; i < 5; i++ {
+		rr := request(t, s, "PUT", "/mytopic", "this is a message", tokenAuth)
+		require.Equal(t, 200, rr.Code)
+	}
+	rr := request(t, s, "GET", "/v1/account", "", tokenAuth)
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, visitorUnlimited, account.Limits.Messages)
+
+	// ... and does not grant any other privileges
+	rr = request(t, s, "PUT", "/othertopic", "this is a message", tokenAuth)
+	require.Equal(t, 403, rr.Code)
+	rr = request(t, s, "GET", "/v1/users", "", tokenAuth)
+	require.Equal(t, 401, rr.Code)
+
+	// Password-based requests of the same user are still limited, and not counted towards the service token
+	passwordAuth := map[string]string{"Authorization": util.BasicAuth("backups", "backups")}
+	for i := 0; i < 2; i++ {
+		rr = request(t, s, "PUT", "/mytopic", "this is a message", passwordAuth)
+		require.Equal(t, 200, rr.Code)
+	}
+	rr = request(t, s, "PUT", "/mytopic", "this is a message", passwordAuth)
+	require.Equal(t, 429, rr.Code)
+}
+
 func TestServer_PublishWithTierBasedMessageLimitAndExpiry(t *testing.T) {
 	c := newTestConfigWithAuthFile(t)
 	s := newTestServer(t, c)
@@ -1842,6 +2743,55 @@ func TestServer_PublishAttachmentTooLargeBodyAttachmentFileSizeLimit(t *testing.
 	require.Equal(t, 41301, err.Code)
 }
 
+func TestServer_PublishAttachmentTooLarge_RefundMessage(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentFileSizeLimit = 5000
+	s := newTestServer(t, c)
+	response := request(t, s, "PUT", "/mytopic", util.RandomString(5001), nil)
+	require.Equal(t, 413, response.Code)
+	require.Equal(t, int64(0), s.visitor(netip.MustParseAddr("9.9.9.9"), nil).Stats().Messages)
+
+	response = request(t, s, "PUT", "/mytopic", "a message", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, int64(1), s.visitor(netip.MustParseAddr("9.9.9.9"), nil).Stats().Messages)
+}
+
+func TestServer_PublishMessageCostSize(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 10
+	c.VisitorMessageCostSize = 1024
+	s := newTestServer(t, c)
+	v := s.visitor(netip.MustParseAddr("9.9.9.9"), nil) // see request()
+
+	// Small message counts as one
+	response := request(t, s, "PUT", "/mytopic", "a small message", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, int64(1), v.Stats().Messages)
+
+	// Large message (3,000 bytes) counts as three
+	response = request(t, s, "PUT", "/mytopic", util.RandomString(3000), nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, int64(4), v.Stats().Messages)
+
+	// Attachment (6,000 bytes) counts as six, which uses up the remaining quota
+	response = request(t, s, "PUT", "/mytopic", util.RandomString(6000), nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, int64(10), v.Stats().Messages)
+	response = request(t, s, "PUT", "/mytopic", util.RandomString(2000), nil)
+	require.Equal(t, 429, response.Code)
+}
+
+func TestServer_PublishMessageCostSize_RefundMessage(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 10
+	c.VisitorMessageCostSize = 1024
+	c.AttachmentFileSizeLimit = 5000
+	s := newTestServer(t, c)
+	response := request(t, s, "PUT", "/mytopic", util.RandomString(5001), nil)
+	require.Equal(t, 413, response.Code)
+	require.Equal(t, int64(0), s.visitor(netip.MustParseAddr("9.9.9.9"), nil).Stats().Messages)
+}
+
 func TestServer_PublishAttachmentExpiryBeforeDelivery(t *testing.T) {
 	c := newTestConfig(t)
 	c.AttachmentExpiryDuration = 10 * time.Minute
@@ -1903,88 +2853,459 @@ func TestServer_PublishAttachmentAndExpire(t *testing.T) {
 	require.Equal(t, 404, response.Code)
 }
 
-func TestServer_PublishAttachmentWithTierBasedExpiry(t *testing.T) {
-	t.Parallel()
-	content := util.RandomString(5000) // > 4096
+func TestServer_PublishAttachmentWithExpiresHeader(t *testing.T) {
+	t.Parallel()
+	content := util.RandomString(5000) // > 4096
+	c := newTestConfig(t)
+	c.AttachmentExpiryDuration = 3 * time.Hour
+	s := newTestServer(t, c)
+
+	// Shorter than the limit
+	response := request(t, s, "PUT", "/mytopic", content, map[string]string{
+		"X-Attachment-Expires": "30m",
+	})
+	msg := toMessage(t, response.Body.String())
+	require.GreaterOrEqual(t, msg.Attachment.Expires, time.Now().Add(30*time.Minute-time.Minute).Unix())
+	require.LessOrEqual(t, msg.Attachment.Expires, time.Now().Add(30*time.Minute).Unix())
+
+	// Longer than the limit is clamped
+	response = request(t, s, "PUT", "/mytopic?attachment-expires=2d", content, nil)
+	msg = toMessage(t, response.Body.String())
+	require.GreaterOrEqual(t, msg.Attachment.Expires, time.Now().Add(3*time.Hour-time.Minute).Unix())
+	require.LessOrEqual(t, msg.Attachment.Expires, time.Now().Add(3*time.Hour).Unix())
+
+	// Expiry is stored in the message cache
+	messages, err := s.messageCache.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Less(t, messages[0].Attachment.Expires, messages[1].Attachment.Expires)
+
+	// Invalid
+	response = request(t, s, "PUT", "/mytopic", content, map[string]string{
+		"X-Attachment-Expires": "not-a-duration",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40047, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishAttachmentDownloadConcurrency(t *testing.T) {
+	t.Parallel()
+	content := util.RandomString(5000) // > 4096
+	c := newTestConfig(t)
+	c.VisitorAttachmentDownloadConcurrency = 1
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", content, nil)
+	msg := toMessage(t, response.Body.String())
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+
+	// Download in progress (simulated), second download is rejected
+	v := s.visitor(netip.MustParseAddr("9.9.9.9"), nil) // see request()
+	require.Nil(t, v.AcquireDownload())
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42915, toHTTPError(t, response.Body.String()).Code)
+
+	// Finished, download works again, and releases its slot
+	v.ReleaseDownload()
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, content, response.Body.String())
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_PublishWithTierBasedMessageLimit_PaymentRequired(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.BaseURL = "https://ntfy.example.com"
+	c.VisitorMessageDailyLimit = 1
+	c.UsePaymentRequiredForTierLimits = true
+	s := newTestServer(t, c)
+
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:         "test",
+		MessageLimit: 1,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "test"))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+
+	// Tier user gets 402 with an upgrade link
+	response := request(t, s, "PUT", "/mytopic", "message 1", headers)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "message 2", headers)
+	require.Equal(t, 402, response.Code)
+	err := toHTTPError(t, response.Body.String())
+	require.Equal(t, 40201, err.Code)
+	require.Equal(t, "https://ntfy.example.com/account", err.Link)
+	require.Contains(t, err.Message, "daily message quota reached")
+
+	// Anonymous visitor still gets 429
+	response = request(t, s, "PUT", "/mytopic", "message 1", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "message 2", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42908, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishAttachmentWithTierBasedExpiry(t *testing.T) {
+	t.Parallel()
+	content := util.RandomString(5000) // > 4096
+
+	c := newTestConfigWithAuthFile(t)
+	c.AttachmentExpiryDuration = time.Millisecond // Hack
+	s := newTestServer(t, c)
+
+	// Create tier with certain limits
+	sevenDays := time.Duration(604800) * time.Second
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:                     "test",
+		MessageLimit:             10,
+		MessageExpiryDuration:    sevenDays,
+		AttachmentFileSizeLimit:  50_000,
+		AttachmentTotalSizeLimit: 200_000,
+		AttachmentExpiryDuration: sevenDays, // 7 days
+		AttachmentBandwidthLimit: 100000,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "test"))
+
+	// Publish and make sure we can retrieve it
+	response := request(t, s, "PUT", "/mytopic", content, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
+	require.True(t, msg.Attachment.Expires > time.Now().Add(sevenDays-30*time.Second).Unix())
+	require.True(t, msg.Expires > time.Now().Add(sevenDays-30*time.Second).Unix())
+	file := filepath.Join(s.config.AttachmentCacheDir, msg.ID)
+	require.FileExists(t, file)
+
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, content, response.Body.String())
+
+	// Prune and makes sure it's still there
+	time.Sleep(time.Second) // Sigh ...
+	s.execManager()
+	require.FileExists(t, file)
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_PublishAttachmentWithTierBasedBandwidthLimit(t *testing.T) {
+	content := util.RandomString(5000) // > 4096
+
+	c := newTestConfigWithAuthFile(t)
+	c.VisitorAttachmentDailyBandwidthLimit = 1000 // Much lower than tier bandwidth!
+	s := newTestServer(t, c)
+
+	// Create tier with certain limits
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:                     "test",
+		MessageLimit:             10,
+		MessageExpiryDuration:    time.Hour,
+		AttachmentFileSizeLimit:  50_000,
+		AttachmentTotalSizeLimit: 200_000,
+		AttachmentExpiryDuration: time.Hour,
+		AttachmentBandwidthLimit: 14000, // < 3x5000 bytes -> enough for one upload, one download
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "test"))
+
+	// Publish and make sure we can retrieve it
+	rr := request(t, s, "PUT", "/mytopic", content, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	msg := toMessage(t, rr.Body.String())
+
+	// Retrieve it (first time succeeds)
+	rr = request(t, s, "GET", "/file/"+msg.ID, content, nil) // File downloads do not send auth headers!!
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, content, rr.Body.String())
+
+	// Retrieve it AGAIN (fails, due to bandwidth limit)
+	rr = request(t, s, "GET", "/file/"+msg.ID, content, nil)
+	require.Equal(t, 429, rr.Code)
+}
+
+func TestServer_PublishAttachmentWithTierBasedAttachmentMessagesLimit(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.VisitorAttachmentMessageDailyLimit = 100 // Tier limit takes precedence
+	s := newTestServer(t, c)
+
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:                     "test",
+		MessageLimit:             10,
+		MessageExpiryDuration:    time.Hour,
+		AttachmentFileSizeLimit:  50_000,
+		AttachmentTotalSizeLimit: 200_000,
+		AttachmentExpiryDuration: time.Hour,
+		AttachmentBandwidthLimit: 100_000,
+		AttachmentMessagesLimit:  2,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "test"))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+
+	// Uploaded file and external attachment count, plain text messages do not
+	rr := request(t, s, "PUT", "/mytopic", util.RandomString(5000), headers)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "some text", headers)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic?attach=https://example.com/file.jpg", "", headers)
+	require.Equal(t, 200, rr.Code)
+
+	// Third attachment is rejected, but text messages still work
+	rr = request(t, s, "PUT", "/mytopic?f=myfile.txt", "this is an attachment", headers)
+	require.Equal(t, 429, rr.Code)
+	require.Equal(t, 42917, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "PUT", "/mytopic", "more text", headers)
+	require.Equal(t, 200, rr.Code)
+
+	// Usage is reported in the account stats
+	rr = request(t, s, "GET", "/v1/account", "", headers)
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, int64(2), account.Limits.AttachmentMessages)
+	require.Equal(t, int64(2), account.Stats.AttachmentMessages)
+	require.Equal(t, int64(0), account.Stats.AttachmentMessagesRemaining)
+	require.Equal(t, int64(4), account.Stats.Messages) // Rejected message was refunded
+}
+
+func TestServer_PublishWithTierBasedUrgentMessagesLimit(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, c)
+
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:                "test",
+		MessageLimit:        10,
+		UrgentMessagesLimit: 1,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "test"))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+
+	// Only priority 5 messages count
+	rr := request(t, s, "PUT", "/mytopic?priority=urgent", "fire!", headers)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic?priority=4", "smoke", headers)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic?priority=5", "more fire!", headers)
+	require.Equal(t, 429, rr.Code)
+	require.Equal(t, 42922, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "PUT", "/mytopic", "all good", headers)
+	require.Equal(t, 200, rr.Code)
+
+	// Usage is reported in the account stats
+	rr = request(t, s, "GET", "/v1/account", "", headers)
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, int64(1), account.Limits.UrgentMessages)
+	require.Equal(t, int64(1), account.Stats.UrgentMessages)
+	require.Equal(t, int64(0), account.Stats.UrgentMessagesRemaining)
+	require.Equal(t, int64(3), account.Stats.Messages) // Rejected message was refunded
+
+	// Anonymous visitors are not affected
+	for i := 0; i < 3; i++ {
+		require.Equal(t, 200, request(t, s, "PUT", "/mytopic?priority=5", "fire!", nil).Code)
+	}
+}
 
+func TestServer_PublishWithTierBasedUrgentMessagesLimit_Refund(t *testing.T) {
 	c := newTestConfigWithAuthFile(t)
-	c.AttachmentExpiryDuration = time.Millisecond // Hack
+	c.VisitorDistinctTopicsDailyLimit = 5
+	c.AttachmentFileSizeLimit = 10
 	s := newTestServer(t, c)
 
-	// Create tier with certain limits
-	sevenDays := time.Duration(604800) * time.Second
 	require.Nil(t, s.userManager.AddTier(&user.Tier{
 		Code:                     "test",
 		MessageLimit:             10,
-		MessageExpiryDuration:    sevenDays,
-		AttachmentFileSizeLimit:  50_000,
-		AttachmentTotalSizeLimit: 200_000,
-		AttachmentExpiryDuration: sevenDays, // 7 days
-		AttachmentBandwidthLimit: 100000,
+		UrgentMessagesLimit:      1,
+		AttachmentMessagesLimit:  1,
+		AttachmentFileSizeLimit:  10,
+		AttachmentTotalSizeLimit: 100,
+		AttachmentBandwidthLimit: 1000,
 	}))
 	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
 	require.Nil(t, s.userManager.ChangeTier("phil", "test"))
-
-	// Publish and make sure we can retrieve it
-	response := request(t, s, "PUT", "/mytopic", content, map[string]string{
+	headers := map[string]string{
 		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+
+	// Attachment is too large, so the counters are given back
+	rr := request(t, s, "PUT", "/mytopic?priority=5&filename=fire.txt", "this attachment is too large", headers)
+	require.Equal(t, 413, rr.Code)
+	rr = request(t, s, "GET", "/v1/account", "", headers)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, int64(0), account.Stats.Messages)
+	require.Equal(t, int64(0), account.Stats.UrgentMessages)
+	require.Equal(t, int64(0), account.Stats.AttachmentMessages)
+
+	rr = request(t, s, "PUT", "/mytopic?priority=5&filename=fire.txt", "fire!", headers)
+	require.Equal(t, 200, rr.Code)
+
+	// Distinct topics of anonymous visitors are given back as well
+	rr = request(t, s, "PUT", "/othertopic?filename=a.txt", "this attachment is too large for anonymous visitors too", nil)
+	require.Equal(t, 413, rr.Code)
+	v := s.visitor(netip.MustParseAddr("9.9.9.9"), nil)
+	require.False(t, v.KnownTopic("othertopic"))
+}
+
+func TestServer_PublishWithMinMessageInterval(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMinMessageInterval = time.Hour
+	c.AttachmentFileSizeLimit = 5
+	s := newTestServer(t, c)
+
+	// Messages that are rejected after the interval check do not start the interval
+	rr := request(t, s, "PUT", "/mytopic?filename=a.txt", "attachment too large", nil)
+	require.Equal(t, 413, rr.Code)
+
+	rr = request(t, s, "PUT", "/mytopic", "first", nil)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "duplicate", nil)
+	require.Equal(t, 429, rr.Code)
+	require.Equal(t, 42920, toHTTPError(t, rr.Body.String()).Code)
+
+	// Other visitors are not affected, and rejected messages are not counted
+	rr = request(t, s, "PUT", "/mytopic", "other visitor", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4:1234"
 	})
-	require.Equal(t, 200, response.Code)
-	msg := toMessage(t, response.Body.String())
-	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
-	require.True(t, msg.Attachment.Expires > time.Now().Add(sevenDays-30*time.Second).Unix())
-	require.True(t, msg.Expires > time.Now().Add(sevenDays-30*time.Second).Unix())
-	file := filepath.Join(s.config.AttachmentCacheDir, msg.ID)
-	require.FileExists(t, file)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, int64(1), s.visitor(netip.MustParseAddr("9.9.9.9"), nil).Stats().Messages)
+}
 
-	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
-	response = request(t, s, "GET", path, "", nil)
-	require.Equal(t, 200, response.Code)
-	require.Equal(t, content, response.Body.String())
+func TestServer_PublishInboundEmail_Limit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorInboundEmailLimitBurst = 2
+	s := newTestServer(t, c)
+	fromSender := func(sender string) func(r *http.Request) {
+		return func(r *http.Request) {
+			*r = *withContext(r, map[contextKey]any{contextInboundEmailSender: sender})
+		}
+	}
 
-	// Prune and makes sure it's still there
-	time.Sleep(time.Second) // Sigh ...
-	s.execManager()
-	require.FileExists(t, file)
-	response = request(t, s, "GET", path, "", nil)
-	require.Equal(t, 200, response.Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "mail 1", nil, fromSender("phil@example.com")).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "mail 2", nil, fromSender("Phil@example.com")).Code)
+	rr := request(t, s, "PUT", "/mytopic", "mail 3", nil, fromSender("phil@example.com"))
+	require.Equal(t, 429, rr.Code)
+	require.Equal(t, 42921, toHTTPError(t, rr.Body.String()).Code)
+
+	// Other senders via the same relay, and regular messages are not affected
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "mail 1", nil, fromSender("lisa@example.com")).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "not a mail", nil).Code)
+	require.Equal(t, int64(4), s.visitor(netip.MustParseAddr("9.9.9.9"), nil).Stats().Messages)
 }
 
-func TestServer_PublishAttachmentWithTierBasedBandwidthLimit(t *testing.T) {
-	content := util.RandomString(5000) // > 4096
+func TestServer_PublishWithDedupWindow_Reject(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorDedupWindow = time.Hour
+	s := newTestServer(t, c)
+
+	rr := request(t, s, "PUT", "/mytopic", "disk full", map[string]string{"Title": "alert"})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "disk full", map[string]string{"Title": "alert"})
+	require.Equal(t, 409, rr.Code)
+	require.Equal(t, 40905, toHTTPError(t, rr.Body.String()).Code)
+
+	// Different topic, title, body or priority is not a duplicate
+	require.Equal(t, 200, request(t, s, "PUT", "/othertopic", "disk full", map[string]string{"Title": "alert"}).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/othertopic", "disk full", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/othertopic", "disk almost full", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/othertopic", "disk almost full", map[string]string{"Priority": "high"}).Code)
+	require.Equal(t, int64(5), s.visitor(netip.MustParseAddr("9.9.9.9"), nil).Stats().Messages) // Duplicate is not counted
+}
+
+func TestServer_PublishWithDedupWindow_Drop(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorDedupWindow = time.Hour
+	c.VisitorDedupMode = VisitorDedupModeDrop
+	s := newTestServer(t, c)
 
+	rr := request(t, s, "PUT", "/mytopic", "disk full", nil)
+	require.Equal(t, 200, rr.Code)
+	first := toMessage(t, rr.Body.String())
+	rr = request(t, s, "PUT", "/mytopic", "disk full", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, first.ID, toMessage(t, rr.Body.String()).ID) // Previous message is returned
+
+	rr = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, 1, len(toMessages(t, rr.Body.String())))
+	require.Equal(t, int64(1), s.visitor(netip.MustParseAddr("9.9.9.9"), nil).Stats().Messages)
+}
+
+func TestServer_PublishWithTierBasedGatewayMessagesLimit(t *testing.T) {
 	c := newTestConfigWithAuthFile(t)
-	c.VisitorAttachmentDailyBandwidthLimit = 1000 // Much lower than tier bandwidth!
+	c.VisitorGatewayMessageDailyLimit = 100 // Tier limit takes precedence
 	s := newTestServer(t, c)
 
-	// Create tier with certain limits
 	require.Nil(t, s.userManager.AddTier(&user.Tier{
-		Code:                     "test",
-		MessageLimit:             10,
-		MessageExpiryDuration:    time.Hour,
-		AttachmentFileSizeLimit:  50_000,
-		AttachmentTotalSizeLimit: 200_000,
-		AttachmentExpiryDuration: time.Hour,
-		AttachmentBandwidthLimit: 14000, // < 3x5000 bytes -> enough for one upload, one download
+		Code:                  "test",
+		MessageLimit:          10,
+		MessageExpiryDuration: time.Hour,
+		GatewayMessagesLimit:  2,
 	}))
 	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
 	require.Nil(t, s.userManager.ChangeTier("phil", "test"))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
 
-	// Publish and make sure we can retrieve it
-	rr := request(t, s, "PUT", "/mytopic", content, map[string]string{
+	// UnifiedPush messages count towards the gateway limit, not the message limit
+	rr := request(t, s, "PUT", "/mytopic?up=1", "push message", headers)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "push message", map[string]string{
 		"Authorization": util.BasicAuth("phil", "phil"),
+		"X-UnifiedPush": "1",
 	})
 	require.Equal(t, 200, rr.Code)
-	msg := toMessage(t, rr.Body.String())
-
-	// Retrieve it (first time succeeds)
-	rr = request(t, s, "GET", "/file/"+msg.ID, content, nil) // File downloads do not send auth headers!!
+	rr = request(t, s, "PUT", "/mytopic", "some text", headers)
 	require.Equal(t, 200, rr.Code)
-	require.Equal(t, content, rr.Body.String())
 
-	// Retrieve it AGAIN (fails, due to bandwidth limit)
-	rr = request(t, s, "GET", "/file/"+msg.ID, content, nil)
+	// Third gateway message is rejected, but normal messages still work
+	rr = request(t, s, "PUT", "/mytopic?up=1", "push message", headers)
 	require.Equal(t, 429, rr.Code)
+	require.Equal(t, 42919, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "PUT", "/mytopic", "more text", headers)
+	require.Equal(t, 200, rr.Code)
+
+	// Usage is reported separately in the account stats
+	rr = request(t, s, "GET", "/v1/account", "", headers)
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, int64(2), account.Limits.GatewayMessages)
+	require.Equal(t, int64(2), account.Stats.GatewayMessages)
+	require.Equal(t, int64(0), account.Stats.GatewayMessagesRemaining)
+	require.Equal(t, int64(2), account.Stats.Messages)
+}
+
+func TestServer_MatrixGateway_Push_CountedAsGatewayMessage(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	notification := `{"notification":{"devices":[{"pushkey":"http://127.0.0.1:12345/mytopic"}]}}`
+	response := request(t, s, "POST", "/_matrix/push/v1/notify", notification, nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "some text", nil)
+	require.Equal(t, 200, response.Code)
+
+	// No separate limit, so the gateway message also counts towards the message limit
+	response = request(t, s, "GET", "/v1/account", "", nil)
+	require.Equal(t, 200, response.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+	require.Equal(t, int64(0), account.Limits.GatewayMessages)
+	require.Equal(t, int64(1), account.Stats.GatewayMessages)
+	require.Equal(t, int64(2), account.Stats.Messages)
 }
 
 func TestServer_PublishAttachmentWithTierBasedLimits(t *testing.T) {
@@ -2043,6 +3364,50 @@ func TestServer_PublishAttachmentWithTierBasedLimits(t *testing.T) {
 	require.Equal(t, 41301, toHTTPError(t, response.Body.String()).Code)
 }
 
+func TestServer_PublishAttachmentWithAttachmentTotalSizeLimitOverride(t *testing.T) {
+	file := util.RandomString(15_000)
+
+	c := newTestConfigWithAuthFile(t)
+	c.AttachmentFileSizeLimit = 20_000
+	c.VisitorAttachmentTotalSizeLimit = 20_000
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	// Without override, the config-based limit applies
+	response := request(t, s, "PUT", "/mytopic", file, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", file, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 413, response.Code)
+
+	// Grant extra storage
+	extra := int64(50_000)
+	require.Nil(t, s.userManager.ChangeLimitOverrides("phil", nil, nil, nil, &extra))
+	response = request(t, s, "PUT", "/mytopic", file, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+	require.Equal(t, int64(50_000), account.Limits.AttachmentTotalSize)
+	require.Equal(t, int64(30_000), account.Stats.AttachmentTotalSize)
+	require.Equal(t, int64(20_000), account.Stats.AttachmentTotalSizeRemaining)
+
+	// Zero falls through to the config-based limit
+	zero := int64(0)
+	require.Nil(t, s.userManager.ChangeLimitOverrides("phil", nil, nil, nil, &zero))
+	response = request(t, s, "PUT", "/mytopic", file, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 413, response.Code)
+}
+
 func TestServer_PublishAttachmentBandwidthLimit(t *testing.T) {
 	content := util.RandomString(5000) // > 4096
 
@@ -2068,6 +3433,107 @@ func TestServer_PublishAttachmentBandwidthLimit(t *testing.T) {
 	err := toHTTPError(t, response.Body.String())
 	require.Equal(t, 429, response.Code)
 	require.Equal(t, 42905, err.Code)
+
+	// Bandwidth usage is reported in the account stats
+	response = request(t, s, "GET", "/v1/account", "", nil)
+	require.Equal(t, 200, response.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+	require.Equal(t, int64(5*5000+123), account.Limits.AttachmentBandwidth)
+	require.InDelta(t, 5*5000, account.Stats.AttachmentBandwidth, 10) // Bucket refills slowly
+	require.InDelta(t, 123, account.Stats.AttachmentBandwidthRemaining, 10)
+}
+
+func TestServer_PublishDistinctTopicsLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorDistinctTopicsDailyLimit = 2
+	s := newTestServer(t, c)
+
+	require.Equal(t, 200, request(t, s, "PUT", "/topic1", "hi", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/topic2", "hi", nil).Code)
+	response := request(t, s, "PUT", "/topic3", "hi", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42914, toHTTPError(t, response.Body.String()).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/topic1", "hi again", nil).Code)
+
+	// Other visitors have their own set of topics
+	response = request(t, s, "PUT", "/topic3", "hi", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4:1234"
+	})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_FakeVisitorLimiter(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorRequestLimitBurst = 1
+	c.VisitorMessageDailyLimit = 1
+	s := newTestServer(t, c)
+
+	// Allowing everything ignores the configured limits
+	s.limiterFor = func(v *visitor) visitorLimiter { return &testVisitorLimiter{allow: true} }
+	for i := 0; i < 5; i++ {
+		require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "hi", nil).Code)
+	}
+
+	// Denying everything rejects the request before it reaches the handler
+	s.limiterFor = func(v *visitor) visitorLimiter { return &testVisitorLimiter{} }
+	response := request(t, s, "PUT", "/mytopic", "hi", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42901, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 429, response.Code)
+}
+
+func TestServer_PublishIngressBandwidthLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorIngressDailyBandwidthLimit = 10000
+	s := newTestServer(t, c)
+
+	// Messages and attachments both count towards the ingress limit
+	response := request(t, s, "PUT", "/mytopic", util.RandomString(3000), nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", util.RandomString(6000), nil)
+	require.Equal(t, 200, response.Code)
+	require.NotNil(t, toMessage(t, response.Body.String()).Attachment)
+
+	// Over the limit, rejected
+	response = request(t, s, "PUT", "/mytopic", util.RandomString(2000), nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42913, toHTTPError(t, response.Body.String()).Code)
+
+	// Still room for a small message, the rejected message was not counted
+	response = request(t, s, "PUT", "/mytopic", "hi", nil)
+	require.Equal(t, 200, response.Code)
+
+	info, err := s.visitor(netip.MustParseAddr("9.9.9.9"), nil).Info() // see request()
+	require.Nil(t, err)
+	require.Equal(t, int64(10000), info.Limits.IngressBandwidthLimit)
+	require.Equal(t, int64(9002), info.Stats.IngressBandwidth)
+	require.Equal(t, int64(998), info.Stats.IngressBandwidthRemaining)
+}
+
+func TestServer_PublishAttachmentBandwidthLimitThrottle(t *testing.T) {
+	content := util.RandomString(5000) // > 4096
+
+	c := newTestConfig(t)
+	c.VisitorAttachmentDailyBandwidthLimit = 5*5000 + 123 // A little more than 1 upload and 3 downloads
+	c.VisitorAttachmentBandwidthMode = VisitorAttachmentBandwidthModeThrottle
+	s := newTestServer(t, c)
+
+	// Publish attachment
+	response := request(t, s, "PUT", "/mytopic", content, nil)
+	msg := toMessage(t, response.Body.String())
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+	for i := 1; i <= 4; i++ { // 4 downloads at full speed
+		response = request(t, s, "GET", path, "", nil)
+		require.Equal(t, 200, response.Code)
+	}
+
+	// Fifth download is not rejected, but throttled
+	start := time.Now()
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, content, response.Body.String())
+	require.True(t, time.Since(start) >= 500*time.Millisecond) // ~123 bytes right away, the rest at 8K/s
 }
 
 func TestServer_PublishAttachmentBandwidthLimitUploadOnly(t *testing.T) {
@@ -2221,6 +3687,102 @@ func TestServer_PublishWhileUpdatingStatsWithLotsOfMessages(t *testing.T) {
 	log.Info("Done: Waiting for all locks")
 }
 
+func TestServer_TierUser_RoamingBetweenIPs_SameVisitor(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "test", MessageLimit: 10}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "test"))
+
+	// Publish from two different networks
+	rr := request(t, s, "POST", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "POST", "/mytopic", "hi again", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4:1234"
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Limiter state is kept, and the IP address is updated
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	v := s.visitor(netip.MustParseAddr("1.2.3.4"), u)
+	require.Equal(t, int64(2), v.Stats().Messages)
+	require.Equal(t, "1.2.3.4", v.IP().String())
+	messages, err := s.messageCache.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, "1.2.3.4", messages[1].Sender.String())
+}
+
+func TestServer_ReloadVisitorLimits(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorSubscriptionLimit = 5
+	conf.VisitorMessageDailyLimit = 10
+	s := newTestServer(t, conf)
+
+	rr := request(t, s, "POST", "/mytopic", "hi", nil)
+	require.Equal(t, 200, rr.Code)
+	v := s.visitor(netip.MustParseAddr("9.9.9.9"), nil)
+	require.Equal(t, int64(5), v.subscriptionLimiter.Remaining())
+
+	// Default mode: existing limiters are kept, new visitors get the new limits
+	s.ReloadVisitorLimits(func(conf *Config) {
+		conf.VisitorSubscriptionLimit = 2
+		conf.VisitorMessageDailyLimit = 3
+	})
+	require.Equal(t, 5, conf.VisitorSubscriptionLimit) // Original config is unchanged
+	require.Equal(t, int64(5), v.subscriptionLimiter.Remaining())
+	require.Equal(t, int64(2), v.Limits().SubscriptionLimit)
+	v2 := s.visitor(netip.MustParseAddr("1.2.3.4"), nil)
+	require.Equal(t, int64(2), v2.subscriptionLimiter.Remaining())
+
+	// Rebuild mode: limiters of existing visitors are rebuilt right away, and keep their counters
+	s.ReloadVisitorLimits(func(conf *Config) {
+		conf.VisitorLimitsReloadMode = VisitorLimitsReloadModeRebuild
+	})
+	require.Equal(t, int64(2), v.subscriptionLimiter.Remaining())
+	require.Equal(t, int64(1), v.Stats().Messages)
+	require.Equal(t, int64(2), v.InfoLight().Stats.MessagesRemaining)
+
+	// Toggling anonymous publishing still works for all visitors
+	s.config.AnonymousPublishDisabled.Store(true)
+	require.Equal(t, errAnonymousPublishDisabled, v.MessageAllowedPeek())
+}
+
+func TestServer_ReloadVisitorLimits_WhileWaiting(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorRequestLimitBurst = 1
+	conf.VisitorRequestLimitReplenish = 10 * time.Millisecond
+	conf.VisitorRequestMaxWait = time.Second
+	s := newTestServer(t, conf)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "message", nil).Code) // Creates the visitor
+
+	// Requests waiting for the request limiter are not affected by a reload (go test -race)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := request(t, s, "PUT", "/mytopic", "message", map[string]string{
+				"X-Backpressure": "wait",
+			})
+			require.Equal(t, 200, rr.Code)
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		s.ReloadVisitorLimits(func(conf *Config) {
+			conf.VisitorRequestMaxWait = time.Duration(1000+i) * time.Millisecond
+		})
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+}
+
 func TestServer_AnonymousUser_And_NonTierUser_Are_Same_Visitor(t *testing.T) {
 	conf := newTestConfigWithAuthFile(t)
 	s := newTestServer(t, conf)
@@ -2306,6 +3868,33 @@ func TestServer_SubscriberRateLimiting_Success(t *testing.T) {
 	require.Equal(t, 429, rr.Code)
 }
 
+func TestServer_SubscriberRateLimiting_LimitObject(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.VisitorMessageDailyLimit = 2
+	c.VisitorSubscriberRateLimiting = true
+	s := newTestServer(t, c)
+
+	rr := request(t, s, "GET", "/upAAAAAAAAAAAA/json?poll=1", "", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4"
+	})
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/some-other-topic", "some message", nil).Code)
+
+	// Limit object describes the subscriber's limits, not the publisher's (which has one message left)
+	for i := 0; i < 2; i++ {
+		require.Equal(t, 200, request(t, s, "PUT", "/upAAAAAAAAAAAA", "some message", nil).Code)
+	}
+	rr = request(t, s, "PUT", "/upAAAAAAAAAAAA", "some message", nil)
+	require.Equal(t, 429, rr.Code)
+	var body struct {
+		Limit *limitErrorResponse `json:"limit"`
+	}
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&body))
+	require.NotNil(t, body.Limit)
+	require.Equal(t, "messages", body.Limit.Limiter)
+	require.Equal(t, int64(0), body.Limit.Remaining)
+}
+
 func TestServer_SubscriberRateLimiting_NotWrongTopic(t *testing.T) {
 	c := newTestConfigWithAuthFile(t)
 	c.VisitorSubscriberRateLimiting = true
@@ -74,6 +74,7 @@ type smtpSession struct {
 	conn    *smtp.Conn
 	topic   string
 	token   string
+	from    string // Sender address (MAIL FROM), may be empty, see visitor.InboundEmailAllowed
 	mu      sync.Mutex
 }
 
@@ -84,6 +85,12 @@ func (s *smtpSession) AuthPlain(username, _ string) error {
 
 func (s *smtpSession) Mail(from string, opts *smtp.MailOptions) error {
 	logem(s.conn).Field("smtp_mail_from", from).Debug("MAIL FROM: %s", from)
+	if address, err := mail.ParseAddress(from); err == nil {
+		from = address.Address
+	}
+	s.mu.Lock()
+	s.from = from
+	s.mu.Unlock()
 	return nil
 }
 
@@ -199,6 +206,9 @@ func (s *smtpSession) publishMessage(m *message) error {
 	if s.token != "" {
 		req.Header.Add("Authorization", "Bearer "+s.token)
 	}
+	req = withContext(req, map[contextKey]any{
+		contextInboundEmailSender: s.from, // Inbound e-mail limit, see visitor.InboundEmailAllowed
+	})
 	rr := httptest.NewRecorder()
 	s.backend.handler(rr, req)
 	if rr.Code != http.StatusOK {
@@ -210,6 +220,7 @@ func (s *smtpSession) publishMessage(m *message) error {
 func (s *smtpSession) Reset() {
 	s.mu.Lock()
 	s.topic = ""
+	s.from = ""
 	s.mu.Unlock()
 }
 
@@ -1386,6 +1386,26 @@ what's up
 	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
 }
 
+func TestSmtpBackend_InboundEmailSender(t *testing.T) {
+	email := `EHLO example.com
+MAIL FROM: <phil@example.com>
+RCPT TO: ntfy-mytopic@ntfy.sh
+DATA
+Subject: Very short mail
+
+what's up
+.
+`
+	s, c, _, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		sender, err := fromContext[string](r, contextInboundEmailSender)
+		require.Nil(t, err)
+		require.Equal(t, "phil@example.com", sender)
+	})
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
 type smtpHandlerFunc func(http.ResponseWriter, *http.Request)
 
 func newTestSMTPServer(t *testing.T, handler smtpHandlerFunc) (s *smtp.Server, c net.Conn, conf *Config, scanner *bufio.Scanner) {
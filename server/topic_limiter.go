@@ -0,0 +1,60 @@
+package server
+
+import (
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// topicLimiter limits the rate of messages per topic, independent of the visitor that publishes them.
+// This protects against a single runaway script flooding a topic, even if it publishes via a shared account
+// with generous visitor limits. See Config.TopicMessageLimitBurst.
+type topicLimiter struct {
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*rate.Limiter // Topic ID -> limiter
+	mu       sync.Mutex
+}
+
+// newTopicLimiter creates a new topic limiter with the given rate and burst for each topic
+func newTopicLimiter(limit rate.Limit, burst int) *topicLimiter {
+	return &topicLimiter{
+		limit:    limit,
+		burst:    burst,
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// Allow returns true if another message may be published to the given topic
+func (l *topicLimiter) Allow(topic string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter, ok := l.limiters[topic]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[topic] = limiter
+	}
+	return limiter.Allow()
+}
+
+// Prune removes the limiters of idle topics, and returns the number of removed limiters. A topic is idle if its
+// bucket is entirely refilled, so removing it does not lose any state.
+func (l *topicLimiter) Prune() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pruned := 0
+	for topic, limiter := range l.limiters {
+		if limiter.Tokens() >= float64(l.burst) {
+			delete(l.limiters, topic)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// Len returns the number of topics that are currently tracked
+func (l *topicLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.limiters)
+}
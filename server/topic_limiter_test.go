@@ -0,0 +1,32 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestTopicLimiter_AllowPrune(t *testing.T) {
+	l := newTopicLimiter(rate.Every(time.Hour), 2)
+	require.True(t, l.Allow("mytopic"))
+	require.True(t, l.Allow("mytopic"))
+	require.False(t, l.Allow("mytopic"))
+	require.True(t, l.Allow("othertopic"))
+	require.Equal(t, 2, l.Len())
+
+	// Topics with a partially drained bucket are kept
+	require.Equal(t, 0, l.Prune())
+	require.Equal(t, 2, l.Len())
+}
+
+func TestTopicLimiter_PruneIdle(t *testing.T) {
+	l := newTopicLimiter(rate.Every(50*time.Millisecond), 1)
+	require.True(t, l.Allow("mytopic"))
+	require.False(t, l.Allow("mytopic"))
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, l.Prune())
+	require.Equal(t, 0, l.Len())
+	require.True(t, l.Allow("mytopic"))
+}
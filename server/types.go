@@ -43,6 +43,7 @@ type message struct {
 	Encoding    string      `json:"encoding,omitempty"`     // empty for raw UTF-8, or "base64" for encoded bytes
 	Sender      netip.Addr  `json:"-"`                      // IP address of uploader, used for rate limiting
 	User        string      `json:"-"`                      // UserID of the uploader, used to associated attachments
+	RateVisitor string      `json:"-"`                      // ID of the visitor charged for a scheduled message, see sendDelayedMessages
 }
 
 func (m *message) Context() log.Context {
@@ -108,6 +109,17 @@ type publishMessage struct {
 	Delay    string   `json:"delay"`
 }
 
+// apiPublishBatchRequest is used as input when publishing multiple messages at once, see handlePublishBatch
+type apiPublishBatchRequest struct {
+	Messages []*publishMessage `json:"messages"`
+	Partial  bool              `json:"partial"` // If true, publish as many messages as the message limit allows
+}
+
+type apiPublishBatchResponse struct {
+	Messages []*message `json:"messages"`
+	Rejected int        `json:"rejected,omitempty"` // Number of messages not published due to the message limit (partial only)
+}
+
 // messageEncoder is a function that knows how to encode a message
 type messageEncoder func(msg *message) (string, error)
 
@@ -271,6 +283,86 @@ type apiUserDeleteRequest struct {
 	Username string `json:"username"`
 }
 
+type apiUserResetLimitsResponse struct {
+	Username string            `json:"username"`
+	Limits   *apiAccountLimits `json:"limits"`
+	Stats    *apiAccountStats  `json:"stats"`
+}
+
+type apiUserPauseRequest struct {
+	Until int64 `json:"until,omitempty"` // Unix timestamp, paused until unpaused if unset
+}
+
+type apiUserPauseResponse struct {
+	Username    string `json:"username"`
+	Paused      bool   `json:"paused"`
+	PausedUntil int64  `json:"paused_until,omitempty"`
+}
+
+type apiUserBoostRequest struct {
+	Multiplier float64 `json:"multiplier"`
+	Expires    int64   `json:"expires"` // Unix timestamp
+}
+
+type apiUserBoostResponse struct {
+	Username     string  `json:"username"`
+	Boost        float64 `json:"boost,omitempty"`
+	BoostExpires int64   `json:"boost_expires,omitempty"`
+}
+
+type apiAdminAnonymousPublishRequest struct {
+	Disabled bool `json:"disabled"`
+}
+
+type apiAdminAnonymousPublishResponse struct {
+	Disabled bool `json:"disabled"`
+}
+
+type apiAdminVisitorResponse struct {
+	IP            string  `json:"ip"`
+	User          string  `json:"user,omitempty"`
+	Basis         string  `json:"basis"`
+	Messages      int64   `json:"messages"`
+	Emails        int64   `json:"emails"`
+	Subscriptions int64   `json:"subscriptions"`
+	Stale         bool    `json:"stale"`
+	Tenant        string  `json:"tenant,omitempty"`
+	Requests      int64   `json:"requests,omitempty"`        // Only if visitor-request-stats is set
+	RequestTimeMs float64 `json:"request_time_ms,omitempty"` // Moving average of the request processing time
+}
+
+type apiAdminFirebasePenaltyResponse struct {
+	Cleared int `json:"cleared"` // Number of visitors whose Firebase penalty was lifted
+}
+
+type apiAdminTenantResponse struct {
+	Tenant   string `json:"tenant"`
+	Visitors int    `json:"visitors"`
+	Messages int64  `json:"messages"`
+	Emails   int64  `json:"emails"`
+}
+
+type apiAdminLimitsResponse struct {
+	Visitor  string                           `json:"visitor"`
+	IP       string                           `json:"ip"`
+	User     string                           `json:"user,omitempty"`
+	Basis    string                           `json:"basis"`
+	Live     bool                             `json:"live"` // False if the visitor is not in memory, and was constructed for this request
+	Created  int64                            `json:"created"`
+	LastSeen int64                            `json:"last_seen"`
+	Limits   *apiAccountLimits                `json:"limits"`
+	Stats    *apiAccountStats                 `json:"stats"`
+	Limiters map[string]*apiAdminLimiterState `json:"limiters"`
+}
+
+type apiAdminLimiterState struct {
+	Value     int64   `json:"value,omitempty"`
+	Remaining int64   `json:"remaining,omitempty"`
+	Tokens    float64 `json:"tokens,omitempty"`
+	Burst     int     `json:"burst,omitempty"`
+	Rate      float64 `json:"rate,omitempty"` // Tokens per second
+}
+
 type apiAccessAllowRequest struct {
 	Username   string `json:"username"`
 	Topic      string `json:"topic"` // This may be a pattern
@@ -331,29 +423,62 @@ type apiAccountTier struct {
 }
 
 type apiAccountLimits struct {
-	Basis                    string `json:"basis,omitempty"` // "ip" or "tier"
-	Messages                 int64  `json:"messages"`
-	MessagesExpiryDuration   int64  `json:"messages_expiry_duration"`
-	Emails                   int64  `json:"emails"`
-	Calls                    int64  `json:"calls"`
-	Reservations             int64  `json:"reservations"`
-	AttachmentTotalSize      int64  `json:"attachment_total_size"`
-	AttachmentFileSize       int64  `json:"attachment_file_size"`
-	AttachmentExpiryDuration int64  `json:"attachment_expiry_duration"`
-	AttachmentBandwidth      int64  `json:"attachment_bandwidth"`
+	Basis                    string  `json:"basis,omitempty"`   // "ip", "tier", "user" or "profile"
+	Profile                  string  `json:"profile,omitempty"` // Limit profile of the token, see Config.VisitorLimitProfiles
+	Messages                 int64   `json:"messages"`
+	MessagesMonthly          int64   `json:"messages_monthly,omitempty"` // Zero if there is no monthly limit
+	MessagesExpiryDuration   int64   `json:"messages_expiry_duration"`
+	Emails                   int64   `json:"emails"`
+	EmailsBurst              int64   `json:"emails_burst"`
+	Calls                    int64   `json:"calls"`
+	Reservations             int64   `json:"reservations"`
+	Subscriptions            int64   `json:"subscriptions"`
+	AttachmentTotalSize      int64   `json:"attachment_total_size"`
+	AttachmentFileSize       int64   `json:"attachment_file_size"`
+	AttachmentExpiryDuration int64   `json:"attachment_expiry_duration"`
+	AttachmentBandwidth      int64   `json:"attachment_bandwidth"`
+	AttachmentMessages       int64   `json:"attachment_messages,omitempty"` // Zero if there is no separate limit for messages with attachments
+	GatewayMessages          int64   `json:"gateway_messages,omitempty"`    // Zero if there is no separate limit for UnifiedPush/Matrix gateway messages
+	UrgentMessages           int64   `json:"urgent_messages,omitempty"`     // Zero if there is no separate limit for urgent messages
+	GraceUntil               int64   `json:"grace_until,omitempty"`         // Unix timestamp, only set during the new account grace
+	Boost                    float64 `json:"boost,omitempty"`               // Multiplier of the temporary limit boost, only set while it is active
+	BoostExpires             int64   `json:"boost_expires,omitempty"`       // Unix timestamp, only set while the boost is active
+}
+
+// limitErrorResponse is the machine-readable "limit" object in the JSON body of 429 responses, see visitor.LimitError
+type limitErrorResponse struct {
+	Limiter   string `json:"limiter"`            // Name of the limiter that rejected the request, e.g. "messages"
+	Basis     string `json:"basis"`              // How the limits are derived, i.e. "ip", "tier", "user" or "profile"
+	Limit     int64  `json:"limit,omitempty"`    // Zero if unknown for this limiter
+	Remaining int64  `json:"remaining"`          // Usually zero, but may be non-zero if the request cost more than one
+	ResetAt   int64  `json:"reset_at,omitempty"` // Unix timestamp at which the limit is reset (or replenished), if known
 }
 
 type apiAccountStats struct {
-	Messages                     int64 `json:"messages"`
-	MessagesRemaining            int64 `json:"messages_remaining"`
-	Emails                       int64 `json:"emails"`
-	EmailsRemaining              int64 `json:"emails_remaining"`
-	Calls                        int64 `json:"calls"`
-	CallsRemaining               int64 `json:"calls_remaining"`
-	Reservations                 int64 `json:"reservations"`
-	ReservationsRemaining        int64 `json:"reservations_remaining"`
-	AttachmentTotalSize          int64 `json:"attachment_total_size"`
-	AttachmentTotalSizeRemaining int64 `json:"attachment_total_size_remaining"`
+	Messages                     int64   `json:"messages"`
+	MessagesRemaining            int64   `json:"messages_remaining"`
+	MessagesResetAt              int64   `json:"messages_reset_at"`
+	MessagesMonthly              int64   `json:"messages_monthly"`
+	MessagesMonthlyRemaining     int64   `json:"messages_monthly_remaining,omitempty"`
+	Emails                       int64   `json:"emails"`
+	EmailsRemaining              int64   `json:"emails_remaining"`
+	Calls                        int64   `json:"calls"`
+	CallsRemaining               int64   `json:"calls_remaining"`
+	Reservations                 int64   `json:"reservations"`
+	ReservationsRemaining        int64   `json:"reservations_remaining"`
+	AttachmentTotalSize          int64   `json:"attachment_total_size"`
+	AttachmentTotalSizeRemaining int64   `json:"attachment_total_size_remaining"`
+	AttachmentBandwidth          int64   `json:"attachment_bandwidth"`
+	AttachmentBandwidthRemaining int64   `json:"attachment_bandwidth_remaining"`
+	AttachmentBandwidthResetAt   int64   `json:"attachment_bandwidth_reset_at"`
+	AttachmentMessages           int64   `json:"attachment_messages,omitempty"`
+	AttachmentMessagesRemaining  int64   `json:"attachment_messages_remaining,omitempty"`
+	GatewayMessages              int64   `json:"gateway_messages"`
+	GatewayMessagesRemaining     int64   `json:"gateway_messages_remaining,omitempty"`
+	UrgentMessages               int64   `json:"urgent_messages,omitempty"`
+	UrgentMessagesRemaining      int64   `json:"urgent_messages_remaining,omitempty"`
+	RequestLimitTokens           float64 `json:"request_limit_tokens"`
+	RequestLimitBurst            int     `json:"request_limit_burst"`
 }
 
 type apiAccountReservation struct {
@@ -1,10 +1,17 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/user"
+	"io"
+	"math"
 	"net/netip"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,10 +23,13 @@ const (
 	// oneDay is an approximation of a day as a time.Duration
 	oneDay = 24 * time.Hour
 
-	// visitorExpungeAfter defines how long a visitor is active before it is removed from memory. This number
-	// has to be very high to prevent e-mail abuse, but it doesn't really affect the other limits anyway, since
-	// they are replenished faster (typically).
-	visitorExpungeAfter = oneDay
+	// visitorAttachmentThrottleMinRate is the minimum rate (bytes per second) at which attachments are served
+	// once the bandwidth limit is reached, see visitor.ThrottledReader
+	visitorAttachmentThrottleMinRate = 8 * 1024
+
+	// visitorUnlimited is the limit reported in the visitor info (and the account API) if a limit does not apply,
+	// e.g. if a tier's message or email limit is zero. Internally, such limits are backed by limiters that never deny.
+	visitorUnlimited = int64(-1)
 
 	// visitorDefaultReservationsLimit is the amount of topic names a user without a tier is allowed to reserve.
 	// This number is zero, and changing it may have unintended consequences in the web app, or otherwise
@@ -28,8 +38,107 @@ const (
 	// visitorDefaultCallsLimit is the amount of calls a user without a tier is allowed to make.
 	// This number is zero, because phone numbers have to be verified first.
 	visitorDefaultCallsLimit = int64(0)
+
+	// visitorTenantMaxLength is the maximum length of the tenant read from the VisitorTenantHeader
+	visitorTenantMaxLength = 64
+
+	// visitorFirebasePenaltyMax is the maximum duration a visitor is denied Firebase access after
+	// consecutive "quota exceeded" responses. The penalty doubles with every consecutive denial.
+	visitorFirebasePenaltyMax = time.Hour
+
+	// visitorRequestLimiterStateMaxAge is the maximum age of a persisted request limiter state (see user.Stats)
+	// to be restored when a visitor is created. Older state is ignored, since the bucket would be mostly refilled anyway.
+	visitorRequestLimiterStateMaxAge = time.Hour
+
+	// visitorSubscriptionSlotHoldDuration is how long the subscription slot of a closed connection is held for
+	// a reconnect with the same connection ID, see visitor.ReserveSubscriptionSlot
+	visitorSubscriptionSlotHoldDuration = 5 * time.Second
+
+	// visitorReservationsCountCacheDuration is how long the reservations count of a user is cached in the visitor,
+	// so that polling the account endpoint does not query the database every time, see visitor.Info
+	visitorReservationsCountCacheDuration = 30 * time.Second
+
+	// visitorInboundEmailSendersMax is the max number of sender addresses whose inbound e-mail limiters are kept
+	// per visitor, see visitor.InboundEmailAllowed. All limiters are discarded when it is reached.
+	visitorInboundEmailSendersMax = 1000
+)
+
+// Limiter names, used as the (low-cardinality) "limiter" label of the limits exceeded metric
+const (
+	visitorLimiterRequest              = "request"
+	visitorLimiterReadRequest          = "read_request"
+	visitorLimiterMessages             = "messages"
+	visitorLimiterMessagesMonthly      = "messages_monthly"
+	visitorLimiterEmails               = "emails"
+	visitorLimiterCalls                = "calls"
+	visitorLimiterSubscriptions        = "subscriptions"
+	visitorLimiterSubscriptionAttempts = "subscription_attempts"
+	visitorLimiterBandwidth            = "bandwidth"
+	visitorLimiterIngress              = "ingress"
+	visitorLimiterTopics               = "topics"
+	visitorLimiterDownloads            = "downloads"
+	visitorLimiterScheduled            = "scheduled_messages"
+	visitorLimiterAttachments          = "attachment_messages"
+	visitorLimiterGateway              = "gateway_messages"
+	visitorLimiterUrgent               = "urgent_messages"
+	visitorLimiterMessageInterval      = "message_interval"
+	visitorLimiterAuth                 = "auth"
+	visitorLimiterAccountCreation      = "account_creation"
+	visitorLimiterFirebase             = "firebase"
+	visitorLimiterInboundEmails        = "inbound_emails"
+)
+
+// Errors returned by the visitor's *Allowed methods. The limiter-specific errors all wrap errVisitorLimitReached,
+// so errors.Is(err, errVisitorLimitReached) can be used to check if any limit was reached.
+var (
+	errVisitorLimitReached             = errors.New("limit reached")
+	errRequestLimitReached             = fmt.Errorf("%w: requests", errVisitorLimitReached)
+	errMessageLimitReached             = fmt.Errorf("%w: messages", errVisitorLimitReached)
+	errEmailLimitReached               = fmt.Errorf("%w: emails", errVisitorLimitReached)
+	errSubscriptionLimitReached        = fmt.Errorf("%w: subscriptions", errVisitorLimitReached)
+	errSubscriptionAttemptLimitReached = fmt.Errorf("%w: subscription attempts", errVisitorLimitReached)
+	errBandwidthLimitReached           = fmt.Errorf("%w: bandwidth", errVisitorLimitReached)
+	errIngressLimitReached             = fmt.Errorf("%w: ingress", errVisitorLimitReached)
+	errTopicsLimitReached              = fmt.Errorf("%w: distinct topics", errVisitorLimitReached)
+	errDownloadLimitReached            = fmt.Errorf("%w: concurrent downloads", errVisitorLimitReached)
+	errScheduledLimitReached           = fmt.Errorf("%w: scheduled messages", errVisitorLimitReached)
+	errAccountCreateLimitReached       = fmt.Errorf("%w: account creation", errVisitorLimitReached)
+	errAttachmentLimitReached          = fmt.Errorf("%w: messages with attachments", errVisitorLimitReached)
+	errGatewayLimitReached             = fmt.Errorf("%w: gateway messages", errVisitorLimitReached)
+	errUrgentLimitReached              = fmt.Errorf("%w: urgent messages", errVisitorLimitReached)
+	errFirebaseLimitReached            = fmt.Errorf("%w: daily firebase messages", errVisitorLimitReached)
+	errMessageIntervalReached          = fmt.Errorf("%w: message interval", errVisitorLimitReached)
+	errInboundEmailLimitReached        = fmt.Errorf("%w: inbound emails", errVisitorLimitReached)
+	errAnonymousPublishDisabled        = errors.New("publishing is disabled for anonymous users")
+	errEmailUnavailable                = errors.New("e-mail temporarily unavailable after repeated send failures")
+	errFirebaseDisabledForTier         = errors.New("forwarding to Firebase is disabled for this tier")
+	errVisitorPaused                   = errors.New("visitor is paused")
 )
 
+var visitorLimiters = []string{
+	visitorLimiterRequest,
+	visitorLimiterReadRequest,
+	visitorLimiterMessages,
+	visitorLimiterMessagesMonthly,
+	visitorLimiterEmails,
+	visitorLimiterCalls,
+	visitorLimiterSubscriptions,
+	visitorLimiterSubscriptionAttempts,
+	visitorLimiterBandwidth,
+	visitorLimiterIngress,
+	visitorLimiterTopics,
+	visitorLimiterDownloads,
+	visitorLimiterScheduled,
+	visitorLimiterAttachments,
+	visitorLimiterGateway,
+	visitorLimiterUrgent,
+	visitorLimiterMessageInterval,
+	visitorLimiterAuth,
+	visitorLimiterAccountCreation,
+	visitorLimiterFirebase,
+	visitorLimiterInboundEmails,
+}
+
 // Constants used to convert a tier-user's MessageSizeLimit (see user.Tier) into adequate request limiter
 // values (token bucket). This is only used to increase the values in server.yml, never decrease them.
 //
@@ -50,51 +159,177 @@ const (
 	visitorEmailLimitBurstMax  = 150
 )
 
+// visitorRequestTimeWeight is the weight of the latest request in the moving average of the request processing
+// time, see visitor.RecordRequest. With 0.1, the average mostly reflects the last ~10-20 requests.
+const visitorRequestTimeWeight = 0.1
+
+// visitorLimiter is the set of limit checks that handlers perform on a visitor. It is implemented by *visitor,
+// but handlers look it up via Server.limiterFor, so that tests can inject a fake that always allows or denies.
+type visitorLimiter interface {
+	RequestAllowed() bool
+	RequestAllowedWithDelay() (time.Duration, error)
+	ReadRequestAllowed() bool
+	MessageAllowed() error
+	MessageAllowedN(n int64) error
+	MessagesAllowed(costs []int64, partial bool) (int, error)
+	ScheduledMessageAllowed() error
+	AttachmentMessageAllowed() error
+	GatewayMessageAllowed() error
+	UrgentMessageAllowed() error
+	IngressAllowed(n int64) error
+	NewTopicAllowed(topic string) error
+	EmailAllowed() error
+	InboundEmailAllowed(sender string) error
+	CallAllowed() bool
+	SubscriptionAllowed() error
+	ReserveSubscriptionSlot(id string) (release func(), err error)
+	OwnedSubscriptionAllowed() error
+	BandwidthAllowed(bytes int64) error
+	AuthAllowed() bool
+	AccountCreateAllowed() error
+}
+
+var _ visitorLimiter = (*visitor)(nil)
+
 // visitor represents an API user, and its associated rate.Limiter used for rate limiting
 type visitor struct {
-	config              *Config
-	messageCache        *messageCache
-	userManager         *user.Manager      // May be nil
-	ip                  netip.Addr         // Visitor IP address
-	user                *user.User         // Only set if authenticated user, otherwise nil
-	requestLimiter      *rate.Limiter      // Rate limiter for (almost) all requests (including messages)
-	messagesLimiter     *util.FixedLimiter // Rate limiter for messages
-	emailsLimiter       *util.RateLimiter  // Rate limiter for emails
-	callsLimiter        *util.FixedLimiter // Rate limiter for calls
-	subscriptionLimiter *util.FixedLimiter // Fixed limiter for active subscriptions (ongoing connections)
-	bandwidthLimiter    *util.RateLimiter  // Limiter for attachment bandwidth downloads
-	accountLimiter      *rate.Limiter      // Rate limiter for account creation, may be nil
-	authLimiter         *rate.Limiter      // Limiter for incorrect login attempts, may be nil
-	firebase            time.Time          // Next allowed Firebase message
-	seen                time.Time          // Last seen time of this visitor (needed for removal of stale visitors)
-	mu                  sync.RWMutex
+	config                 *Config
+	messageCache           *messageCache
+	userManager            *user.Manager            // May be nil
+	limiterStore           *util.RedisClient        // Shared store for the messages limiter, may be nil (see Config.VisitorLimiterStore)
+	billingLimiters        *billingAccountLimiters  // Registry of messages limiters shared per billing account, may be nil
+	geoIP                  *geoIPResolver           // Resolves the country of the visitor's IP address, may be nil
+	ip                     netip.Addr               // Visitor IP address
+	country                string                   // Country code of the IP address (for logging, and see Config.GeoRestrictedCountries), may be empty
+	user                   *user.User               // Only set if authenticated user, otherwise nil
+	exempt                 bool                     // Exempt from request and message limits, see Config.VisitorRequestExemptIPAddrs
+	noPersist              bool                     // If true, the visitor never writes its stats anywhere, see newVisitorNoPersist
+	requestLimiter         *rate.Limiter            // Rate limiter for (almost) all requests (including messages)
+	readRequestLimiter     *rate.Limiter            // Rate limiter for read requests (subscribe, poll), may be nil
+	messagesLimiter        util.RemainingLimiter    // Rate limiter for messages (fixed, sliding or decaying, see VisitorMessageLimiterMode)
+	messagesMonthlyLimiter *util.FixedLimiter       // Fixed limiter for messages per month, reset on the first of the month
+	emailsLimiter          *util.RateLimiter        // Rate limiter for emails
+	callsLimiter           *util.FixedLimiter       // Rate limiter for calls
+	subscriptionLimiter    *util.FixedLimiter       // Fixed limiter for active subscriptions (ongoing connections)
+	connectLimiter         *rate.Limiter            // Rate limiter for new subscriptions (connection attempts), may be nil
+	downloadLimiter        util.Limiter             // Fixed limiter for concurrent attachment downloads, may be nil
+	scheduledLimiter       util.RemainingLimiter    // Daily limiter for scheduled messages, may be nil, see VisitorScheduledMessageMode
+	attachmentLimiter      util.RemainingLimiter    // Daily limiter for messages with attachments, may be nil, see AttachmentMessageAllowed
+	gatewayLimiter         *util.FixedLimiter       // Daily limiter for UnifiedPush/Matrix gateway messages, see GatewayMessageAllowed
+	gatewayLimited         bool                     // True if gateway messages are limited separately, see GatewayMessagesLimited
+	urgentLimiter          util.RemainingLimiter    // Daily limiter for urgent (priority 5) messages, may be nil, see UrgentMessageAllowed
+	bandwidthLimiter       util.RemainingLimiter    // Limiter for attachment bandwidth downloads, see VisitorAttachmentBandwidthResetMode
+	ingressLimiter         util.RemainingLimiter    // Limiter for published request body bytes, may be nil (see VisitorIngressDailyBandwidthLimit)
+	accountLimiter         *rate.Limiter            // Rate limiter for account creation, may be nil
+	authLimiter            *rate.Limiter            // Limiter for incorrect login attempts, may be nil
+	firebaseLimiter        util.Limiter             // Rate limiter for messages forwarded to Firebase, may be nil
+	firebase               time.Time                // Next allowed Firebase message (quota exceeded penalty)
+	firebasePenalty        time.Duration            // Duration of the last Firebase penalty
+	firebasePenaltyCount   int                      // Number of consecutive Firebase denials (reset if a penalty window passes without denial)
+	firebaseCount          int64                    // Messages forwarded to Firebase today, see IncrFirebase and VisitorFirebaseDailyLimit
+	lastMessageAt          time.Time                // Time of the last message, see MessageIntervalAllowed
+	lastMessage            *message                 // Last published message, see DuplicateMessage; may be nil
+	inboundEmailLimiters   map[string]*rate.Limiter // Rate limiters for inbound e-mails per sender address, see InboundEmailAllowed
+	lastMessageHash        string                   // Hash of the last published message, see messageHash
+	lastMessageHashAt      time.Time                // Time at which the last message was published, see Config.VisitorDedupWindow
+	created                time.Time                // Time at which this visitor was created (in memory), see Info
+	seen                   time.Time                // Last seen time of this visitor (needed for removal of stale visitors)
+	graceUntil             time.Time                // End of the new account grace, see Config.NewAccountGraceDuration
+	boostExpires           time.Time                // End of the user's temporary limit boost, see applyBoost
+	limitHits              int                      // Number of consecutive limit hits within the penalty box window
+	limitHitsSince         time.Time                // Time of the first of the consecutive limit hits
+	penaltyUntil           time.Time                // End of the penalty box, see Config.VisitorPenaltyBoxDuration
+	paused                 bool                     // Paused (frozen) by an admin, all *Allowed methods return errVisitorPaused
+	pausedUntil            time.Time                // End of the pause, zero if paused until unpaused, see SetPaused
+	statsResetJitter       time.Duration            // Offset of this visitor's daily stats reset, see Config.VisitorLimitResetJitter
+	statsReset             time.Time                // Next (global) daily stats reset not yet applied to this visitor, only set if jittered
+	subscriptionSlots      map[string]int           // Connection ID -> generation of the connection holding the slot, see ReserveSubscriptionSlot
+	softLimitWarned        time.Time                // Last time the visitor was warned about reaching the soft message limit
+	topics                 map[string]struct{}      // Distinct topics published to since topicsReset, see NewTopicAllowed
+	emailFailures          int                      // Consecutive failed e-mails, see EmailSendFailed
+	requests               int64                    // Requests since the last daily reset, see RecordRequest
+	requestTime            time.Duration            // Moving average of the request processing time, see RecordRequest
+	tenant                 string                   // Tenant read from the Config.VisitorTenantHeader, see Tenant
+	downgradeMessageLimit  int64                    // Previous (higher) message limit after a tier downgrade, see Config.VisitorTierDowngradeMode
+	downgradeUntil         time.Time                // The previous message limit applies until then (next daily reset), zero if none
+	emailBlockedUntil      time.Time                // E-mails are rejected until then (circuit breaker open), see EmailAllowed
+	topicsReset            time.Time                // Last time the topics set was cleared
+	reservationsCount      int64                    // Cached number of reservations of the user, see reservationsCountCached
+	reservationsCountAt    time.Time                // Time at which reservationsCount was read from the database, zero if not cached
+	clock                  func() time.Time         // Current time, used for Firebase penalties and staleness; replaced in tests
+	mu                     sync.RWMutex
 }
 
 type visitorInfo struct {
-	Limits *visitorLimits
-	Stats  *visitorStats
+	Limits       *visitorLimits
+	Stats        *visitorStats
+	Created      int64  // Unix timestamp at which the visitor was created (in memory)
+	LastSeen     int64  // Unix timestamp at which the visitor was last seen, see visitor.LastSeen
+	LimitProfile string // Name of the active limit profile, empty if none, see Config.VisitorLimitProfiles
+}
+
+// visitorSnapshot is a point-in-time copy of a visitor's rate limiting state, see visitor.Snapshot
+type visitorSnapshot struct {
+	IP            netip.Addr
+	User          string // Username, empty if anonymous
+	Basis         visitorLimitBasis
+	Messages      int64
+	Emails        int64
+	Subscriptions int64
+	Stale         bool
+	Tenant        string        // Empty if the visitor has no tenant, see visitor.Tenant
+	Shared        bool          // True if the messages counter is shared with other visitors (billing account)
+	Requests      int64         // Requests since the last daily reset, only if Config.VisitorRequestStats is set
+	RequestTime   time.Duration // Moving average of the request processing time, see visitor.RecordRequest
+}
+
+// visitorLimiterState is the live state of a single limiter, see visitor.LimiterStates. Counting limiters report
+// their value and the remaining amount, token buckets (e.g. the request limiter) report their tokens and burst.
+type visitorLimiterState struct {
+	Value     int64
+	Remaining int64
+	Tokens    float64
+	Burst     int
+	Rate      float64 // Tokens per second, only set for token buckets
 }
 
 type visitorLimits struct {
-	Basis                    visitorLimitBasis
-	RequestLimitBurst        int
-	RequestLimitReplenish    rate.Limit
-	MessageLimit             int64
-	MessageExpiryDuration    time.Duration
-	EmailLimit               int64
-	EmailLimitBurst          int
-	EmailLimitReplenish      rate.Limit
-	CallLimit                int64
-	ReservationsLimit        int64
-	AttachmentTotalSizeLimit int64
-	AttachmentFileSizeLimit  int64
-	AttachmentExpiryDuration time.Duration
-	AttachmentBandwidthLimit int64
+	Basis                     visitorLimitBasis
+	RequestLimitBurst         int
+	RequestLimitReplenish     rate.Limit
+	ReadRequestLimitBurst     int
+	ReadRequestLimitReplenish rate.Limit
+	MessageLimit              int64
+	MessageExpiryDuration     time.Duration
+	EmailLimit                int64
+	EmailLimitBurst           int
+	EmailLimitReplenish       rate.Limit
+	CallLimit                 int64
+	ReservationsLimit         int64
+	SubscriptionLimit         int64
+	AttachmentTotalSizeLimit  int64
+	AttachmentFileSizeLimit   int64
+	AttachmentExpiryDuration  time.Duration
+	AttachmentBandwidthLimit  int64
+	IngressBandwidthLimit     int64     // If zero, published bytes are not limited
+	MessageMonthlyLimit       int64     // If zero, there is no monthly message limit
+	FirebaseDisabled          bool      // If true, messages are not forwarded to Firebase (see user.Tier)
+	FirebaseLimit             int64     // If zero, messages forwarded to Firebase are not capped per day
+	AttachmentMessagesLimit   int64     // If zero, messages with attachments only count towards the message limit
+	GatewayMessagesLimit      int64     // If zero, gateway messages count towards the message limit (but are still counted)
+	UrgentMessagesLimit       int64     // If zero, urgent messages only count towards the message limit
+	GraceUntil                time.Time // If non-zero, RequestLimitBurst is boosted for a new account until then
+	BoostMultiplier           float64   // If non-zero, the message and email limits are boosted until BoostExpires, see applyBoost
+	BoostExpires              time.Time
+	Profile                   string // Name of the limit profile of the token, if any, see applyLimitProfile
 }
 
 type visitorStats struct {
 	Messages                     int64
 	MessagesRemaining            int64
+	MessagesResetAt              int64 // Unix timestamp at which the messages counter drops next
+	MessagesMonthly              int64
+	MessagesMonthlyRemaining     int64 // Zero if there is no monthly limit
 	Emails                       int64
 	EmailsRemaining              int64
 	Calls                        int64
@@ -103,45 +338,186 @@ type visitorStats struct {
 	ReservationsRemaining        int64
 	AttachmentTotalSize          int64
 	AttachmentTotalSizeRemaining int64
+	AttachmentBandwidth          int64 // Bandwidth used within the current (rolling) window
+	AttachmentBandwidthRemaining int64
+	AttachmentBandwidthResetAt   int64 // Unix timestamp at which the full bandwidth allowance is available again, see BandwidthResetAt
+	AttachmentMessages           int64 // Messages with attachments today, if limited
+	AttachmentMessagesRemaining  int64
+	GatewayMessages              int64 // UnifiedPush/Matrix gateway messages today
+	GatewayMessagesRemaining     int64 // Zero if there is no separate gateway messages limit
+	UrgentMessages               int64 // Urgent (priority 5) messages today, if limited
+	UrgentMessagesRemaining      int64
+	IngressBandwidth             int64 // Published bytes within the current (rolling) window, if limited
+	IngressBandwidthRemaining    int64
+	RequestLimitTokens           float64       // Tokens currently available in the request limiter
+	RequestLimitBurst            int           // Burst (bucket size) of the request limiter
+	FirebaseBackoff              time.Duration // Remaining time until Firebase access is allowed again
+	FirebasePenaltyCount         int           // Number of consecutive Firebase denials
+	Firebase                     int64         // Messages forwarded to Firebase today
+	FirebaseRemaining            int64         // Zero if there is no daily Firebase limit
 }
 
 // visitorLimitBasis describes how the visitor limits were derived, either from a user's
-// IP address (default config), or from its tier
+// IP address (default config), from its tier, or from per-user limit overrides
 type visitorLimitBasis string
 
 const (
-	visitorLimitBasisIP   = visitorLimitBasis("ip")
-	visitorLimitBasisTier = visitorLimitBasis("tier")
+	visitorLimitBasisIP      = visitorLimitBasis("ip")
+	visitorLimitBasisTier    = visitorLimitBasis("tier")
+	visitorLimitBasisUser    = visitorLimitBasis("user")
+	visitorLimitBasisProfile = visitorLimitBasis("profile")
 )
 
-func newVisitor(conf *Config, messageCache *messageCache, userManager *user.Manager, ip netip.Addr, user *user.User) *visitor {
-	var messages, emails, calls int64
-	if user != nil {
+func newVisitor(conf *Config, messageCache *messageCache, userManager *user.Manager, limiterStore *util.RedisClient, billingLimiters *billingAccountLimiters, geoIP *geoIPResolver, ip netip.Addr, user *user.User) *visitor {
+	var messages, messagesMonthly, emails, calls, firebaseCount int64
+	clock := time.Now
+	now := clock()
+	if user != nil && !hasTokenVisitor(user) {
 		messages = user.Stats.Messages
+		messagesMonthly = monthlyMessages(user.Stats, now)
 		emails = user.Stats.Emails
 		calls = user.Stats.Calls
+		firebaseCount = user.Stats.Firebase
 	}
+	ip = visitorIP(conf, ip)
 	v := &visitor{
-		config:              conf,
-		messageCache:        messageCache,
-		userManager:         userManager, // May be nil
-		ip:                  ip,
-		user:                user,
-		firebase:            time.Unix(0, 0),
-		seen:                time.Now(),
-		subscriptionLimiter: util.NewFixedLimiter(int64(conf.VisitorSubscriptionLimit)),
-		requestLimiter:      nil, // Set in resetLimiters
-		messagesLimiter:     nil, // Set in resetLimiters, may be nil
-		emailsLimiter:       nil, // Set in resetLimiters
-		callsLimiter:        nil, // Set in resetLimiters, may be nil
-		bandwidthLimiter:    nil, // Set in resetLimiters
-		accountLimiter:      nil, // Set in resetLimiters, may be nil
-		authLimiter:         nil, // Set in resetLimiters, may be nil
-	}
-	v.resetLimitersNoLock(messages, emails, calls, false)
+		config:                 conf,
+		messageCache:           messageCache,
+		userManager:            userManager,     // May be nil
+		limiterStore:           limiterStore,    // May be nil
+		billingLimiters:        billingLimiters, // May be nil
+		geoIP:                  geoIP,           // May be nil
+		ip:                     ip,
+		country:                geoIP.Country(ip),
+		user:                   user,
+		exempt:                 util.ContainsIP(conf.VisitorRequestExemptIPAddrs, ip) || hasTokenExemption(user),
+		firebase:               time.Unix(0, 0),
+		firebaseCount:          firebaseCount,
+		created:                now,
+		seen:                   now,
+		clock:                  clock,
+		subscriptionSlots:      make(map[string]int),
+		subscriptionLimiter:    nil, // Set in resetLimiters
+		requestLimiter:         nil, // Set in resetLimiters
+		readRequestLimiter:     nil, // Set in resetLimiters, may be nil
+		messagesLimiter:        nil, // Set in resetLimiters, may be nil
+		messagesMonthlyLimiter: nil, // Set in resetLimiters
+		emailsLimiter:          nil, // Set in resetLimiters
+		callsLimiter:           nil, // Set in resetLimiters, may be nil
+		bandwidthLimiter:       nil, // Set in resetLimiters
+		accountLimiter:         nil, // Set in resetLimiters, may be nil
+		authLimiter:            nil, // Set in resetLimiters, may be nil
+		connectLimiter:         nil, // Set below, may be nil
+		firebaseLimiter:        nil, // Set below, may be nil
+		downloadLimiter:        nil, // Set below, may be nil
+	}
+	if conf.VisitorSubscriptionAttemptLimitBurst > 0 {
+		v.connectLimiter = rate.NewLimiter(safeEvery(conf.VisitorSubscriptionAttemptLimitReplenish), conf.VisitorSubscriptionAttemptLimitBurst)
+	}
+	if conf.VisitorFirebaseLimitBurst > 0 {
+		v.firebaseLimiter = util.NewRateLimiter(safeEvery(conf.VisitorFirebaseLimitReplenish), conf.VisitorFirebaseLimitBurst)
+	}
+	if conf.VisitorAttachmentDownloadConcurrency > 0 {
+		v.downloadLimiter = util.NewFixedLimiter(int64(conf.VisitorAttachmentDownloadConcurrency))
+	}
+	if conf.VisitorLimitResetJitter > 0 {
+		v.statsResetJitter = visitorResetJitter(conf.VisitorLimitResetJitter, visitorID(ip, user))
+		v.statsReset = nextStatsReset(conf, v.seen)
+	}
+	v.resetLimitersNoLock(messages, messagesMonthly, emails, calls, false)
+	if hasTokenLimitProfile(user) && conf.VisitorLimitProfiles[user.TokenLimitProfile] == nil {
+		log.Fields(v.contextNoLock()).Warn("Unknown limit profile %s of token, using tier (or config) limits", user.TokenLimitProfile)
+	}
+	if hasTokenExemption(user) {
+		log.Fields(v.contextNoLock()).Info("Visitor of service token is exempt from all limits")
+	}
+	if user != nil && !hasTokenVisitor(user) {
+		v.restoreRequestLimiterNoLock(user.Stats)
+	}
+	v.setPausedFromUserNoLock(user)
+	if conf.VisitorEmailLimitPersist && !hasUserLimits(user) && !hasTokenVisitor(user) {
+		v.restoreEmailsNoLock()
+	}
+	if log.IsTrace() {
+		v.logLimitsNoLock()
+	}
 	return v
 }
 
+// newVisitorNoPersist creates a throwaway visitor for the given user from its persisted stats, e.g. to explain the
+// limits a user experiences. The visitor does not use the shared messages limiters (see Config.VisitorLimiterStore
+// and billingAccountLimiters), and never writes its stats to the user database or the cache, so nothing it does
+// affects the real visitor of the user.
+func newVisitorNoPersist(conf *Config, messageCache *messageCache, userManager *user.Manager, geoIP *geoIPResolver, ip netip.Addr, user *user.User) *visitor {
+	v := newVisitor(conf, messageCache, userManager, nil, nil, geoIP, ip, user)
+	v.noPersist = true
+	return v
+}
+
+// logLimitsNoLock logs the basis of the visitor's limits (see limitBasis), and the resulting limits. This makes
+// it easy to see if a tier or per-user override applies as expected. Only used if trace logging is enabled.
+func (v *visitor) logLimitsNoLock() {
+	limits := v.limitsNoLock()
+	fields := log.Context{
+		"visitor_limit_basis":                 string(limits.Basis),
+		"visitor_request_limit_burst":         limits.RequestLimitBurst,
+		"visitor_messages_limit":              limits.MessageLimit,
+		"visitor_emails_limit":                limits.EmailLimit,
+		"visitor_subscriptions_limit":         limits.SubscriptionLimit,
+		"visitor_attachment_bandwidth_limit":  limits.AttachmentBandwidthLimit,
+		"visitor_attachment_total_size_limit": limits.AttachmentTotalSizeLimit,
+		"visitor_attachment_file_size_limit":  limits.AttachmentFileSizeLimit,
+	}
+	if v.user != nil {
+		fields["user_role"] = string(v.user.Role)
+	}
+	log.Fields(v.contextNoLock()).Fields(fields).Trace("Created visitor with %s-based limits", limits.Basis)
+}
+
+// restoreEmailsNoLock restores the email count of an IP-based visitor from the cache database (see
+// Config.VisitorEmailLimitPersist), unless it was persisted before the last daily reset. Users with their own
+// limits persist their email count in the user stats instead. Since the email limiter is a token bucket, the
+// restored emails (up to the burst) are drained from the bucket, so that a restart does not refill it.
+func (v *visitor) restoreEmailsNoLock() {
+	emails, reset, err := v.messageCache.VisitorEmails(v.ip.String())
+	if err != nil {
+		log.Fields(v.contextNoLock()).Err(err).Warn("Cannot restore email count of visitor")
+		return
+	} else if emails <= 0 || reset.Before(lastStatsReset(v.config, v.clock())) {
+		return
+	}
+	limits := v.limitsNoLock()
+	drain := util.MinMax(emails, 0, int64(limits.EmailLimitBurst))
+	v.emailsLimiter = util.NewRateLimiterWithValue(limits.EmailLimitReplenish, limits.EmailLimitBurst, emails-drain)
+	if drain > 0 {
+		v.emailsLimiter.AllowN(drain) // Adds to the value, which is then the restored email count
+	}
+}
+
+// persistEmailsNoLock writes the email count of an IP-based visitor to the cache database, see restoreEmailsNoLock
+func (v *visitor) persistEmailsNoLock() {
+	if v.noPersist {
+		return
+	}
+	if err := v.messageCache.UpdateVisitorEmails(v.ip.String(), v.emailsLimiter.Value(), lastStatsReset(v.config, v.clock())); err != nil {
+		log.Fields(v.contextNoLock()).Err(err).Warn("Cannot persist email count of visitor")
+	}
+}
+
+// restoreRequestLimiterNoLock drains the (full) request limiter to the token level persisted in the user stats,
+// plus the tokens that were replenished since. This prevents throttled users from spiking after a server restart.
+func (v *visitor) restoreRequestLimiterNoLock(stats *user.Stats) {
+	if stats == nil || v.clock().Sub(stats.RequestTokensUpdated) > visitorRequestLimiterStateMaxAge {
+		return
+	}
+	elapsed := v.clock().Sub(stats.RequestTokensUpdated)
+	burst := v.requestLimiter.Burst()
+	tokens := stats.RequestTokens + elapsed.Seconds()*float64(v.requestLimiter.Limit())
+	if drain := burst - int(math.Max(tokens, 0)); drain > 0 {
+		v.requestLimiter.ReserveN(time.Now(), drain) // rate.Limiter always uses the real time
+	}
+}
+
 func (v *visitor) Context() log.Context {
 	v.mu.RLock()
 	defer v.mu.RUnlock()
@@ -160,9 +536,16 @@ func (v *visitor) contextNoLock() log.Context {
 		"visitor_request_limiter_limit":  v.requestLimiter.Limit(),
 		"visitor_request_limiter_tokens": v.requestLimiter.Tokens(),
 	}
+	if v.country != "" {
+		fields["visitor_country"] = v.country
+	}
+	if info.LimitProfile != "" {
+		fields["visitor_limit_profile"] = info.LimitProfile
+	}
 	if v.config.SMTPSenderFrom != "" {
 		fields["visitor_emails"] = info.Stats.Emails
 		fields["visitor_emails_limit"] = info.Limits.EmailLimit
+		fields["visitor_emails_limit_burst"] = info.Limits.EmailLimitBurst
 		fields["visitor_emails_remaining"] = info.Stats.EmailsRemaining
 	}
 	if v.config.TwilioAccount != "" {
@@ -170,6 +553,14 @@ func (v *visitor) contextNoLock() log.Context {
 		fields["visitor_calls_limit"] = info.Limits.CallLimit
 		fields["visitor_calls_remaining"] = info.Stats.CallsRemaining
 	}
+	if v.ingressLimiter != nil {
+		fields["visitor_ingress_bandwidth"] = info.Stats.IngressBandwidth
+		fields["visitor_ingress_bandwidth_remaining"] = info.Stats.IngressBandwidthRemaining
+	}
+	if v.readRequestLimiter != nil {
+		fields["visitor_read_request_limiter_limit"] = v.readRequestLimiter.Limit()
+		fields["visitor_read_request_limiter_tokens"] = v.readRequestLimiter.Tokens()
+	}
 	if v.authLimiter != nil {
 		fields["visitor_auth_limiter_limit"] = v.authLimiter.Limit()
 		fields["visitor_auth_limiter_tokens"] = v.authLimiter.Tokens()
@@ -200,315 +591,2158 @@ func visitorExtendedInfoContext(info *visitorInfo) log.Context {
 		"visitor_attachment_total_size":           info.Stats.AttachmentTotalSize,
 		"visitor_attachment_total_size_limit":     info.Limits.AttachmentTotalSizeLimit,
 		"visitor_attachment_total_size_remaining": info.Stats.AttachmentTotalSizeRemaining,
+		"visitor_attachment_bandwidth":            info.Stats.AttachmentBandwidth,
+		"visitor_attachment_bandwidth_remaining":  info.Stats.AttachmentBandwidthRemaining,
 	}
 
 }
 func (v *visitor) RequestAllowed() bool {
 	v.mu.RLock() // limiters could be replaced!
 	defer v.mu.RUnlock()
-	return v.requestLimiter.Allow()
+	if v.pausedNoLock() {
+		return false
+	}
+	return mallowed(visitorLimiterRequest, v.requestLimiter.Allow())
+}
+
+// RequestAllowedWithDelay is like RequestAllowed, but if the request is not allowed, it also returns the
+// delay until the next token is available, so that the caller can set a Retry-After header.
+func (v *visitor) RequestAllowedWithDelay() (time.Duration, error) {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.pausedNoLock() {
+		return 0, errVisitorPaused
+	}
+	if mallowed(visitorLimiterRequest, v.requestLimiter.Allow()) {
+		return 0, nil
+	}
+	reservation := v.requestLimiter.Reserve()
+	defer reservation.Cancel() // We only want to know the delay, not actually consume the token
+	if !reservation.OK() {
+		return 0, errRequestLimitReached // Burst is zero, no token will ever be available
+	}
+	return reservation.Delay(), errRequestLimitReached
+}
+
+// RequestWait is like RequestAllowed, but instead of rejecting the request right away if the limit is reached, it waits
+// for the request limiter to allow it, for up to VisitorRequestMaxWait. If the wait would take longer than that (or the
+// context is cancelled), errRequestLimitReached is returned immediately. This is used for publishers that prefer
+// backpressure over a 429 response, see the "X-Backpressure: wait" header.
+func (v *visitor) RequestWait(ctx context.Context) error {
+	v.mu.RLock() // limiters and config could be replaced!
+	limiter, paused, maxWait := v.requestLimiter, v.pausedNoLock(), v.config.VisitorRequestMaxWait
+	v.mu.RUnlock() // Don't hold the lock while waiting, waiting for the old limiter is fine
+	if paused {
+		return errVisitorPaused
+	}
+	ctx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+	if err := limiter.Wait(ctx); err != nil {
+		mallowed(visitorLimiterRequest, false)
+		return errRequestLimitReached
+	}
+	mallowed(visitorLimiterRequest, true)
+	return nil
 }
 
-func (v *visitor) FirebaseAllowed() bool {
+// PenaltyBoxRemaining returns the remaining time the visitor is blocked for, or zero if it is not in the penalty box
+// (see Config.VisitorPenaltyBoxThreshold). While a visitor is in the penalty box, its requests are rejected right away,
+// without checking any of the other limiters.
+func (v *visitor) PenaltyBoxRemaining() time.Duration {
 	v.mu.RLock()
 	defer v.mu.RUnlock()
-	return !time.Now().Before(v.firebase)
+	return util.Max(v.penaltyUntil.Sub(v.clock()), 0)
 }
 
-func (v *visitor) FirebaseTemporarilyDeny() {
+// RecordRequest counts a request, and adds its processing time to the visitor's moving average, so that admins can
+// find visitors that cause disproportionate load (see Snapshot). This does nothing unless Config.VisitorRequestStats
+// is set. Long-lived subscriptions are not recorded, since their duration says nothing about the load they cause.
+func (v *visitor) RecordRequest(d time.Duration) {
 	v.mu.Lock()
 	defer v.mu.Unlock()
-	v.firebase = time.Now().Add(v.config.FirebaseQuotaExceededPenaltyDuration)
+	if !v.config.VisitorRequestStats {
+		return
+	}
+	v.requests++
+	if v.requests == 1 && v.requestTime == 0 {
+		v.requestTime = d
+	} else {
+		v.requestTime += time.Duration(visitorRequestTimeWeight * float64(d-v.requestTime))
+	}
 }
 
-func (v *visitor) MessageAllowed() bool {
-	v.mu.RLock() // limiters could be replaced!
-	defer v.mu.RUnlock()
-	return v.messagesLimiter.Allow()
+// RecordLimitResult records whether a request hit a limit. A visitor that hits a limit VisitorPenaltyBoxThreshold
+// times in a row within VisitorPenaltyBoxWindow is put in the penalty box for VisitorPenaltyBoxDuration. A request
+// that was allowed resets the counter.
+func (v *visitor) RecordLimitResult(limited bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.config.VisitorPenaltyBoxThreshold <= 0 || v.exempt {
+		return
+	} else if !limited {
+		v.limitHits = 0
+		return
+	}
+	now := v.clock()
+	if v.limitHits == 0 || now.Sub(v.limitHitsSince) > v.config.VisitorPenaltyBoxWindow {
+		v.limitHits, v.limitHitsSince = 0, now
+	}
+	v.limitHits++
+	if v.limitHits >= v.config.VisitorPenaltyBoxThreshold {
+		v.limitHits = 0
+		v.penaltyUntil = now.Add(v.config.VisitorPenaltyBoxDuration)
+		log.Fields(v.contextNoLock()).Info("Visitor hit limits %d times in a row, blocking it until %s", v.config.VisitorPenaltyBoxThreshold, util.FormatTime(v.penaltyUntil))
+	}
 }
 
-func (v *visitor) EmailAllowed() bool {
-	v.mu.RLock() // limiters could be replaced!
-	defer v.mu.RUnlock()
-	return v.emailsLimiter.Allow()
+// SetPaused pauses or unpauses the visitor. While a visitor is paused, all *Allowed methods (except AuthAllowed)
+// fail with errVisitorPaused. If until is non-zero, the visitor is automatically unpaused after that time. For users,
+// the state is persisted to the user record (see user.Manager.ChangePaused), and restored in SetUser.
+func (v *visitor) SetPaused(paused bool, until time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.paused = paused
+	v.pausedUntil = time.Time{}
+	if paused {
+		v.pausedUntil = until
+	}
 }
 
-func (v *visitor) CallAllowed() bool {
-	v.mu.RLock() // limiters could be replaced!
+// Paused returns true if the visitor is currently paused, see SetPaused
+func (v *visitor) Paused() bool {
+	v.mu.RLock()
 	defer v.mu.RUnlock()
-	return v.callsLimiter.Allow()
+	return v.pausedNoLock()
 }
 
-func (v *visitor) SubscriptionAllowed() bool {
-	v.mu.RLock() // limiters could be replaced!
+func (v *visitor) pausedNoLock() bool {
+	return v.paused && (v.pausedUntil.IsZero() || v.clock().Before(v.pausedUntil))
+}
+
+// setPausedFromUserNoLock applies the persisted pause state of the given user (may be nil) to the visitor
+func (v *visitor) setPausedFromUserNoLock(u *user.User) {
+	v.paused, v.pausedUntil = u.IsPaused(v.clock()), time.Time{}
+	if v.paused && u.PausedUntil.Unix() > 0 {
+		v.pausedUntil = u.PausedUntil
+	}
+}
+
+// RequestLimitExempt returns true if the visitor's IP address (or its service token) is exempt from request and
+// message limits. This is determined when the visitor is created, and re-evaluated if the IP address changes (see UpdateIP).
+func (v *visitor) RequestLimitExempt() bool {
+	v.mu.RLock()
 	defer v.mu.RUnlock()
-	return v.subscriptionLimiter.Allow()
+	return v.exempt && !v.pausedNoLock() // Paused visitors are never exempt
 }
 
-// AuthAllowed returns true if an auth request can be attempted (> 1 token available)
-func (v *visitor) AuthAllowed() bool {
-	v.mu.RLock() // limiters could be replaced!
+// ShouldCountMessage returns false if messages published to the given topic do not count towards the message
+// limits, because the topic is exempt (see Config.RateLimitExemptTopics), e.g. for frequent heartbeat messages.
+// Request limits and access control still apply to these topics.
+func (v *visitor) ShouldCountMessage(topic string) bool {
+	v.mu.RLock() // config could be replaced!
 	defer v.mu.RUnlock()
-	if v.authLimiter == nil {
-		return true
+	return !util.Contains(v.config.RateLimitExemptTopics, topic)
+}
+
+// NewTopicAllowed returns errTopicsLimitReached if publishing to the given topic would exceed the number of
+// distinct topics the visitor may publish to per day (see Config.VisitorDistinctTopicsDailyLimit). This protects
+// against topic enumeration. Topics that were already published to today are always allowed. Users with their own
+// limits (see hasUserLimits) are exempt. The set of topics is bounded by the limit, and cleared at the daily stats reset.
+func (v *visitor) NewTopicAllowed(topic string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	limit := v.config.VisitorDistinctTopicsDailyLimit
+	if v.pausedNoLock() {
+		return errVisitorPaused
+	} else if limit <= 0 || hasUserLimits(v.user) || hasTokenVisitor(v.user) {
+		return nil
 	}
-	return v.authLimiter.Tokens() > 1
+	now := v.clock()
+	if reset := lastStatsReset(v.config, now); v.topics == nil || v.topicsReset.Before(reset) {
+		v.topics = make(map[string]struct{})
+		v.topicsReset = now
+	}
+	if _, ok := v.topics[topic]; ok {
+		return nil
+	} else if len(v.topics) >= limit {
+		mallowed(visitorLimiterTopics, false)
+		return errTopicsLimitReached
+	}
+	v.topics[topic] = struct{}{}
+	return nil
 }
 
-// AuthFailed records an auth failure
-func (v *visitor) AuthFailed() {
-	v.mu.RLock() // limiters could be replaced!
+// KnownTopic returns true if the visitor already published to the given topic today, see NewTopicAllowed
+func (v *visitor) KnownTopic(topic string) bool {
+	v.mu.RLock()
 	defer v.mu.RUnlock()
-	if v.authLimiter != nil {
-		v.authLimiter.Allow()
-	}
+	_, ok := v.topics[topic]
+	return ok
+}
+
+// RefundNewTopic removes a topic that was added by NewTopicAllowed, because the message was never published.
+// Callers must make sure that the topic was not known before, see KnownTopic.
+func (v *visitor) RefundNewTopic(topic string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.topics, topic)
 }
 
-// AccountCreationAllowed returns true if a new account can be created
-func (v *visitor) AccountCreationAllowed() bool {
+// ReadRequestAllowed returns true if a read request (e.g. subscribing or polling) is allowed. If no separate
+// read request limiter is configured, read requests count towards the regular request limiter.
+func (v *visitor) ReadRequestAllowed() bool {
 	v.mu.RLock() // limiters could be replaced!
 	defer v.mu.RUnlock()
-	if v.accountLimiter == nil || (v.accountLimiter != nil && v.accountLimiter.Tokens() < 1) {
+	if v.pausedNoLock() {
 		return false
+	} else if v.readRequestLimiter == nil {
+		return mallowed(visitorLimiterRequest, v.requestLimiter.Allow())
 	}
-	return true
+	return mallowed(visitorLimiterReadRequest, v.readRequestLimiter.Allow())
 }
 
-// AccountCreated decreases the account limiter. This is to be called after an account was created.
-func (v *visitor) AccountCreated() {
-	v.mu.RLock() // limiters could be replaced!
+// FirebaseAllowed returns true if a message may be forwarded to Firebase, i.e. if the visitor is not
+// temporarily denied (see FirebaseTemporarilyDeny), has not reached its daily Firebase limit (see
+// VisitorFirebaseDailyLimit), and has not used up its fair share of Firebase messages (see VisitorFirebaseLimitBurst).
+// Successfully forwarded messages must be counted with IncrFirebase.
+func (v *visitor) FirebaseAllowed() error {
+	v.mu.RLock()
 	defer v.mu.RUnlock()
-	if v.accountLimiter != nil {
-		v.accountLimiter.Allow()
+	if v.user != nil && v.user.Tier != nil && v.user.Tier.FirebaseDisabled {
+		return errFirebaseDisabledForTier // Not a limit, so it is not counted in the metrics
+	} else if v.clock().Before(v.firebase) {
+		mallowed(visitorLimiterFirebase, false)
+		return errVisitorLimitReached
+	} else if v.config.VisitorFirebaseDailyLimit > 0 && v.firebaseCount >= int64(v.config.VisitorFirebaseDailyLimit) {
+		mallowed(visitorLimiterFirebase, false)
+		return errFirebaseLimitReached
+	} else if v.firebaseLimiter != nil && !v.firebaseLimiter.Allow() {
+		mallowed(visitorLimiterFirebase, false)
+		return errVisitorLimitReached
 	}
+	return nil
 }
 
-func (v *visitor) BandwidthAllowed(bytes int64) bool {
-	v.mu.RLock() // limiters could be replaced!
-	defer v.mu.RUnlock()
-	return v.bandwidthLimiter.AllowN(bytes)
+// IncrFirebase counts a message that was forwarded to Firebase towards the daily Firebase limit, see FirebaseAllowed
+func (v *visitor) IncrFirebase() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.firebaseCount++
 }
 
-func (v *visitor) RemoveSubscription() {
-	v.mu.RLock()
-	defer v.mu.RUnlock()
-	v.subscriptionLimiter.AllowN(-1)
+// FirebaseTemporarilyDeny denies Firebase access to this visitor for a while. The penalty starts at
+// FirebaseQuotaExceededPenaltyDuration, and doubles with every consecutive denial (up to visitorFirebasePenaltyMax).
+func (v *visitor) FirebaseTemporarilyDeny() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	count := v.firebasePenaltyCountNoLock()
+	penalty := v.config.FirebaseQuotaExceededPenaltyDuration
+	for i := 0; i < count && penalty < visitorFirebasePenaltyMax; i++ {
+		penalty *= 2
+	}
+	if penalty > visitorFirebasePenaltyMax {
+		penalty = visitorFirebasePenaltyMax
+	}
+	v.firebase = v.clock().Add(penalty)
+	v.firebasePenalty = penalty
+	v.firebasePenaltyCount = count + 1
 }
 
-func (v *visitor) Keepalive() {
+// ClearFirebasePenalty lifts the Firebase penalty of this visitor (see FirebaseTemporarilyDeny), and resets the number
+// of consecutive denials, e.g. after the underlying Firebase quota issue was resolved. It returns true if the visitor
+// was denied Firebase access at the time.
+func (v *visitor) ClearFirebasePenalty() bool {
 	v.mu.Lock()
 	defer v.mu.Unlock()
-	v.seen = time.Now()
+	denied := v.clock().Before(v.firebase)
+	v.firebase = time.Unix(0, 0)
+	v.firebasePenalty = 0
+	v.firebasePenaltyCount = 0
+	return denied
 }
 
-func (v *visitor) BandwidthLimiter() util.Limiter {
-	v.mu.RLock() // limiters could be replaced!
-	defer v.mu.RUnlock()
-	return v.bandwidthLimiter
+// firebasePenaltyCountNoLock returns the number of consecutive Firebase denials. If another full penalty window
+// has passed since the last penalty expired without being denied again, the count is considered reset.
+func (v *visitor) firebasePenaltyCountNoLock() int {
+	if v.clock().Sub(v.firebase) > v.firebasePenalty {
+		return 0
+	}
+	return v.firebasePenaltyCount
 }
 
-func (v *visitor) Stale() bool {
-	v.mu.RLock()
-	defer v.mu.RUnlock()
-	return time.Since(v.seen) > visitorExpungeAfter
+// MessageAllowed counts a message towards the message limits, and returns errMessageLimitReached if
+// a limit was reached. If anonymous publishing is disabled (see AnonymousPublishDisabled), it returns
+// errAnonymousPublishDisabled for anonymous visitors.
+func (v *visitor) MessageAllowed() error {
+	return v.MessageAllowedN(1)
 }
 
-func (v *visitor) Stats() *user.Stats {
+// MessageAllowedN is like MessageAllowed, but counts the message as n messages towards the message limit,
+// e.g. because it is a large message (see messageCost)
+func (v *visitor) MessageAllowedN(n int64) error {
 	v.mu.RLock() // limiters could be replaced!
 	defer v.mu.RUnlock()
-	return &user.Stats{
-		Messages: v.messagesLimiter.Value(),
-		Emails:   v.emailsLimiter.Value(),
-		Calls:    v.callsLimiter.Value(),
-	}
+	return v.messageAllowedNNoLock(n)
 }
 
-func (v *visitor) ResetStats() {
+// MessagesAllowed is like MessageAllowedN, but for a batch of messages with the given costs (see messageCost), so
+// that the whole batch is counted at once. If the batch does not fit into the message limits, none of the messages
+// are counted, and a limit error is returned, unless partial is true: then as many messages as fit (from the start
+// of the batch) are counted. It returns the number of counted messages, which is always at least one if err is nil.
+func (v *visitor) MessagesAllowed(costs []int64, partial bool) (int, error) {
 	v.mu.RLock() // limiters could be replaced!
 	defer v.mu.RUnlock()
-	v.emailsLimiter.Reset()
-	v.messagesLimiter.Reset()
-	v.callsLimiter.Reset()
+	n := len(costs)
+	if partial {
+		remaining := v.messagesLimiter.Remaining()
+		if monthly := v.messagesMonthlyLimiter.Remaining(); monthly < remaining {
+			remaining = monthly
+		}
+		var total int64
+		for n = 0; n < len(costs) && total+costs[n] <= remaining; n++ {
+			total += costs[n]
+		}
+		n = util.Max(n, 1) // If not even one message fits, the check below returns the limit error
+	}
+	var total int64
+	for _, cost := range costs[:n] {
+		total += cost
+	}
+	if err := v.messageAllowedNNoLock(total); err != nil {
+		return 0, err
+	}
+	return n, nil
 }
 
-// User returns the visitor user, or nil if there is none
-func (v *visitor) User() *user.User {
-	v.mu.RLock()
-	defer v.mu.RUnlock()
-	return v.user // May be nil
+func (v *visitor) messageAllowedNNoLock(n int64) error {
+	if v.pausedNoLock() {
+		return errVisitorPaused
+	} else if v.user == nil && v.config.AnonymousPublishDisabled.Load() {
+		return errAnonymousPublishDisabled
+	} else if !v.messagesMonthlyLimiter.AllowN(n) {
+		mallowed(visitorLimiterMessagesMonthly, false)
+		return v.limitErrorNoLock(errMessageLimitReached)
+	} else if !v.messagesLimiter.AllowN(n) {
+		v.messagesMonthlyLimiter.AllowN(-n) // Not sent, give back to monthly limiter
+		mallowed(visitorLimiterMessages, false)
+		return v.limitErrorNoLock(errMessageLimitReached)
+	}
+	return nil
 }
 
-// IP returns the visitor IP address
-func (v *visitor) IP() netip.Addr {
+// MessageIntervalAllowed returns errMessageIntervalReached if the visitor published another message less than
+// VisitorMinMessageInterval ago. This protects against clients accidentally firing (duplicate) messages in rapid
+// succession, and is independent of the daily message limit. The interval is only restarted by StartMessageInterval,
+// so that rejected messages do not restart it.
+func (v *visitor) MessageIntervalAllowed() error {
 	v.mu.RLock()
 	defer v.mu.RUnlock()
-	return v.ip
+	if v.config.VisitorMinMessageInterval <= 0 {
+		return nil
+	}
+	if !mallowed(visitorLimiterMessageInterval, v.clock().Sub(v.lastMessageAt) >= v.config.VisitorMinMessageInterval) {
+		return errMessageIntervalReached
+	}
+	return nil
 }
 
-// Authenticated returns true if a user successfully authenticated
-func (v *visitor) Authenticated() bool {
+// StartMessageInterval restarts the interval checked by MessageIntervalAllowed. It must be called once a message
+// was accepted, i.e. after all other checks passed.
+func (v *visitor) StartMessageInterval() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.lastMessageAt = v.clock()
+}
+
+// DuplicateMessage returns the visitor's previous message, if it has the given hash (see messageHash) and was published
+// less than VisitorDedupWindow ago. Otherwise, or if deduplication is disabled, it returns nil. Duplicates do not
+// restart the window.
+func (v *visitor) DuplicateMessage(hash string) *message {
 	v.mu.RLock()
 	defer v.mu.RUnlock()
-	return v.user != nil
+	if v.config.VisitorDedupWindow <= 0 || v.lastMessage == nil || v.lastMessageHash != hash {
+		return nil
+	} else if v.clock().Sub(v.lastMessageHashAt) >= v.config.VisitorDedupWindow {
+		return nil
+	}
+	return v.lastMessage
 }
 
-// SetUser sets the visitors user to the given value
-func (v *visitor) SetUser(u *user.User) {
+// SetLastMessage remembers the given message and its hash (see messageHash), see DuplicateMessage
+func (v *visitor) SetLastMessage(hash string, m *message) {
 	v.mu.Lock()
 	defer v.mu.Unlock()
-	shouldResetLimiters := v.user.TierID() != u.TierID() // TierID works with nil receiver
-	v.user = u                                           // u may be nil!
-	if shouldResetLimiters {
-		var messages, emails, calls int64
-		if u != nil {
-			messages, emails, calls = u.Stats.Messages, u.Stats.Emails, u.Stats.Calls
-		}
-		v.resetLimitersNoLock(messages, emails, calls, true)
+	v.lastMessage, v.lastMessageHash, v.lastMessageHashAt = m, hash, v.clock()
+}
+
+// MessageSoftLimitWarning returns true if the visitor has used VisitorMessageSoftLimitPercent of its daily message
+// limit, so that publishers can be warned before they hit the hard limit (see "X-RateLimit-Warning" header). To avoid
+// nagging, it only returns true once per day, i.e. until the next daily stats reset.
+func (v *visitor) MessageSoftLimitWarning() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	percent := int64(v.config.VisitorMessageSoftLimitPercent)
+	limit := v.limitsNoLock().MessageLimit
+	if percent <= 0 || limit <= 0 || limit == visitorUnlimited {
+		return false
+	} else if v.messagesLimiter.Value()*100 < limit*percent {
+		return false
+	} else if v.softLimitWarned.After(lastStatsReset(v.config, v.clock())) {
+		return false // Already warned today
 	}
+	v.softLimitWarned = v.clock()
+	return true
 }
 
-// MaybeUserID returns the user ID of the visitor (if any). If this is an anonymous visitor,
-// an empty string is returned.
-func (v *visitor) MaybeUserID() string {
-	v.mu.RLock()
+// MessageAllowedPeek is like MessageAllowed, but only checks whether a message would be allowed, without
+// counting it towards any limits. This can be used for pre-flight checks, e.g. to disable the send button in the UI.
+func (v *visitor) MessageAllowedPeek() error {
+	v.mu.RLock() // limiters could be replaced!
 	defer v.mu.RUnlock()
-	if v.user != nil {
-		return v.user.ID
+	if v.pausedNoLock() {
+		return errVisitorPaused
+	} else if v.exempt {
+		return nil
+	} else if v.user == nil && v.config.AnonymousPublishDisabled.Load() {
+		return errAnonymousPublishDisabled
+	} else if v.requestLimiter.Tokens() < 1 {
+		return errRequestLimitReached
+	} else if v.messagesMonthlyLimiter.Remaining() < 1 || v.messagesLimiter.Remaining() < 1 {
+		return v.limitErrorNoLock(errMessageLimitReached)
 	}
-	return ""
+	return nil
 }
 
-func (v *visitor) resetLimitersNoLock(messages, emails, calls int64, enqueueUpdate bool) {
-	limits := v.limitsNoLock()
-	v.requestLimiter = rate.NewLimiter(limits.RequestLimitReplenish, limits.RequestLimitBurst)
-	v.messagesLimiter = util.NewFixedLimiterWithValue(limits.MessageLimit, messages)
-	v.emailsLimiter = util.NewRateLimiterWithValue(limits.EmailLimitReplenish, limits.EmailLimitBurst, emails)
-	v.callsLimiter = util.NewFixedLimiterWithValue(limits.CallLimit, calls)
-	v.bandwidthLimiter = util.NewBytesLimiter(int(limits.AttachmentBandwidthLimit), oneDay)
-	if v.user == nil {
-		v.accountLimiter = rate.NewLimiter(rate.Every(v.config.VisitorAccountCreationLimitReplenish), v.config.VisitorAccountCreationLimitBurst)
-		v.authLimiter = rate.NewLimiter(rate.Every(v.config.VisitorAuthFailureLimitReplenish), v.config.VisitorAuthFailureLimitBurst)
-	} else {
-		v.accountLimiter = nil // Users cannot create accounts when logged in
-		v.authLimiter = nil    // Users are already logged in, no need to limit requests
+// ExceededLimits returns the names of all limiters that are currently at or over capacity (see visitorLimiters),
+// without counting anything towards them. Unlike MessageAllowed, which stops at the first failure, this is meant
+// to tell users about all exceeded limits at once, e.g. "messages and bandwidth limits exceeded". Limiters that
+// were never used are not reported, so that a zero limit (e.g. no attachment bandwidth) does not show up.
+func (v *visitor) ExceededLimits() []string {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	exceeded := make([]string, 0)
+	if !v.exempt {
+		if v.requestLimiter.Tokens() < 1 {
+			exceeded = append(exceeded, visitorLimiterRequest)
+		}
+		if v.messagesLimiter.Remaining() < 1 {
+			exceeded = append(exceeded, visitorLimiterMessages)
+		}
+		if v.messagesMonthlyLimiter.Remaining() < 1 {
+			exceeded = append(exceeded, visitorLimiterMessagesMonthly)
+		}
 	}
-	if enqueueUpdate && v.user != nil {
-		go v.userManager.EnqueueUserStats(v.user.ID, &user.Stats{
-			Messages: messages,
-			Emails:   emails,
-			Calls:    calls,
-		})
+	if v.emailsLimiter.Value() > 0 && v.emailsLimiter.Remaining() < 1 {
+		exceeded = append(exceeded, visitorLimiterEmails)
 	}
-	log.Fields(v.contextNoLock()).Debug("Rate limiters reset for visitor") // Must be after function, because contextNoLock() describes rate limiters
+	if v.subscriptionLimiter.Value() > 0 && v.subscriptionLimiter.Remaining() < 1 {
+		exceeded = append(exceeded, visitorLimiterSubscriptions)
+	}
+	if v.bandwidthLimiter.Value() > 0 && v.bandwidthLimiter.Remaining() < 1 {
+		exceeded = append(exceeded, visitorLimiterBandwidth)
+	}
+	if v.ingressLimiter != nil && v.ingressLimiter.Value() > 0 && v.ingressLimiter.Remaining() < 1 {
+		exceeded = append(exceeded, visitorLimiterIngress)
+	}
+	return exceeded
 }
 
-func (v *visitor) Limits() *visitorLimits {
-	v.mu.RLock()
-	defer v.mu.RUnlock()
-	return v.limitsNoLock()
+// RefundMessage gives back a message that was counted by MessageAllowed, but never published, e.g.
+// because the attachment upload failed. The message count never drops below zero.
+func (v *visitor) RefundMessage() {
+	v.RefundMessageN(1)
 }
 
-func (v *visitor) limitsNoLock() *visitorLimits {
-	if v.user != nil && v.user.Tier != nil {
-		return tierBasedVisitorLimits(v.config, v.user.Tier)
+// ScheduledMessageAllowed counts a scheduled message towards the scheduled messages limit, and returns
+// errScheduledLimitReached if the limit was reached. This is used instead of MessageAllowed when a scheduled
+// message is published in "delivery" mode (see VisitorScheduledMessageMode), so that a batch of messages can be
+// queued without hitting the daily message limit. The message is counted via MessageAllowed once it is delivered.
+func (v *visitor) ScheduledMessageAllowed() error {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.pausedNoLock() {
+		return errVisitorPaused
+	} else if v.user == nil && v.config.AnonymousPublishDisabled.Load() {
+		return errAnonymousPublishDisabled
+	} else if v.scheduledLimiter == nil {
+		return nil
+	} else if !mallowed(visitorLimiterScheduled, v.scheduledLimiter.Allow()) {
+		return v.limitErrorNoLock(errScheduledLimitReached)
 	}
-	return configBasedVisitorLimits(v.config)
+	return nil
 }
 
-func tierBasedVisitorLimits(conf *Config, tier *user.Tier) *visitorLimits {
-	return &visitorLimits{
-		Basis:                    visitorLimitBasisTier,
-		RequestLimitBurst:        util.MinMax(int(float64(tier.MessageLimit)*visitorMessageToRequestLimitBurstRate), conf.VisitorRequestLimitBurst, visitorMessageToRequestLimitBurstMax),
-		RequestLimitReplenish:    util.Max(rate.Every(conf.VisitorRequestLimitReplenish), dailyLimitToRate(tier.MessageLimit*visitorMessageToRequestLimitReplenishFactor)),
-		MessageLimit:             tier.MessageLimit,
-		MessageExpiryDuration:    tier.MessageExpiryDuration,
-		EmailLimit:               tier.EmailLimit,
-		EmailLimitBurst:          util.MinMax(int(float64(tier.EmailLimit)*visitorEmailLimitBurstRate), conf.VisitorEmailLimitBurst, visitorEmailLimitBurstMax),
-		EmailLimitReplenish:      dailyLimitToRate(tier.EmailLimit),
-		CallLimit:                tier.CallLimit,
-		ReservationsLimit:        tier.ReservationLimit,
-		AttachmentTotalSizeLimit: tier.AttachmentTotalSizeLimit,
-		AttachmentFileSizeLimit:  tier.AttachmentFileSizeLimit,
-		AttachmentExpiryDuration: tier.AttachmentExpiryDuration,
-		AttachmentBandwidthLimit: tier.AttachmentBandwidthLimit,
+// RefundScheduledMessage gives back a message that was counted by ScheduledMessageAllowed, but never queued
+func (v *visitor) RefundScheduledMessage() {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.scheduledLimiter != nil && v.scheduledLimiter.Value() > 0 {
+		v.scheduledLimiter.AllowN(-1)
 	}
 }
 
-func configBasedVisitorLimits(conf *Config) *visitorLimits {
-	messagesLimit := replenishDurationToDailyLimit(conf.VisitorRequestLimitReplenish) // Approximation!
-	if conf.VisitorMessageDailyLimit > 0 {
-		messagesLimit = int64(conf.VisitorMessageDailyLimit)
-	}
-	return &visitorLimits{
-		Basis:                    visitorLimitBasisIP,
-		RequestLimitBurst:        conf.VisitorRequestLimitBurst,
-		RequestLimitReplenish:    rate.Every(conf.VisitorRequestLimitReplenish),
-		MessageLimit:             messagesLimit,
-		MessageExpiryDuration:    conf.CacheDuration,
-		EmailLimit:               replenishDurationToDailyLimit(conf.VisitorEmailLimitReplenish), // Approximation!
-		EmailLimitBurst:          conf.VisitorEmailLimitBurst,
-		EmailLimitReplenish:      rate.Every(conf.VisitorEmailLimitReplenish),
-		CallLimit:                visitorDefaultCallsLimit,
-		ReservationsLimit:        visitorDefaultReservationsLimit,
-		AttachmentTotalSizeLimit: conf.VisitorAttachmentTotalSizeLimit,
-		AttachmentFileSizeLimit:  conf.AttachmentFileSizeLimit,
-		AttachmentExpiryDuration: conf.AttachmentExpiryDuration,
-		AttachmentBandwidthLimit: conf.VisitorAttachmentDailyBandwidthLimit,
+// AttachmentMessageAllowed counts a message with an attachment towards the daily attachment messages limit, and
+// returns errAttachmentLimitReached if the limit was reached. It is called in addition to MessageAllowed,
+// since messages with attachments are more expensive than plain text messages (see user.Tier).
+func (v *visitor) AttachmentMessageAllowed() error {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.pausedNoLock() {
+		return errVisitorPaused
+	} else if v.attachmentLimiter == nil {
+		return nil
+	} else if !mallowed(visitorLimiterAttachments, v.attachmentLimiter.Allow()) {
+		return v.limitErrorNoLock(errAttachmentLimitReached)
 	}
+	return nil
 }
 
-func (v *visitor) Info() (*visitorInfo, error) {
-	v.mu.RLock()
-	info := v.infoLightNoLock()
-	v.mu.RUnlock()
+// RefundAttachmentMessage gives back a message that was counted by AttachmentMessageAllowed, but never published
+func (v *visitor) RefundAttachmentMessage() {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.attachmentLimiter != nil && v.attachmentLimiter.Value() > 0 {
+		v.attachmentLimiter.AllowN(-1)
+	}
+}
 
-	// Attachment stats from database
-	var attachmentsBytesUsed int64
-	var err error
-	u := v.User()
-	if u != nil {
-		attachmentsBytesUsed, err = v.messageCache.AttachmentBytesUsedByUser(u.ID)
-	} else {
-		attachmentsBytesUsed, err = v.messageCache.AttachmentBytesUsedBySender(v.IP().String())
+// UrgentMessageAllowed counts an urgent (priority 5) message towards the daily urgent messages limit of the tier, and
+// returns errUrgentLimitReached if the limit was reached. Like AttachmentMessageAllowed, it is called in addition to
+// MessageAllowed, to keep publishers from wearing out their subscribers with urgent notifications.
+func (v *visitor) UrgentMessageAllowed() error {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.pausedNoLock() {
+		return errVisitorPaused
+	} else if v.urgentLimiter == nil {
+		return nil
+	} else if !mallowed(visitorLimiterUrgent, v.urgentLimiter.Allow()) {
+		return v.limitErrorNoLock(errUrgentLimitReached)
 	}
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+// RefundUrgentMessage gives back a message that was counted by UrgentMessageAllowed, but never published
+func (v *visitor) RefundUrgentMessage() {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.urgentLimiter != nil && v.urgentLimiter.Value() > 0 {
+		v.urgentLimiter.AllowN(-1)
 	}
-	info.Stats.AttachmentTotalSize = attachmentsBytesUsed
-	info.Stats.AttachmentTotalSizeRemaining = zeroIfNegative(info.Limits.AttachmentTotalSizeLimit - attachmentsBytesUsed)
+}
+
+// GatewayMessageAllowed counts a UnifiedPush/Matrix gateway message towards the daily gateway messages limit, and
+// returns errGatewayLimitReached if the limit was reached. Gateway messages are always counted (so they can be
+// reported separately), but they are only limited if a gateway messages limit is set. In that case, they do not
+// count towards the daily message limit, see GatewayMessagesLimited.
+func (v *visitor) GatewayMessageAllowed() error {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.pausedNoLock() {
+		return errVisitorPaused
+	} else if !mallowed(visitorLimiterGateway, v.gatewayLimiter.Allow()) {
+		return v.limitErrorNoLock(errGatewayLimitReached)
+	}
+	return nil
+}
+
+// GatewayMessagesLimited returns true if gateway messages are limited separately, and are therefore not
+// counted towards the daily message limit, see GatewayMessageAllowed
+func (v *visitor) GatewayMessagesLimited() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.gatewayLimited
+}
+
+// RefundGatewayMessage gives back a gateway message that was counted by GatewayMessageAllowed
+func (v *visitor) RefundGatewayMessage() {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.gatewayLimiter.Value() > 0 {
+		v.gatewayLimiter.AllowN(-1)
+	}
+}
+
+// RefundMessageN gives back n messages that were counted by MessageAllowedN, see RefundMessage
+func (v *visitor) RefundMessageN(n int64) {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	refund := n
+	if value := v.messagesLimiter.Value(); value < refund {
+		refund = value
+	}
+	if refund > 0 {
+		v.messagesLimiter.AllowN(-refund)
+		v.messagesMonthlyLimiter.AllowN(-util.MinMax(refund, 0, v.messagesMonthlyLimiter.Value()))
+	}
+}
+
+// EmailAllowed counts an email towards the email limit, and returns errEmailLimitReached if the limit was reached
+func (v *visitor) EmailAllowed() error {
+	v.mu.Lock() // limiters could be replaced, and the circuit breaker may be updated
+	defer v.mu.Unlock()
+	if v.pausedNoLock() {
+		return errVisitorPaused
+	} else if err := v.emailBreakerAllowedNoLock(); err != nil {
+		return err
+	} else if !mallowed(visitorLimiterEmails, v.emailsLimiter.Allow()) {
+		return v.limitErrorNoLock(errEmailLimitReached)
+	} else if v.config.VisitorEmailLimitPersist && !hasUserLimits(v.user) && !hasTokenVisitor(v.user) {
+		v.persistEmailsNoLock()
+	}
+	return nil
+}
+
+// InboundEmailAllowed counts an inbound e-mail (i.e. a message published via the SMTP server) from the given sender
+// address towards the inbound e-mail limit, and returns errInboundEmailLimitReached if the limit was reached. The limit
+// applies per sender address, or per visitor if the sender is empty, so that senders behind the same mail relay do not
+// share a limit. Inbound e-mails still count towards the message limit. If there is no inbound e-mail limit (see
+// VisitorInboundEmailLimitBurst), nil is returned.
+func (v *visitor) InboundEmailAllowed(sender string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.pausedNoLock() {
+		return errVisitorPaused
+	} else if v.config.VisitorInboundEmailLimitBurst <= 0 {
+		return nil
+	}
+	sender = strings.ToLower(sender)
+	limiter, ok := v.inboundEmailLimiters[sender]
+	if !ok {
+		if len(v.inboundEmailLimiters) >= visitorInboundEmailSendersMax {
+			v.inboundEmailLimiters = nil // Cleared when full, like the GeoIP cache
+		}
+		if v.inboundEmailLimiters == nil {
+			v.inboundEmailLimiters = make(map[string]*rate.Limiter)
+		}
+		limiter = rate.NewLimiter(safeEvery(v.config.VisitorInboundEmailLimitReplenish), v.config.VisitorInboundEmailLimitBurst)
+		v.inboundEmailLimiters[sender] = limiter
+	}
+	if !mallowed(visitorLimiterInboundEmails, limiter.Allow()) {
+		return v.limitErrorNoLock(errInboundEmailLimitReached)
+	}
+	return nil
+}
+
+// emailBreakerAllowedNoLock returns errEmailUnavailable if the e-mail circuit breaker is open, i.e. if the last
+// VisitorEmailFailureThreshold e-mails failed, and the cooldown has not passed yet. Once it has passed, a single
+// e-mail is let through as a probe, and all others are rejected for another cooldown, until the probe succeeds
+// (see EmailSendSucceeded) or fails (see EmailSendFailed).
+func (v *visitor) emailBreakerAllowedNoLock() error {
+	threshold := v.config.VisitorEmailFailureThreshold
+	if threshold <= 0 || v.emailFailures < threshold {
+		return nil
+	}
+	now := v.clock()
+	if now.Before(v.emailBlockedUntil) {
+		return errEmailUnavailable
+	}
+	v.emailBlockedUntil = now.Add(v.config.VisitorEmailFailureCooldown) // Probe
+	return nil
+}
+
+// EmailSendSucceeded closes the e-mail circuit breaker, see EmailAllowed
+func (v *visitor) EmailSendSucceeded() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.emailFailures = 0
+	v.emailBlockedUntil = time.Time{}
+}
+
+// EmailSendFailed counts a failed e-mail, and opens the e-mail circuit breaker for VisitorEmailFailureCooldown
+// once VisitorEmailFailureThreshold consecutive e-mails have failed. While the breaker is open, EmailAllowed
+// returns errEmailUnavailable without counting the e-mail towards the e-mail limit.
+func (v *visitor) EmailSendFailed() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.emailFailures++
+	if threshold := v.config.VisitorEmailFailureThreshold; threshold > 0 && v.emailFailures >= threshold {
+		v.emailBlockedUntil = v.clock().Add(v.config.VisitorEmailFailureCooldown)
+	}
+}
+
+func (v *visitor) CallAllowed() bool {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.pausedNoLock() {
+		return false
+	}
+	return mallowed(visitorLimiterCalls, v.callsLimiter.Allow())
+}
+
+// SubscriptionAllowed counts an active subscription, and returns errSubscriptionLimitReached if the limit was
+// reached. If the visitor opens new subscriptions too quickly (see VisitorSubscriptionAttemptLimitBurst), it returns
+// errSubscriptionAttemptLimitReached instead. If it returns nil, RemoveSubscription must be called once the
+// subscription is closed.
+func (v *visitor) SubscriptionAllowed() error {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.pausedNoLock() {
+		return errVisitorPaused
+	} else if !v.subscriptionAttemptAllowedNoLock() {
+		return errSubscriptionAttemptLimitReached // Not a tier limit, so upgrading does not help
+	} else if !mallowed(visitorLimiterSubscriptions, v.subscriptionLimiter.Allow()) {
+		return v.limitErrorNoLock(errSubscriptionLimitReached)
+	}
+	return nil
+}
+
+// subscriptionAttemptAllowedNoLock counts a subscription attempt, and returns false if the visitor is connecting
+// too quickly. Every attempt counts, even if the subscription is rejected afterward.
+func (v *visitor) subscriptionAttemptAllowedNoLock() bool {
+	if v.connectLimiter == nil {
+		return true
+	}
+	return mallowed(visitorLimiterSubscriptionAttempts, v.connectLimiter.Allow())
+}
+
+// AuthAllowed returns true if an auth request can be attempted (> 1 token available)
+func (v *visitor) AuthAllowed() bool {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.authLimiter == nil {
+		return true
+	}
+	return mallowed(visitorLimiterAuth, v.authLimiter.Tokens() > 1)
+}
+
+// AuthFailed records an auth failure
+func (v *visitor) AuthFailed() {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.authLimiter != nil {
+		v.authLimiter.Allow()
+	}
+}
+
+// AuthSucceeded resets the auth failure limiter after a successful login
+func (v *visitor) AuthSucceeded() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.authLimiter != nil {
+		v.authLimiter = rate.NewLimiter(safeEvery(v.config.VisitorAuthFailureLimitReplenish), v.config.VisitorAuthFailureLimitBurst)
+	}
+}
+
+// AccountCreateAllowed counts an account creation towards the account creation limit, and returns
+// errAccountCreateLimitReached if the limit was reached. The account limiter is only set for anonymous
+// visitors; logged-in users cannot create accounts anyway (see handleAccountCreate), so nil is returned.
+func (v *visitor) AccountCreateAllowed() error {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.pausedNoLock() {
+		return errVisitorPaused
+	} else if v.accountLimiter == nil {
+		return nil
+	} else if !mallowed(visitorLimiterAccountCreation, v.accountLimiter.Allow()) {
+		return errAccountCreateLimitReached
+	}
+	return nil
+}
+
+// BandwidthAllowed counts the given bytes towards the attachment bandwidth limit, and returns
+// errBandwidthLimitReached if the limit was reached
+func (v *visitor) BandwidthAllowed(bytes int64) error {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.pausedNoLock() {
+		return errVisitorPaused
+	} else if !mallowed(visitorLimiterBandwidth, v.bandwidthLimiter.AllowN(bytes)) {
+		return v.limitErrorNoLock(errBandwidthLimitReached)
+	}
+	return nil
+}
+
+// BandwidthRemaining returns the number of attachment bytes that can still be transferred before the
+// bandwidth limit is reached
+func (v *visitor) BandwidthRemaining() int64 {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	return v.bandwidthLimiter.Remaining()
+}
+
+// BandwidthResetAt returns the time at which the full attachment bandwidth allowance is available again. In
+// "calendar" mode (see VisitorAttachmentBandwidthResetMode), this is the next daily stats reset. In "rolling"
+// mode, it is the time at which the used-up bytes are replenished, or now if nothing was used.
+func (v *visitor) BandwidthResetAt() time.Time {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	return v.bandwidthResetAtNoLock()
+}
+
+func (v *visitor) bandwidthResetAtNoLock() time.Time {
+	if v.config.VisitorAttachmentBandwidthResetMode == VisitorAttachmentBandwidthResetModeCalendar {
+		return v.statsResetAtNoLock()
+	}
+	limit := v.limitsNoLock().AttachmentBandwidthLimit
+	used := limit - v.bandwidthLimiter.Remaining()
+	if limit <= 0 || used <= 0 {
+		return v.clock()
+	}
+	return v.clock().Add(time.Duration(float64(used) / float64(limit) * float64(oneDay)))
+}
+
+// ThrottledReader returns a reader that serves r at a reduced rate, to be used for attachment downloads once the
+// bandwidth limit is reached (see VisitorAttachmentBandwidthModeThrottle). What's left of the remaining allowance
+// is read at full speed, after which reads are paced at the rate at which the bandwidth limit is replenished.
+func (v *visitor) ThrottledReader(r io.Reader) io.Reader {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	remaining := v.bandwidthLimiter.Remaining()
+	if remaining > 0 {
+		v.bandwidthLimiter.AllowN(remaining)
+	}
+	replenish := rate.Limit(v.limitsNoLock().AttachmentBandwidthLimit) * rate.Every(oneDay)
+	limit := rate.Limit(math.Max(float64(replenish), visitorAttachmentThrottleMinRate))
+	burst := int(util.Max(remaining, visitorAttachmentThrottleMinRate))
+	limiter := rate.NewLimiter(limit, burst)
+	limiter.AllowN(time.Now(), burst-int(remaining)) // Only the remaining allowance is available right away
+	return util.NewThrottledReader(r, limiter)
+}
+
+// AcquireDownload counts an ongoing attachment download, and returns errDownloadLimitReached if the visitor already
+// has VisitorAttachmentDownloadConcurrency downloads in progress. If it returns nil, ReleaseDownload must be called
+// once the download is finished. If there is no limit, nil is returned.
+func (v *visitor) AcquireDownload() error {
+	if v.downloadLimiter == nil {
+		return nil
+	} else if !mallowed(visitorLimiterDownloads, v.downloadLimiter.Allow()) {
+		return errDownloadLimitReached
+	}
+	return nil
+}
+
+// ReleaseDownload marks an attachment download as finished, see AcquireDownload
+func (v *visitor) ReleaseDownload() {
+	if v.downloadLimiter != nil {
+		v.downloadLimiter.AllowN(-1)
+	}
+}
+
+// OwnedSubscriptionAllowed is like SubscriptionAllowed, but for subscriptions to topics that the user owns (see
+// Server.subscriptionTopicsOwned). These do not count against the subscription limit, so RemoveSubscription must
+// not be called for them. Subscription attempts are still counted, see VisitorSubscriptionAttemptLimitBurst.
+func (v *visitor) OwnedSubscriptionAllowed() error {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.pausedNoLock() {
+		return errVisitorPaused
+	} else if !v.subscriptionAttemptAllowedNoLock() {
+		return errSubscriptionAttemptLimitReached
+	}
+	return nil
+}
+
+func (v *visitor) RemoveSubscription() {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	v.subscriptionLimiter.AllowN(-1)
+}
+
+// ReserveSubscriptionSlot is like SubscriptionAllowed, but keys the subscription slot by a client-provided connection
+// ID (see "X-Connection-ID" header). This lets a reconnecting authenticated user reclaim its slot: If a connection with
+// the same ID still holds the slot (e.g. because the old TCP connection was not torn down yet), or held it within the
+// last few seconds (see visitorSubscriptionSlotHoldDuration), the new connection takes it over without counting
+// as a new subscription. Anonymous visitors, or connections without an ID, are counted as usual.
+//
+// The returned release function must be called once the connection is closed. It holds the slot for a reconnect,
+// and frees it automatically after visitorSubscriptionSlotHoldDuration.
+func (v *visitor) ReserveSubscriptionSlot(id string) (release func(), err error) {
+	if id == "" || !v.Authenticated() {
+		if err := v.SubscriptionAllowed(); err != nil {
+			return nil, err
+		}
+		return v.RemoveSubscription, nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	gen, exists := v.subscriptionSlots[id]
+	if v.pausedNoLock() {
+		return nil, errVisitorPaused
+	} else if !v.subscriptionAttemptAllowedNoLock() {
+		return nil, errSubscriptionAttemptLimitReached
+	} else if !exists && !mallowed(visitorLimiterSubscriptions, v.subscriptionLimiter.Allow()) {
+		return nil, v.limitErrorNoLock(errSubscriptionLimitReached)
+	}
+	gen++
+	v.subscriptionSlots[id] = gen
+	return func() { v.holdSubscriptionSlot(id, gen) }, nil
+}
+
+// holdSubscriptionSlot keeps the slot of a closed connection for a reconnect, unless it was already taken over
+// by a newer connection with the same ID, and frees it after visitorSubscriptionSlotHoldDuration
+func (v *visitor) holdSubscriptionSlot(id string, gen int) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if v.subscriptionSlots[id] == gen {
+		time.AfterFunc(visitorSubscriptionSlotHoldDuration, func() { v.expireSubscriptionSlot(id, gen) })
+	}
+}
+
+// expireSubscriptionSlot frees a held subscription slot, unless it was reclaimed by a reconnect in the meantime
+func (v *visitor) expireSubscriptionSlot(id string, gen int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.subscriptionSlots[id] == gen {
+		delete(v.subscriptionSlots, id)
+		v.subscriptionLimiter.AllowN(-1)
+	}
+}
+
+func (v *visitor) Keepalive() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.seen = v.clock()
+	if v.paused && !v.pausedUntil.IsZero() && !v.seen.Before(v.pausedUntil) {
+		v.paused, v.pausedUntil = false, time.Time{} // Pause is over, see SetPaused
+	}
+	if !v.statsReset.IsZero() && !v.seen.Before(v.statsReset.Add(v.statsResetJitter)) {
+		v.resetStatsNoLock() // Jittered daily reset, see Config.VisitorLimitResetJitter
+		v.statsReset = nextStatsReset(v.config, v.statsReset.Add(time.Second))
+	}
+	if !v.graceUntil.IsZero() && v.seen.After(v.graceUntil) {
+		v.graceUntil = time.Time{}
+		v.requestLimiter.SetBurst(v.limitsNoLock().RequestLimitBurst) // New account grace is over, back to normal
+	}
+	if !v.boostExpires.IsZero() && !v.seen.Before(v.boostExpires) {
+		v.resetLimitersKeepValuesNoLock() // Boost is over, back to normal; this also clears boostExpires
+	}
+}
+
+// IngressAllowed counts the given number of published bytes (i.e. the request body) towards the ingress bandwidth
+// limit, and returns errIngressLimitReached if the limit was reached. If there is no ingress limit (see
+// VisitorIngressDailyBandwidthLimit), or the body is empty, nil is returned.
+func (v *visitor) IngressAllowed(n int64) error {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if v.pausedNoLock() {
+		return errVisitorPaused
+	} else if v.ingressLimiter == nil || n <= 0 {
+		return nil
+	} else if !mallowed(visitorLimiterIngress, v.ingressLimiter.AllowN(n)) {
+		return v.limitErrorNoLock(errIngressLimitReached)
+	}
+	return nil
+}
+
+// RefundIngress gives back n bytes that were counted by IngressAllowed, because the message was never published
+func (v *visitor) RefundIngress(n int64) {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	if limiter, ok := v.ingressLimiter.(*util.RateLimiter); ok {
+		limiter.Refund(n)
+	}
+}
+
+func (v *visitor) BandwidthLimiter() util.Limiter {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	return v.bandwidthLimiter
+}
+
+// Basis returns how the visitor's limits are derived, see visitorLimitBasis. Unlike Info, this is cheap
+// and does not require any database lookups.
+func (v *visitor) Basis() visitorLimitBasis {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.basisNoLock()
+}
+
+func (v *visitor) basisNoLock() visitorLimitBasis {
+	return limitBasis(v.user)
+}
+
+// visitorLimitError is a limit error (see errVisitorLimitReached), annotated with the basis of the visitor's limits
+// at the time the limit was hit. It is only used if Config.UsePaymentRequiredForTierLimits is set, so that
+// errHTTPFromLimitError can tell tier users (402) from anonymous visitors (429).
+type visitorLimitError struct {
+	err        error
+	basis      visitorLimitBasis
+	upgradeURL string
+}
+
+func (e *visitorLimitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *visitorLimitError) Unwrap() error {
+	return e.err
+}
+
+// limitErrorNoLock annotates the given limit error with the visitor's limit basis, see visitorLimitError
+func (v *visitor) limitErrorNoLock(err error) error {
+	if !v.config.UsePaymentRequiredForTierLimits {
+		return err
+	}
+	var upgradeURL string
+	if v.config.BaseURL != "" {
+		upgradeURL = v.config.BaseURL + accountPath
+	}
+	return &visitorLimitError{
+		err:        err,
+		basis:      limitBasis(v.user),
+		upgradeURL: upgradeURL,
+	}
+}
+
+// LimitError assembles the machine-readable limit object for a 429 response, after the limiter with the given name
+// (see visitorLimiters) rejected a request. Like Snapshot, this does not require any database lookups. For limiters
+// that are not simple counters (e.g. the auth limiter), only the limiter name and the basis are set.
+func (v *visitor) LimitError(limiter string) *limitErrorResponse {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	info := v.infoLightNoLock()
+	limits, stats := info.Limits, info.Stats
+	resp := &limitErrorResponse{
+		Limiter: limiter,
+		Basis:   string(limits.Basis),
+	}
+	switch limiter {
+	case visitorLimiterMessages:
+		if limits.MessageMonthlyLimit > 0 && stats.MessagesMonthlyRemaining == 0 && stats.MessagesRemaining > 0 {
+			now := v.clock().UTC()
+			resp.Limiter, resp.Limit = visitorLimiterMessagesMonthly, limits.MessageMonthlyLimit
+			resp.ResetAt = time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC).Unix() // See user.MonthlyPeriod
+		} else {
+			resp.Limit, resp.Remaining, resp.ResetAt = limits.MessageLimit, stats.MessagesRemaining, stats.MessagesResetAt
+		}
+	case visitorLimiterEmails:
+		resp.Limit, resp.Remaining, resp.ResetAt = int64(limits.EmailLimitBurst), v.emailsLimiter.Remaining(), nextTokenAt(v.emailsLimiter.Rate(), v.clock())
+	case visitorLimiterCalls:
+		resp.Limit, resp.Remaining, resp.ResetAt = limits.CallLimit, stats.CallsRemaining, v.statsResetAtNoLock().Unix()
+	case visitorLimiterSubscriptions:
+		resp.Limit, resp.Remaining = limits.SubscriptionLimit, v.subscriptionLimiter.Remaining()
+	case visitorLimiterBandwidth:
+		resp.Limit, resp.Remaining, resp.ResetAt = limits.AttachmentBandwidthLimit, stats.AttachmentBandwidthRemaining, stats.AttachmentBandwidthResetAt
+	case visitorLimiterIngress:
+		resp.Limit, resp.Remaining, resp.ResetAt = limits.IngressBandwidthLimit, stats.IngressBandwidthRemaining, v.statsResetAtNoLock().Unix()
+	case visitorLimiterAttachments:
+		resp.Limit, resp.Remaining, resp.ResetAt = limits.AttachmentMessagesLimit, stats.AttachmentMessagesRemaining, v.statsResetAtNoLock().Unix()
+	case visitorLimiterGateway:
+		resp.Limit, resp.Remaining, resp.ResetAt = limits.GatewayMessagesLimit, stats.GatewayMessagesRemaining, v.statsResetAtNoLock().Unix()
+	case visitorLimiterUrgent:
+		resp.Limit, resp.Remaining, resp.ResetAt = limits.UrgentMessagesLimit, stats.UrgentMessagesRemaining, v.statsResetAtNoLock().Unix()
+	case visitorLimiterRequest:
+		resp.Limit, resp.Remaining, resp.ResetAt = int64(limits.RequestLimitBurst), int64(stats.RequestLimitTokens), nextTokenAt(v.requestLimiter.Limit(), v.clock())
+	}
+	resp.Remaining = zeroIfNegative(resp.Remaining)
+	return resp
+}
+
+// nextTokenAt returns the Unix timestamp at which a token bucket with the given rate gets its next token (roughly,
+// ignoring the fractions of tokens that are already in the bucket), or zero if the rate is unknown
+func nextTokenAt(r rate.Limit, now time.Time) int64 {
+	if r <= 0 || r == rate.Inf {
+		return 0
+	}
+	return now.Add(time.Duration(float64(time.Second) / float64(r))).Unix()
+}
+
+// limitBasis returns how the limits of a visitor with the given user (may be nil) are derived. It is used
+// by limitsNoLock, Basis and the visitor creation log, so that they always agree.
+func limitBasis(u *user.User) visitorLimitBasis {
+	if hasTokenLimitProfile(u) {
+		return visitorLimitBasisProfile
+	} else if u.HasLimitOverrides() {
+		return visitorLimitBasisUser
+	} else if u != nil && u.Tier != nil {
+		return visitorLimitBasisTier
+	}
+	return visitorLimitBasisIP
+}
+
+// Snapshot returns a copy of the visitor's current rate limiting state, e.g. for monitoring. Like Basis,
+// this is cheap and does not require any database lookups.
+func (v *visitor) Snapshot() *visitorSnapshot {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	var username string
+	if v.user != nil {
+		username = v.user.Name
+	}
+	return &visitorSnapshot{
+		IP:            v.ip,
+		User:          username,
+		Basis:         v.basisNoLock(),
+		Messages:      v.messagesLimiter.Value(),
+		Emails:        v.emailsLimiter.Value(),
+		Subscriptions: v.subscriptionLimiter.Value(),
+		Stale:         v.clock().Sub(v.seen) > v.config.VisitorExpungeAfter,
+		Tenant:        v.tenantNoLock(),
+		Shared:        v.billingAccountNoLock() != "",
+		Requests:      v.requests,
+		RequestTime:   v.requestTime,
+	}
+}
+
+// LimiterStates returns the live state of all of the visitor's limiters, keyed by limiter name (see
+// visitorLimiters). Limiters that are not in use (e.g. the auth limiter of logged-in users) are omitted.
+// Like Snapshot, this does not require any database lookups.
+func (v *visitor) LimiterStates() map[string]*visitorLimiterState {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	states := map[string]*visitorLimiterState{
+		visitorLimiterRequest:         tokenBucketState(v.requestLimiter),
+		visitorLimiterMessages:        remainingLimiterState(v.messagesLimiter),
+		visitorLimiterMessagesMonthly: remainingLimiterState(v.messagesMonthlyLimiter),
+		visitorLimiterEmails:          remainingLimiterState(v.emailsLimiter),
+		visitorLimiterCalls:           remainingLimiterState(v.callsLimiter),
+		visitorLimiterSubscriptions:   remainingLimiterState(v.subscriptionLimiter),
+		visitorLimiterBandwidth:       remainingLimiterState(v.bandwidthLimiter),
+	}
+	if v.readRequestLimiter != nil {
+		states[visitorLimiterReadRequest] = tokenBucketState(v.readRequestLimiter)
+	}
+	if v.ingressLimiter != nil {
+		states[visitorLimiterIngress] = remainingLimiterState(v.ingressLimiter)
+	}
+	if v.connectLimiter != nil {
+		states[visitorLimiterSubscriptionAttempts] = tokenBucketState(v.connectLimiter)
+	}
+	if v.authLimiter != nil {
+		states[visitorLimiterAuth] = tokenBucketState(v.authLimiter)
+	}
+	if v.accountLimiter != nil {
+		states[visitorLimiterAccountCreation] = tokenBucketState(v.accountLimiter)
+	}
+	if limiter, ok := v.firebaseLimiter.(util.RemainingLimiter); ok {
+		states[visitorLimiterFirebase] = remainingLimiterState(limiter)
+	}
+	if v.scheduledLimiter != nil {
+		states[visitorLimiterScheduled] = remainingLimiterState(v.scheduledLimiter)
+	}
+	if v.attachmentLimiter != nil {
+		states[visitorLimiterAttachments] = remainingLimiterState(v.attachmentLimiter)
+	}
+	if v.urgentLimiter != nil {
+		states[visitorLimiterUrgent] = remainingLimiterState(v.urgentLimiter)
+	}
+	states[visitorLimiterGateway] = remainingLimiterState(v.gatewayLimiter)
+	return states
+}
+
+// Utilization returns how much of the request, message, email, subscription and bandwidth limits the visitor
+// uses, as a percentage (0-100) keyed by limiter name (see visitorLimiters), e.g. for a dashboard gauge. Like
+// LimiterStates, it is based on the live limiters. Unlimited (or zero) limits are omitted.
+func (v *visitor) Utilization() map[string]float64 {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	limits := v.limitsNoLock()
+	utilization := make(map[string]float64)
+	add := func(name string, used, limit float64) {
+		if limit > 0 {
+			utilization[name] = math.Min(math.Max(used/limit*100, 0), 100)
+		}
+	}
+	burst := float64(v.requestLimiter.Burst())
+	add(visitorLimiterRequest, burst-v.requestLimiter.Tokens(), burst)
+	if limits.MessageLimit != visitorUnlimited {
+		messages := v.messagesLimiter.Value()
+		add(visitorLimiterMessages, float64(messages), float64(messages+v.messagesLimiter.Remaining()))
+	}
+	if limits.EmailLimit != visitorUnlimited {
+		add(visitorLimiterEmails, float64(int64(limits.EmailLimitBurst)-v.emailsLimiter.Remaining()), float64(limits.EmailLimitBurst))
+	}
+	subscriptions := v.subscriptionLimiter.Value()
+	add(visitorLimiterSubscriptions, float64(subscriptions), float64(subscriptions+v.subscriptionLimiter.Remaining()))
+	add(visitorLimiterBandwidth, float64(limits.AttachmentBandwidthLimit-v.bandwidthLimiter.Remaining()), float64(limits.AttachmentBandwidthLimit)) // Rolling limiter: value is not the usage
+	return utilization
+}
+
+func tokenBucketState(limiter *rate.Limiter) *visitorLimiterState {
+	return &visitorLimiterState{
+		Tokens: limiter.Tokens(),
+		Burst:  limiter.Burst(),
+		Rate:   float64(limiter.Limit()),
+	}
+}
+
+func remainingLimiterState(limiter util.RemainingLimiter) *visitorLimiterState {
+	return &visitorLimiterState{
+		Value:     limiter.Value(),
+		Remaining: limiter.Remaining(),
+	}
+}
+
+// RateLimitHeaders returns the standard X-RateLimit-* headers for the visitor's message limit: the daily
+// message limit (from the tier or config), the remaining messages, and the time at which the message counter
+// drops next (Unix timestamp). This is cheap and does not require any database lookups.
+func (v *visitor) RateLimitHeaders() map[string]string {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	limits := v.limitsNoLock()
+	if limits.MessageLimit == visitorUnlimited {
+		return nil // No message limit, nothing to report
+	}
+	messages := v.messagesLimiter.Value()
+	return map[string]string{
+		"X-RateLimit-Limit":     strconv.FormatInt(limits.MessageLimit, 10),
+		"X-RateLimit-Remaining": strconv.FormatInt(zeroIfNegative(subSaturating(limits.MessageLimit, messages)), 10),
+		"X-RateLimit-Reset":     strconv.FormatInt(v.messagesResetAtNoLock().Unix(), 10),
+	}
+}
+
+// MessagesRemaining returns the number of remaining messages and the time at which the message counter drops next,
+// see RateLimitHeaders. Like those, it is computed from the messages limiter only, without any database lookups.
+// If the visitor has no message limit, ok is false.
+func (v *visitor) MessagesRemaining() (remaining int64, resetAt time.Time, ok bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	limits := v.limitsNoLock()
+	if limits.MessageLimit == visitorUnlimited {
+		return 0, time.Time{}, false
+	}
+	remaining = zeroIfNegative(subSaturating(limits.MessageLimit, v.messagesLimiter.Value()))
+	return remaining, v.messagesResetAtNoLock(), true
+}
+
+// Close flushes the stats of the visitor's user (if any) to the user database queue, so that message/email counts
+// since the last persistence are not lost. It is called when a stale visitor is removed. Stats are only flushed for
+// users with their own limits, since other users share their (IP-based) visitor with others, see hasUserLimits.
+// The user is kept, since long-lived handlers (e.g. subscriptions) may still hold on to the visitor.
+func (v *visitor) Close() {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if v.userManager != nil && hasUserLimits(v.user) && !v.noPersist {
+		v.userManager.EnqueueUserStats(v.user.ID, v.statsNoLock())
+	}
+}
+
+// LogFields returns the final state of the visitor as log fields, to be logged when it is removed from memory:
+// its IP address and user, its message and email counts, and how long ago it was last seen
+func (v *visitor) LogFields() log.Context {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	fields := log.Context{
+		"visitor_id":         visitorID(v.ip, v.user),
+		"visitor_ip":         v.ip.String(),
+		"visitor_messages":   v.messagesLimiter.Value(),
+		"visitor_emails":     v.emailsLimiter.Value(),
+		"visitor_seen":       util.FormatTime(v.seen),
+		"visitor_seen_since": v.clock().Sub(v.seen).Round(time.Second).String(),
+	}
+	if v.user != nil {
+		fields["user_id"] = v.user.ID
+		fields["user_name"] = v.user.Name
+	}
+	return fields
+}
+
+// AttachmentFileSizeLimit returns the effective per-file attachment size limit of this visitor, i.e. the limit
+// of the user's tier, or the config-based limit for IP-based visitors, users without a tier and admins
+func (v *visitor) AttachmentFileSizeLimit() int64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	var tier *user.Tier
+	if v.user != nil {
+		tier = v.user.Tier
+	}
+	return attachmentFileSizeLimit(v.config, tier)
+}
+
+// LastSeen returns the time at which the visitor was last seen, see Keepalive
+func (v *visitor) LastSeen() time.Time {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.seen
+}
+
+func (v *visitor) Stale() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.clock().Sub(v.seen) > v.config.VisitorExpungeAfter
+}
+
+func (v *visitor) Stats() *user.Stats {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	return v.statsNoLock()
+}
+
+func (v *visitor) statsNoLock() *user.Stats {
+	return &user.Stats{
+		Messages:              v.messagesLimiter.Value(),
+		Emails:                v.emailsLimiter.Value(),
+		Calls:                 v.callsLimiter.Value(),
+		Firebase:              v.firebaseCount,
+		RequestTokens:         v.requestLimiter.Tokens(),
+		RequestTokensUpdated:  v.clock(),
+		MessagesMonthly:       v.messagesMonthlyLimiter.Value(),
+		MessagesMonthlyPeriod: user.MonthlyPeriod(v.clock()),
+	}
+}
+
+func (v *visitor) ResetStats() {
+	v.mu.Lock() // limiters could be replaced, see below
+	defer v.mu.Unlock()
+	v.resetStatsNoLock()
+}
+
+func (v *visitor) resetStatsNoLock() {
+	v.emailsLimiter.Reset()
+	if !v.downgradeUntil.IsZero() && !v.clock().Before(v.downgradeUntil) {
+		v.downgradeMessageLimit, v.downgradeUntil = 0, time.Time{}
+		v.messagesLimiter = v.newMessagesLimiterNoLock(v.limitsNoLock(), 0) // Deferred downgrade applies from now on
+	} else if !v.messagesLimiterReplenishesNoLock() {
+		v.messagesLimiter.Reset() // Sliding window and decaying limiters expire messages by themselves
+	}
+	v.callsLimiter.Reset()
+	v.firebaseCount = 0
+	v.requests = 0 // The moving average of the request time is kept
+	if v.scheduledLimiter != nil {
+		v.scheduledLimiter.Reset()
+	}
+	if v.attachmentLimiter != nil {
+		v.attachmentLimiter.Reset()
+	}
+	if v.urgentLimiter != nil {
+		v.urgentLimiter.Reset()
+	}
+	v.gatewayLimiter.Reset()
+	if v.config.VisitorAttachmentBandwidthResetMode == VisitorAttachmentBandwidthResetModeCalendar {
+		v.bandwidthLimiter.Reset() // Rolling bandwidth limiter replenishes by itself
+	}
+}
+
+// ResetMonthlyStats resets the monthly message counter, see Server.resetStats
+func (v *visitor) ResetMonthlyStats() {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	v.messagesMonthlyLimiter.Reset()
+}
+
+// ResetLimits zeroes the daily counters (messages, emails, calls) and refills all token buckets. Unlike
+// ResetStats, this re-creates the rate limiters, and persists the cleared user stats (if it's a user).
+// The monthly message counter is kept, and so is the message pool of a billing account, since it is shared
+// with the other members of the account (see messagesLimiterSharedNoLock).
+func (v *visitor) ResetLimits() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.firebaseCount = 0
+	v.bandwidthLimiter, v.ingressLimiter = nil, nil // Not carried over, see resetLimitersNoLock
+	v.resetLimitersNoLock(0, v.messagesMonthlyLimiter.Value(), 0, 0, true)
+	if !v.messagesLimiterSharedNoLock() {
+		v.messagesLimiter.Reset() // Limiters in the limiter store (see Config.VisitorLimiterStore) keep their value otherwise
+	}
+}
+
+// User returns the visitor user, or nil if there is none
+func (v *visitor) User() *user.User {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.user // May be nil
+}
+
+// IP returns the visitor IP address
+func (v *visitor) IP() netip.Addr {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.ip
+}
+
+// ID returns the key of the visitor in Server.visitors, see visitorID
+func (v *visitor) ID() string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return visitorID(v.ip, v.user)
+}
+
+// UpdateIP sets the visitor's IP address to the given address, e.g. if a user with its own limits (see hasUserLimits)
+// roams between networks. Since such visitors are keyed by user, the limiter state is kept. The IP address is
+// used as the sender of published messages, and to determine whether the visitor is exempt from limits.
+func (v *visitor) UpdateIP(ip netip.Addr) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.ip == ip {
+		return
+	}
+	v.ip = ip
+	v.country = v.geoIP.Country(ip)
+	v.exempt = util.ContainsIP(v.config.VisitorRequestExemptIPAddrs, ip) || hasTokenExemption(v.user)
+}
+
+// Authenticated returns true if a user successfully authenticated
+func (v *visitor) Authenticated() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.user != nil
+}
+
+// SetUser sets the visitors user to the given value
+func (v *visitor) SetUser(u *user.User) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	shouldResetLimiters := v.user.TierID() != u.TierID() || !sameLimitOverrides(v.user, u) || billingAccount(v.user) != billingAccount(u) || !sameBoost(v.user, u, v.clock()) // Work with nil receiver
+	previousLimits := v.limitsNoLock()
+	v.user = u // u may be nil!
+	v.setPausedFromUserNoLock(u)
+	if shouldResetLimiters {
+		v.maybeDeferDowngradeNoLock(previousLimits)
+		var messages, messagesMonthly, emails, calls int64
+		if hasTokenVisitor(u) {
+			messages, messagesMonthly, emails, calls = v.messagesLimiter.Value(), v.messagesMonthlyLimiter.Value(), v.emailsLimiter.Value(), v.callsLimiter.Value()
+		} else if u != nil {
+			messages, messagesMonthly, emails, calls = u.Stats.Messages, monthlyMessages(u.Stats, v.clock()), u.Stats.Emails, u.Stats.Calls
+		}
+		v.resetLimitersNoLock(messages, messagesMonthly, emails, calls, true)
+	}
+}
+
+// SetTier applies a new tier to the visitor's user right away, e.g. after an upgrade, instead of waiting for the
+// next request to pick up the tier (see SetUser). The limiters are rebuilt from the new tier's limits, but keep
+// the messages, emails and calls consumed so far. This also picks up changed limits of the same tier. Anonymous visitors have no tier, so this is a no-op for them.
+func (v *visitor) SetTier(tier *user.Tier) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.user == nil {
+		return
+	}
+	previousLimits := v.limitsNoLock()
+	u := *v.user // Copy, the user may be shared with other goroutines
+	u.Tier = tier
+	v.user = &u
+	v.maybeDeferDowngradeNoLock(previousLimits)
+	v.resetLimitersKeepValuesNoLock()
+}
+
+// SetBoost applies a new temporary limit boost (see user.User.BoostMultiplier) to the visitor's user right away.
+// Like SetTier, the limiters are rebuilt, but keep the messages, emails and calls consumed so far. Once the boost
+// expires, the limiters are rebuilt again, see Keepalive. Anonymous visitors cannot be boosted.
+func (v *visitor) SetBoost(multiplier float64, expires time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.user == nil {
+		return
+	}
+	u := *v.user // Copy, the user may be shared with other goroutines
+	u.BoostMultiplier, u.BoostExpires = multiplier, expires
+	v.user = &u
+	v.resetLimitersKeepValuesNoLock()
+}
+
+// resetLimitersKeepValuesNoLock rebuilds the limiters from the current limits, keeping the messages, emails and
+// calls consumed so far
+func (v *visitor) resetLimitersKeepValuesNoLock() {
+	messages, messagesMonthly, emails, calls := v.messagesLimiter.Value(), v.messagesMonthlyLimiter.Value(), v.emailsLimiter.Value(), v.callsLimiter.Value()
+	v.resetLimitersNoLock(messages, messagesMonthly, emails, calls, false) // Stats are unchanged, no need to persist them
+}
+
+// SetConfig replaces the visitor's config, e.g. after the visitor limits were reloaded (see Server.ReloadVisitorLimits).
+// Limits that are derived from the config on every check (e.g. the attachment total size limit) apply right away. If
+// rebuild is true, the limiters are rebuilt from the new limits as well, keeping the messages, emails and calls consumed
+// so far (like SetTier). Otherwise, the existing limiters keep their settings until the visitor is expunged.
+func (v *visitor) SetConfig(conf *Config, rebuild bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.config = conf
+	if rebuild {
+		messages, messagesMonthly, emails, calls := v.messagesLimiter.Value(), v.messagesMonthlyLimiter.Value(), v.emailsLimiter.Value(), v.callsLimiter.Value()
+		v.resetLimitersNoLock(messages, messagesMonthly, emails, calls, false)
+	}
+}
+
+// maybeDeferDowngradeNoLock keeps the previous message limit until the next daily reset, if the visitor's message
+// limit was lowered (e.g. by a tier downgrade) and VisitorTierDowngradeMode is "nextday". This avoids rejecting all
+// messages for the rest of the day if the user already sent more than the new limit. It must be called after the
+// user was changed, but before the limiters are reset. Upgrades cancel a deferred downgrade.
+func (v *visitor) maybeDeferDowngradeNoLock(previous *visitorLimits) {
+	if v.config.VisitorTierDowngradeMode != VisitorTierDowngradeModeNextDay {
+		return
+	}
+	v.downgradeMessageLimit, v.downgradeUntil = 0, time.Time{}
+	previousLimit, newLimit := previous.MessageLimit, v.limitsNoLock().MessageLimit
+	if previousLimit == visitorUnlimited {
+		previousLimit = math.MaxInt64
+	}
+	if newLimit != visitorUnlimited && newLimit < previousLimit {
+		v.downgradeMessageLimit = previous.MessageLimit
+		v.downgradeUntil = nextStatsReset(v.config, v.clock())
+	}
+}
+
+// MaybeUserID returns the user ID of the visitor (if any). If this is an anonymous visitor,
+// an empty string is returned.
+func (v *visitor) MaybeUserID() string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if v.user != nil {
+		return v.user.ID
+	}
+	return ""
+}
+
+// BillingAccount returns the billing account of the visitor's user, if any
+func (v *visitor) BillingAccount() string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.billingAccountNoLock()
+}
+
+// billingAccountNoLock returns the billing account of the visitor's user, if any. Users with the same billing
+// account share one messages limiter, see billingAccountLimiters.
+func (v *visitor) billingAccountNoLock() string {
+	return billingAccount(v.user)
+}
+
+// Tenant returns the tenant of the visitor, e.g. the team or organization it belongs to, or an empty string if
+// it has none. The tenant is the user's billing account (if any), or the tenant read from the VisitorTenantHeader.
+func (v *visitor) Tenant() string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.tenantNoLock()
+}
+
+func (v *visitor) tenantNoLock() string {
+	if account := v.billingAccountNoLock(); account != "" {
+		return account
+	}
+	return v.tenant
+}
+
+// SetTenant sets the tenant read from the VisitorTenantHeader. Values that are too long are ignored, so that the
+// header cannot be used to blow up the tenant metrics. An empty value removes the tenant.
+func (v *visitor) SetTenant(tenant string) {
+	if len(tenant) > visitorTenantMaxLength {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.tenant = tenant
+}
+
+// newMessagesLimiterNoLock creates the daily messages limiter for the given limits, depending on the limiter
+// mode (see VisitorMessageLimiterMode), the limiter store (see VisitorLimiterStore) and the billing account
+func (v *visitor) newMessagesLimiterNoLock(limits *visitorLimits, messages int64) util.RemainingLimiter {
+	messageLimit := limits.MessageLimit
+	if messageLimit == visitorUnlimited {
+		messageLimit = math.MaxInt64 // No daily limit, but messages are still counted
+	}
+	if v.config.VisitorMessageLimiterMode == VisitorMessageLimiterModeSliding && v.config.VisitorLimitResetMode != VisitorLimitResetModeCalendar {
+		return util.NewSlidingWindowLimiterWithValue(messageLimit, oneDay, messages)
+	} else if v.config.VisitorMessageLimiterMode == VisitorMessageLimiterModeDecay && v.config.VisitorLimitResetMode != VisitorLimitResetModeCalendar {
+		return util.NewDecayingLimiterWithValue(messageLimit, oneDay, messages)
+	} else if v.limiterStore != nil {
+		key := fmt.Sprintf("ntfy:visitor:%s:messages", visitorID(v.ip, v.user))
+		if account := v.billingAccountNoLock(); account != "" {
+			key = fmt.Sprintf("ntfy:billing:%s:messages", account)
+		}
+		return util.NewRedisFixedLimiterWithValue(v.limiterStore, key, messageLimit, messages)
+	} else if account := v.billingAccountNoLock(); account != "" && v.billingLimiters != nil {
+		return v.billingLimiters.MessagesLimiter(account, messageLimit, messages)
+	}
+	return util.NewFixedLimiterWithValue(messageLimit, messages)
+}
+
+// messagesLimiterSharedNoLock returns true if the daily messages limiter is the pool of a billing account, which is
+// shared with the other members of the account, see newMessagesLimiterNoLock
+func (v *visitor) messagesLimiterSharedNoLock() bool {
+	if v.config.VisitorLimitResetMode != VisitorLimitResetModeCalendar && (v.config.VisitorMessageLimiterMode == VisitorMessageLimiterModeSliding || v.config.VisitorMessageLimiterMode == VisitorMessageLimiterModeDecay) {
+		return false
+	}
+	return v.billingAccountNoLock() != "" && (v.limiterStore != nil || v.billingLimiters != nil)
+}
+
+func (v *visitor) resetLimitersNoLock(messages, messagesMonthly, emails, calls int64, enqueueUpdate bool) {
+	limits := v.limitsNoLock()
+	loopbackExempt := v.config.VisitorRequestLimitExemptLoopback && v.ip.Unmap().IsLoopback()
+	if loopbackExempt {
+		v.requestLimiter = rate.NewLimiter(rate.Inf, limits.RequestLimitBurst) // Never runs out, see Config.VisitorRequestLimitExemptLoopback
+	} else {
+		v.requestLimiter = rate.NewLimiter(limits.RequestLimitReplenish, limits.RequestLimitBurst)
+	}
+	v.graceUntil = limits.GraceUntil
+	v.boostExpires = limits.BoostExpires
+	if limits.ReadRequestLimitBurst > 0 && loopbackExempt {
+		v.readRequestLimiter = rate.NewLimiter(rate.Inf, limits.ReadRequestLimitBurst)
+	} else if limits.ReadRequestLimitBurst > 0 {
+		v.readRequestLimiter = rate.NewLimiter(limits.ReadRequestLimitReplenish, limits.ReadRequestLimitBurst)
+	} else {
+		v.readRequestLimiter = nil // Read requests count towards the request limiter
+	}
+	v.messagesLimiter = v.newMessagesLimiterNoLock(limits, messages)
+	messageMonthlyLimit := limits.MessageMonthlyLimit
+	if messageMonthlyLimit <= 0 {
+		messageMonthlyLimit = math.MaxInt64 // No monthly limit, but messages are still counted
+	}
+	v.messagesMonthlyLimiter = util.NewFixedLimiterWithValue(messageMonthlyLimit, messagesMonthly)
+	v.emailsLimiter = util.NewRateLimiterWithValue(limits.EmailLimitReplenish, limits.EmailLimitBurst, emails)
+	v.callsLimiter = util.NewFixedLimiterWithValue(limits.CallLimit, calls)
+	if v.config.VisitorScheduledMessageMode == VisitorScheduledMessageModeDelivery {
+		scheduledLimit, scheduled := int64(v.config.VisitorScheduledMessageDailyLimit), int64(0)
+		if scheduledLimit <= 0 {
+			scheduledLimit = limits.MessageLimit
+		}
+		if scheduledLimit == visitorUnlimited {
+			scheduledLimit = math.MaxInt64
+		}
+		if v.scheduledLimiter != nil {
+			scheduled = v.scheduledLimiter.Value() // Keep the scheduled messages until the daily reset, e.g. after a tier change
+		}
+		v.scheduledLimiter = util.NewFixedLimiterWithValue(scheduledLimit, scheduled)
+	}
+	if limits.AttachmentMessagesLimit > 0 {
+		var attachmentMessages int64
+		if v.attachmentLimiter != nil {
+			attachmentMessages = v.attachmentLimiter.Value() // Keep the counter until the daily reset, e.g. after a tier change
+		}
+		v.attachmentLimiter = util.NewFixedLimiterWithValue(limits.AttachmentMessagesLimit, attachmentMessages)
+	} else {
+		v.attachmentLimiter = nil
+	}
+	if limits.UrgentMessagesLimit > 0 {
+		var urgentMessages int64
+		if v.urgentLimiter != nil {
+			urgentMessages = v.urgentLimiter.Value() // Keep the counter until the daily reset, e.g. after a tier change
+		}
+		v.urgentLimiter = util.NewFixedLimiterWithValue(limits.UrgentMessagesLimit, urgentMessages)
+	} else {
+		v.urgentLimiter = nil
+	}
+	gatewayLimit, gatewayMessages := limits.GatewayMessagesLimit, int64(0)
+	if gatewayLimit <= 0 {
+		gatewayLimit = math.MaxInt64 // No separate limit, but gateway messages are still counted
+	}
+	if v.gatewayLimiter != nil {
+		gatewayMessages = v.gatewayLimiter.Value() // Keep the counter until the daily reset, e.g. after a tier change
+	}
+	v.gatewayLimiter = util.NewFixedLimiterWithValue(gatewayLimit, gatewayMessages)
+	v.gatewayLimited = limits.GatewayMessagesLimit > 0
+	bandwidth := usedBytes(v.bandwidthLimiter) // Keep the used bytes, e.g. after a tier change
+	if v.config.VisitorAttachmentBandwidthResetMode == VisitorAttachmentBandwidthResetModeCalendar {
+		v.bandwidthLimiter = util.NewFixedLimiterWithValue(limits.AttachmentBandwidthLimit, bandwidth)
+	} else {
+		v.bandwidthLimiter = util.NewBytesLimiterWithValue(int(limits.AttachmentBandwidthLimit), oneDay, bandwidth)
+	}
+	if limits.IngressBandwidthLimit > 0 {
+		v.ingressLimiter = util.NewBytesLimiterWithValue(int(limits.IngressBandwidthLimit), oneDay, usedBytes(v.ingressLimiter))
+	} else {
+		v.ingressLimiter = nil
+	}
+	var subscriptions int64
+	if v.subscriptionLimiter != nil {
+		subscriptions = v.subscriptionLimiter.Value() // Keep active subscriptions, e.g. when the tier changes
+	}
+	v.subscriptionLimiter = util.NewFixedLimiterWithValue(limits.SubscriptionLimit, subscriptions)
+	if v.user == nil {
+		v.accountLimiter = rate.NewLimiter(safeEvery(v.config.VisitorAccountCreationLimitReplenish), v.config.VisitorAccountCreationLimitBurst)
+		v.authLimiter = rate.NewLimiter(safeEvery(v.config.VisitorAuthFailureLimitReplenish), v.config.VisitorAuthFailureLimitBurst)
+	} else {
+		v.accountLimiter = nil // Users cannot create accounts when logged in
+		v.authLimiter = nil    // Users are already logged in, no need to limit requests
+	}
+	if enqueueUpdate && v.user != nil && !hasTokenVisitor(v.user) && !v.noPersist {
+		go v.userManager.EnqueueUserStats(v.user.ID, &user.Stats{
+			Messages:              messages,
+			Emails:                emails,
+			Calls:                 calls,
+			Firebase:              v.firebaseCount,
+			MessagesMonthly:       messagesMonthly,
+			MessagesMonthlyPeriod: user.MonthlyPeriod(v.clock()),
+		})
+	}
+	log.Fields(v.contextNoLock()).Debug("Rate limiters reset for visitor") // Must be after function, because contextNoLock() describes rate limiters
+}
+
+func (v *visitor) Limits() *visitorLimits {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.limitsNoLock()
+}
+
+func (v *visitor) limitsNoLock() *visitorLimits {
+	var limits *visitorLimits
+	if v.user != nil && v.user.Tier != nil {
+		limits = tierBasedVisitorLimits(v.config, v.user.Tier)
+	} else {
+		limits = configBasedVisitorLimits(v.config)
+	}
+	if v.user.HasLimitOverrides() {
+		applyLimitOverrides(v.config, limits, v.user)
+	}
+	if hasTokenLimitProfile(v.user) {
+		applyLimitProfile(limits, v.config.VisitorLimitProfiles[v.user.TokenLimitProfile], v.user.TokenLimitProfile)
+	}
+	if hasTokenExemption(v.user) {
+		applyTokenExemption(limits)
+	}
+	applyNewAccountGrace(v.config, limits, v.user, v.clock())
+	applyBoost(limits, v.user, v.clock())
+	if limitBasis(v.user) == visitorLimitBasisIP && geoRestricted(v.config, v.country) {
+		applyGeoRestriction(v.config, limits)
+	}
+	if !v.downgradeUntil.IsZero() && v.clock().Before(v.downgradeUntil) {
+		limits.MessageLimit = v.downgradeMessageLimit // Deferred downgrade, see maybeDeferDowngradeNoLock
+	}
+	limits.Basis = limitBasis(v.user)
+	return limits
+}
+
+// applyLimitProfile applies the given limit profile (see Config.VisitorLimitProfiles) to the limits. Zero values
+// of the profile are not applied. If the profile does not exist (anymore), the limits are not changed at all.
+func applyLimitProfile(limits *visitorLimits, profile *VisitorLimitProfile, name string) {
+	if profile == nil {
+		return
+	}
+	limits.Profile = name
+	if profile.MessageLimit > 0 {
+		limits.MessageLimit = profile.MessageLimit
+	}
+	if profile.EmailLimit > 0 {
+		limits.EmailLimit = profile.EmailLimit
+		limits.EmailLimitReplenish = dailyLimitToRate(profile.EmailLimit)
+	}
+	if profile.RequestLimitBurst > 0 {
+		limits.RequestLimitBurst = profile.RequestLimitBurst
+	}
+	if profile.RequestLimitReplenish > 0 {
+		limits.RequestLimitReplenish = safeEvery(profile.RequestLimitReplenish)
+	}
+	if profile.SubscriptionLimit > 0 {
+		limits.SubscriptionLimit = profile.SubscriptionLimit
+	}
+}
+
+// applyTokenExemption lifts the request, message and email limits of a service token (see user.Token.Exempt),
+// so that they show up as unlimited in the visitor info. Most checks skip the limiters entirely, see RequestLimitExempt.
+func applyTokenExemption(limits *visitorLimits) {
+	limits.RequestLimitReplenish = rate.Inf
+	limits.ReadRequestLimitReplenish = rate.Inf
+	limits.MessageLimit = visitorUnlimited
+	limits.MessageMonthlyLimit = 0
+	limits.EmailLimit, limits.EmailLimitReplenish = visitorUnlimited, rate.Inf
+}
+
+// applyNewAccountGrace multiplies the request limit burst of users with their own limits (see hasUserLimits),
+// if their account is younger than NewAccountGraceDuration. This allows new users to import a backlog of messages.
+func applyNewAccountGrace(conf *Config, limits *visitorLimits, u *user.User, now time.Time) {
+	if conf.NewAccountGraceDuration <= 0 || conf.NewAccountGraceMultiplier <= 1 || !hasUserLimits(u) || u.Created.Unix() <= 0 {
+		return
+	}
+	graceUntil := u.Created.Add(conf.NewAccountGraceDuration)
+	if now.Before(graceUntil) {
+		limits.RequestLimitBurst *= conf.NewAccountGraceMultiplier
+		limits.GraceUntil = graceUntil
+	}
+}
+
+// applyBoost multiplies the message and email limits of the given user with its temporary limit boost, if the
+// user has one that has not expired yet (see user.User.BoostMultiplier). Unlimited limits stay unlimited.
+func applyBoost(limits *visitorLimits, u *user.User, now time.Time) {
+	if !u.IsBoosted(now) {
+		return
+	}
+	m := u.BoostMultiplier
+	if limits.MessageLimit != visitorUnlimited {
+		limits.MessageLimit = int64(float64(limits.MessageLimit) * m)
+	}
+	if limits.EmailLimit != visitorUnlimited {
+		limits.EmailLimit = int64(float64(limits.EmailLimit) * m)
+		limits.EmailLimitBurst = int(float64(limits.EmailLimitBurst) * m)
+		limits.EmailLimitReplenish = limits.EmailLimitReplenish * rate.Limit(m)
+	}
+	limits.BoostMultiplier = m
+	limits.BoostExpires = u.BoostExpires
+}
+
+// applyGeoRestriction reduces the limits of anonymous visitors (and users without tier) from one of the
+// Config.GeoRestrictedCountries by the Config.GeoRestrictedLimitMultiplier. Limits never drop below one.
+func applyGeoRestriction(conf *Config, limits *visitorLimits) {
+	m := conf.GeoRestrictedLimitMultiplier
+	limits.RequestLimitBurst = util.Max(1, int(float64(limits.RequestLimitBurst)*m))
+	limits.RequestLimitReplenish = limits.RequestLimitReplenish * rate.Limit(m)
+	limits.MessageLimit = util.Max(1, int64(float64(limits.MessageLimit)*m))
+	limits.EmailLimit = util.Max(1, int64(float64(limits.EmailLimit)*m))
+	limits.EmailLimitBurst = util.Max(1, int(float64(limits.EmailLimitBurst)*m))
+	limits.EmailLimitReplenish = limits.EmailLimitReplenish * rate.Limit(m)
+	limits.AttachmentBandwidthLimit = util.Max(1, int64(float64(limits.AttachmentBandwidthLimit)*m))
+}
+
+// applyLimitOverrides applies the per-user limit overrides of the given user to the limits. Overrides take
+// precedence over the tier (or config) limits.
+func applyLimitOverrides(conf *Config, limits *visitorLimits, u *user.User) {
+	if u.MessagesLimitOverride != nil {
+		limits.MessageLimit = *u.MessagesLimitOverride
+	}
+	if u.EmailsLimitOverride != nil {
+		limits.EmailLimit = *u.EmailsLimitOverride
+		limits.EmailLimitBurst = util.MinMax(int(float64(limits.EmailLimit)*visitorEmailLimitBurstRate), conf.VisitorEmailLimitBurst, visitorEmailLimitBurstMax)
+		limits.EmailLimitReplenish = dailyLimitToRate(limits.EmailLimit)
+	}
+	limits.AttachmentTotalSizeLimit = attachmentTotalSizeLimit(conf, u)
+	if u.CallsLimitOverride != nil {
+		limits.CallLimit = *u.CallsLimitOverride
+	}
+}
+
+// sameLimitOverrides returns true if both users have the same per-user limit overrides. Both users may be nil.
+func sameLimitOverrides(a, b *user.User) bool {
+	if !a.HasLimitOverrides() || !b.HasLimitOverrides() {
+		return a.HasLimitOverrides() == b.HasLimitOverrides()
+	}
+	return equalInt64Ptr(a.MessagesLimitOverride, b.MessagesLimitOverride) &&
+		equalInt64Ptr(a.EmailsLimitOverride, b.EmailsLimitOverride) &&
+		equalInt64Ptr(a.CallsLimitOverride, b.CallsLimitOverride) &&
+		equalInt64Ptr(a.AttachmentTotalSizeLimitOverride, b.AttachmentTotalSizeLimitOverride)
+}
+
+// sameBoost returns true if both users have the same temporary limit boost at the given time. Both users may be nil.
+func sameBoost(a, b *user.User, now time.Time) bool {
+	if !a.IsBoosted(now) || !b.IsBoosted(now) {
+		return a.IsBoosted(now) == b.IsBoosted(now)
+	}
+	return a.BoostMultiplier == b.BoostMultiplier && a.BoostExpires.Equal(b.BoostExpires)
+}
+
+func equalInt64Ptr(a, b *int64) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+// attachmentFileSizeLimit returns the per-file attachment size limit for the given tier, or the config-based
+// limit if tier is nil. This is shared by visitor.AttachmentFileSizeLimit and visitor.Info to avoid drift.
+func attachmentFileSizeLimit(conf *Config, tier *user.Tier) int64 {
+	if tier != nil {
+		return tier.AttachmentFileSizeLimit
+	}
+	return conf.AttachmentFileSizeLimit
+}
+
+// attachmentTotalSizeLimit returns the total attachment storage of the given user (may be nil), i.e. the per-user
+// override if it is set (and not zero), then the limit of the user's tier, and finally the config-based limit
+func attachmentTotalSizeLimit(conf *Config, u *user.User) int64 {
+	if u != nil && u.AttachmentTotalSizeLimitOverride != nil && *u.AttachmentTotalSizeLimitOverride > 0 {
+		return *u.AttachmentTotalSizeLimitOverride
+	} else if u != nil && u.Tier != nil {
+		return u.Tier.AttachmentTotalSizeLimit
+	}
+	return conf.VisitorAttachmentTotalSizeLimit
+}
+
+// tierBasedVisitorLimits returns the limits of the given tier. A message or email limit of zero means that the
+// tier is not limited (reported as visitorUnlimited). Zero subscription limits fall back to the config-based limit.
+func tierBasedVisitorLimits(conf *Config, tier *user.Tier) *visitorLimits {
+	requestLimitBurst := util.MinMax(int(float64(tier.MessageLimit)*visitorMessageToRequestLimitBurstRate), conf.VisitorRequestLimitBurst, visitorMessageToRequestLimitBurstMax)
+	if tier.RequestLimitBurst > 0 {
+		requestLimitBurst = int(tier.RequestLimitBurst) // Explicit tier burst overrides the derived value
+	}
+	emailLimitBurst := util.MinMax(int(float64(tier.EmailLimit)*visitorEmailLimitBurstRate), conf.VisitorEmailLimitBurst, visitorEmailLimitBurstMax)
+	if tier.EmailLimitBurst > 0 {
+		emailLimitBurst = int(tier.EmailLimitBurst) // Explicit tier burst overrides the derived value
+	}
+	subscriptionLimit := int64(conf.VisitorSubscriptionLimit)
+	if tier.SubscriptionLimit > 0 {
+		subscriptionLimit = tier.SubscriptionLimit
+	}
+	attachmentMessagesLimit := int64(conf.VisitorAttachmentMessageDailyLimit)
+	if tier.AttachmentMessagesLimit > 0 {
+		attachmentMessagesLimit = tier.AttachmentMessagesLimit
+	}
+	gatewayMessagesLimit := int64(conf.VisitorGatewayMessageDailyLimit)
+	if tier.GatewayMessagesLimit > 0 {
+		gatewayMessagesLimit = tier.GatewayMessagesLimit
+	}
+	messageLimit := tier.MessageLimit
+	if messageLimit <= 0 {
+		messageLimit = visitorUnlimited
+	}
+	emailLimit, emailLimitReplenish := tier.EmailLimit, dailyLimitToRate(tier.EmailLimit)
+	if emailLimit <= 0 {
+		emailLimit, emailLimitReplenish = visitorUnlimited, rate.Inf
+	}
+	return &visitorLimits{
+		Basis:                     visitorLimitBasisTier,
+		RequestLimitBurst:         requestLimitBurst,
+		RequestLimitReplenish:     util.Max(safeEvery(conf.VisitorRequestLimitReplenish), dailyLimitToRate(tier.MessageLimit*visitorMessageToRequestLimitReplenishFactor)),
+		ReadRequestLimitBurst:     conf.VisitorReadRequestLimitBurst,
+		ReadRequestLimitReplenish: safeEvery(conf.VisitorReadRequestLimitReplenish),
+		MessageLimit:              messageLimit,
+		MessageExpiryDuration:     tier.MessageExpiryDuration,
+		EmailLimit:                emailLimit,
+		EmailLimitBurst:           emailLimitBurst,
+		EmailLimitReplenish:       emailLimitReplenish,
+		CallLimit:                 tier.CallLimit,
+		ReservationsLimit:         tier.ReservationLimit,
+		SubscriptionLimit:         subscriptionLimit,
+		AttachmentTotalSizeLimit:  tier.AttachmentTotalSizeLimit,
+		AttachmentFileSizeLimit:   attachmentFileSizeLimit(conf, tier),
+		AttachmentExpiryDuration:  tier.AttachmentExpiryDuration,
+		AttachmentBandwidthLimit:  tier.AttachmentBandwidthLimit,
+		IngressBandwidthLimit:     conf.VisitorIngressDailyBandwidthLimit,
+		MessageMonthlyLimit:       tier.MessageMonthlyLimit,
+		FirebaseDisabled:          tier.FirebaseDisabled,
+		FirebaseLimit:             int64(conf.VisitorFirebaseDailyLimit),
+		AttachmentMessagesLimit:   attachmentMessagesLimit,
+		GatewayMessagesLimit:      gatewayMessagesLimit,
+		UrgentMessagesLimit:       tier.UrgentMessagesLimit,
+	}
+}
+
+func configBasedVisitorLimits(conf *Config) *visitorLimits {
+	messagesLimit := replenishDurationToDailyLimit(conf.VisitorRequestLimitReplenish) // Approximation!
+	if conf.VisitorMessageDailyLimit > 0 {
+		messagesLimit = int64(conf.VisitorMessageDailyLimit)
+	}
+	return &visitorLimits{
+		Basis:                     visitorLimitBasisIP,
+		RequestLimitBurst:         conf.VisitorRequestLimitBurst,
+		RequestLimitReplenish:     safeEvery(conf.VisitorRequestLimitReplenish),
+		ReadRequestLimitBurst:     conf.VisitorReadRequestLimitBurst,
+		ReadRequestLimitReplenish: safeEvery(conf.VisitorReadRequestLimitReplenish),
+		MessageLimit:              messagesLimit,
+		MessageExpiryDuration:     conf.CacheDuration,
+		EmailLimit:                replenishDurationToDailyLimit(conf.VisitorEmailLimitReplenish), // Approximation!
+		EmailLimitBurst:           conf.VisitorEmailLimitBurst,
+		EmailLimitReplenish:       safeEvery(conf.VisitorEmailLimitReplenish),
+		CallLimit:                 visitorDefaultCallsLimit,
+		ReservationsLimit:         visitorDefaultReservationsLimit,
+		SubscriptionLimit:         int64(conf.VisitorSubscriptionLimit),
+		AttachmentTotalSizeLimit:  conf.VisitorAttachmentTotalSizeLimit,
+		AttachmentFileSizeLimit:   attachmentFileSizeLimit(conf, nil),
+		AttachmentExpiryDuration:  conf.AttachmentExpiryDuration,
+		AttachmentBandwidthLimit:  conf.VisitorAttachmentDailyBandwidthLimit,
+		IngressBandwidthLimit:     conf.VisitorIngressDailyBandwidthLimit,
+		AttachmentMessagesLimit:   int64(conf.VisitorAttachmentMessageDailyLimit),
+		GatewayMessagesLimit:      int64(conf.VisitorGatewayMessageDailyLimit),
+		FirebaseLimit:             int64(conf.VisitorFirebaseDailyLimit),
+	}
+}
+
+// AttachmentTotalSizeUsage returns the attachment bytes stored by this visitor (by user, or by IP address for anonymous
+// visitors), and the bytes remaining until its total size limit is reached, see attachmentTotalSizeLimit. It is used
+// by Info, and to enforce the limit when an attachment is uploaded.
+func (v *visitor) AttachmentTotalSizeUsage() (used int64, remaining int64, err error) {
+	v.mu.RLock()
+	u, ip, limit := v.user, v.ip, v.limitsNoLock().AttachmentTotalSizeLimit
+	v.mu.RUnlock()
+	if u != nil {
+		used, err = v.messageCache.AttachmentBytesUsedByUser(u.ID)
+	} else {
+		used, err = v.messageCache.AttachmentBytesUsedBySender(ip.String())
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return used, zeroIfNegative(subSaturating(limit, used)), nil
+}
+
+func (v *visitor) Info() (*visitorInfo, error) {
+	v.mu.RLock()
+	info := v.infoLightNoLock()
+	strict := v.config.StrictAccountInfo
+	v.mu.RUnlock()
+
+	// Attachment stats from database; best-effort, so that the rest of the info is still available
+	attachmentsBytesUsed, attachmentsBytesRemaining, err := v.AttachmentTotalSizeUsage()
+	if err != nil && strict {
+		return nil, err
+	} else if err != nil {
+		log.Fields(v.Context()).Err(err).Warn("Cannot determine attachment usage of visitor, reporting it as unknown")
+		attachmentsBytesUsed, attachmentsBytesRemaining = -1, -1
+	}
+	info.Stats.AttachmentTotalSize = attachmentsBytesUsed
+	info.Stats.AttachmentTotalSizeRemaining = attachmentsBytesRemaining
 
 	// Reservation stats from database
 	var reservations int64
+	u := v.User()
 	if v.userManager != nil && u != nil {
-		reservations, err = v.userManager.ReservationsCount(u.Name)
+		reservations, err = v.reservationsCountCached(u)
 		if err != nil {
 			return nil, err
 		}
 	}
+	// Admins without a tier are not limited by the config-based limits (they can reserve topics, etc.),
+	// so report the limits of the default admin tier instead, if configured
+	if v.userManager != nil && u.IsAdmin() && u.Tier == nil && v.config.DefaultAdminTier != "" {
+		tier, err := v.userManager.Tier(v.config.DefaultAdminTier)
+		if err != nil && !errors.Is(err, user.ErrTierNotFound) {
+			return nil, err
+		} else if tier != nil {
+			info.Limits.MessageExpiryDuration = tier.MessageExpiryDuration
+			info.Limits.AttachmentExpiryDuration = tier.AttachmentExpiryDuration
+			info.Limits.ReservationsLimit = tier.ReservationLimit
+		}
+	}
 	info.Stats.Reservations = reservations
-	info.Stats.ReservationsRemaining = zeroIfNegative(info.Limits.ReservationsLimit - reservations)
+	info.Stats.ReservationsRemaining = zeroIfNegative(subSaturating(info.Limits.ReservationsLimit, reservations))
 
 	return info, nil
 }
 
+// reservationsCountCached returns the number of topic reservations of the given user, either from the short-lived
+// cache (see visitorReservationsCountCacheDuration) or from the database. Reservations made or removed through this
+// server invalidate the cache, see InvalidateReservationsCache.
+func (v *visitor) reservationsCountCached(u *user.User) (int64, error) {
+	v.mu.RLock()
+	if !v.reservationsCountAt.IsZero() && v.clock().Sub(v.reservationsCountAt) < visitorReservationsCountCacheDuration {
+		defer v.mu.RUnlock()
+		return v.reservationsCount, nil
+	}
+	v.mu.RUnlock()
+	reservations, err := v.userManager.ReservationsCount(u.Name)
+	if err != nil {
+		return 0, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.reservationsCount = reservations
+	v.reservationsCountAt = v.clock()
+	return reservations, nil
+}
+
+// InvalidateReservationsCache drops the cached reservations count, so that the next call to Info reads it
+// from the database again. It must be called whenever a reservation of the visitor's user is added or removed.
+func (v *visitor) InvalidateReservationsCache() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.reservationsCountAt = time.Time{}
+}
+
+// InfoLight is like Info, but without the stats that require database lookups (attachments and reservations)
+func (v *visitor) InfoLight() *visitorInfo {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.infoLightNoLock()
+}
+
 func (v *visitor) infoLightNoLock() *visitorInfo {
 	messages := v.messagesLimiter.Value()
+	messagesMonthly := v.messagesMonthlyLimiter.Value()
 	emails := v.emailsLimiter.Value()
 	calls := v.callsLimiter.Value()
 	limits := v.limitsNoLock()
+	bandwidthRemaining := v.bandwidthLimiter.Remaining()
+	messagesRemaining := remainingOrUnlimited(limits.MessageLimit, messages)
+	if v.messagesLimiter != nil && limits.MessageLimit != visitorUnlimited {
+		// Prefer what the live limiter actually enforces, which may differ from the limits derived from the
+		// tier (e.g. if the tier was changed in place); the stats-based value above is only a fallback
+		messagesRemaining = v.messagesLimiter.Remaining()
+	}
 	stats := &visitorStats{
-		Messages:          messages,
-		MessagesRemaining: zeroIfNegative(limits.MessageLimit - messages),
-		Emails:            emails,
-		EmailsRemaining:   zeroIfNegative(limits.EmailLimit - emails),
-		Calls:             calls,
-		CallsRemaining:    zeroIfNegative(limits.CallLimit - calls),
+		Messages:                     messages,
+		MessagesRemaining:            messagesRemaining,
+		MessagesResetAt:              v.messagesResetAtNoLock().Unix(),
+		MessagesMonthly:              messagesMonthly,
+		MessagesMonthlyRemaining:     zeroIfNegative(subSaturating(limits.MessageMonthlyLimit, messagesMonthly)),
+		Emails:                       emails,
+		EmailsRemaining:              remainingOrUnlimited(limits.EmailLimit, emails),
+		Calls:                        calls,
+		CallsRemaining:               zeroIfNegative(subSaturating(limits.CallLimit, calls)),
+		AttachmentBandwidth:          zeroIfNegative(subSaturating(limits.AttachmentBandwidthLimit, bandwidthRemaining)),
+		AttachmentBandwidthRemaining: bandwidthRemaining,
+		AttachmentBandwidthResetAt:   v.bandwidthResetAtNoLock().Unix(),
+		RequestLimitTokens:           v.requestLimiter.Tokens(),
+		RequestLimitBurst:            v.requestLimiter.Burst(),
+		FirebaseBackoff:              util.Max(v.firebase.Sub(v.clock()), 0),
+		FirebasePenaltyCount:         v.firebasePenaltyCountNoLock(),
+		Firebase:                     v.firebaseCount,
+	}
+	if limits.FirebaseLimit > 0 {
+		stats.FirebaseRemaining = zeroIfNegative(subSaturating(limits.FirebaseLimit, v.firebaseCount))
+	}
+	if v.ingressLimiter != nil {
+		stats.IngressBandwidthRemaining = v.ingressLimiter.Remaining()
+		stats.IngressBandwidth = zeroIfNegative(subSaturating(limits.IngressBandwidthLimit, stats.IngressBandwidthRemaining))
+	}
+	if v.attachmentLimiter != nil {
+		stats.AttachmentMessages = v.attachmentLimiter.Value()
+		stats.AttachmentMessagesRemaining = v.attachmentLimiter.Remaining()
+	}
+	if v.urgentLimiter != nil {
+		stats.UrgentMessages = v.urgentLimiter.Value()
+		stats.UrgentMessagesRemaining = v.urgentLimiter.Remaining()
+	}
+	stats.GatewayMessages = v.gatewayLimiter.Value()
+	if limits.GatewayMessagesLimit > 0 {
+		stats.GatewayMessagesRemaining = v.gatewayLimiter.Remaining()
 	}
 	return &visitorInfo{
-		Limits: limits,
-		Stats:  stats,
+		Limits:       limits,
+		Stats:        stats,
+		Created:      v.created.Unix(),
+		LastSeen:     v.seen.Unix(),
+		LimitProfile: limits.Profile,
+	}
+}
+
+// messagesResetAtNoLock returns the time at which the messages counter drops next. For the fixed limiter,
+// this is the next daily stats reset (see nextStatsReset). For the sliding window limiter, it is the
+// time at which the oldest messages leave the window, and for the decaying limiter the time at which the
+// counter drops by one. If there are no messages to expire, it is now.
+func (v *visitor) messagesResetAtNoLock() time.Time {
+	var expiry time.Time
+	switch l := v.messagesLimiter.(type) {
+	case *util.SlidingWindowLimiter:
+		expiry = l.NextExpiry()
+	case *util.DecayingLimiter:
+		expiry = l.NextExpiry()
+	default:
+		return v.statsResetAtNoLock()
+	}
+	if !expiry.IsZero() {
+		return expiry
+	}
+	return v.clock()
+}
+
+// messagesLimiterReplenishesNoLock returns true if the messages limiter frees up capacity by itself over time,
+// i.e. if it must not be reset by the daily stats reset (see VisitorMessageLimiterMode)
+func (v *visitor) messagesLimiterReplenishesNoLock() bool {
+	switch v.messagesLimiter.(type) {
+	case *util.SlidingWindowLimiter, *util.DecayingLimiter:
+		return true
+	}
+	return false
+}
+
+// statsResetAtNoLock returns the time of this visitor's next daily stats reset, including its jitter (if any)
+func (v *visitor) statsResetAtNoLock() time.Time {
+	if !v.statsReset.IsZero() {
+		return v.statsReset.Add(v.statsResetJitter)
+	}
+	return nextStatsReset(v.config, v.clock())
+}
+
+// visitorResetJitter returns a stable offset in [-jitter, +jitter] for the given visitor ID, so that the daily reset
+// of all visitors is spread out over time, instead of happening at the same instant (see Config.VisitorLimitResetJitter)
+func visitorResetJitter(jitter time.Duration, id string) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return time.Duration(h.Sum64()%uint64(2*jitter+1)) - jitter
+}
+
+// nextStatsReset returns the time of the next daily stats reset after now, i.e. the next midnight in
+// VisitorLimitResetTimezone in calendar mode, or the next VisitorStatsResetTime (UTC) otherwise
+func nextStatsReset(conf *Config, now time.Time) time.Time {
+	if conf.VisitorLimitResetMode == VisitorLimitResetModeCalendar {
+		return util.NextMidnight(now, conf.VisitorLimitResetTimezone)
+	}
+	return util.NextOccurrenceUTC(conf.VisitorStatsResetTime, now)
+}
+
+// lastStatsReset returns the time of the last daily stats reset before now, see nextStatsReset
+func lastStatsReset(conf *Config, now time.Time) time.Time {
+	return nextStatsReset(conf, now).AddDate(0, 0, -1)
+}
+
+// monthlyMessages returns the persisted monthly message count, or zero if it is from a previous month
+func monthlyMessages(stats *user.Stats, now time.Time) int64 {
+	if stats == nil || stats.MessagesMonthlyPeriod != user.MonthlyPeriod(now) {
+		return 0
+	}
+	return stats.MessagesMonthly
+}
+
+// subSaturating returns a - b, saturated at math.MaxInt64 and math.MinInt64 instead of wrapping around. This matters
+// for "remaining" calculations, if a limit is set to a huge sentinel value (e.g. math.MaxInt64 for "unlimited").
+func subSaturating(a, b int64) int64 {
+	if b > 0 && a < math.MinInt64+b {
+		return math.MinInt64
+	} else if b < 0 && a > math.MaxInt64+b {
+		return math.MaxInt64
 	}
+	return a - b
 }
+
 func zeroIfNegative(value int64) int64 {
 	if value < 0 {
 		return 0
@@ -516,17 +2750,106 @@ func zeroIfNegative(value int64) int64 {
 	return value
 }
 
+// remainingOrUnlimited returns the remaining amount for the given limit and value, or visitorUnlimited
+// if the limit does not apply
+func remainingOrUnlimited(limit, value int64) int64 {
+	if limit == visitorUnlimited {
+		return visitorUnlimited
+	}
+	return zeroIfNegative(subSaturating(limit, value))
+}
+
 func replenishDurationToDailyLimit(duration time.Duration) int64 {
+	if duration <= 0 {
+		duration = DefaultVisitorRequestLimitReplenish // Avoid division by zero, see safeEvery
+	}
 	return int64(oneDay / duration)
 }
 
+// safeEvery is like rate.Every, but falls back to DefaultVisitorRequestLimitReplenish if the duration is zero
+// or negative. A misconfigured replenish duration would otherwise result in an unlimited (or broken) limiter.
+func safeEvery(duration time.Duration) rate.Limit {
+	if duration <= 0 {
+		return rate.Every(DefaultVisitorRequestLimitReplenish)
+	}
+	return rate.Every(duration)
+}
+
 func dailyLimitToRate(limit int64) rate.Limit {
 	return rate.Limit(limit) * rate.Every(oneDay)
 }
 
+// visitorIP returns the canonical visitor IP address for the given address. IPv6 addresses are collapsed to
+// their network prefix (see VisitorRequestLimitIPv6Prefix), so that a whole network shares the same visitor.
+// IPv4 addresses and explicitly exempt addresses (including loopback, if VisitorRequestLimitExemptLoopback
+// is set) are returned as is.
+func visitorIP(conf *Config, ip netip.Addr) netip.Addr {
+	if !ip.Is6() || ip.Is4In6() || conf.VisitorRequestLimitIPv6Prefix <= 0 || conf.VisitorRequestLimitIPv6Prefix >= 128 {
+		return ip
+	} else if util.ContainsIP(conf.VisitorRequestExemptIPAddrs, ip) || (conf.VisitorRequestLimitExemptLoopback && ip.IsLoopback()) {
+		return ip
+	}
+	prefix, err := ip.Prefix(conf.VisitorRequestLimitIPv6Prefix)
+	if err != nil {
+		return ip
+	}
+	return prefix.Addr()
+}
+
 func visitorID(ip netip.Addr, u *user.User) string {
-	if u != nil && u.Tier != nil {
+	if hasTokenExemption(u) {
+		return fmt.Sprintf("user:%s:exempt", u.ID)
+	} else if hasTokenLimitProfile(u) {
+		return fmt.Sprintf("user:%s:profile:%s", u.ID, u.TokenLimitProfile)
+	} else if hasUserLimits(u) {
 		return fmt.Sprintf("user:%s", u.ID)
 	}
 	return fmt.Sprintf("ip:%s", ip.String())
 }
+
+// usedBytes returns the bytes that are currently counted against the given bandwidth limiter, or zero if it is nil.
+// For rolling limiters, this is less than the value, since they replenish over time, see util.RateLimiter.Used.
+func usedBytes(l util.RemainingLimiter) int64 {
+	if l == nil {
+		return 0
+	} else if rl, ok := l.(*util.RateLimiter); ok {
+		return rl.Used()
+	}
+	return l.Value()
+}
+
+// billingAccount returns the billing account of the given user, or an empty string if the user has none,
+// or if the user itself is nil
+func billingAccount(u *user.User) string {
+	if u == nil {
+		return ""
+	}
+	return u.BillingAccount
+}
+
+// hasUserLimits returns true if the limits of the given user are derived from its tier or its per-user
+// limit overrides. Other users share the IP-based visitor, see visitorID. Requests with a token limit profile
+// have their own visitor, whose stats are not persisted to the user, see hasTokenVisitor.
+func hasUserLimits(u *user.User) bool {
+	return u != nil && !hasTokenVisitor(u) && (u.Tier != nil || u.HasLimitOverrides())
+}
+
+// hasTokenVisitor returns true if the given user was authenticated with a token that has its own visitor,
+// i.e. a token with a limit profile or a service token. The stats of such visitors are not persisted to the user.
+func hasTokenVisitor(u *user.User) bool {
+	return hasTokenLimitProfile(u) || hasTokenExemption(u)
+}
+
+// hasTokenExemption returns true if the given user was authenticated with a service token (see user.Token.Exempt).
+// All requests with service tokens of the user share one visitor, which is exempt from all limits. The token does
+// not grant any other privileges though, i.e. access control still applies as usual.
+func hasTokenExemption(u *user.User) bool {
+	return u != nil && u.TokenExempt
+}
+
+// hasTokenLimitProfile returns true if the given user was authenticated with a token that has a limit profile.
+// All requests of the user with a profile share one visitor per profile, which is independent of the user's
+// other visitors (see visitorID), and is limited by the profile (see applyLimitProfile).
+func hasTokenLimitProfile(u *user.User) bool {
+	return u != nil && u.TokenLimitProfile != ""
+}
@@ -0,0 +1,1479 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"math"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVisitor_RequestLimitExempt(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorRequestLimitBurst = 1
+	conf.VisitorRequestExemptIPAddrs = []netip.Prefix{
+		netip.MustParsePrefix("10.1.0.0/16"),
+		netip.MustParsePrefix("10.1.2.0/24"), // Overlapping, first one matches
+		netip.MustParsePrefix("fd00::/8"),
+	}
+	for _, ip := range []string{"10.1.2.3", "10.1.99.1", "fd12::1"} {
+		v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr(ip), nil)
+		require.True(t, v.RequestLimitExempt(), ip)
+	}
+	for _, ip := range []string{"10.2.0.1", "9.9.9.9", "fc00::1"} {
+		v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr(ip), nil)
+		require.False(t, v.RequestLimitExempt(), ip)
+	}
+}
+
+func TestVisitor_RefundMessage(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorMessageDailyLimit = 2
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.MessageAllowed())
+	require.Nil(t, v.MessageAllowed())
+	require.Equal(t, errMessageLimitReached, v.MessageAllowed())
+
+	v.RefundMessage()
+	require.Equal(t, int64(1), v.Stats().Messages)
+	require.Nil(t, v.MessageAllowed())
+
+	// Never drops below zero
+	v.RefundMessage()
+	v.RefundMessage()
+	v.RefundMessage()
+	require.Equal(t, int64(0), v.Stats().Messages)
+}
+
+func TestVisitor_Stale_VisitorExpungeAfter(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorExpungeAfter = time.Hour
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.False(t, v.Stale())
+
+	v.seen = time.Now().Add(-59 * time.Minute)
+	require.False(t, v.Stale())
+
+	v.seen = time.Now().Add(-61 * time.Minute)
+	require.True(t, v.Stale())
+}
+
+func TestVisitor_CreatedLastSeen(t *testing.T) {
+	clock := newTestClock()
+	v := newTestVisitorWithClock(t, newTestConfig(t), nil, clock)
+	created := clock.Now()
+	clock.Add(time.Hour)
+	v.Keepalive()
+	require.Equal(t, created.Add(time.Hour), v.LastSeen())
+
+	info, err := v.Info()
+	require.Nil(t, err)
+	require.Equal(t, created.Unix(), info.Created)
+	require.Equal(t, created.Add(time.Hour).Unix(), info.LastSeen)
+}
+
+func TestVisitor_MessageIntervalAllowed(t *testing.T) {
+	clock := newTestClock()
+	conf := newTestConfig(t)
+	v := newTestVisitorWithClock(t, conf, nil, clock)
+	require.Nil(t, v.MessageIntervalAllowed())
+	require.Nil(t, v.MessageIntervalAllowed()) // Disabled by default
+
+	conf.VisitorMinMessageInterval = 100 * time.Millisecond
+	v = newTestVisitorWithClock(t, conf, nil, clock)
+	require.Nil(t, v.MessageIntervalAllowed())
+	require.Nil(t, v.MessageIntervalAllowed()) // Interval not started yet, e.g. message rejected by another limit
+	v.StartMessageInterval()
+	clock.Add(50 * time.Millisecond)
+	require.Equal(t, errMessageIntervalReached, v.MessageIntervalAllowed())
+	clock.Add(50 * time.Millisecond)
+	require.Nil(t, v.MessageIntervalAllowed()) // Rejected message did not restart the interval
+	v.StartMessageInterval()
+	require.Equal(t, errMessageIntervalReached, v.MessageIntervalAllowed())
+}
+
+func TestVisitor_DuplicateMessage(t *testing.T) {
+	clock := newTestClock()
+	conf := newTestConfig(t)
+	m := newDefaultMessage("mytopic", "disk full")
+	v := newTestVisitorWithClock(t, conf, nil, clock)
+	v.SetLastMessage("hash1", m)
+	require.Nil(t, v.DuplicateMessage("hash1")) // Disabled by default
+
+	conf.VisitorDedupWindow = time.Minute
+	v = newTestVisitorWithClock(t, conf, nil, clock)
+	require.Nil(t, v.DuplicateMessage("hash1"))
+	v.SetLastMessage("hash1", m)
+	clock.Add(30 * time.Second)
+	require.Equal(t, m, v.DuplicateMessage("hash1"))
+	require.Nil(t, v.DuplicateMessage("hash2"))
+	clock.Add(30 * time.Second)
+	require.Nil(t, v.DuplicateMessage("hash1")) // Duplicate did not restart the window
+}
+
+func TestVisitor_LimitError(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorMessageDailyLimit = 10
+	conf.VisitorEmailLimitBurst = 1
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.EmailAllowed())
+	require.Equal(t, errEmailLimitReached, v.EmailAllowed())
+
+	limit := v.LimitError(visitorLimiterEmails)
+	require.Equal(t, visitorLimiterEmails, limit.Limiter)
+	require.Equal(t, "ip", limit.Basis)
+	require.Equal(t, int64(1), limit.Limit)
+	require.Equal(t, int64(0), limit.Remaining)
+	require.Greater(t, limit.ResetAt, time.Now().Unix())
+	limit = v.LimitError(visitorLimiterMessages)
+	require.Equal(t, int64(10), limit.Limit)
+	require.Equal(t, int64(10), limit.Remaining)
+
+	// Limiters without counters only report the name and basis
+	limit = v.LimitError(visitorLimiterAuth)
+	require.Equal(t, &limitErrorResponse{Limiter: visitorLimiterAuth, Basis: "ip"}, limit)
+}
+
+func TestVisitor_SubscriptionLimit_Tier(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.VisitorSubscriptionLimit = 2
+	s := newTestServer(t, conf)
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro", SubscriptionLimit: 4}))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "basic"}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	v := s.visitor(netip.MustParseAddr("1.2.3.4"), u)
+	require.Equal(t, int64(2), v.Limits().SubscriptionLimit)
+	require.Nil(t, v.SubscriptionAllowed())
+
+	// Tier overrides the limit, active subscriptions are kept
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+	u, err = s.userManager.User("phil")
+	require.Nil(t, err)
+	v.SetUser(u)
+	require.Equal(t, int64(4), v.Limits().SubscriptionLimit)
+	require.Equal(t, int64(1), v.subscriptionLimiter.Value())
+	for i := 0; i < 3; i++ {
+		require.Nil(t, v.SubscriptionAllowed())
+	}
+	require.Equal(t, errSubscriptionLimitReached, v.SubscriptionAllowed())
+
+	// Tier without subscription limit falls back to the config value
+	require.Nil(t, s.userManager.ChangeTier("phil", "basic"))
+	u, err = s.userManager.User("phil")
+	require.Nil(t, err)
+	v.SetUser(u)
+	require.Equal(t, int64(2), v.Limits().SubscriptionLimit)
+}
+
+func TestVisitor_SubscriptionAttemptLimit(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorSubscriptionLimit = 10
+	conf.VisitorSubscriptionAttemptLimitBurst = 3
+	conf.VisitorSubscriptionAttemptLimitReplenish = time.Hour
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+
+	// Connecting and disconnecting quickly is not caught by the concurrent subscriptions limit
+	for i := 0; i < 3; i++ {
+		require.Nil(t, v.SubscriptionAllowed())
+		v.RemoveSubscription()
+	}
+	require.Equal(t, errSubscriptionAttemptLimitReached, v.SubscriptionAllowed())
+	require.False(t, errors.Is(errSubscriptionAttemptLimitReached, errSubscriptionLimitReached))
+	require.Equal(t, int64(0), v.subscriptionLimiter.Value())
+	require.Equal(t, errHTTPTooManyRequestsLimitSubscriptionAttempts, errHTTPFromLimitError(errSubscriptionAttemptLimitReached))
+	require.Equal(t, 3, v.LimiterStates()[visitorLimiterSubscriptionAttempts].Burst)
+
+	// Disabled by default
+	v = newVisitor(newTestConfig(t), newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.connectLimiter)
+	require.Nil(t, v.LimiterStates()[visitorLimiterSubscriptionAttempts])
+}
+
+func TestVisitor_LimitsExceededMetric(t *testing.T) {
+	metricVisitorLimitsExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntfy_visitor_limits_exceeded_total",
+	}, []string{"limiter"})
+	defer func() { metricVisitorLimitsExceeded = nil }()
+
+	conf := newTestConfig(t)
+	conf.VisitorMessageDailyLimit = 1
+	conf.VisitorSubscriptionLimit = 1
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.MessageAllowed())
+	require.Equal(t, errMessageLimitReached, v.MessageAllowed())
+	require.Equal(t, errMessageLimitReached, v.MessageAllowed())
+	require.Nil(t, v.SubscriptionAllowed())
+	require.Equal(t, errSubscriptionLimitReached, v.SubscriptionAllowed())
+	require.Equal(t, float64(2), testutil.ToFloat64(metricVisitorLimitsExceeded.WithLabelValues(visitorLimiterMessages)))
+	require.Equal(t, float64(1), testutil.ToFloat64(metricVisitorLimitsExceeded.WithLabelValues(visitorLimiterSubscriptions)))
+	require.Equal(t, float64(0), testutil.ToFloat64(metricVisitorLimitsExceeded.WithLabelValues(visitorLimiterEmails)))
+}
+
+func TestVisitor_RestoreRequestLimiter(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorRequestLimitBurst = 10
+	conf.VisitorRequestLimitReplenish = 10 * time.Second
+	newUser := func(tokens float64, updated time.Time) *user.User {
+		return &user.User{
+			ID:      "u_123",
+			Name:    "phil",
+			Stats:   &user.Stats{RequestTokens: tokens, RequestTokensUpdated: updated},
+			Billing: &user.Billing{},
+		}
+	}
+
+	// Recent state is restored
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), newUser(2, time.Now()))
+	require.InDelta(t, 2, v.requestLimiter.Tokens(), 0.1)
+
+	// Tokens replenished since the state was saved are added
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), newUser(2, time.Now().Add(-30*time.Second)))
+	require.InDelta(t, 5, v.requestLimiter.Tokens(), 0.1)
+
+	// Stale (or missing) state is ignored
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), newUser(2, time.Now().Add(-2*time.Hour)))
+	require.InDelta(t, 10, v.requestLimiter.Tokens(), 0.1)
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), newUser(0, time.Unix(0, 0)))
+	require.InDelta(t, 10, v.requestLimiter.Tokens(), 0.1)
+}
+
+func TestVisitor_VisitorIP_IPv6Prefix(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorRequestExemptIPAddrs = []netip.Prefix{netip.MustParsePrefix("2001:db8:ffff::/48")}
+	require.Equal(t, "1.2.3.4", visitorIP(conf, netip.MustParseAddr("1.2.3.4")).String())
+	require.Equal(t, "::ffff:1.2.3.4", visitorIP(conf, netip.MustParseAddr("::ffff:1.2.3.4")).String())
+	require.Equal(t, "2001:db8:1:2::", visitorIP(conf, netip.MustParseAddr("2001:db8:1:2:aaaa:bbbb:cccc:dddd")).String())
+	require.Equal(t, "2001:db8:1:2::", visitorIP(conf, netip.MustParseAddr("2001:db8:1:2::1")).String())
+	require.Equal(t, "2001:db8:ffff:1::1", visitorIP(conf, netip.MustParseAddr("2001:db8:ffff:1::1")).String()) // Exempt
+
+	conf.VisitorRequestLimitIPv6Prefix = 56
+	require.Equal(t, "2001:db8:1:200::", visitorIP(conf, netip.MustParseAddr("2001:db8:1:2ff::1")).String())
+
+	conf.VisitorRequestLimitIPv6Prefix = 128
+	require.Equal(t, "2001:db8:1:2::1", visitorIP(conf, netip.MustParseAddr("2001:db8:1:2::1")).String())
+}
+
+func TestVisitor_EmailLimitBurst_Tier(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorEmailLimitBurst = 2
+	limits := tierBasedVisitorLimits(conf, &user.Tier{EmailLimit: 10})
+	require.Equal(t, 2, limits.EmailLimitBurst) // Derived from email limit, at least the config value
+
+	limits = tierBasedVisitorLimits(conf, &user.Tier{EmailLimit: 10, EmailLimitBurst: 5})
+	require.Equal(t, 5, limits.EmailLimitBurst)
+
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), &user.User{
+		Tier:    &user.Tier{EmailLimit: 10, EmailLimitBurst: 5},
+		Stats:   &user.Stats{},
+		Billing: &user.Billing{},
+	})
+	for i := 0; i < 5; i++ {
+		require.Nil(t, v.EmailAllowed())
+	}
+	require.Equal(t, errEmailLimitReached, v.EmailAllowed())
+}
+
+func TestVisitor_MessageMonthlyLimit(t *testing.T) {
+	conf := newTestConfig(t)
+	newUser := func(tier *user.Tier, stats *user.Stats) *user.User {
+		return &user.User{ID: "u_123", Name: "phil", Tier: tier, Stats: stats, Billing: &user.Billing{}}
+	}
+
+	// Monthly limit is reached before the daily limit
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), newUser(&user.Tier{MessageLimit: 10, MessageMonthlyLimit: 3}, &user.Stats{}))
+	for i := 0; i < 3; i++ {
+		require.Nil(t, v.MessageAllowed())
+	}
+	require.Equal(t, errMessageLimitReached, v.MessageAllowed())
+	require.Equal(t, int64(3), v.Stats().Messages)
+	require.Equal(t, int64(3), v.Stats().MessagesMonthly)
+	require.Equal(t, int64(0), v.infoLightNoLock().Stats.MessagesMonthlyRemaining)
+
+	// Daily reset does not reset monthly counter
+	v.ResetStats()
+	require.Equal(t, errMessageLimitReached, v.MessageAllowed())
+	v.ResetMonthlyStats()
+	require.Nil(t, v.MessageAllowed())
+
+	// Daily limit is reached first, monthly counter is not incremented
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), newUser(&user.Tier{MessageLimit: 2, MessageMonthlyLimit: 5}, &user.Stats{}))
+	require.Nil(t, v.MessageAllowed())
+	require.Nil(t, v.MessageAllowed())
+	require.Equal(t, errMessageLimitReached, v.MessageAllowed())
+	require.Equal(t, int64(2), v.Stats().MessagesMonthly)
+
+	// Persisted monthly counter is only restored within the same month
+	tier := &user.Tier{MessageLimit: 10, MessageMonthlyLimit: 5}
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), newUser(tier, &user.Stats{MessagesMonthly: 4, MessagesMonthlyPeriod: user.MonthlyPeriod(time.Now())}))
+	require.Equal(t, int64(4), v.Stats().MessagesMonthly)
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), newUser(tier, &user.Stats{MessagesMonthly: 4, MessagesMonthlyPeriod: "2000-01"}))
+	require.Equal(t, int64(0), v.Stats().MessagesMonthly)
+}
+
+func TestVisitor_MessagesResetAt(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorStatsResetTime = time.Date(0, 0, 0, 3, 0, 0, 0, time.UTC)
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.MessageAllowed())
+	require.Equal(t, util.NextOccurrenceUTC(conf.VisitorStatsResetTime, time.Now()).Unix(), v.infoLightNoLock().Stats.MessagesResetAt)
+
+	// Sliding window: oldest message leaves the window after one day
+	conf.VisitorMessageLimiterMode = VisitorMessageLimiterModeSliding
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.InDelta(t, time.Now().Unix(), v.infoLightNoLock().Stats.MessagesResetAt, 2)
+	require.Nil(t, v.MessageAllowed())
+	require.InDelta(t, time.Now().Add(24*time.Hour).Unix(), v.infoLightNoLock().Stats.MessagesResetAt, 24*60) // Bucket granularity
+
+	// Decay: counter drops by one after 24h / limit
+	conf.VisitorMessageLimiterMode = VisitorMessageLimiterModeDecay
+	conf.VisitorMessageDailyLimit = 24
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.IsType(t, &util.DecayingLimiter{}, v.messagesLimiter)
+	require.InDelta(t, time.Now().Unix(), v.infoLightNoLock().Stats.MessagesResetAt, 2)
+	require.Nil(t, v.MessageAllowed())
+	require.InDelta(t, time.Now().Add(time.Hour).Unix(), v.infoLightNoLock().Stats.MessagesResetAt, 2)
+}
+
+func TestVisitor_ZeroReplenish_SafeEvery(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorRequestLimitBurst = 1
+	conf.VisitorRequestLimitReplenish = 0
+	conf.VisitorEmailLimitReplenish = -time.Second
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Equal(t, rate.Every(DefaultVisitorRequestLimitReplenish), v.requestLimiter.Limit())
+	require.True(t, v.RequestAllowed())
+	require.False(t, v.RequestAllowed()) // Not unlimited
+	require.Equal(t, replenishDurationToDailyLimit(DefaultVisitorRequestLimitReplenish), v.Limits().EmailLimit)
+}
+
+func TestVisitor_Close_FlushesStats(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthStatsQueueWriterInterval = 100 * time.Millisecond
+	s := newTestServer(t, conf)
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro", MessageLimit: 10}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	v := s.visitor(netip.MustParseAddr("1.2.3.4"), u)
+	require.Nil(t, v.MessageAllowed())
+	require.Nil(t, v.MessageAllowed())
+	v.Close()
+	require.Equal(t, "phil", v.User().Name) // Still usable by handlers that hold on to the visitor
+	require.Equal(t, visitorLimitBasisTier, v.Basis())
+	time.Sleep(300 * time.Millisecond)
+
+	u, err = s.userManager.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), u.Stats.Messages)
+}
+
+func TestVisitor_UserLimitOverrides(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.VisitorMessageDailyLimit = 5
+	s := newTestServer(t, conf)
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro", MessageLimit: 100, EmailLimit: 10, CallLimit: 3}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+
+	// Overrides take precedence over the tier, unset overrides fall back to the tier
+	messages, calls := int64(1000), int64(0)
+	require.Nil(t, s.userManager.ChangeLimitOverrides("phil", &messages, nil, &calls, nil))
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	v := s.visitor(netip.MustParseAddr("1.2.3.4"), u)
+	limits := v.Limits()
+	require.Equal(t, visitorLimitBasisUser, limits.Basis)
+	require.Equal(t, visitorLimitBasisUser, v.Basis())
+	require.Equal(t, int64(1000), limits.MessageLimit)
+	require.Equal(t, int64(10), limits.EmailLimit)
+	require.Equal(t, int64(0), limits.CallLimit)
+
+	// Users without tier get their own visitor if they have overrides
+	require.Nil(t, s.userManager.ChangeLimitOverrides("ben", &messages, nil, nil, nil))
+	u, err = s.userManager.User("ben")
+	require.Nil(t, err)
+	v = s.visitor(netip.MustParseAddr("1.2.3.4"), u)
+	require.Equal(t, "user:"+u.ID, visitorID(v.ip, u))
+	require.Equal(t, int64(1000), v.Limits().MessageLimit)
+	require.Equal(t, int64(5), s.visitor(netip.MustParseAddr("1.2.3.4"), nil).Limits().MessageLimit)
+
+	// Changing the overrides resets the limiters
+	require.Nil(t, v.MessageAllowed())
+	messages = 1
+	require.Nil(t, s.userManager.ChangeLimitOverrides("ben", &messages, nil, nil, nil))
+	u, err = s.userManager.User("ben")
+	require.Nil(t, err)
+	v.SetUser(u)
+	require.Equal(t, int64(1), v.Limits().MessageLimit)
+	require.Nil(t, v.MessageAllowed())
+	require.Equal(t, errMessageLimitReached, v.MessageAllowed())
+}
+
+func TestVisitor_MessageAllowedPeek(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorMessageDailyLimit = 2
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+
+	// Peeking does not count the message
+	for i := 0; i < 5; i++ {
+		require.Nil(t, v.MessageAllowedPeek())
+	}
+	require.Equal(t, int64(0), v.Stats().Messages)
+	require.InDelta(t, float64(conf.VisitorRequestLimitBurst), v.requestLimiter.Tokens(), 0.1)
+
+	require.Nil(t, v.MessageAllowed())
+	require.Nil(t, v.MessageAllowed())
+	require.Equal(t, errMessageLimitReached, v.MessageAllowedPeek())
+
+	// Request limiter is checked too
+	conf.VisitorMessageDailyLimit = 10
+	conf.VisitorRequestLimitBurst = 1
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.MessageAllowedPeek())
+	require.True(t, v.RequestAllowed())
+	require.Equal(t, errRequestLimitReached, v.MessageAllowedPeek())
+
+	// Anonymous publishing disabled
+	conf.AnonymousPublishDisabled.Store(true)
+	require.Equal(t, errAnonymousPublishDisabled, v.MessageAllowedPeek())
+}
+
+func TestVisitor_ExceededLimits(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorMessageDailyLimit = 1
+	conf.VisitorAttachmentDailyBandwidthLimit = 1000
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Empty(t, v.ExceededLimits())
+
+	require.Nil(t, v.MessageAllowed())
+	require.Equal(t, []string{visitorLimiterMessages}, v.ExceededLimits())
+
+	require.Nil(t, v.BandwidthAllowed(1000))
+	require.Equal(t, errBandwidthLimitReached, v.BandwidthAllowed(1))
+	require.Equal(t, []string{visitorLimiterMessages, visitorLimiterBandwidth}, v.ExceededLimits())
+
+	// Exempt visitors are never over the request and message limits
+	v.exempt = true
+	require.Equal(t, []string{visitorLimiterBandwidth}, v.ExceededLimits())
+}
+
+func TestVisitor_BandwidthRemainingAndResetAt(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorAttachmentDailyBandwidthLimit = 1000
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Equal(t, int64(1000), v.BandwidthRemaining())
+	require.WithinDuration(t, time.Now(), v.BandwidthResetAt(), time.Second) // Nothing used
+
+	// Rolling: the used bytes are replenished over 24h
+	require.Nil(t, v.BandwidthAllowed(500))
+	require.Equal(t, int64(500), v.BandwidthRemaining())
+	require.WithinDuration(t, time.Now().Add(12*time.Hour), v.BandwidthResetAt(), time.Minute)
+	v.ResetStats()
+	require.Equal(t, int64(500), v.BandwidthRemaining())
+
+	// Calendar: the allowance is refilled at the daily stats reset, and surfaced in the visitor info
+	conf.VisitorAttachmentBandwidthResetMode = VisitorAttachmentBandwidthResetModeCalendar
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.BandwidthAllowed(1000))
+	require.Equal(t, errBandwidthLimitReached, v.BandwidthAllowed(1))
+	require.Equal(t, int64(0), v.BandwidthRemaining())
+	require.Equal(t, nextStatsReset(conf, time.Now()), v.BandwidthResetAt())
+	info, err := v.Info()
+	require.Nil(t, err)
+	require.Equal(t, int64(0), info.Stats.AttachmentBandwidthRemaining)
+	require.Equal(t, v.BandwidthResetAt().Unix(), info.Stats.AttachmentBandwidthResetAt)
+	v.ResetStats()
+	require.Equal(t, int64(1000), v.BandwidthRemaining())
+	require.Nil(t, v.BandwidthAllowed(1000))
+}
+
+func TestVisitor_Info_AttachmentUsageError(t *testing.T) {
+	conf := newTestConfig(t)
+	cache := newMemTestCache(t)
+	v := newVisitor(conf, cache, nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.MessageAllowed())
+	require.Nil(t, cache.Close())
+
+	// Best-effort by default: attachment usage is unknown, but the rest is still there
+	info, err := v.Info()
+	require.Nil(t, err)
+	require.Equal(t, int64(-1), info.Stats.AttachmentTotalSize)
+	require.Equal(t, int64(-1), info.Stats.AttachmentTotalSizeRemaining)
+	require.Equal(t, int64(1), info.Stats.Messages)
+
+	// Strict mode
+	conf.StrictAccountInfo = true
+	_, err = v.Info()
+	require.NotNil(t, err)
+}
+
+func TestVisitor_AttachmentMessageAllowed(t *testing.T) {
+	conf := newTestConfig(t)
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	for i := 0; i < 10; i++ {
+		require.Nil(t, v.AttachmentMessageAllowed()) // No separate limit by default
+	}
+
+	conf.VisitorAttachmentMessageDailyLimit = 2
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.AttachmentMessageAllowed())
+	require.Nil(t, v.AttachmentMessageAllowed())
+	require.Equal(t, errAttachmentLimitReached, v.AttachmentMessageAllowed())
+	info, err := v.Info()
+	require.Nil(t, err)
+	require.Equal(t, int64(2), info.Limits.AttachmentMessagesLimit)
+	require.Equal(t, int64(2), info.Stats.AttachmentMessages)
+	require.Equal(t, int64(0), info.Stats.AttachmentMessagesRemaining)
+	v.ResetStats()
+	require.Nil(t, v.AttachmentMessageAllowed())
+}
+
+func TestVisitor_GatewayMessageAllowed(t *testing.T) {
+	conf := newTestConfig(t)
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	for i := 0; i < 10; i++ {
+		require.Nil(t, v.GatewayMessageAllowed()) // No separate limit by default, but still counted
+	}
+	require.False(t, v.GatewayMessagesLimited())
+	info, err := v.Info()
+	require.Nil(t, err)
+	require.Equal(t, int64(10), info.Stats.GatewayMessages)
+	require.Equal(t, int64(0), info.Stats.GatewayMessagesRemaining)
+
+	conf.VisitorGatewayMessageDailyLimit = 2
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.True(t, v.GatewayMessagesLimited())
+	require.Nil(t, v.GatewayMessageAllowed())
+	require.Nil(t, v.GatewayMessageAllowed())
+	require.Equal(t, errGatewayLimitReached, v.GatewayMessageAllowed())
+	info, err = v.Info()
+	require.Nil(t, err)
+	require.Equal(t, int64(2), info.Limits.GatewayMessagesLimit)
+	require.Equal(t, int64(2), info.Stats.GatewayMessages)
+	require.Equal(t, int64(0), info.Stats.GatewayMessagesRemaining)
+	require.Equal(t, int64(0), info.Stats.Messages) // Not counted as regular messages
+	v.RefundGatewayMessage()
+	require.Nil(t, v.GatewayMessageAllowed())
+	v.ResetStats()
+	require.Nil(t, v.GatewayMessageAllowed())
+}
+
+func TestVisitor_RecordRequest(t *testing.T) {
+	conf := newTestConfig(t)
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	v.RecordRequest(time.Second)
+	require.Equal(t, int64(0), v.Snapshot().Requests) // Disabled by default
+
+	conf.VisitorRequestStats = true
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	v.RecordRequest(100 * time.Millisecond)
+	require.Equal(t, int64(1), v.Snapshot().Requests)
+	require.Equal(t, 100*time.Millisecond, v.Snapshot().RequestTime)
+	v.RecordRequest(200 * time.Millisecond)
+	require.Equal(t, int64(2), v.Snapshot().Requests)
+	require.Equal(t, 110*time.Millisecond, v.Snapshot().RequestTime) // Moving average
+
+	// Daily reset clears the counter, but keeps the average
+	v.ResetStats()
+	require.Equal(t, int64(0), v.Snapshot().Requests)
+	require.Equal(t, 110*time.Millisecond, v.Snapshot().RequestTime)
+}
+
+func TestVisitor_Tenant(t *testing.T) {
+	conf := newTestConfig(t)
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Equal(t, "", v.Tenant())
+	v.SetTenant("team-b")
+	require.Equal(t, "team-b", v.Tenant())
+	require.Equal(t, "team-b", v.Snapshot().Tenant)
+	v.SetTenant(strings.Repeat("x", visitorTenantMaxLength+1)) // Ignored
+	require.Equal(t, "team-b", v.Tenant())
+
+	// The billing account takes precedence
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), &user.User{
+		ID:             "u_123",
+		BillingAccount: "team-a",
+		Stats:          &user.Stats{},
+		Billing:        &user.Billing{},
+	})
+	v.SetTenant("team-b")
+	require.Equal(t, "team-a", v.Tenant())
+	require.True(t, v.Snapshot().Shared)
+}
+
+func TestVisitor_LogFields(t *testing.T) {
+	conf := newTestConfig(t)
+	u := &user.User{ID: "u_123", Name: "phil", Stats: &user.Stats{}, Billing: &user.Billing{}}
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), u)
+	require.Nil(t, v.MessageAllowed())
+	require.Nil(t, v.MessageAllowed())
+	require.Nil(t, v.EmailAllowed())
+	v.seen = time.Now().Add(-time.Hour)
+
+	fields := v.LogFields()
+	require.Equal(t, "ip:1.2.3.4", fields["visitor_id"])
+	require.Equal(t, "1.2.3.4", fields["visitor_ip"])
+	require.Equal(t, int64(2), fields["visitor_messages"])
+	require.Equal(t, int64(1), fields["visitor_emails"])
+	require.Equal(t, "1h0m0s", fields["visitor_seen_since"])
+	require.Equal(t, "phil", fields["user_name"])
+}
+
+func TestVisitor_AttachmentFileSizeLimit(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.AttachmentFileSizeLimit = 1000
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Equal(t, int64(1000), v.AttachmentFileSizeLimit())
+
+	// Admins without a tier use the config-based limit
+	v.SetUser(&user.User{ID: "u_admin", Name: "phil", Role: user.RoleAdmin, Stats: &user.Stats{}, Billing: &user.Billing{}})
+	require.Equal(t, int64(1000), v.AttachmentFileSizeLimit())
+
+	v.SetUser(&user.User{ID: "u_123", Name: "ben", Tier: &user.Tier{AttachmentFileSizeLimit: 5000}, Stats: &user.Stats{}, Billing: &user.Billing{}})
+	require.Equal(t, int64(5000), v.AttachmentFileSizeLimit())
+	require.Equal(t, v.AttachmentFileSizeLimit(), v.Limits().AttachmentFileSizeLimit)
+}
+
+func TestVisitor_LimitResetModeCalendar(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	require.Nil(t, err)
+	conf := newTestConfig(t)
+	now := time.Date(2023, time.January, 10, 22, 0, 0, 0, loc)
+	require.Equal(t, time.Date(2023, time.January, 12, 0, 0, 0, 0, time.UTC), nextStatsReset(conf, now)) // Continuous: midnight UTC (already Jan 11 in UTC)
+
+	conf.VisitorLimitResetMode = VisitorLimitResetModeCalendar
+	conf.VisitorLimitResetTimezone = loc
+	require.Equal(t, time.Date(2023, time.January, 11, 0, 0, 0, 0, loc), nextStatsReset(conf, now))
+
+	// Calendar mode always uses the fixed limiter, which is fully reset by the stats resetter
+	conf.VisitorMessageLimiterMode = VisitorMessageLimiterModeSliding
+	conf.VisitorMessageDailyLimit = 1
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.IsType(t, &util.FixedLimiter{}, v.messagesLimiter)
+	require.Nil(t, v.MessageAllowed())
+	require.Equal(t, errMessageLimitReached, v.MessageAllowed())
+	v.ResetStats()
+	require.Nil(t, v.MessageAllowed())
+}
+
+func TestVisitor_InfoMessagesRemainingFromLimiter(t *testing.T) {
+	conf := newTestConfig(t)
+	u := &user.User{ID: "u_123", Name: "phil", Tier: &user.Tier{MessageLimit: 10}, Stats: &user.Stats{}, Billing: &user.Billing{}}
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), u)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, v.MessageAllowed())
+	}
+	info, err := v.Info()
+	require.Nil(t, err)
+	require.Equal(t, int64(7), info.Stats.MessagesRemaining)
+
+	// Tier changed in place, but the limiter was not reset: report what the limiter enforces
+	u.Tier.MessageLimit = 2
+	info, err = v.Info()
+	require.Nil(t, err)
+	require.Equal(t, int64(2), info.Limits.MessageLimit)
+	require.Equal(t, int64(7), info.Stats.MessagesRemaining)
+	require.Nil(t, v.MessageAllowed())
+}
+
+func TestVisitor_PenaltyBox(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorPenaltyBoxThreshold = 3
+	conf.VisitorPenaltyBoxWindow = time.Minute
+	conf.VisitorPenaltyBoxDuration = time.Hour
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+
+	// An allowed request resets the counter
+	v.RecordLimitResult(true)
+	v.RecordLimitResult(true)
+	v.RecordLimitResult(false)
+	v.RecordLimitResult(true)
+	require.Zero(t, v.PenaltyBoxRemaining())
+
+	// Hits outside the window are not counted
+	v.limitHitsSince = time.Now().Add(-2 * time.Minute)
+	v.RecordLimitResult(true)
+	require.Zero(t, v.PenaltyBoxRemaining())
+	require.Equal(t, 1, v.limitHits)
+
+	v.RecordLimitResult(true)
+	v.RecordLimitResult(true)
+	require.InDelta(t, time.Hour.Seconds(), v.PenaltyBoxRemaining().Seconds(), 2)
+}
+
+func TestVisitor_PenaltyBox_Clock(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorPenaltyBoxThreshold = 2
+	conf.VisitorPenaltyBoxWindow = time.Minute
+	conf.VisitorPenaltyBoxDuration = time.Hour
+	conf.VisitorDistinctTopicsDailyLimit = 1
+	clock := newTestClock()
+	v := newTestVisitorWithClock(t, conf, nil, clock)
+
+	v.RecordLimitResult(true)
+	clock.Add(2 * time.Minute) // Outside the window
+	v.RecordLimitResult(true)
+	require.Zero(t, v.PenaltyBoxRemaining())
+	v.RecordLimitResult(true)
+	require.Equal(t, time.Hour, v.PenaltyBoxRemaining())
+	clock.Add(time.Hour)
+	require.Zero(t, v.PenaltyBoxRemaining())
+
+	// Distinct topics are cleared at the (fake) daily reset
+	require.Nil(t, v.NewTopicAllowed("topic1"))
+	require.Equal(t, errTopicsLimitReached, v.NewTopicAllowed("topic2"))
+	clock.Add(25 * time.Hour)
+	require.Nil(t, v.NewTopicAllowed("topic2"))
+}
+
+func TestVisitor_LimitResetJitter(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorMessageDailyLimit = 1
+	conf.VisitorLimitResetJitter = time.Hour
+
+	// Jitter is stable per visitor, and within bounds
+	jitter := visitorResetJitter(time.Hour, "ip:1.2.3.4")
+	require.Equal(t, jitter, visitorResetJitter(time.Hour, "ip:1.2.3.4"))
+	require.NotEqual(t, jitter, visitorResetJitter(time.Hour, "ip:5.6.7.8"))
+	for i := 0; i < 100; i++ {
+		j := visitorResetJitter(time.Hour, fmt.Sprintf("ip:1.2.3.%d", i))
+		require.True(t, j >= -time.Hour && j <= time.Hour)
+	}
+	require.Equal(t, time.Duration(0), visitorResetJitter(0, "ip:1.2.3.4"))
+
+	// Visitor resets itself once its jittered reset time has passed
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Equal(t, jitter, v.statsResetJitter)
+	require.Equal(t, v.statsReset.Add(jitter).Unix(), v.infoLightNoLock().Stats.MessagesResetAt)
+	require.Nil(t, v.MessageAllowed())
+	require.Equal(t, errMessageLimitReached, v.MessageAllowed())
+	v.Keepalive()
+	require.Equal(t, errMessageLimitReached, v.MessageAllowed())
+
+	v.statsReset = time.Now().Add(-jitter - time.Second)
+	v.Keepalive()
+	require.Nil(t, v.MessageAllowed())
+	require.True(t, v.statsReset.Add(jitter).After(time.Now())) // Next reset is scheduled
+}
+
+func TestVisitor_TierZeroLimitsUnlimited(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorRequestLimitBurst = 1000
+	u := &user.User{ID: "u_123", Name: "phil", Tier: &user.Tier{MessageLimit: 0, EmailLimit: 0}, Stats: &user.Stats{}, Billing: &user.Billing{}}
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), u)
+	for i := 0; i < 100; i++ {
+		require.Nil(t, v.MessageAllowed())
+		require.Nil(t, v.EmailAllowed())
+	}
+	info := v.infoLightNoLock()
+	require.Equal(t, visitorUnlimited, info.Limits.MessageLimit)
+	require.Equal(t, visitorUnlimited, info.Limits.EmailLimit)
+	require.Equal(t, int64(100), info.Stats.Messages)
+	require.Equal(t, visitorUnlimited, info.Stats.MessagesRemaining)
+	require.Equal(t, visitorUnlimited, info.Stats.EmailsRemaining)
+	require.Nil(t, v.RateLimitHeaders())
+}
+
+func TestVisitor_NewAccountGrace(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.NewAccountGraceDuration = 2 * time.Hour
+	conf.NewAccountGraceMultiplier = 3
+	tier := &user.Tier{MessageLimit: 1000, RequestLimitBurst: 100}
+	created := time.Now().Add(-time.Hour)
+	u := &user.User{ID: "u_123", Name: "phil", Tier: tier, Created: created, Stats: &user.Stats{}, Billing: &user.Billing{}}
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), u)
+	require.Equal(t, 300, v.requestLimiter.Burst())
+	require.Equal(t, created.Add(2*time.Hour).Unix(), v.Limits().GraceUntil.Unix())
+	require.Equal(t, created.Add(2*time.Hour).Unix(), newAPIAccountLimits(v.Limits()).GraceUntil)
+
+	// Grace is over: back to normal on the next request
+	conf.NewAccountGraceDuration = 30 * time.Minute
+	v.graceUntil = created.Add(30 * time.Minute)
+	v.Keepalive()
+	require.Equal(t, 100, v.requestLimiter.Burst())
+	require.True(t, v.Limits().GraceUntil.IsZero())
+
+	// Users without their own limits do not get a grace
+	conf.NewAccountGraceDuration = 2 * time.Hour
+	u = &user.User{ID: "u_456", Name: "ben", Created: created, Stats: &user.Stats{}, Billing: &user.Billing{}}
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), u)
+	require.Equal(t, conf.VisitorRequestLimitBurst, v.requestLimiter.Burst())
+}
+
+func TestVisitor_AccountCreateAllowed(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorAccountCreationLimitBurst = 2
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.AccountCreateAllowed())
+	require.Nil(t, v.AccountCreateAllowed())
+	err := v.AccountCreateAllowed()
+	require.Equal(t, errAccountCreateLimitReached, err)
+	require.Equal(t, errHTTPTooManyRequestsLimitAccountCreation, errHTTPFromLimitError(err))
+
+	// Logged-in users have no account limiter
+	u := &user.User{ID: "u_123", Name: "phil", Stats: &user.Stats{}, Billing: &user.Billing{}}
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), u)
+	for i := 0; i < 5; i++ {
+		require.Nil(t, v.AccountCreateAllowed())
+	}
+}
+
+func TestVisitor_GeoRestrictedLimits(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorRequestLimitBurst = 10
+	conf.VisitorMessageDailyLimit = 100
+	conf.GeoRestrictedCountries = []string{"XX"}
+	conf.GeoRestrictedLimitMultiplier = 0.2
+	geoIP := newGeoIPResolver(func(ip netip.Addr) (string, error) {
+		if ip == netip.MustParseAddr("1.2.3.4") {
+			return "XX", nil
+		}
+		return "YY", nil
+	})
+
+	// Restricted country
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, geoIP, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Equal(t, "XX", v.country)
+	require.Equal(t, "XX", v.Context()["visitor_country"])
+	limits := v.Limits()
+	require.Equal(t, 2, limits.RequestLimitBurst)
+	require.Equal(t, int64(20), limits.MessageLimit)
+
+	// Other country
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, geoIP, netip.MustParseAddr("5.6.7.8"), nil)
+	require.Equal(t, "YY", v.country)
+	require.Equal(t, 10, v.Limits().RequestLimitBurst)
+
+	// Tier users keep the limits of their tier
+	u := &user.User{ID: "u_123", Name: "phil", Tier: &user.Tier{MessageLimit: 50}, Stats: &user.Stats{}, Billing: &user.Billing{}}
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, geoIP, netip.MustParseAddr("1.2.3.4"), u)
+	require.Equal(t, int64(50), v.Limits().MessageLimit)
+
+	// No GeoIP database, no-op
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Equal(t, "", v.country)
+	require.Equal(t, int64(100), v.Limits().MessageLimit)
+}
+
+func TestVisitor_Paused(t *testing.T) {
+	clock := newTestClock()
+	v := newTestVisitorWithClock(t, newTestConfig(t), nil, clock)
+	require.Nil(t, v.MessageAllowed())
+
+	v.SetPaused(true, clock.Now().Add(time.Hour))
+	require.True(t, v.Paused())
+	require.False(t, v.RequestAllowed())
+	require.False(t, v.ReadRequestAllowed())
+	require.Equal(t, errVisitorPaused, v.MessageAllowed())
+	require.Equal(t, errVisitorPaused, v.EmailAllowed())
+	require.Equal(t, errVisitorPaused, v.SubscriptionAllowed())
+	require.Equal(t, errVisitorPaused, v.BandwidthAllowed(1))
+	_, err := v.RequestAllowedWithDelay()
+	require.Equal(t, errVisitorPaused, err)
+	require.Equal(t, errHTTPForbiddenVisitorPaused, errHTTPFromLimitError(err))
+
+	// Automatically unpaused
+	clock.Add(time.Hour)
+	v.Keepalive()
+	require.False(t, v.Paused())
+	require.Nil(t, v.MessageAllowed())
+
+	// Restored from the user record
+	u := &user.User{ID: "u_123", Name: "phil", Stats: &user.Stats{}, Billing: &user.Billing{}, Paused: true, PausedUntil: time.Unix(0, 0)}
+	v = newTestVisitorWithClock(t, newTestConfig(t), u, clock)
+	require.True(t, v.Paused())
+	v.SetUser(nil) // Anonymous request from the same IP address
+	require.False(t, v.Paused())
+	require.Nil(t, v.MessageAllowed())
+}
+
+func TestVisitor_LimitErrors(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorRequestLimitBurst = 1
+	conf.VisitorMessageDailyLimit = 1
+	conf.VisitorEmailLimitBurst = 1
+	conf.VisitorSubscriptionLimit = 1
+	conf.VisitorAttachmentDailyBandwidthLimit = 1
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+
+	require.True(t, v.RequestAllowed())
+	_, requestErr := v.RequestAllowedWithDelay()
+	require.Nil(t, v.MessageAllowed())
+	require.Nil(t, v.EmailAllowed())
+	require.Nil(t, v.SubscriptionAllowed())
+	require.Nil(t, v.BandwidthAllowed(1))
+
+	errs := map[error]*errHTTP{
+		requestErr:              errHTTPTooManyRequestsLimitRequests,
+		v.MessageAllowed():      errHTTPTooManyRequestsLimitMessages,
+		v.EmailAllowed():        errHTTPTooManyRequestsLimitEmails,
+		v.SubscriptionAllowed(): errHTTPTooManyRequestsLimitSubscriptions,
+		v.BandwidthAllowed(1):   errHTTPTooManyRequestsLimitAttachmentBandwidth,
+		errVisitorLimitReached:  errHTTPTooManyRequestsLimitRequests,
+	}
+	require.Len(t, errs, 6) // All errors are distinct
+	for err, httpErr := range errs {
+		require.True(t, errors.Is(err, errVisitorLimitReached))
+		require.True(t, isLimitReachedError(err))
+		require.Equal(t, httpErr, errHTTPFromLimitError(err))
+	}
+	require.Nil(t, errHTTPFromLimitError(errAnonymousPublishDisabled))
+}
+
+func TestVisitor_SetTier(t *testing.T) {
+	conf := newTestConfig(t)
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), &user.User{
+		ID:      "u_123",
+		Tier:    &user.Tier{ID: "ti_free", MessageLimit: 2, EmailLimit: 1},
+		Stats:   &user.Stats{},
+		Billing: &user.Billing{},
+	})
+	require.Nil(t, v.MessageAllowed())
+	require.Nil(t, v.MessageAllowed())
+	require.Equal(t, errMessageLimitReached, v.MessageAllowed())
+	require.Nil(t, v.EmailAllowed())
+
+	// Upgrade keeps the consumed messages and emails
+	v.SetTier(&user.Tier{ID: "ti_pro", MessageLimit: 3, EmailLimit: 5})
+	require.Equal(t, "ti_pro", v.User().TierID())
+	require.Equal(t, int64(3), v.Limits().MessageLimit)
+	require.Equal(t, int64(2), v.Stats().Messages)
+	require.Equal(t, int64(1), v.Stats().Emails)
+	require.Nil(t, v.MessageAllowed())
+	require.Equal(t, errMessageLimitReached, v.MessageAllowed())
+
+	// Anonymous visitors have no tier
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	v.SetTier(&user.Tier{ID: "ti_pro", MessageLimit: 3})
+	require.Nil(t, v.User())
+	require.NotEqual(t, int64(3), v.Limits().MessageLimit)
+}
+
+func TestVisitor_SetTier_DowngradeNextDay(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorTierDowngradeMode = VisitorTierDowngradeModeNextDay
+	conf.VisitorStatsResetTime = time.Date(0, 0, 0, 0, 0, 0, 0, time.UTC)
+	clock := newTestClock()
+	v := newTestVisitorWithClock(t, conf, &user.User{
+		ID:      "u_123",
+		Tier:    &user.Tier{ID: "ti_pro", MessageLimit: 5},
+		Stats:   &user.Stats{},
+		Billing: &user.Billing{},
+	}, clock)
+	require.Nil(t, v.MessageAllowedN(3))
+
+	// Downgrade keeps the previous limit until the next daily reset
+	v.SetTier(&user.Tier{ID: "ti_free", MessageLimit: 2})
+	require.Equal(t, int64(5), v.Limits().MessageLimit)
+	require.Nil(t, v.MessageAllowed())
+	require.Equal(t, int64(4), v.Stats().Messages)
+	v.ResetStats() // Too early, the previous limit still applies
+	require.Equal(t, int64(5), v.Limits().MessageLimit)
+
+	// After the daily reset, the new limit applies
+	clock.Add(24 * time.Hour)
+	v.ResetStats()
+	require.Equal(t, int64(2), v.Limits().MessageLimit)
+	require.Equal(t, int64(0), v.Stats().Messages)
+	require.Nil(t, v.MessageAllowedN(2))
+	require.Equal(t, errMessageLimitReached, v.MessageAllowed())
+
+	// An upgrade cancels a pending downgrade
+	v.SetTier(&user.Tier{ID: "ti_free", MessageLimit: 1})
+	require.Equal(t, int64(2), v.Limits().MessageLimit)
+	v.SetTier(&user.Tier{ID: "ti_pro", MessageLimit: 5})
+	require.Equal(t, int64(5), v.Limits().MessageLimit)
+	require.True(t, v.downgradeUntil.IsZero())
+
+	// In immediate mode (default), the new limit applies right away
+	conf.VisitorTierDowngradeMode = VisitorTierDowngradeModeImmediate
+	v.SetTier(&user.Tier{ID: "ti_free", MessageLimit: 2})
+	require.Equal(t, int64(2), v.Limits().MessageLimit)
+	require.Equal(t, errMessageLimitReached, v.MessageAllowed())
+}
+
+func TestVisitor_IngressAllowed(t *testing.T) {
+	conf := newTestConfig(t)
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.ingressLimiter)
+	require.Nil(t, v.IngressAllowed(1<<30)) // Disabled by default
+
+	conf.VisitorIngressDailyBandwidthLimit = 1000
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.IngressAllowed(0)) // Empty bodies are always allowed
+	require.Nil(t, v.IngressAllowed(800))
+	require.Equal(t, errIngressLimitReached, v.IngressAllowed(201))
+	require.Nil(t, v.IngressAllowed(200))
+	require.Equal(t, []string{visitorLimiterIngress}, v.ExceededLimits())
+}
+
+func TestVisitor_SetConfig_KeepsBandwidthUsage(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorIngressDailyBandwidthLimit = 1000
+	conf.VisitorAttachmentDailyBandwidthLimit = 1000
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.IngressAllowed(800))
+	require.Nil(t, v.BandwidthAllowed(800))
+
+	// Rebuilding the limiters (e.g. after a reload or tier change) does not hand out a fresh allowance
+	newConf := *conf
+	newConf.VisitorIngressDailyBandwidthLimit = 2000
+	newConf.VisitorAttachmentDailyBandwidthLimit = 2000
+	v.SetConfig(&newConf, true)
+	require.InDelta(t, 1200, v.ingressLimiter.Remaining(), 1)
+	require.InDelta(t, 1200, v.BandwidthRemaining(), 1)
+	require.Equal(t, errIngressLimitReached, v.IngressAllowed(1300))
+	require.Nil(t, v.IngressAllowed(1100))
+
+	// Resetting the limits does
+	v.ResetLimits()
+	require.Nil(t, v.IngressAllowed(2000))
+}
+
+func TestVisitor_RequestLimitExemptLoopback(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorRequestLimitBurst = 1
+	conf.VisitorMessageDailyLimit = 2
+	conf.VisitorRequestLimitExemptLoopback = true
+	for _, ip := range []string{"127.0.0.1", "::1", "::ffff:127.0.0.1"} {
+		v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr(ip), nil)
+		for i := 0; i < 10; i++ {
+			require.True(t, v.RequestAllowed())
+		}
+		require.Nil(t, v.MessageAllowedN(2))
+		require.Equal(t, errMessageLimitReached, v.MessageAllowed()) // Other limits still apply
+	}
+
+	// Other addresses, or disabled
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.True(t, v.RequestAllowed())
+	require.False(t, v.RequestAllowed())
+	conf.VisitorRequestLimitExemptLoopback = false
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("127.0.0.1"), nil)
+	require.True(t, v.RequestAllowed())
+	require.False(t, v.RequestAllowed())
+}
+
+func TestVisitor_EmailCircuitBreaker(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorEmailFailureThreshold = 2
+	conf.VisitorEmailFailureCooldown = time.Minute
+	clock := newTestClock()
+	v := newTestVisitorWithClock(t, conf, nil, clock)
+
+	// A single failure does not open the breaker, a success resets the count
+	require.Nil(t, v.EmailAllowed())
+	v.EmailSendFailed()
+	require.Nil(t, v.EmailAllowed())
+	v.EmailSendSucceeded()
+	require.Nil(t, v.EmailAllowed())
+	v.EmailSendFailed()
+	require.Nil(t, v.EmailAllowed())
+	v.EmailSendFailed()
+
+	// Open: e-mails are rejected and not counted
+	emails := v.Stats().Emails
+	require.Equal(t, errEmailUnavailable, v.EmailAllowed())
+	require.False(t, errors.Is(v.EmailAllowed(), errVisitorLimitReached))
+	require.Equal(t, emails, v.Stats().Emails)
+
+	// After the cooldown, only one probe is let through
+	clock.Add(time.Minute)
+	require.Nil(t, v.EmailAllowed())
+	require.Equal(t, errEmailUnavailable, v.EmailAllowed())
+	v.EmailSendFailed() // Probe failed, open again
+	clock.Add(30 * time.Second)
+	require.Equal(t, errEmailUnavailable, v.EmailAllowed())
+	clock.Add(31 * time.Second)
+	require.Nil(t, v.EmailAllowed())
+	v.EmailSendSucceeded() // Probe succeeded, closed
+	require.Nil(t, v.EmailAllowed())
+	require.Nil(t, v.EmailAllowed())
+}
+
+func TestVisitor_LimitBasis(t *testing.T) {
+	conf := newTestConfig(t)
+	messages := int64(10)
+	users := map[visitorLimitBasis]*user.User{
+		visitorLimitBasisIP:   nil,
+		visitorLimitBasisTier: {ID: "u_tier", Tier: &user.Tier{ID: "ti_pro", MessageLimit: 100}, Stats: &user.Stats{}, Billing: &user.Billing{}},
+		visitorLimitBasisUser: {ID: "u_override", Tier: &user.Tier{ID: "ti_pro", MessageLimit: 100}, MessagesLimitOverride: &messages, Stats: &user.Stats{}, Billing: &user.Billing{}},
+	}
+	for basis, u := range users {
+		v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), u)
+		require.Equal(t, basis, limitBasis(u))
+		require.Equal(t, basis, v.Basis())
+		require.Equal(t, basis, v.Limits().Basis)
+	}
+}
+
+func TestVisitor_SubSaturating(t *testing.T) {
+	require.Equal(t, int64(3), subSaturating(5, 2))
+	require.Equal(t, int64(-3), subSaturating(2, 5))
+	require.Equal(t, int64(math.MaxInt64), subSaturating(math.MaxInt64, -1))
+	require.Equal(t, int64(math.MaxInt64), subSaturating(1, math.MinInt64))
+	require.Equal(t, int64(math.MinInt64), subSaturating(math.MinInt64, 1))
+	require.Equal(t, int64(math.MinInt64), subSaturating(-2, math.MaxInt64))
+	require.Equal(t, int64(0), zeroIfNegative(subSaturating(math.MinInt64+1, math.MaxInt64)))
+	require.Equal(t, int64(math.MaxInt64), remainingOrUnlimited(math.MaxInt64, -5))
+}
+
+func TestVisitor_Info_MaxInt64Limits(t *testing.T) {
+	conf := newTestConfig(t)
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), &user.User{
+		ID: "u_123",
+		Tier: &user.Tier{
+			ID:                       "ti_huge",
+			MessageLimit:             math.MaxInt64,
+			EmailLimit:               math.MaxInt64,
+			CallLimit:                math.MaxInt64,
+			ReservationLimit:         math.MaxInt64,
+			AttachmentTotalSizeLimit: math.MaxInt64,
+			AttachmentFileSizeLimit:  math.MaxInt64,
+			AttachmentBandwidthLimit: math.MaxInt64,
+		},
+		Stats:   &user.Stats{Messages: 10, Emails: 2},
+		Billing: &user.Billing{},
+	})
+	require.Nil(t, v.MessageAllowed())
+	info, err := v.Info()
+	require.Nil(t, err)
+	require.GreaterOrEqual(t, info.Stats.MessagesRemaining, int64(0))
+	require.GreaterOrEqual(t, info.Stats.MessagesMonthlyRemaining, int64(0))
+	require.GreaterOrEqual(t, info.Stats.EmailsRemaining, int64(0))
+	require.GreaterOrEqual(t, info.Stats.CallsRemaining, int64(0))
+	require.GreaterOrEqual(t, info.Stats.AttachmentBandwidth, int64(0))
+	require.GreaterOrEqual(t, info.Stats.AttachmentTotalSizeRemaining, int64(0))
+	require.GreaterOrEqual(t, info.Stats.ReservationsRemaining, int64(0))
+	require.Equal(t, int64(math.MaxInt64), info.Stats.AttachmentTotalSizeRemaining)
+}
+
+func TestVisitor_NewTopicAllowed(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorDistinctTopicsDailyLimit = 2
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.NewTopicAllowed("topic1"))
+	require.Nil(t, v.NewTopicAllowed("topic2"))
+	require.Nil(t, v.NewTopicAllowed("topic1")) // Known topic
+	require.Equal(t, errTopicsLimitReached, v.NewTopicAllowed("topic3"))
+	require.ErrorIs(t, v.NewTopicAllowed("topic4"), errVisitorLimitReached)
+	require.Nil(t, v.NewTopicAllowed("topic2"))
+
+	// Set is cleared at the daily reset
+	v.topicsReset = time.Now().Add(-25 * time.Hour)
+	require.Nil(t, v.NewTopicAllowed("topic3"))
+	require.Equal(t, 1, len(v.topics))
+
+	// Users with a tier are exempt
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), &user.User{
+		ID:      "u_123",
+		Tier:    &user.Tier{ID: "ti_free", MessageLimit: 100},
+		Stats:   &user.Stats{},
+		Billing: &user.Billing{},
+	})
+	for i := 0; i < 5; i++ {
+		require.Nil(t, v.NewTopicAllowed(fmt.Sprintf("topic%d", i)))
+	}
+	require.Nil(t, v.topics)
+}
+
+func TestVisitor_AcquireDownload(t *testing.T) {
+	conf := newTestConfig(t)
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.downloadLimiter)
+	require.Nil(t, v.AcquireDownload()) // Disabled by default
+	v.ReleaseDownload()
+
+	conf.VisitorAttachmentDownloadConcurrency = 2
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.AcquireDownload())
+	require.Nil(t, v.AcquireDownload())
+	require.Equal(t, errDownloadLimitReached, v.AcquireDownload())
+	v.ReleaseDownload()
+	require.Nil(t, v.AcquireDownload())
+	v.ReleaseDownload()
+	v.ReleaseDownload()
+	require.Equal(t, int64(0), v.downloadLimiter.Value())
+}
+
+func TestVisitor_BillingAccountSharedMessages(t *testing.T) {
+	conf := newTestConfig(t)
+	billingLimiters := newBillingAccountLimiters()
+	newTeamUser := func(id, account string) *user.User {
+		return &user.User{
+			ID:             id,
+			Tier:           &user.Tier{ID: "ti_team", MessageLimit: 5},
+			Stats:          &user.Stats{},
+			Billing:        &user.Billing{},
+			BillingAccount: account,
+		}
+	}
+	phil := newVisitor(conf, newMemTestCache(t), nil, nil, billingLimiters, nil, netip.MustParseAddr("1.2.3.4"), newTeamUser("u_phil", "team-a"))
+	ben := newVisitor(conf, newMemTestCache(t), nil, nil, billingLimiters, nil, netip.MustParseAddr("1.2.3.5"), newTeamUser("u_ben", "team-a"))
+	solo := newVisitor(conf, newMemTestCache(t), nil, nil, billingLimiters, nil, netip.MustParseAddr("1.2.3.6"), newTeamUser("u_solo", ""))
+
+	// Both team members draw from the same pool
+	require.Nil(t, phil.MessageAllowedN(3))
+	require.Nil(t, ben.MessageAllowedN(2))
+	require.Equal(t, errMessageLimitReached, phil.MessageAllowed())
+	require.Equal(t, errMessageLimitReached, ben.MessageAllowed())
+	info, err := ben.Info()
+	require.Nil(t, err)
+	require.Equal(t, int64(5), info.Stats.Messages)
+	require.Equal(t, int64(0), info.Stats.MessagesRemaining)
+
+	// Users without billing account are not affected
+	require.Nil(t, solo.MessageAllowedN(5))
+	require.Equal(t, 1, billingLimiters.Len())
+
+	// New members join the existing pool
+	lisa := newVisitor(conf, newMemTestCache(t), nil, nil, billingLimiters, nil, netip.MustParseAddr("1.2.3.7"), newTeamUser("u_lisa", "team-a"))
+	require.Equal(t, errMessageLimitReached, lisa.MessageAllowed())
+
+	// Resetting the limits of one member does not reset the pool of the others
+	phil.noPersist = true
+	phil.ResetLimits()
+	require.Equal(t, errMessageLimitReached, ben.MessageAllowed())
+	require.Equal(t, int64(5), phil.Stats().Messages)
+	solo.noPersist = true
+	solo.ResetLimits()
+	require.Equal(t, int64(0), solo.Stats().Messages)
+}
+
+func TestVisitor_ReserveSubscriptionSlot(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorSubscriptionLimit = 2
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), &user.User{
+		ID:      "u_123",
+		Stats:   &user.Stats{},
+		Billing: &user.Billing{},
+	})
+
+	// Reconnect before the old connection is closed takes over the slot
+	releaseOld, err := v.ReserveSubscriptionSlot("conn1")
+	require.Nil(t, err)
+	releaseNew, err := v.ReserveSubscriptionSlot("conn1")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), v.subscriptionLimiter.Value())
+	releaseOld() // No-op, the slot was taken over
+	require.Equal(t, int64(1), v.subscriptionLimiter.Value())
+
+	// Reconnect after the connection was closed reclaims the held slot
+	releaseNew()
+	require.Equal(t, int64(1), v.subscriptionLimiter.Value())
+	release, err := v.ReserveSubscriptionSlot("conn1")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), v.subscriptionLimiter.Value())
+
+	// Other connection IDs count as usual
+	_, err = v.ReserveSubscriptionSlot("conn2")
+	require.Nil(t, err)
+	_, err = v.ReserveSubscriptionSlot("conn3")
+	require.Equal(t, errSubscriptionLimitReached, err)
+
+	// Held slots expire
+	release()
+	v.expireSubscriptionSlot("conn1", v.subscriptionSlots["conn1"])
+	require.Equal(t, int64(1), v.subscriptionLimiter.Value())
+	_, err = v.ReserveSubscriptionSlot("conn3")
+	require.Nil(t, err)
+
+	// Anonymous visitors cannot reclaim slots
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	release, err = v.ReserveSubscriptionSlot("conn1")
+	require.Nil(t, err)
+	release()
+	require.Equal(t, int64(0), v.subscriptionLimiter.Value())
+}
+
+func TestVisitor_EmailLimitPersist(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorEmailLimitBurst = 3
+	conf.VisitorEmailLimitPersist = true
+	cache := newMemTestCache(t)
+	v := newVisitor(conf, cache, nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Nil(t, v.EmailAllowed())
+	require.Nil(t, v.EmailAllowed())
+
+	// Restored after a restart, and the bucket stays drained
+	v = newVisitor(conf, cache, nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Equal(t, int64(2), v.Stats().Emails)
+	require.Nil(t, v.EmailAllowed())
+	require.Equal(t, errEmailLimitReached, v.EmailAllowed())
+
+	// Counts from before the last daily reset are not restored
+	require.Nil(t, cache.UpdateVisitorEmails("1.2.3.4", 3, lastStatsReset(conf, time.Now()).Add(-time.Second)))
+	v = newVisitor(conf, cache, nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Equal(t, int64(0), v.Stats().Emails)
+
+	// Disabled, not restored
+	require.Nil(t, cache.UpdateVisitorEmails("1.2.3.4", 3, time.Now()))
+	conf.VisitorEmailLimitPersist = false
+	v = newVisitor(conf, cache, nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	require.Equal(t, int64(0), v.Stats().Emails)
+}
+
+func TestVisitor_Clock_StaleAndFirebasePenalty(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorExpungeAfter = time.Hour
+	conf.FirebaseQuotaExceededPenaltyDuration = 20 * time.Minute
+	clock := newTestClock()
+	v := newTestVisitorWithClock(t, conf, nil, clock)
+
+	// Stale after VisitorExpungeAfter, Keepalive uses the clock too
+	clock.Add(59 * time.Minute)
+	require.False(t, v.Stale())
+	clock.Add(2 * time.Minute)
+	require.True(t, v.Stale())
+	v.Keepalive()
+	require.False(t, v.Stale())
+
+	// Firebase penalty expires, and is reset after another full window
+	v.FirebaseTemporarilyDeny()
+	require.Equal(t, errVisitorLimitReached, v.FirebaseAllowed())
+	info, err := v.Info()
+	require.Nil(t, err)
+	require.Equal(t, 20*time.Minute, info.Stats.FirebaseBackoff)
+	clock.Add(20*time.Minute + time.Second)
+	require.Nil(t, v.FirebaseAllowed())
+	v.FirebaseTemporarilyDeny()
+	require.Equal(t, 40*time.Minute, v.firebasePenalty) // Consecutive denial
+	clock.Add(81 * time.Minute)
+	v.FirebaseTemporarilyDeny()
+	require.Equal(t, 20*time.Minute, v.firebasePenalty) // Reset
+}
+
+// testClock is a fake clock that only moves when told to, see newTestVisitorWithClock
+type testClock struct {
+	now time.Time
+	mu  sync.Mutex
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Unix(1700000000, 0)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestVisitor_Boost(t *testing.T) {
+	conf := newTestConfig(t)
+	clock := newTestClock()
+	u := &user.User{ID: "u_123", Name: "phil", Tier: &user.Tier{MessageLimit: 10, EmailLimit: 5}, Stats: &user.Stats{}, Billing: &user.Billing{}}
+	v := newTestVisitorWithClock(t, conf, u, clock)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, v.MessageAllowed())
+	}
+	require.Equal(t, int64(10), v.Limits().MessageLimit)
+
+	// Boost doubles message and email limits, and keeps the messages sent so far
+	v.SetBoost(2, clock.Now().Add(24*time.Hour))
+	limits := v.Limits()
+	require.Equal(t, int64(20), limits.MessageLimit)
+	require.Equal(t, int64(10), limits.EmailLimit)
+	require.Equal(t, 2.0, limits.BoostMultiplier)
+	require.Equal(t, clock.Now().Add(24*time.Hour), limits.BoostExpires)
+	require.Equal(t, int64(3), v.Stats().Messages)
+	info, err := v.Info()
+	require.Nil(t, err)
+	require.Equal(t, int64(17), info.Stats.MessagesRemaining)
+
+	// Boost is ignored once it expired, and the limiters are rebuilt
+	clock.Add(25 * time.Hour)
+	v.Keepalive()
+	limits = v.Limits()
+	require.Equal(t, int64(10), limits.MessageLimit)
+	require.Equal(t, int64(5), limits.EmailLimit)
+	require.Zero(t, limits.BoostMultiplier)
+	require.True(t, v.boostExpires.IsZero())
+	require.Equal(t, int64(3), v.Stats().Messages)
+}
+
+func TestVisitor_Boost_Unlimited(t *testing.T) {
+	conf := newTestConfig(t)
+	clock := newTestClock()
+	u := &user.User{ID: "u_123", Name: "phil", Tier: &user.Tier{MessageLimit: 10, EmailLimit: 0}, Stats: &user.Stats{}, Billing: &user.Billing{}}
+	v := newTestVisitorWithClock(t, conf, u, clock)
+	v.SetBoost(2, clock.Now().Add(24*time.Hour))
+
+	// Unlimited email limit is not scaled by the boost
+	limits := v.Limits()
+	require.Equal(t, int64(20), limits.MessageLimit)
+	require.Equal(t, visitorUnlimited, limits.EmailLimit)
+	require.Equal(t, rate.Inf, limits.EmailLimitReplenish)
+	info, err := v.Info()
+	require.Nil(t, err)
+	require.Equal(t, visitorUnlimited, info.Limits.EmailLimit)
+	require.NotContains(t, v.Utilization(), visitorLimiterEmails)
+}
+
+func TestVisitor_Utilization(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.VisitorRequestLimitBurst = 10
+	conf.VisitorMessageDailyLimit = 4
+	conf.VisitorEmailLimitBurst = 2
+	conf.VisitorSubscriptionLimit = 5
+	conf.VisitorAttachmentDailyBandwidthLimit = 1000
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	utilization := v.Utilization()
+	require.Len(t, utilization, 5)
+	for _, percent := range utilization {
+		require.Equal(t, float64(0), percent)
+	}
+
+	for i := 0; i < 5; i++ {
+		require.True(t, v.RequestAllowed())
+	}
+	require.Nil(t, v.MessageAllowed())
+	require.Nil(t, v.EmailAllowed())
+	require.Nil(t, v.EmailAllowed())
+	require.Nil(t, v.SubscriptionAllowed())
+	require.Nil(t, v.BandwidthAllowed(250))
+	utilization = v.Utilization()
+	require.InDelta(t, 50, utilization[visitorLimiterRequest], 1)
+	require.Equal(t, float64(25), utilization[visitorLimiterMessages])
+	require.Equal(t, float64(100), utilization[visitorLimiterEmails])
+	require.Equal(t, float64(20), utilization[visitorLimiterSubscriptions])
+	require.InDelta(t, 25, utilization[visitorLimiterBandwidth], 1)
+
+	// Unlimited limits are omitted
+	u := &user.User{ID: "u_123", Name: "phil", Tier: &user.Tier{MessageLimit: 0, EmailLimit: 0}, Stats: &user.Stats{}, Billing: &user.Billing{}}
+	v = newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), u)
+	utilization = v.Utilization()
+	require.NotContains(t, utilization, visitorLimiterMessages)
+	require.NotContains(t, utilization, visitorLimiterEmails)
+	require.Contains(t, utilization, visitorLimiterRequest)
+}
+
+// newTestVisitorWithClock creates an anonymous (or user) visitor that uses the given fake clock wherever it
+// reads the current time (except for rate.Limiter based limiters), so that expiry can be tested without sleeping
+func newTestVisitorWithClock(t *testing.T, conf *Config, u *user.User, clock *testClock) *visitor {
+	v := newVisitor(conf, newMemTestCache(t), nil, nil, nil, nil, netip.MustParseAddr("1.2.3.4"), u)
+	v.clock = clock.Now
+	v.created, v.seen = clock.Now(), clock.Now()
+	return v
+}
@@ -61,6 +61,14 @@ const (
 			attachment_total_size_limit INT NOT NULL,
 			attachment_expiry_duration INT NOT NULL,
 			attachment_bandwidth_limit INT NOT NULL,
+			request_limit_burst INT NOT NULL DEFAULT (0),
+			subscription_limit INT NOT NULL DEFAULT (0),
+			emails_limit_burst INT NOT NULL DEFAULT (0),
+			messages_monthly_limit INT NOT NULL DEFAULT (0),
+			firebase_disabled INT NOT NULL DEFAULT (0),
+			attachment_messages_limit INT NOT NULL DEFAULT (0),
+			gateway_messages_limit INT NOT NULL DEFAULT (0),
+			urgent_messages_limit INT NOT NULL DEFAULT (0),
 			stripe_monthly_price_id TEXT,
 			stripe_yearly_price_id TEXT
 		);
@@ -78,6 +86,20 @@ const (
 			stats_messages INT NOT NULL DEFAULT (0),
 			stats_emails INT NOT NULL DEFAULT (0),
 			stats_calls INT NOT NULL DEFAULT (0),
+			stats_firebase INT NOT NULL DEFAULT (0),
+			stats_request_tokens REAL NOT NULL DEFAULT (0),
+			stats_request_tokens_updated INT NOT NULL DEFAULT (0),
+			stats_messages_monthly INT NOT NULL DEFAULT (0),
+			stats_messages_monthly_period TEXT NOT NULL DEFAULT (''),
+			messages_limit_override INT,
+			emails_limit_override INT,
+			calls_limit_override INT,
+			attachment_total_size_limit_override INT,
+			billing_account TEXT,
+			paused INT NOT NULL DEFAULT (0),
+			paused_until INT NOT NULL DEFAULT (0),
+			boost_multiplier REAL NOT NULL DEFAULT (0),
+			boost_expires INT NOT NULL DEFAULT (0),
 			stripe_customer_id TEXT,
 			stripe_subscription_id TEXT,
 			stripe_subscription_status TEXT,
@@ -108,6 +130,8 @@ const (
 			last_access INT NOT NULL,
 			last_origin TEXT NOT NULL,
 			expires INT NOT NULL,
+			limit_profile TEXT NOT NULL DEFAULT '',
+			exempt INT NOT NULL DEFAULT (0),
 			PRIMARY KEY (user_id, token),
 			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
 		);
@@ -132,26 +156,26 @@ const (
 	`
 
 	selectUserByIDQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.created, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_firebase, u.stats_request_tokens, u.stats_request_tokens_updated, u.stats_messages_monthly, u.stats_messages_monthly_period, u.messages_limit_override, u.emails_limit_override, u.calls_limit_override, u.attachment_total_size_limit_override, u.billing_account, u.paused, u.paused_until, u.boost_multiplier, u.boost_expires, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.request_limit_burst, t.subscription_limit, t.emails_limit_burst, t.messages_monthly_limit, t.firebase_disabled, t.attachment_messages_limit, t.gateway_messages_limit, t.urgent_messages_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM user u
 		LEFT JOIN tier t on t.id = u.tier_id
 		WHERE u.id = ?
 	`
 	selectUserByNameQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.created, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_firebase, u.stats_request_tokens, u.stats_request_tokens_updated, u.stats_messages_monthly, u.stats_messages_monthly_period, u.messages_limit_override, u.emails_limit_override, u.calls_limit_override, u.attachment_total_size_limit_override, u.billing_account, u.paused, u.paused_until, u.boost_multiplier, u.boost_expires, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.request_limit_burst, t.subscription_limit, t.emails_limit_burst, t.messages_monthly_limit, t.firebase_disabled, t.attachment_messages_limit, t.gateway_messages_limit, t.urgent_messages_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM user u
 		LEFT JOIN tier t on t.id = u.tier_id
 		WHERE user = ?
 	`
 	selectUserByTokenQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.created, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_firebase, u.stats_request_tokens, u.stats_request_tokens_updated, u.stats_messages_monthly, u.stats_messages_monthly_period, u.messages_limit_override, u.emails_limit_override, u.calls_limit_override, u.attachment_total_size_limit_override, u.billing_account, u.paused, u.paused_until, u.boost_multiplier, u.boost_expires, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.request_limit_burst, t.subscription_limit, t.emails_limit_burst, t.messages_monthly_limit, t.firebase_disabled, t.attachment_messages_limit, t.gateway_messages_limit, t.urgent_messages_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM user u
 		JOIN user_token tk on u.id = tk.user_id
 		LEFT JOIN tier t on t.id = u.tier_id
 		WHERE tk.token = ? AND (tk.expires = 0 OR tk.expires >= ?)
 	`
 	selectUserByStripeCustomerIDQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.created, u.stats_messages, u.stats_emails, u.stats_calls, u.stats_firebase, u.stats_request_tokens, u.stats_request_tokens_updated, u.stats_messages_monthly, u.stats_messages_monthly_period, u.messages_limit_override, u.emails_limit_override, u.calls_limit_override, u.attachment_total_size_limit_override, u.billing_account, u.paused, u.paused_until, u.boost_multiplier, u.boost_expires, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.request_limit_burst, t.subscription_limit, t.emails_limit_burst, t.messages_monthly_limit, t.firebase_disabled, t.attachment_messages_limit, t.gateway_messages_limit, t.urgent_messages_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM user u
 		LEFT JOIN tier t on t.id = u.tier_id
 		WHERE u.stripe_customer_id = ?
@@ -178,15 +202,16 @@ const (
 				ELSE 2
 			END, user
 	`
-	selectUserCountQuery         = `SELECT COUNT(*) FROM user`
-	updateUserPassQuery          = `UPDATE user SET pass = ? WHERE user = ?`
-	updateUserRoleQuery          = `UPDATE user SET role = ? WHERE user = ?`
-	updateUserPrefsQuery         = `UPDATE user SET prefs = ? WHERE id = ?`
-	updateUserStatsQuery         = `UPDATE user SET stats_messages = ?, stats_emails = ?, stats_calls = ? WHERE id = ?`
-	updateUserStatsResetAllQuery = `UPDATE user SET stats_messages = 0, stats_emails = 0, stats_calls = 0`
-	updateUserDeletedQuery       = `UPDATE user SET deleted = ? WHERE id = ?`
-	deleteUsersMarkedQuery       = `DELETE FROM user WHERE deleted < ?`
-	deleteUserQuery              = `DELETE FROM user WHERE user = ?`
+	selectUserCountQuery             = `SELECT COUNT(*) FROM user`
+	updateUserPassQuery              = `UPDATE user SET pass = ? WHERE user = ?`
+	updateUserRoleQuery              = `UPDATE user SET role = ? WHERE user = ?`
+	updateUserPrefsQuery             = `UPDATE user SET prefs = ? WHERE id = ?`
+	updateUserStatsQuery             = `UPDATE user SET stats_messages = ?, stats_emails = ?, stats_calls = ?, stats_firebase = ?, stats_request_tokens = ?, stats_request_tokens_updated = ?, stats_messages_monthly = ?, stats_messages_monthly_period = ? WHERE id = ?`
+	updateUserStatsResetAllQuery     = `UPDATE user SET stats_messages = 0, stats_emails = 0, stats_calls = 0, stats_firebase = 0`
+	updateUserStatsResetMonthlyQuery = `UPDATE user SET stats_messages_monthly = 0`
+	updateUserDeletedQuery           = `UPDATE user SET deleted = ? WHERE id = ?`
+	deleteUsersMarkedQuery           = `DELETE FROM user WHERE deleted < ?`
+	deleteUserQuery                  = `DELETE FROM user WHERE user = ?`
 
 	upsertUserAccessQuery = `
 		INSERT INTO user_access (user_id, topic, read, write, owner_user_id)
@@ -251,11 +276,14 @@ const (
   	`
 
 	selectTokenCountQuery      = `SELECT COUNT(*) FROM user_token WHERE user_id = ?`
-	selectTokensQuery          = `SELECT token, label, last_access, last_origin, expires FROM user_token WHERE user_id = ?`
-	selectTokenQuery           = `SELECT token, label, last_access, last_origin, expires FROM user_token WHERE user_id = ? AND token = ?`
+	selectTokensQuery          = `SELECT token, label, last_access, last_origin, expires, limit_profile, exempt FROM user_token WHERE user_id = ?`
+	selectTokenQuery           = `SELECT token, label, last_access, last_origin, expires, limit_profile, exempt FROM user_token WHERE user_id = ? AND token = ?`
+	selectTokenProfileQuery    = `SELECT limit_profile, exempt FROM user_token WHERE token = ?`
 	insertTokenQuery           = `INSERT INTO user_token (user_id, token, label, last_access, last_origin, expires) VALUES (?, ?, ?, ?, ?, ?)`
 	updateTokenExpiryQuery     = `UPDATE user_token SET expires = ? WHERE user_id = ? AND token = ?`
 	updateTokenLabelQuery      = `UPDATE user_token SET label = ? WHERE user_id = ? AND token = ?`
+	updateTokenProfileQuery    = `UPDATE user_token SET limit_profile = ? WHERE user_id = ? AND token = ?`
+	updateTokenExemptQuery     = `UPDATE user_token SET exempt = ? WHERE user_id = ? AND token = ?`
 	updateTokenLastAccessQuery = `UPDATE user_token SET last_access = ?, last_origin = ? WHERE token = ?`
 	deleteTokenQuery           = `DELETE FROM user_token WHERE user_id = ? AND token = ?`
 	deleteAllTokenQuery        = `DELETE FROM user_token WHERE user_id = ?`
@@ -277,31 +305,36 @@ const (
 	deletePhoneNumberQuery  = `DELETE FROM user_phone WHERE user_id = ? AND phone_number = ?`
 
 	insertTierQuery = `
-		INSERT INTO tier (id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO tier (id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, request_limit_burst, subscription_limit, emails_limit_burst, messages_monthly_limit, firebase_disabled, attachment_messages_limit, gateway_messages_limit, urgent_messages_limit, stripe_monthly_price_id, stripe_yearly_price_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	updateTierQuery = `
 		UPDATE tier
-		SET name = ?, messages_limit = ?, messages_expiry_duration = ?, emails_limit = ?, calls_limit = ?, reservations_limit = ?, attachment_file_size_limit = ?, attachment_total_size_limit = ?, attachment_expiry_duration = ?, attachment_bandwidth_limit = ?, stripe_monthly_price_id = ?, stripe_yearly_price_id = ?
+		SET name = ?, messages_limit = ?, messages_expiry_duration = ?, emails_limit = ?, calls_limit = ?, reservations_limit = ?, attachment_file_size_limit = ?, attachment_total_size_limit = ?, attachment_expiry_duration = ?, attachment_bandwidth_limit = ?, request_limit_burst = ?, subscription_limit = ?, emails_limit_burst = ?, messages_monthly_limit = ?, firebase_disabled = ?, attachment_messages_limit = ?, gateway_messages_limit = ?, urgent_messages_limit = ?, stripe_monthly_price_id = ?, stripe_yearly_price_id = ?
 		WHERE code = ?
 	`
 	selectTiersQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, request_limit_burst, subscription_limit, emails_limit_burst, messages_monthly_limit, firebase_disabled, attachment_messages_limit, gateway_messages_limit, urgent_messages_limit, stripe_monthly_price_id, stripe_yearly_price_id
 		FROM tier
 	`
 	selectTierByCodeQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, request_limit_burst, subscription_limit, emails_limit_burst, messages_monthly_limit, firebase_disabled, attachment_messages_limit, gateway_messages_limit, urgent_messages_limit, stripe_monthly_price_id, stripe_yearly_price_id
 		FROM tier
 		WHERE code = ?
 	`
 	selectTierByPriceIDQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, request_limit_burst, subscription_limit, emails_limit_burst, messages_monthly_limit, firebase_disabled, attachment_messages_limit, gateway_messages_limit, urgent_messages_limit, stripe_monthly_price_id, stripe_yearly_price_id
 		FROM tier
 		WHERE (stripe_monthly_price_id = ? OR stripe_yearly_price_id = ?)
 	`
 	updateUserTierQuery = `UPDATE user SET tier_id = (SELECT id FROM tier WHERE code = ?) WHERE user = ?`
 	deleteUserTierQuery = `UPDATE user SET tier_id = null WHERE user = ?`
-	deleteTierQuery     = `DELETE FROM tier WHERE code = ?`
+
+	updateUserLimitOverridesQuery = `UPDATE user SET messages_limit_override = ?, emails_limit_override = ?, calls_limit_override = ?, attachment_total_size_limit_override = ? WHERE user = ?`
+	updateUserBillingAccountQuery = `UPDATE user SET billing_account = ? WHERE user = ?`
+	updateUserPausedQuery         = `UPDATE user SET paused = ?, paused_until = ? WHERE user = ?`
+	updateUserBoostQuery          = `UPDATE user SET boost_multiplier = ?, boost_expires = ? WHERE user = ?`
+	deleteTierQuery               = `DELETE FROM tier WHERE code = ?`
 
 	updateBillingQuery = `
 		UPDATE user
@@ -312,7 +345,7 @@ const (
 
 // Schema management queries
 const (
-	currentSchemaVersion     = 5
+	currentSchemaVersion     = 22
 	insertSchemaVersion      = `INSERT INTO schemaVersion VALUES (1, ?)`
 	updateSchemaVersion      = `UPDATE schemaVersion SET version = ? WHERE id = 1`
 	selectSchemaVersionQuery = `SELECT version FROM schemaVersion WHERE id = 1`
@@ -427,14 +460,123 @@ const (
 	migrate4To5UpdateQueries = `
 		UPDATE user_access SET topic = REPLACE(topic, '_', '\_');
 	`
+
+	// 5 -> 6
+	migrate5To6UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN request_limit_burst INT NOT NULL DEFAULT (0);
+	`
+
+	// 6 -> 7
+	migrate6To7UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN subscription_limit INT NOT NULL DEFAULT (0);
+	`
+
+	// 7 -> 8
+	migrate7To8UpdateQueries = `
+		ALTER TABLE user ADD COLUMN stats_request_tokens REAL NOT NULL DEFAULT (0);
+		ALTER TABLE user ADD COLUMN stats_request_tokens_updated INT NOT NULL DEFAULT (0);
+	`
+
+	// 8 -> 9
+	migrate8To9UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN emails_limit_burst INT NOT NULL DEFAULT (0);
+	`
+
+	// 9 -> 10
+	migrate9To10UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN messages_monthly_limit INT NOT NULL DEFAULT (0);
+		ALTER TABLE user ADD COLUMN stats_messages_monthly INT NOT NULL DEFAULT (0);
+		ALTER TABLE user ADD COLUMN stats_messages_monthly_period TEXT NOT NULL DEFAULT ('');
+	`
+
+	// 10 -> 11
+	migrate10To11UpdateQueries = `
+		ALTER TABLE user ADD COLUMN messages_limit_override INT;
+		ALTER TABLE user ADD COLUMN emails_limit_override INT;
+		ALTER TABLE user ADD COLUMN calls_limit_override INT;
+	`
+
+	// 11 -> 12
+	migrate11To12UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN firebase_disabled INT NOT NULL DEFAULT (0);
+	`
+
+	// 12 -> 13
+	migrate12To13UpdateQueries = `
+		ALTER TABLE user ADD COLUMN billing_account TEXT;
+	`
+
+	// 13 -> 14
+	migrate13To14UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN attachment_messages_limit INT NOT NULL DEFAULT (0);
+	`
+
+	// 14 -> 15
+	migrate14To15UpdateQueries = `
+		ALTER TABLE user ADD COLUMN paused INT NOT NULL DEFAULT (0);
+		ALTER TABLE user ADD COLUMN paused_until INT NOT NULL DEFAULT (0);
+	`
+
+	// 15 -> 16
+	migrate15To16UpdateQueries = `
+		ALTER TABLE user ADD COLUMN attachment_total_size_limit_override INT;
+	`
+
+	// 16 -> 17
+	migrate16To17UpdateQueries = `
+		ALTER TABLE user_token ADD COLUMN limit_profile TEXT NOT NULL DEFAULT '';
+	`
+
+	// 17 -> 18
+	migrate17To18UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN gateway_messages_limit INT NOT NULL DEFAULT (0);
+	`
+
+	// 18 -> 19
+	migrate18To19UpdateQueries = `
+		ALTER TABLE user ADD COLUMN stats_firebase INT NOT NULL DEFAULT (0);
+	`
+
+	// 19 -> 20
+	migrate19To20UpdateQueries = `
+		ALTER TABLE user ADD COLUMN boost_multiplier REAL NOT NULL DEFAULT (0);
+		ALTER TABLE user ADD COLUMN boost_expires INT NOT NULL DEFAULT (0);
+	`
+
+	// 20 -> 21
+	migrate20To21UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN urgent_messages_limit INT NOT NULL DEFAULT (0);
+	`
+
+	// 21 -> 22
+	migrate21To22UpdateQueries = `
+		ALTER TABLE user_token ADD COLUMN exempt INT NOT NULL DEFAULT (0);
+	`
 )
 
 var (
 	migrations = map[int]func(db *sql.DB) error{
-		1: migrateFrom1,
-		2: migrateFrom2,
-		3: migrateFrom3,
-		4: migrateFrom4,
+		1:  migrateFrom1,
+		2:  migrateFrom2,
+		3:  migrateFrom3,
+		4:  migrateFrom4,
+		5:  migrateFrom5,
+		6:  migrateFrom6,
+		7:  migrateFrom7,
+		8:  migrateFrom8,
+		9:  migrateFrom9,
+		10: migrateFrom10,
+		11: migrateFrom11,
+		12: migrateFrom12,
+		13: migrateFrom13,
+		14: migrateFrom14,
+		15: migrateFrom15,
+		16: migrateFrom16,
+		17: migrateFrom17,
+		18: migrateFrom18,
+		19: migrateFrom19,
+		20: migrateFrom20,
+		21: migrateFrom21,
 	}
 )
 
@@ -498,7 +640,8 @@ func (a *Manager) Authenticate(username, password string) (*User, error) {
 }
 
 // AuthenticateToken checks if the token exists and returns the associated User if it does.
-// The method sets the User.Token value to the token that was used for authentication.
+// The method sets the User.Token value to the token that was used for authentication, and
+// User.TokenLimitProfile and User.TokenExempt to the token's limit profile (if any) and exemption.
 func (a *Manager) AuthenticateToken(token string) (*User, error) {
 	if len(token) != tokenLength {
 		return nil, ErrUnauthenticated
@@ -509,9 +652,28 @@ func (a *Manager) AuthenticateToken(token string) (*User, error) {
 		return nil, ErrUnauthenticated
 	}
 	user.Token = token
+	user.TokenLimitProfile, user.TokenExempt, err = a.tokenLimits(token)
+	if err != nil {
+		return nil, err
+	}
 	return user, nil
 }
 
+func (a *Manager) tokenLimits(token string) (profile string, exempt bool, err error) {
+	rows, err := a.db.Query(selectTokenProfileQuery, token)
+	if err != nil {
+		return "", false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return "", false, ErrTokenNotFound
+	}
+	if err := rows.Scan(&profile, &exempt); err != nil {
+		return "", false, err
+	}
+	return profile, exempt, rows.Err()
+}
+
 // CreateToken generates a random token for the given user and returns it. The token expires
 // after a fixed duration unless ChangeToken is called. This function also prunes tokens for the
 // given user, if there are too many of them.
@@ -588,12 +750,13 @@ func (a *Manager) Token(userID, token string) (*Token, error) {
 }
 
 func (a *Manager) readToken(rows *sql.Rows) (*Token, error) {
-	var token, label, lastOrigin string
+	var token, label, lastOrigin, limitProfile string
 	var lastAccess, expires int64
+	var exempt bool
 	if !rows.Next() {
 		return nil, ErrTokenNotFound
 	}
-	if err := rows.Scan(&token, &label, &lastAccess, &lastOrigin, &expires); err != nil {
+	if err := rows.Scan(&token, &label, &lastAccess, &lastOrigin, &expires, &limitProfile, &exempt); err != nil {
 		return nil, err
 	} else if err := rows.Err(); err != nil {
 		return nil, err
@@ -603,11 +766,13 @@ func (a *Manager) readToken(rows *sql.Rows) (*Token, error) {
 		lastOriginIP = netip.IPv4Unspecified()
 	}
 	return &Token{
-		Value:      token,
-		Label:      label,
-		LastAccess: time.Unix(lastAccess, 0),
-		LastOrigin: lastOriginIP,
-		Expires:    time.Unix(expires, 0),
+		Value:        token,
+		Label:        label,
+		LastAccess:   time.Unix(lastAccess, 0),
+		LastOrigin:   lastOriginIP,
+		Expires:      time.Unix(expires, 0),
+		LimitProfile: limitProfile,
+		Exempt:       exempt,
 	}, nil
 }
 
@@ -637,6 +802,40 @@ func (a *Manager) ChangeToken(userID, token string, label *string, expires *time
 	return a.Token(userID, token)
 }
 
+// ChangeTokenLimitProfile sets the limit profile of a token, i.e. the name of one of the limit presets defined in
+// the server config. An empty profile removes the profile, so that the usual tier (or IP-based) limits apply.
+func (a *Manager) ChangeTokenLimitProfile(userID, token, profile string) error {
+	if token == "" {
+		return errNoTokenProvided
+	}
+	res, err := a.db.Exec(updateTokenProfileQuery, profile, userID, token)
+	if err != nil {
+		return err
+	} else if rows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// ChangeTokenExempt marks a token as a service token, whose requests are exempt from all limits (but which does
+// not have any other privileges than the user). This is meant for internal automation, and must be set explicitly.
+func (a *Manager) ChangeTokenExempt(userID, token string, exempt bool) error {
+	if token == "" {
+		return errNoTokenProvided
+	}
+	res, err := a.db.Exec(updateTokenExemptQuery, exempt, userID, token)
+	if err != nil {
+		return err
+	} else if rows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
 // RemoveToken deletes the token defined in User.Token
 func (a *Manager) RemoveToken(userID, token string) error {
 	if token == "" {
@@ -737,6 +936,19 @@ func (a *Manager) ResetStats() error {
 	return nil
 }
 
+// ResetMonthlyStats resets the monthly message count of all users in the user database. This touches all users.
+func (a *Manager) ResetMonthlyStats() error {
+	a.mu.Lock() // Includes database query to avoid races!
+	defer a.mu.Unlock()
+	if _, err := a.db.Exec(updateUserStatsResetMonthlyQuery); err != nil {
+		return err
+	}
+	for _, stats := range a.statsQueue {
+		stats.MessagesMonthly = 0
+	}
+	return nil
+}
+
 // EnqueueUserStats adds the user to a queue which writes out user stats (messages, emails, ..) in
 // batches at a regular interval
 func (a *Manager) EnqueueUserStats(userID string, stats *Stats) {
@@ -785,13 +997,20 @@ func (a *Manager) writeUserStatsQueue() error {
 		log.
 			Tag(tag).
 			Fields(log.Context{
-				"user_id":        userID,
-				"messages_count": update.Messages,
-				"emails_count":   update.Emails,
-				"calls_count":    update.Calls,
+				"user_id":                userID,
+				"messages_count":         update.Messages,
+				"emails_count":           update.Emails,
+				"calls_count":            update.Calls,
+				"firebase_count":         update.Firebase,
+				"request_tokens":         update.RequestTokens,
+				"messages_monthly_count": update.MessagesMonthly,
 			}).
 			Trace("Updating stats for user %s", userID)
-		if _, err := tx.Exec(updateUserStatsQuery, update.Messages, update.Emails, update.Calls, userID); err != nil {
+		var requestTokensUpdated int64
+		if !update.RequestTokensUpdated.IsZero() {
+			requestTokensUpdated = update.RequestTokensUpdated.Unix()
+		}
+		if _, err := tx.Exec(updateUserStatsQuery, update.Messages, update.Emails, update.Calls, update.Firebase, update.RequestTokens, requestTokensUpdated, update.MessagesMonthly, update.MessagesMonthlyPeriod, userID); err != nil {
 			return err
 		}
 	}
@@ -1004,13 +1223,16 @@ func (a *Manager) userByToken(token string) (*User, error) {
 func (a *Manager) readUser(rows *sql.Rows) (*User, error) {
 	defer rows.Close()
 	var id, username, hash, role, prefs, syncTopic string
-	var stripeCustomerID, stripeSubscriptionID, stripeSubscriptionStatus, stripeSubscriptionInterval, stripeMonthlyPriceID, stripeYearlyPriceID, tierID, tierCode, tierName sql.NullString
-	var messages, emails, calls int64
-	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit, stripeSubscriptionPaidUntil, stripeSubscriptionCancelAt, deleted sql.NullInt64
+	var billingAccount, stripeCustomerID, stripeSubscriptionID, stripeSubscriptionStatus, stripeSubscriptionInterval, stripeMonthlyPriceID, stripeYearlyPriceID, tierID, tierCode, tierName sql.NullString
+	var created, messages, emails, calls, firebase, requestTokensUpdated, messagesMonthly, pausedUntil, boostExpires int64
+	var paused bool
+	var requestTokens, boostMultiplier float64
+	var messagesMonthlyPeriod string
+	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit, requestLimitBurst, subscriptionLimit, emailsLimitBurst, messagesMonthlyLimit, messagesLimitOverride, emailsLimitOverride, callsLimitOverride, attachmentTotalSizeLimitOverride, firebaseDisabled, attachmentMessagesLimit, gatewayMessagesLimit, urgentMessagesLimit, stripeSubscriptionPaidUntil, stripeSubscriptionCancelAt, deleted sql.NullInt64
 	if !rows.Next() {
 		return nil, ErrUserNotFound
 	}
-	if err := rows.Scan(&id, &username, &hash, &role, &prefs, &syncTopic, &messages, &emails, &calls, &stripeCustomerID, &stripeSubscriptionID, &stripeSubscriptionStatus, &stripeSubscriptionInterval, &stripeSubscriptionPaidUntil, &stripeSubscriptionCancelAt, &deleted, &tierID, &tierCode, &tierName, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
+	if err := rows.Scan(&id, &username, &hash, &role, &prefs, &syncTopic, &created, &messages, &emails, &calls, &firebase, &requestTokens, &requestTokensUpdated, &messagesMonthly, &messagesMonthlyPeriod, &messagesLimitOverride, &emailsLimitOverride, &callsLimitOverride, &attachmentTotalSizeLimitOverride, &billingAccount, &paused, &pausedUntil, &boostMultiplier, &boostExpires, &stripeCustomerID, &stripeSubscriptionID, &stripeSubscriptionStatus, &stripeSubscriptionInterval, &stripeSubscriptionPaidUntil, &stripeSubscriptionCancelAt, &deleted, &tierID, &tierCode, &tierName, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &requestLimitBurst, &subscriptionLimit, &emailsLimitBurst, &messagesMonthlyLimit, &firebaseDisabled, &attachmentMessagesLimit, &gatewayMessagesLimit, &urgentMessagesLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
 		return nil, err
 	} else if err := rows.Err(); err != nil {
 		return nil, err
@@ -1022,10 +1244,16 @@ func (a *Manager) readUser(rows *sql.Rows) (*User, error) {
 		Role:      Role(role),
 		Prefs:     &Prefs{},
 		SyncTopic: syncTopic,
+		Created:   time.Unix(created, 0),
 		Stats: &Stats{
-			Messages: messages,
-			Emails:   emails,
-			Calls:    calls,
+			Messages:              messages,
+			Emails:                emails,
+			Calls:                 calls,
+			Firebase:              firebase,
+			RequestTokens:         requestTokens,
+			RequestTokensUpdated:  time.Unix(requestTokensUpdated, 0), // May be zero
+			MessagesMonthly:       messagesMonthly,
+			MessagesMonthlyPeriod: messagesMonthlyPeriod,
 		},
 		Billing: &Billing{
 			StripeCustomerID:            stripeCustomerID.String,                                          // May be empty
@@ -1035,7 +1263,16 @@ func (a *Manager) readUser(rows *sql.Rows) (*User, error) {
 			StripeSubscriptionPaidUntil: time.Unix(stripeSubscriptionPaidUntil.Int64, 0),                  // May be zero
 			StripeSubscriptionCancelAt:  time.Unix(stripeSubscriptionCancelAt.Int64, 0),                   // May be zero
 		},
-		Deleted: deleted.Valid,
+		MessagesLimitOverride:            nullInt64Ptr(messagesLimitOverride),
+		EmailsLimitOverride:              nullInt64Ptr(emailsLimitOverride),
+		CallsLimitOverride:               nullInt64Ptr(callsLimitOverride),
+		AttachmentTotalSizeLimitOverride: nullInt64Ptr(attachmentTotalSizeLimitOverride),
+		BillingAccount:                   billingAccount.String, // May be empty
+		Paused:                           paused,
+		PausedUntil:                      time.Unix(pausedUntil, 0), // May be zero
+		BoostMultiplier:                  boostMultiplier,
+		BoostExpires:                     time.Unix(boostExpires, 0), // May be zero
+		Deleted:                          deleted.Valid,
 	}
 	if err := json.Unmarshal([]byte(prefs), user.Prefs); err != nil {
 		return nil, err
@@ -1055,6 +1292,14 @@ func (a *Manager) readUser(rows *sql.Rows) (*User, error) {
 			AttachmentTotalSizeLimit: attachmentTotalSizeLimit.Int64,
 			AttachmentExpiryDuration: time.Duration(attachmentExpiryDuration.Int64) * time.Second,
 			AttachmentBandwidthLimit: attachmentBandwidthLimit.Int64,
+			RequestLimitBurst:        requestLimitBurst.Int64,
+			SubscriptionLimit:        subscriptionLimit.Int64,
+			EmailLimitBurst:          emailsLimitBurst.Int64,
+			MessageMonthlyLimit:      messagesMonthlyLimit.Int64,
+			FirebaseDisabled:         firebaseDisabled.Int64 == 1,
+			AttachmentMessagesLimit:  attachmentMessagesLimit.Int64,
+			GatewayMessagesLimit:     gatewayMessagesLimit.Int64,
+			UrgentMessagesLimit:      urgentMessagesLimit.Int64,
 			StripeMonthlyPriceID:     stripeMonthlyPriceID.String, // May be empty
 			StripeYearlyPriceID:      stripeYearlyPriceID.String,  // May be empty
 		}
@@ -1249,6 +1494,88 @@ func (a *Manager) ResetTier(username string) error {
 	return err
 }
 
+// ChangeLimitOverrides sets the per-user limit overrides of the given user. Overrides take precedence over the
+// limits of the user's tier. A nil value removes the override, i.e. the tier (or config) limit is used. Since there
+// is no point in a zero attachment storage limit, a zero attachmentTotalSizeLimit removes the override as well.
+func (a *Manager) ChangeLimitOverrides(username string, messagesLimit, emailsLimit, callsLimit, attachmentTotalSizeLimit *int64) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument
+	}
+	if attachmentTotalSizeLimit != nil && *attachmentTotalSizeLimit <= 0 {
+		attachmentTotalSizeLimit = nil
+	}
+	result, err := a.db.Exec(updateUserLimitOverridesQuery, nullInt64FromPtr(messagesLimit), nullInt64FromPtr(emailsLimit), nullInt64FromPtr(callsLimit), nullInt64FromPtr(attachmentTotalSizeLimit), username)
+	if err != nil {
+		return err
+	} else if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ChangeBillingAccount sets the billing account of the given user. Users with the same billing account share one
+// pool of messages (see User.BillingAccount). An empty account removes the user from its billing account.
+func (a *Manager) ChangeBillingAccount(username, account string) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument
+	}
+	result, err := a.db.Exec(updateUserBillingAccountQuery, nullString(account), username)
+	if err != nil {
+		return err
+	} else if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ChangePaused pauses or unpauses the given user (see User.Paused). If until is non-zero, the user is automatically
+// unpaused after that time.
+func (a *Manager) ChangePaused(username string, paused bool, until time.Time) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument
+	}
+	var pausedUntil int64
+	if paused && !until.IsZero() {
+		pausedUntil = until.Unix()
+	}
+	result, err := a.db.Exec(updateUserPausedQuery, paused, pausedUntil, username)
+	if err != nil {
+		return err
+	} else if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ChangeBoost grants the given user a temporary limit boost (see User.BoostMultiplier), which expires at the
+// given time. A multiplier of zero removes the boost.
+func (a *Manager) ChangeBoost(username string, multiplier float64, expires time.Time) error {
+	if !AllowedUsername(username) || multiplier < 0 {
+		return ErrInvalidArgument
+	}
+	var boostExpires int64
+	if multiplier > 0 {
+		boostExpires = expires.Unix()
+	} else {
+		multiplier = 0
+	}
+	result, err := a.db.Exec(updateUserBoostQuery, multiplier, boostExpires, username)
+	if err != nil {
+		return err
+	} else if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
 func (a *Manager) checkReservationsLimit(username string, reservationsLimit int64) error {
 	u, err := a.User(username)
 	if err != nil {
@@ -1382,7 +1709,7 @@ func (a *Manager) AddTier(tier *Tier) error {
 	if tier.ID == "" {
 		tier.ID = util.RandomStringPrefix(tierIDPrefix, tierIDLength)
 	}
-	if _, err := a.db.Exec(insertTierQuery, tier.ID, tier.Code, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID)); err != nil {
+	if _, err := a.db.Exec(insertTierQuery, tier.ID, tier.Code, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, tier.RequestLimitBurst, tier.SubscriptionLimit, tier.EmailLimitBurst, tier.MessageMonthlyLimit, tier.FirebaseDisabled, tier.AttachmentMessagesLimit, tier.GatewayMessagesLimit, tier.UrgentMessagesLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID)); err != nil {
 		return err
 	}
 	return nil
@@ -1390,7 +1717,7 @@ func (a *Manager) AddTier(tier *Tier) error {
 
 // UpdateTier updates a tier's properties in the database
 func (a *Manager) UpdateTier(tier *Tier) error {
-	if _, err := a.db.Exec(updateTierQuery, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID), tier.Code); err != nil {
+	if _, err := a.db.Exec(updateTierQuery, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, tier.RequestLimitBurst, tier.SubscriptionLimit, tier.EmailLimitBurst, tier.MessageMonthlyLimit, tier.FirebaseDisabled, tier.AttachmentMessagesLimit, tier.GatewayMessagesLimit, tier.UrgentMessagesLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID), tier.Code); err != nil {
 		return err
 	}
 	return nil
@@ -1459,11 +1786,11 @@ func (a *Manager) TierByStripePrice(priceID string) (*Tier, error) {
 func (a *Manager) readTier(rows *sql.Rows) (*Tier, error) {
 	var id, code, name string
 	var stripeMonthlyPriceID, stripeYearlyPriceID sql.NullString
-	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit sql.NullInt64
+	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit, requestLimitBurst, subscriptionLimit, emailsLimitBurst, messagesMonthlyLimit, firebaseDisabled, attachmentMessagesLimit, gatewayMessagesLimit, urgentMessagesLimit sql.NullInt64
 	if !rows.Next() {
 		return nil, ErrTierNotFound
 	}
-	if err := rows.Scan(&id, &code, &name, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
+	if err := rows.Scan(&id, &code, &name, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &requestLimitBurst, &subscriptionLimit, &emailsLimitBurst, &messagesMonthlyLimit, &firebaseDisabled, &attachmentMessagesLimit, &gatewayMessagesLimit, &urgentMessagesLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
 		return nil, err
 	} else if err := rows.Err(); err != nil {
 		return nil, err
@@ -1482,6 +1809,14 @@ func (a *Manager) readTier(rows *sql.Rows) (*Tier, error) {
 		AttachmentTotalSizeLimit: attachmentTotalSizeLimit.Int64,
 		AttachmentExpiryDuration: time.Duration(attachmentExpiryDuration.Int64) * time.Second,
 		AttachmentBandwidthLimit: attachmentBandwidthLimit.Int64,
+		RequestLimitBurst:        requestLimitBurst.Int64,
+		SubscriptionLimit:        subscriptionLimit.Int64,
+		EmailLimitBurst:          emailsLimitBurst.Int64,
+		MessageMonthlyLimit:      messagesMonthlyLimit.Int64,
+		FirebaseDisabled:         firebaseDisabled.Int64 == 1,
+		AttachmentMessagesLimit:  attachmentMessagesLimit.Int64,
+		GatewayMessagesLimit:     gatewayMessagesLimit.Int64,
+		UrgentMessagesLimit:      urgentMessagesLimit.Int64,
 		StripeMonthlyPriceID:     stripeMonthlyPriceID.String, // May be empty
 		StripeYearlyPriceID:      stripeYearlyPriceID.String,  // May be empty
 	}, nil
@@ -1663,6 +1998,278 @@ func migrateFrom4(db *sql.DB) error {
 	return tx.Commit()
 }
 
+func migrateFrom5(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 5 to 6")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate5To6UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 6); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom6(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 6 to 7")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate6To7UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 7); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom7(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 7 to 8")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate7To8UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 8); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom8(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 8 to 9")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate8To9UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 9); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom9(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 9 to 10")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate9To10UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 10); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom10(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 10 to 11")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate10To11UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 11); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom11(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 11 to 12")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate11To12UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 12); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom12(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 12 to 13")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate12To13UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 13); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom13(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 13 to 14")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate13To14UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 14); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom14(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 14 to 15")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate14To15UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 15); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom15(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 15 to 16")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate15To16UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 16); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom16(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 16 to 17")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate16To17UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 17); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom17(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 17 to 18")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate17To18UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 18); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom18(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 18 to 19")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate18To19UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 19); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom19(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 19 to 20")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate19To20UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 20); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom20(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 20 to 21")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate20To21UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 21); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom21(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 21 to 22")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate21To22UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 22); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func nullString(s string) sql.NullString {
 	if s == "" {
 		return sql.NullString{}
@@ -1676,3 +2283,19 @@ func nullInt64(v int64) sql.NullInt64 {
 	}
 	return sql.NullInt64{Int64: v, Valid: true}
 }
+
+// nullInt64FromPtr converts a nullable value to a sql.NullInt64. Unlike nullInt64, zero is a valid value.
+func nullInt64FromPtr(v *int64) sql.NullInt64 {
+	if v == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *v, Valid: true}
+}
+
+// nullInt64Ptr converts a sql.NullInt64 to a nullable value, see nullInt64FromPtr
+func nullInt64Ptr(v sql.NullInt64) *int64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Int64
+}
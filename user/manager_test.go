@@ -173,6 +173,7 @@ func TestManager_AddUser_And_Query(t *testing.T) {
 	u, err := a.User("user")
 	require.Nil(t, err)
 	require.Equal(t, "user", u.Name)
+	require.InDelta(t, time.Now().Unix(), u.Created.Unix(), 5)
 
 	u2, err := a.UserByID(u.ID)
 	require.Nil(t, err)
@@ -643,6 +644,73 @@ func TestManager_Token_Extend(t *testing.T) {
 	require.True(t, time.Now().Add(99*time.Hour).Unix() < extendedToken.Expires.Unix())
 }
 
+func TestManager_Token_LimitProfile(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	u, err := a.User("ben")
+	require.Nil(t, err)
+
+	token, err := a.CreateToken(u.ID, "ci", time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+	require.Equal(t, "", token.LimitProfile)
+	u2, err := a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.Equal(t, "", u2.TokenLimitProfile)
+
+	require.Nil(t, a.ChangeTokenLimitProfile(u.ID, token.Value, "integration"))
+	token2, err := a.Token(u.ID, token.Value)
+	require.Nil(t, err)
+	require.Equal(t, "integration", token2.LimitProfile)
+	u2, err = a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.Equal(t, "integration", u2.TokenLimitProfile)
+
+	// Logging in with a password does not select a profile
+	u3, err := a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+	require.Equal(t, "", u3.TokenLimitProfile)
+
+	require.Nil(t, a.ChangeTokenLimitProfile(u.ID, token.Value, ""))
+	u2, err = a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.Equal(t, "", u2.TokenLimitProfile)
+	require.Equal(t, ErrTokenNotFound, a.ChangeTokenLimitProfile(u.ID, "tk_notatoken", "integration"))
+}
+
+func TestManager_Token_Exempt(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	u, err := a.User("ben")
+	require.Nil(t, err)
+
+	token, err := a.CreateToken(u.ID, "backups", time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+	require.False(t, token.Exempt)
+	u2, err := a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.False(t, u2.TokenExempt)
+
+	require.Nil(t, a.ChangeTokenExempt(u.ID, token.Value, true))
+	token2, err := a.Token(u.ID, token.Value)
+	require.Nil(t, err)
+	require.True(t, token2.Exempt)
+	u2, err = a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.True(t, u2.TokenExempt)
+	require.Equal(t, RoleUser, u2.Role) // Not an admin
+
+	// Logging in with a password is not exempt
+	u3, err := a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+	require.False(t, u3.TokenExempt)
+
+	require.Nil(t, a.ChangeTokenExempt(u.ID, token.Value, false))
+	u2, err = a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.False(t, u2.TokenExempt)
+	require.Equal(t, ErrTokenNotFound, a.ChangeTokenExempt(u.ID, "tk_notatoken", true))
+}
+
 func TestManager_Token_MaxCount_AutoDelete(t *testing.T) {
 	// Tests that tokens are automatically deleted when the maximum number of tokens is reached
 
@@ -731,8 +799,13 @@ func TestManager_EnqueueStats_ResetStats(t *testing.T) {
 	require.Equal(t, int64(0), u.Stats.Messages)
 	require.Equal(t, int64(0), u.Stats.Emails)
 	a.EnqueueUserStats(u.ID, &Stats{
-		Messages: 11,
-		Emails:   2,
+		Messages:              11,
+		Emails:                2,
+		Firebase:              7,
+		RequestTokens:         12.5,
+		RequestTokensUpdated:  time.Unix(1700000000, 0),
+		MessagesMonthly:       120,
+		MessagesMonthlyPeriod: "2024-01",
 	})
 
 	// Still no change, because it's queued asynchronously
@@ -748,6 +821,11 @@ func TestManager_EnqueueStats_ResetStats(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, int64(11), u.Stats.Messages)
 	require.Equal(t, int64(2), u.Stats.Emails)
+	require.Equal(t, int64(7), u.Stats.Firebase)
+	require.Equal(t, 12.5, u.Stats.RequestTokens)
+	require.Equal(t, int64(1700000000), u.Stats.RequestTokensUpdated.Unix())
+	require.Equal(t, int64(120), u.Stats.MessagesMonthly)
+	require.Equal(t, "2024-01", u.Stats.MessagesMonthlyPeriod)
 
 	// Now reset stats (enqueued stats will be thrown out)
 	a.EnqueueUserStats(u.ID, &Stats{
@@ -760,6 +838,14 @@ func TestManager_EnqueueStats_ResetStats(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, int64(0), u.Stats.Messages)
 	require.Equal(t, int64(0), u.Stats.Emails)
+	require.Equal(t, int64(0), u.Stats.Firebase)
+	require.Equal(t, int64(120), u.Stats.MessagesMonthly) // Not reset daily
+
+	// Reset monthly stats
+	require.Nil(t, a.ResetMonthlyStats())
+	u, err = a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), u.Stats.MessagesMonthly)
 }
 
 func TestManager_EnqueueTokenUpdate(t *testing.T) {
@@ -864,6 +950,14 @@ func TestManager_Tier_Create_Update_List_Delete(t *testing.T) {
 		AttachmentTotalSizeLimit: 123123,
 		AttachmentExpiryDuration: 10800 * time.Second,
 		AttachmentBandwidthLimit: 21474836480,
+		RequestLimitBurst:        250,
+		SubscriptionLimit:        40,
+		EmailLimitBurst:          7,
+		MessageMonthlyLimit:      30000,
+		FirebaseDisabled:         true,
+		AttachmentMessagesLimit:  50,
+		GatewayMessagesLimit:     500,
+		UrgentMessagesLimit:      5,
 		StripeMonthlyPriceID:     "price_2",
 	}))
 	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
@@ -890,6 +984,14 @@ func TestManager_Tier_Create_Update_List_Delete(t *testing.T) {
 	require.Equal(t, int64(123123), ti.AttachmentTotalSizeLimit)
 	require.Equal(t, 10800*time.Second, ti.AttachmentExpiryDuration)
 	require.Equal(t, int64(21474836480), ti.AttachmentBandwidthLimit)
+	require.Equal(t, int64(250), ti.RequestLimitBurst)
+	require.Equal(t, int64(40), ti.SubscriptionLimit)
+	require.Equal(t, int64(7), ti.EmailLimitBurst)
+	require.Equal(t, int64(30000), ti.MessageMonthlyLimit)
+	require.True(t, ti.FirebaseDisabled)
+	require.Equal(t, int64(50), ti.AttachmentMessagesLimit)
+	require.Equal(t, int64(500), ti.GatewayMessagesLimit)
+	require.Equal(t, int64(5), ti.UrgentMessagesLimit)
 	require.Equal(t, "price_2", ti.StripeMonthlyPriceID)
 
 	// Update tier
@@ -1004,6 +1106,123 @@ func TestManager_Tier_Change_And_Reset(t *testing.T) {
 	require.Nil(t, a.ResetTier("phil"))
 }
 
+func TestManager_ChangeLimitOverrides(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+
+	u, err := a.User("phil")
+	require.Nil(t, err)
+	require.False(t, u.HasLimitOverrides())
+
+	// Zero is a valid override, nil means unset
+	messages, calls := int64(1000), int64(0)
+	require.Nil(t, a.ChangeLimitOverrides("phil", &messages, nil, &calls, nil))
+	u, err = a.User("phil")
+	require.Nil(t, err)
+	require.True(t, u.HasLimitOverrides())
+	require.Equal(t, int64(1000), *u.MessagesLimitOverride)
+	require.Nil(t, u.EmailsLimitOverride)
+	require.Equal(t, int64(0), *u.CallsLimitOverride)
+
+	// Reset
+	require.Nil(t, a.ChangeLimitOverrides("phil", nil, nil, nil, nil))
+	u, err = a.User("phil")
+	require.Nil(t, err)
+	require.False(t, u.HasLimitOverrides())
+
+	require.Equal(t, ErrUserNotFound, a.ChangeLimitOverrides("nobody", &messages, nil, nil, nil))
+}
+
+func TestManager_ChangeBillingAccount(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+
+	u, err := a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, "", u.BillingAccount)
+
+	require.Nil(t, a.ChangeBillingAccount("phil", "team-a"))
+	require.Nil(t, a.ChangeBillingAccount("ben", "team-a"))
+	u, err = a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, "team-a", u.BillingAccount)
+	u, err = a.UserByID(u.ID)
+	require.Nil(t, err)
+	require.Equal(t, "team-a", u.BillingAccount)
+
+	// Remove
+	require.Nil(t, a.ChangeBillingAccount("phil", ""))
+	u, err = a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, "", u.BillingAccount)
+
+	require.Equal(t, ErrUserNotFound, a.ChangeBillingAccount("nobody", "team-a"))
+}
+
+func TestManager_ChangePaused(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+
+	u, err := a.User("phil")
+	require.Nil(t, err)
+	require.False(t, u.Paused)
+	require.False(t, u.IsPaused(time.Now()))
+
+	// Paused indefinitely
+	require.Nil(t, a.ChangePaused("phil", true, time.Time{}))
+	u, err = a.User("phil")
+	require.Nil(t, err)
+	require.True(t, u.Paused)
+	require.True(t, u.IsPaused(time.Now().Add(24*time.Hour)))
+
+	// Paused for an hour
+	until := time.Now().Add(time.Hour)
+	require.Nil(t, a.ChangePaused("phil", true, until))
+	u, err = a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, until.Unix(), u.PausedUntil.Unix())
+	require.True(t, u.IsPaused(time.Now()))
+	require.False(t, u.IsPaused(until.Add(time.Second)))
+
+	// Unpause
+	require.Nil(t, a.ChangePaused("phil", false, time.Time{}))
+	u, err = a.User("phil")
+	require.Nil(t, err)
+	require.False(t, u.IsPaused(time.Now()))
+
+	require.Equal(t, ErrUserNotFound, a.ChangePaused("nobody", true, time.Time{}))
+}
+
+func TestManager_ChangeBoost(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+
+	u, err := a.User("phil")
+	require.Nil(t, err)
+	require.False(t, u.IsBoosted(time.Now()))
+
+	// Boosted for a day
+	expires := time.Now().Add(24 * time.Hour)
+	require.Nil(t, a.ChangeBoost("phil", 2, expires))
+	u, err = a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, 2.0, u.BoostMultiplier)
+	require.Equal(t, expires.Unix(), u.BoostExpires.Unix())
+	require.True(t, u.IsBoosted(time.Now()))
+	require.False(t, u.IsBoosted(expires.Add(time.Second)))
+
+	// Remove boost
+	require.Nil(t, a.ChangeBoost("phil", 0, time.Time{}))
+	u, err = a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, 0.0, u.BoostMultiplier)
+	require.False(t, u.IsBoosted(time.Now()))
+
+	require.Equal(t, ErrInvalidArgument, a.ChangeBoost("phil", -1, expires))
+	require.Equal(t, ErrUserNotFound, a.ChangeBoost("nobody", 2, expires))
+}
+
 func TestUser_PhoneNumberAddListRemove(t *testing.T) {
 	a := newTestManager(t, PermissionDenyAll)
 
@@ -22,7 +22,32 @@ type User struct {
 	Stats     *Stats
 	Billing   *Billing
 	SyncTopic string
+	Created   time.Time
 	Deleted   bool
+
+	// Per-user limit overrides, taking precedence over the tier's limits. Nil means "use tier (or config)".
+	MessagesLimitOverride            *int64
+	EmailsLimitOverride              *int64
+	CallsLimitOverride               *int64
+	AttachmentTotalSizeLimitOverride *int64 // Extra storage for attachments, zero means "use tier (or config)" as well
+
+	// Optional billing account, e.g. a team. Users with the same billing account share one pool of messages.
+	BillingAccount string
+
+	// Paused users are temporarily frozen by an admin, i.e. all their limit checks fail. If PausedUntil is
+	// non-zero, the user is automatically unpaused after that time.
+	Paused      bool
+	PausedUntil time.Time
+
+	// Temporary limit boost, e.g. as a promo or apology: the message and email limits are multiplied by
+	// BoostMultiplier until BoostExpires. After that, the boost is ignored. Zero means "no boost".
+	BoostMultiplier float64
+	BoostExpires    time.Time
+
+	// Limit profile and exemption of the token that was used to log in, see Token.LimitProfile and
+	// Token.Exempt. Only set if the user was authenticated with a token.
+	TokenLimitProfile string
+	TokenExempt       bool
 }
 
 // TierID returns the ID of the User.Tier, or an empty string if the user has no tier,
@@ -34,6 +59,21 @@ func (u *User) TierID() string {
 	return u.Tier.ID
 }
 
+// HasLimitOverrides returns true if any of the per-user limit overrides is set
+func (u *User) HasLimitOverrides() bool {
+	return u != nil && (u.MessagesLimitOverride != nil || u.EmailsLimitOverride != nil || u.CallsLimitOverride != nil || u.AttachmentTotalSizeLimitOverride != nil)
+}
+
+// IsPaused returns true if the user is paused at the given time, see User.Paused
+func (u *User) IsPaused(now time.Time) bool {
+	return u != nil && u.Paused && (u.PausedUntil.Unix() <= 0 || now.Before(u.PausedUntil))
+}
+
+// IsBoosted returns true if the user has a temporary limit boost at the given time, see User.BoostMultiplier
+func (u *User) IsBoosted(now time.Time) bool {
+	return u != nil && u.BoostMultiplier > 1 && now.Before(u.BoostExpires)
+}
+
 // IsAdmin returns true if the user is an admin
 func (u *User) IsAdmin() bool {
 	return u != nil && u.Role == RoleAdmin
@@ -63,6 +103,14 @@ type Token struct {
 	LastAccess time.Time
 	LastOrigin netip.Addr
 	Expires    time.Time
+
+	// Optional limit profile, i.e. the name of a limit preset defined in the server config. If set, the
+	// limits of the profile apply to requests authenticated with this token, instead of the user's tier.
+	LimitProfile string
+
+	// Service tokens are exempt from all limits, e.g. for internal automation. Unlike admins, they do not
+	// have any other privileges than their user. This is only set explicitly, see Manager.ChangeTokenExempt.
+	Exempt bool
 }
 
 // TokenUpdate holds information about the last access time and origin IP address of a token
@@ -92,6 +140,14 @@ type Tier struct {
 	AttachmentTotalSizeLimit int64         // Total file size for all files of this user (bytes)
 	AttachmentExpiryDuration time.Duration // Duration after which attachments will be deleted
 	AttachmentBandwidthLimit int64         // Daily bandwidth limit for the user
+	RequestLimitBurst        int64         // Request limiter burst size (overrides the default burst, if non-zero)
+	SubscriptionLimit        int64         // Number of concurrent subscriptions (overrides the default limit, if non-zero)
+	EmailLimitBurst          int64         // Email limiter burst size (overrides the default burst, if non-zero)
+	MessageMonthlyLimit      int64         // Monthly message limit (in addition to the daily limit, if non-zero)
+	FirebaseDisabled         bool          // If true, messages are not forwarded to Firebase for users of this tier
+	AttachmentMessagesLimit  int64         // Daily limit for messages with attachments (in addition to the daily message limit, if non-zero)
+	GatewayMessagesLimit     int64         // Daily limit for UnifiedPush/Matrix gateway messages (instead of the daily message limit, if non-zero)
+	UrgentMessagesLimit      int64         // Daily limit for urgent (priority 5) messages (in addition to the daily message limit, if non-zero)
 	StripeMonthlyPriceID     string        // Monthly price ID for paid tiers (price_...)
 	StripeYearlyPriceID      string        // Yearly price ID for paid tiers (price_...)
 }
@@ -130,9 +186,19 @@ type NotificationPrefs struct {
 
 // Stats is a struct holding daily user statistics
 type Stats struct {
-	Messages int64
-	Emails   int64
-	Calls    int64
+	Messages              int64
+	Emails                int64
+	Calls                 int64
+	Firebase              int64     // Messages forwarded to Firebase today
+	RequestTokens         float64   // Approximate request limiter tokens, used to restore the limiter after a restart
+	RequestTokensUpdated  time.Time // Time at which RequestTokens was recorded, may be zero
+	MessagesMonthly       int64     // Messages sent in MessagesMonthlyPeriod
+	MessagesMonthlyPeriod string    // Month of MessagesMonthly, e.g. "2024-01" (UTC), see MonthlyPeriod
+}
+
+// MonthlyPeriod returns the month (UTC) of the given time, as used in Stats.MessagesMonthlyPeriod, e.g. "2024-01"
+func MonthlyPeriod(t time.Time) string {
+	return t.UTC().Format("2006-01")
 }
 
 // Billing is a struct holding a user's billing information
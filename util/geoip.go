@@ -0,0 +1,61 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// ErrGeoIPInvalidDatabase is returned by the GeoIPReader if the database file is not a valid MaxMind DB file
+var ErrGeoIPInvalidDatabase = errors.New("invalid geoip database")
+
+// GeoIPReader reads MaxMind DB files (e.g. GeoLite2-Country.mmdb), using the maxminddb package. It only supports
+// looking up the country of an IP address, which is all that is needed to apply limits by region. The entire
+// database is read into memory. GeoIPReader may be used by multiple goroutines.
+type GeoIPReader struct {
+	reader *maxminddb.Reader
+}
+
+// geoIPRecord is the part of a MaxMind DB (GeoIP2/GeoLite2 country or city) record that is needed by GeoIPReader
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// NewGeoIPReader reads the MaxMind DB file with the given filename
+func NewGeoIPReader(filename string) (*GeoIPReader, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewGeoIPReaderFromBytes(b)
+}
+
+// NewGeoIPReaderFromBytes creates a GeoIPReader from the contents of a MaxMind DB file
+func NewGeoIPReaderFromBytes(b []byte) (*GeoIPReader, error) {
+	reader, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrGeoIPInvalidDatabase, err.Error())
+	}
+	return &GeoIPReader{reader: reader}, nil
+}
+
+// Country returns the ISO 3166-1 country code (e.g. "DE") of the given IP address, or an empty string
+// if the address is not in the database
+func (r *GeoIPReader) Country(ip netip.Addr) (string, error) {
+	var record geoIPRecord
+	if err := r.reader.Lookup(net.IP(ip.Unmap().AsSlice()), &record); err != nil {
+		return "", err
+	} else if record.Country.ISOCode != "" {
+		return record.Country.ISOCode, nil
+	}
+	return record.RegisteredCountry.ISOCode, nil
+}
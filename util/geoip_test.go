@@ -0,0 +1,99 @@
+package util
+
+import (
+	"bytes"
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testGeoIPDatabase builds a tiny MaxMind DB file that maps the given prefixes to country codes
+func testGeoIPDatabase(t *testing.T, ipVersion int, countries map[string]string) []byte {
+	tree, err := mmdbwriter.New(mmdbwriter.Options{
+		DatabaseType:            "GeoLite2-Country",
+		IPVersion:               ipVersion,
+		RecordSize:              24,
+		IncludeReservedNetworks: true,
+	})
+	require.Nil(t, err)
+	for prefix, country := range countries {
+		_, network, err := net.ParseCIDR(prefix)
+		require.Nil(t, err)
+		require.Nil(t, tree.Insert(network, mmdbtype.Map{
+			"country": mmdbtype.Map{"iso_code": mmdbtype.String(country)},
+		}))
+	}
+	var buf bytes.Buffer
+	_, err = tree.WriteTo(&buf)
+	require.Nil(t, err)
+	return buf.Bytes()
+}
+
+func TestGeoIPReader_Country(t *testing.T) {
+	for _, ipVersion := range []int{4, 6} {
+		db := testGeoIPDatabase(t, ipVersion, map[string]string{
+			"1.2.3.0/24": "DE",
+			"5.6.0.0/16": "FR",
+		})
+		r, err := NewGeoIPReaderFromBytes(db)
+		require.Nil(t, err)
+
+		country, err := r.Country(netip.MustParseAddr("1.2.3.4"))
+		require.Nil(t, err)
+		require.Equal(t, "DE", country)
+		country, err = r.Country(netip.MustParseAddr("5.6.7.8"))
+		require.Nil(t, err)
+		require.Equal(t, "FR", country)
+		country, err = r.Country(netip.MustParseAddr("::ffff:5.6.7.8"))
+		require.Nil(t, err)
+		require.Equal(t, "FR", country)
+		country, err = r.Country(netip.MustParseAddr("9.9.9.9"))
+		require.Nil(t, err)
+		require.Equal(t, "", country)
+	}
+}
+
+func TestGeoIPReader_RegisteredCountry(t *testing.T) {
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: "GeoLite2-Country", RecordSize: 24})
+	require.Nil(t, err)
+	_, network, err := net.ParseCIDR("1.2.3.0/24")
+	require.Nil(t, err)
+	require.Nil(t, tree.Insert(network, mmdbtype.Map{
+		"registered_country": mmdbtype.Map{"iso_code": mmdbtype.String("IT")},
+	}))
+	var buf bytes.Buffer
+	_, err = tree.WriteTo(&buf)
+	require.Nil(t, err)
+
+	r, err := NewGeoIPReaderFromBytes(buf.Bytes())
+	require.Nil(t, err)
+	country, err := r.Country(netip.MustParseAddr("1.2.3.4"))
+	require.Nil(t, err)
+	require.Equal(t, "IT", country)
+}
+
+func TestGeoIPReader_File(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "country.mmdb")
+	require.Nil(t, os.WriteFile(filename, testGeoIPDatabase(t, 6, map[string]string{"2001:db8::/32": "NL"}), 0600))
+	r, err := NewGeoIPReader(filename)
+	require.Nil(t, err)
+	country, err := r.Country(netip.MustParseAddr("2001:db8::1"))
+	require.Nil(t, err)
+	require.Equal(t, "NL", country)
+	country, err = r.Country(netip.MustParseAddr("1.2.3.4"))
+	require.Nil(t, err)
+	require.Equal(t, "", country)
+}
+
+func TestGeoIPReader_Invalid(t *testing.T) {
+	_, err := NewGeoIPReaderFromBytes([]byte("not a database"))
+	require.ErrorIs(t, err, ErrGeoIPInvalidDatabase)
+	db := testGeoIPDatabase(t, 4, map[string]string{"1.2.3.0/24": "DE"})
+	_, err = NewGeoIPReaderFromBytes(db[len(db)/2:]) // Truncated, no tree
+	require.ErrorIs(t, err, ErrGeoIPInvalidDatabase)
+}
@@ -1,9 +1,12 @@
 package util
 
 import (
+	"context"
 	"errors"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/time/rate"
 	"io"
+	"math"
 	"sync"
 	"time"
 )
@@ -26,6 +29,14 @@ type Limiter interface {
 	Reset()
 }
 
+// RemainingLimiter is a Limiter that can also report how much can still be added before the limit is reached
+type RemainingLimiter interface {
+	Limiter
+
+	// Remaining returns the amount that can be added to the limiter before the limit is reached
+	Remaining() int64
+}
+
 // FixedLimiter is a helper that allows adding values up to a well-defined limit. Once the limit is reached
 // ErrLimitReached will be returned. FixedLimiter may be used by multiple goroutines.
 type FixedLimiter struct {
@@ -34,7 +45,7 @@ type FixedLimiter struct {
 	mu    sync.Mutex
 }
 
-var _ Limiter = (*FixedLimiter)(nil)
+var _ RemainingLimiter = (*FixedLimiter)(nil)
 
 // NewFixedLimiter creates a new Limiter
 func NewFixedLimiter(limit int64) *FixedLimiter {
@@ -74,6 +85,20 @@ func (l *FixedLimiter) Value() int64 {
 	return l.value
 }
 
+// Remaining returns the amount that can be added before the limit is reached
+func (l *FixedLimiter) Remaining() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Max(l.limit-l.value, 0)
+}
+
+// SetLimit changes the limit, keeping the current value
+func (l *FixedLimiter) SetLimit(limit int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+}
+
 // Reset sets the limiter's value back to zero
 func (l *FixedLimiter) Reset() {
 	l.mu.Lock()
@@ -81,6 +106,160 @@ func (l *FixedLimiter) Reset() {
 	l.value = 0
 }
 
+// redisFixedLimiterTTL is the time after which the key of an unused RedisFixedLimiter expires. It is slightly
+// longer than a day, since fixed limiters are typically reset daily anyway.
+const redisFixedLimiterTTL = 25 * time.Hour
+
+// redisFixedLimiterCacheDuration is the time for which a RedisFixedLimiter's value is served from its local copy,
+// before it is refreshed (in the background) from Redis
+const redisFixedLimiterCacheDuration = 5 * time.Second
+
+// redisFixedLimiterAllowScript atomically adds ARGV[1] to the value in KEYS[1], unless that would exceed the limit
+// ARGV[2]. If the key does not exist, it is created with the initial value ARGV[3], and expires after ARGV[4] seconds.
+// The value never drops below zero. It returns whether the value was added, and the resulting value.
+var redisFixedLimiterAllowScript = redis.NewScript(`
+	local n, limit = tonumber(ARGV[1]), tonumber(ARGV[2])
+	local current = redis.call('GET', KEYS[1])
+	local value = tonumber(current or ARGV[3])
+	if n > 0 and value + n > limit then
+		return {0, value}
+	end
+	local updated = math.max(value + n, 0)
+	if current then
+		redis.call('INCRBY', KEYS[1], updated - value)
+	else
+		redis.call('SET', KEYS[1], updated, 'EX', ARGV[4])
+	end
+	return {1, updated}
+`)
+
+// RedisFixedLimiter is like FixedLimiter, but its value is stored in Redis, so that multiple processes (e.g.
+// replicas behind a load balancer) can share the same limit. If Redis is unreachable, the limiter degrades
+// gracefully to a local FixedLimiter, which starts off with the last known value. Only AllowN and Reset talk
+// to Redis directly; Value is served from the local copy, which is refreshed in the background, so that reading
+// the value (e.g. for rate limit headers) never waits on Redis. RedisFixedLimiter may be used by multiple goroutines.
+type RedisFixedLimiter struct {
+	client        *RedisClient
+	key           string
+	limit         int64
+	fallback      *FixedLimiter
+	cacheDuration time.Duration
+	synced        bool      // True if the value was read from or written to Redis at least once
+	syncedAt      time.Time // Last time the value was read from or written to Redis
+	refreshing    bool      // True while the value is refreshed in the background, see Value
+	mu            sync.Mutex
+}
+
+var _ RemainingLimiter = (*RedisFixedLimiter)(nil)
+
+// NewRedisFixedLimiter creates a new RedisFixedLimiter, storing its value in the given key
+func NewRedisFixedLimiter(client *RedisClient, key string, limit int64) *RedisFixedLimiter {
+	return NewRedisFixedLimiterWithValue(client, key, limit, 0)
+}
+
+// NewRedisFixedLimiterWithValue creates a new RedisFixedLimiter. The initial value is only used if the key
+// does not exist yet, i.e. if no other process is already using the shared limiter. No connection to Redis is
+// made until the limiter is used, so the limiter can be created while holding locks.
+func NewRedisFixedLimiterWithValue(client *RedisClient, key string, limit, value int64) *RedisFixedLimiter {
+	return &RedisFixedLimiter{
+		client:        client,
+		key:           key,
+		limit:         limit,
+		fallback:      NewFixedLimiterWithValue(limit, value),
+		cacheDuration: redisFixedLimiterCacheDuration,
+	}
+}
+
+// Allow adds one to the limiters value, but only if the limit has not been reached
+func (l *RedisFixedLimiter) Allow() bool {
+	return l.AllowN(1)
+}
+
+// AllowN adds n to the limiters value, but only if the limit has not been reached. If the limit was
+// exceeded after adding n, false is returned. Negative values can be used to give back previously added values.
+// The check and the update are atomic, so that processes sharing the limiter never see each other's rejected values.
+func (l *RedisFixedLimiter) AllowN(n int64) bool {
+	var initial int64
+	l.mu.Lock()
+	if !l.synced {
+		initial = l.fallback.Value() // Only the first use creates the key, afterwards a missing key was expired or reset
+	}
+	l.mu.Unlock()
+	var result []int64
+	err := l.client.Do(func(ctx context.Context, rc redis.Cmdable) error {
+		var err error
+		result, err = redisFixedLimiterAllowScript.Run(ctx, rc, []string{l.key}, n, l.limit, initial, int64(redisFixedLimiterTTL.Seconds())).Int64Slice()
+		return err
+	})
+	if err != nil || len(result) != 2 {
+		return l.fallback.AllowN(n)
+	}
+	l.syncFallback(result[1])
+	return result[0] == 1
+}
+
+// Value returns the current (shared) limiter value, as last read from or written to Redis. If that was longer
+// than the cache duration ago, the value is refreshed in the background.
+func (l *RedisFixedLimiter) Value() int64 {
+	l.mu.Lock()
+	refresh := !l.refreshing && time.Since(l.syncedAt) >= l.cacheDuration
+	if refresh {
+		l.refreshing = true
+	}
+	l.mu.Unlock()
+	if refresh {
+		go l.refresh()
+	}
+	return l.fallback.Value()
+}
+
+func (l *RedisFixedLimiter) refresh() {
+	start := time.Now()
+	var value int64
+	var exists bool
+	err := l.client.Do(func(ctx context.Context, rc redis.Cmdable) error {
+		var err error
+		value, err = rc.Get(ctx, l.key).Int64()
+		if errors.Is(err, redis.Nil) {
+			return nil // Key does not exist (yet), or was expired or reset
+		}
+		exists = err == nil
+		return err
+	})
+	l.mu.Lock()
+	l.refreshing = false
+	synced, outdated := l.synced, l.syncedAt.After(start) // AllowN may have synced a newer value in the meantime
+	l.mu.Unlock()
+	if err == nil && (exists || synced) && !outdated {
+		l.syncFallback(value) // Before the first use, a missing key means that the initial value is still valid
+	}
+}
+
+// Remaining returns the amount that can be added before the limit is reached
+func (l *RedisFixedLimiter) Remaining() int64 {
+	return Max(l.limit-l.Value(), 0)
+}
+
+// Reset sets the limiter's value back to zero
+func (l *RedisFixedLimiter) Reset() {
+	err := l.client.Do(func(ctx context.Context, rc redis.Cmdable) error {
+		return rc.Del(ctx, l.key).Err()
+	})
+	l.fallback.Reset()
+	if err == nil {
+		l.syncFallback(0)
+	}
+}
+
+func (l *RedisFixedLimiter) syncFallback(value int64) {
+	l.mu.Lock()
+	l.synced, l.syncedAt = true, time.Now()
+	l.mu.Unlock()
+	l.fallback.mu.Lock()
+	defer l.fallback.mu.Unlock()
+	l.fallback.value = value
+}
+
 // RateLimiter is a Limiter that wraps a rate.Limiter, allowing a floating time-based limit.
 type RateLimiter struct {
 	r       rate.Limit
@@ -90,7 +269,7 @@ type RateLimiter struct {
 	mu      sync.Mutex
 }
 
-var _ Limiter = (*RateLimiter)(nil)
+var _ RemainingLimiter = (*RateLimiter)(nil)
 
 // NewRateLimiter creates a new RateLimiter
 func NewRateLimiter(r rate.Limit, b int) *RateLimiter {
@@ -116,6 +295,18 @@ func NewBytesLimiter(bytes int, interval time.Duration) *RateLimiter {
 	return NewRateLimiter(rate.Limit(bytes)*rate.Every(interval), bytes)
 }
 
+// NewBytesLimiterWithValue is like NewBytesLimiter, but with used bytes already counted against the limit, e.g. to
+// carry over the usage of a previous limiter (see RateLimiter.Used) when the limit changes
+func NewBytesLimiterWithValue(bytes int, interval time.Duration, used int64) *RateLimiter {
+	l := NewBytesLimiter(bytes, interval)
+	used = MinMax(used, 0, int64(bytes))
+	if used > 0 {
+		l.limiter.AllowN(time.Now(), int(used))
+		l.value = used
+	}
+	return l
+}
+
 // Allow adds one to the limiters internal value, but only if the limit has not been reached. If the limit was
 // exceeded, false is returned.
 func (l *RateLimiter) Allow() bool {
@@ -144,6 +335,43 @@ func (l *RateLimiter) Value() int64 {
 	return l.value
 }
 
+// Remaining returns the amount that can be added before the limit is reached, i.e. the number of
+// tokens currently available in the underlying rate.Limiter
+func (l *RateLimiter) Remaining() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Max(int64(l.limiter.Tokens()), 0)
+}
+
+// Used returns the amount that is currently counted against the limit, i.e. the burst minus the number of tokens
+// currently available in the underlying rate.Limiter. Unlike Value, this takes into account that the limiter
+// replenishes over time.
+func (l *RateLimiter) Used() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return MinMax(int64(l.b)-int64(l.limiter.Tokens()), 0, int64(l.b))
+}
+
+// Rate returns the rate at which the underlying rate.Limiter is replenished
+func (l *RateLimiter) Rate() rate.Limit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r
+}
+
+// Refund gives back n that were added with AllowN, e.g. if the operation they were counted for failed
+// afterwards. The value never drops below zero, and the tokens never exceed the limiter's burst.
+func (l *RateLimiter) Refund(n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n = MinMax(n, 0, l.value)
+	if n == 0 {
+		return
+	}
+	l.limiter.AllowN(time.Now(), -int(n)) // Negative n returns tokens; they are capped at the burst when the limiter advances
+	l.value -= n
+}
+
 // Reset sets the limiter's value back to zero, and resets the underlying rate.Limiter
 func (l *RateLimiter) Reset() {
 	l.mu.Lock()
@@ -152,6 +380,227 @@ func (l *RateLimiter) Reset() {
 	l.value = 0
 }
 
+// slidingWindowLimiterBuckets is the number of buckets a SlidingWindowLimiter's window is divided into.
+// Values expire with bucket granularity, e.g. for a 24h window, every 24 minutes.
+const slidingWindowLimiterBuckets = 60
+
+// SlidingWindowLimiter is a Limiter that allows adding values up to a limit within a rolling time window.
+// Unlike the FixedLimiter, values expire gradually as the window moves forward, instead of all at once when
+// the limiter is reset. SlidingWindowLimiter may be used by multiple goroutines.
+type SlidingWindowLimiter struct {
+	limit    int64
+	interval time.Duration // Duration of a single bucket
+	buckets  []int64
+	current  int       // Index of the current bucket
+	start    time.Time // Start time of the current bucket
+	mu       sync.Mutex
+}
+
+var _ RemainingLimiter = (*SlidingWindowLimiter)(nil)
+
+// NewSlidingWindowLimiter creates a new SlidingWindowLimiter
+func NewSlidingWindowLimiter(limit int64, window time.Duration) *SlidingWindowLimiter {
+	return NewSlidingWindowLimiterWithValue(limit, window, 0)
+}
+
+// NewSlidingWindowLimiterWithValue creates a new SlidingWindowLimiter and sets the initial value.
+// The initial value is attributed to the current point in time, i.e. it expires after the window passed.
+func NewSlidingWindowLimiterWithValue(limit int64, window time.Duration, value int64) *SlidingWindowLimiter {
+	interval := window / slidingWindowLimiterBuckets
+	if interval <= 0 {
+		interval = 1
+	}
+	l := &SlidingWindowLimiter{
+		limit:    limit,
+		interval: interval,
+		buckets:  make([]int64, slidingWindowLimiterBuckets),
+		start:    time.Now(),
+	}
+	l.buckets[0] = value
+	return l
+}
+
+// Allow adds one to the limiters internal value, but only if the limit has not been reached. If the limit was
+// exceeded, false is returned.
+func (l *SlidingWindowLimiter) Allow() bool {
+	return l.AllowN(1)
+}
+
+// AllowN adds n to the limiters internal value, but only if the sum of all values within the window does not
+// exceed the limit after adding n. If the limit was exceeded, false is returned.
+func (l *SlidingWindowLimiter) AllowN(n int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advanceNoLock()
+	if l.valueNoLock()+n > l.limit {
+		return false
+	}
+	l.buckets[l.current] += n
+	return true
+}
+
+// Value returns the sum of all values within the current window
+func (l *SlidingWindowLimiter) Value() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advanceNoLock()
+	return l.valueNoLock()
+}
+
+// Remaining returns the amount that can be added before the limit is reached
+func (l *SlidingWindowLimiter) Remaining() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advanceNoLock()
+	return Max(l.limit-l.valueNoLock(), 0)
+}
+
+// NextExpiry returns the time at which the oldest values within the window expire, i.e. the time at which
+// the value will drop next. If the limiter's value is zero, the zero time is returned.
+func (l *SlidingWindowLimiter) NextExpiry() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advanceNoLock()
+	n := len(l.buckets)
+	for age := n - 1; age >= 0; age-- {
+		if l.buckets[(l.current-age+n)%n] > 0 {
+			return l.start.Add(time.Duration(n-age) * l.interval)
+		}
+	}
+	return time.Time{}
+}
+
+// Reset sets the limiter's value back to zero
+func (l *SlidingWindowLimiter) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.buckets {
+		l.buckets[i] = 0
+	}
+	l.current = 0
+	l.start = time.Now()
+}
+
+func (l *SlidingWindowLimiter) valueNoLock() int64 {
+	var value int64
+	for _, v := range l.buckets {
+		value += v
+	}
+	return value
+}
+
+// advanceNoLock moves the window forward, clearing all buckets that have fallen out of the window
+func (l *SlidingWindowLimiter) advanceNoLock() {
+	steps := int(time.Since(l.start) / l.interval)
+	if steps <= 0 {
+		return
+	}
+	for i := 0; i < steps && i < len(l.buckets); i++ {
+		l.current = (l.current + 1) % len(l.buckets)
+		l.buckets[l.current] = 0
+	}
+	l.start = l.start.Add(time.Duration(steps) * l.interval)
+}
+
+// DecayingLimiter is a Limiter that allows adding values up to a limit, while the value continuously decays at a
+// rate of limit per window. Unlike the FixedLimiter, the value is not reset all at once, and unlike the
+// SlidingWindowLimiter, capacity is freed up gradually right after it is used. DecayingLimiter may be used by
+// multiple goroutines.
+type DecayingLimiter struct {
+	limit   int64
+	rate    float64 // Decay per second
+	value   float64
+	updated time.Time // Time at which value was last decayed
+	mu      sync.Mutex
+}
+
+var _ RemainingLimiter = (*DecayingLimiter)(nil)
+
+// NewDecayingLimiter creates a new DecayingLimiter
+func NewDecayingLimiter(limit int64, window time.Duration) *DecayingLimiter {
+	return NewDecayingLimiterWithValue(limit, window, 0)
+}
+
+// NewDecayingLimiterWithValue creates a new DecayingLimiter and sets the initial value
+func NewDecayingLimiterWithValue(limit int64, window time.Duration, value int64) *DecayingLimiter {
+	if window <= 0 {
+		window = 1
+	}
+	return &DecayingLimiter{
+		limit:   limit,
+		rate:    float64(limit) / window.Seconds(),
+		value:   float64(value),
+		updated: time.Now(),
+	}
+}
+
+// Allow adds one to the limiters internal value, but only if the limit has not been reached. If the limit was
+// exceeded, false is returned.
+func (l *DecayingLimiter) Allow() bool {
+	return l.AllowN(1)
+}
+
+// AllowN adds n to the limiters internal value, but only if the decayed value does not exceed the limit
+// after adding n. If the limit was exceeded, false is returned.
+func (l *DecayingLimiter) AllowN(n int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decayNoLock()
+	if l.valueNoLock()+n > l.limit {
+		return false
+	}
+	l.value += float64(n)
+	return true
+}
+
+// Value returns the current (decayed) value, rounded up to the next integer
+func (l *DecayingLimiter) Value() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decayNoLock()
+	return l.valueNoLock()
+}
+
+// Remaining returns the amount that can be added before the limit is reached
+func (l *DecayingLimiter) Remaining() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decayNoLock()
+	return Max(l.limit-l.valueNoLock(), 0)
+}
+
+// NextExpiry returns the time at which the value will drop by one next. If the limiter's value is zero,
+// the zero time is returned.
+func (l *DecayingLimiter) NextExpiry() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decayNoLock()
+	if l.value <= 0 || l.rate <= 0 {
+		return time.Time{}
+	}
+	fraction := l.value - math.Ceil(l.value) + 1 // Amount that has to decay until the rounded value drops
+	return l.updated.Add(time.Duration(fraction / l.rate * float64(time.Second)))
+}
+
+// Reset sets the limiter's value back to zero
+func (l *DecayingLimiter) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.value = 0
+	l.updated = time.Now()
+}
+
+func (l *DecayingLimiter) valueNoLock() int64 {
+	return int64(math.Ceil(l.value))
+}
+
+// decayNoLock reduces the value in proportion to the time passed since the last update
+func (l *DecayingLimiter) decayNoLock() {
+	now := time.Now()
+	l.value = math.Max(l.value-now.Sub(l.updated).Seconds()*l.rate, 0)
+	l.updated = now
+}
+
 // LimitWriter implements an io.Writer that will pass through all Write calls to the underlying
 // writer w until any of the limiter's limit is reached, at which point a Write will return ErrLimitReached.
 // Each limiter's value is increased with every write.
@@ -186,3 +635,33 @@ func (w *LimitWriter) Write(p []byte) (n int, err error) {
 	w.written += int64(n)
 	return
 }
+
+// ThrottledReader implements an io.Reader that paces all reads from the underlying reader r according
+// to the given rate.Limiter, i.e. a Read blocks until the limiter allows the bytes that were read. Reads
+// are never larger than the limiter's burst.
+type ThrottledReader struct {
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+// NewThrottledReader creates a new ThrottledReader
+func NewThrottledReader(r io.Reader, limiter *rate.Limiter) *ThrottledReader {
+	return &ThrottledReader{
+		r:       r,
+		limiter: limiter,
+	}
+}
+
+// Read reads from the underlying reader, and waits until the limiter allows the number of bytes read
+func (r *ThrottledReader) Read(p []byte) (n int, err error) {
+	if burst := r.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err = r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.WaitN(context.Background(), n); werr != nil {
+			return n, werr
+		}
+	}
+	return
+}
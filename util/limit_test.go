@@ -2,7 +2,13 @@ package util
 
 import (
 	"bytes"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -25,6 +31,23 @@ func TestFixedLimiter_AllowValueReset(t *testing.T) {
 	require.False(t, l.Allow())
 }
 
+func TestLimiter_Remaining(t *testing.T) {
+	fixed := NewFixedLimiterWithValue(10, 3)
+	require.Equal(t, int64(7), fixed.Remaining())
+	require.True(t, fixed.AllowN(7))
+	require.Equal(t, int64(0), fixed.Remaining())
+
+	bytes := NewBytesLimiter(1000, time.Hour)
+	require.True(t, bytes.AllowN(600))
+	require.Equal(t, int64(400), bytes.Remaining())
+
+	sliding := NewSlidingWindowLimiterWithValue(10, time.Hour, 4)
+	require.Equal(t, int64(6), sliding.Remaining())
+
+	decaying := NewDecayingLimiterWithValue(10, time.Hour, 4)
+	require.Equal(t, int64(6), decaying.Remaining())
+}
+
 func TestFixedLimiter_AddSub(t *testing.T) {
 	l := NewFixedLimiter(10)
 	l.AllowN(5)
@@ -37,6 +60,17 @@ func TestFixedLimiter_AddSub(t *testing.T) {
 	}
 }
 
+func TestFixedLimiter_SetLimit(t *testing.T) {
+	l := NewFixedLimiterWithValue(10, 8)
+	l.SetLimit(5)
+	require.Equal(t, int64(8), l.Value())
+	require.Equal(t, int64(0), l.Remaining())
+	require.False(t, l.Allow())
+	l.SetLimit(20)
+	require.Equal(t, int64(12), l.Remaining())
+	require.True(t, l.Allow())
+}
+
 func TestBytesLimiter_Add_Simple(t *testing.T) {
 	l := NewBytesLimiter(250*1024*1024, 24*time.Hour) // 250 MB per 24h
 	require.True(t, l.AllowN(100*1024*1024))
@@ -49,6 +83,33 @@ func TestBytesLimiter_Add_Simple(t *testing.T) {
 	require.Equal(t, int64(200*1024*1024), l.Value())
 }
 
+func TestBytesLimiter_Refund(t *testing.T) {
+	l := NewBytesLimiter(1000, 24*time.Hour)
+	require.True(t, l.AllowN(800))
+	require.False(t, l.AllowN(400))
+	l.Refund(300)
+	require.Equal(t, int64(500), l.Value())
+	require.True(t, l.AllowN(400))
+	l.Refund(5000) // Never more than was added
+	require.Equal(t, int64(0), l.Value())
+	require.LessOrEqual(t, l.Remaining(), int64(1000))
+}
+
+func TestBytesLimiter_WithValue(t *testing.T) {
+	l := NewBytesLimiter(1000, 24*time.Hour)
+	require.True(t, l.AllowN(800))
+	require.InDelta(t, 800, l.Used(), 1)
+
+	l = NewBytesLimiterWithValue(2000, 24*time.Hour, l.Used())
+	require.InDelta(t, 800, l.Used(), 1)
+	require.InDelta(t, 1200, l.Remaining(), 1)
+	require.False(t, l.AllowN(1300))
+	require.True(t, l.AllowN(1100))
+
+	l = NewBytesLimiterWithValue(500, 24*time.Hour, 800) // Never more than the limit
+	require.Equal(t, int64(500), l.Used())
+}
+
 func TestBytesLimiter_Add_Wait(t *testing.T) {
 	l := NewBytesLimiter(250*1024*1024, 24*time.Hour) // 250 MB per 24h (~ 303 bytes per 100ms)
 	require.True(t, l.AllowN(250*1024*1024))
@@ -57,6 +118,86 @@ func TestBytesLimiter_Add_Wait(t *testing.T) {
 	require.True(t, l.AllowN(400))
 }
 
+func TestSlidingWindowLimiter_AllowValueReset(t *testing.T) {
+	l := NewSlidingWindowLimiterWithValue(10, time.Hour, 3)
+	require.Equal(t, int64(3), l.Value())
+	require.True(t, l.AllowN(7))
+	require.False(t, l.Allow())
+	require.Equal(t, int64(10), l.Value())
+
+	l.Reset()
+	require.Equal(t, int64(0), l.Value())
+	require.True(t, l.AllowN(10))
+	require.False(t, l.Allow())
+}
+
+func TestSlidingWindowLimiter_Expire(t *testing.T) {
+	l := NewSlidingWindowLimiter(10, 600*time.Millisecond) // 10ms buckets
+	require.True(t, l.AllowN(5))
+	time.Sleep(300 * time.Millisecond)
+	require.True(t, l.AllowN(5))
+	require.False(t, l.Allow())
+
+	time.Sleep(350 * time.Millisecond) // First 5 have left the window, the others have not
+	require.Equal(t, int64(5), l.Value())
+	require.True(t, l.AllowN(5))
+	require.False(t, l.Allow())
+
+	time.Sleep(700 * time.Millisecond) // Everything expired
+	require.Equal(t, int64(0), l.Value())
+}
+
+func TestSlidingWindowLimiter_NextExpiry(t *testing.T) {
+	l := NewSlidingWindowLimiter(10, time.Hour)
+	require.True(t, l.NextExpiry().IsZero())
+
+	start := time.Now()
+	require.True(t, l.AllowN(3))
+	require.WithinDuration(t, start.Add(time.Hour), l.NextExpiry(), time.Minute)
+
+	l.Reset()
+	require.True(t, l.NextExpiry().IsZero())
+}
+
+func TestDecayingLimiter_AllowValueReset(t *testing.T) {
+	l := NewDecayingLimiterWithValue(10, time.Hour, 3)
+	require.Equal(t, int64(3), l.Value())
+	require.True(t, l.AllowN(7))
+	require.False(t, l.Allow())
+	require.Equal(t, int64(10), l.Value())
+	require.Equal(t, int64(0), l.Remaining())
+
+	l.Reset()
+	require.Equal(t, int64(0), l.Value())
+	require.True(t, l.AllowN(10))
+	require.False(t, l.Allow())
+}
+
+func TestDecayingLimiter_Decay(t *testing.T) {
+	l := NewDecayingLimiter(10, time.Second) // One per 100ms
+	require.True(t, l.AllowN(10))
+	require.False(t, l.Allow())
+
+	time.Sleep(250 * time.Millisecond) // 2.5 have decayed, value rounded up
+	require.Equal(t, int64(8), l.Value())
+	require.Equal(t, int64(2), l.Remaining())
+	require.True(t, l.AllowN(2))
+	require.False(t, l.Allow())
+
+	time.Sleep(1100 * time.Millisecond) // Everything decayed
+	require.Equal(t, int64(0), l.Value())
+	require.True(t, l.NextExpiry().IsZero())
+}
+
+func TestDecayingLimiter_NextExpiry(t *testing.T) {
+	l := NewDecayingLimiter(24, 24*time.Hour) // One per hour
+	require.True(t, l.NextExpiry().IsZero())
+
+	start := time.Now()
+	require.True(t, l.AllowN(3))
+	require.WithinDuration(t, start.Add(time.Hour), l.NextExpiry(), time.Second)
+}
+
 func TestLimitWriter_WriteNoLimiter(t *testing.T) {
 	var buf bytes.Buffer
 	lw := NewLimitWriter(&buf)
@@ -147,3 +288,97 @@ func TestLimitWriter_WriteTwoDifferentLimiters_Wait_FixedLimiterFail(t *testing.
 	_, err = lw.Write(make([]byte, 8)) // <<< FixedLimiter fails
 	require.Equal(t, ErrLimitReached, err)
 }
+
+func TestThrottledReader_Read(t *testing.T) {
+	content := strings.Repeat("x", 3000)
+	r := NewThrottledReader(strings.NewReader(content), rate.NewLimiter(rate.Limit(10000), 1000))
+	start := time.Now()
+	b, err := io.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, content, string(b))
+	require.True(t, time.Since(start) >= 150*time.Millisecond) // 1000 bytes burst, then 2000 bytes at 10000/s
+}
+
+func TestRedisFixedLimiter_SharedValue(t *testing.T) {
+	server := miniredis.RunT(t)
+	client1, client2 := NewRedisClient(server.Addr()), NewRedisClient(server.Addr())
+	l1 := NewRedisFixedLimiterWithValue(client1, "visitor:1", 5, 2)
+	l2 := NewRedisFixedLimiterWithValue(client2, "visitor:1", 5, 0) // Initial value is ignored, key exists
+	require.False(t, server.Exists("visitor:1"))                    // Key is created on first use
+
+	require.True(t, l1.AllowN(2))
+	require.True(t, l2.Allow())
+	require.False(t, l2.Allow()) // Shared limit reached
+	require.Equal(t, int64(5), l2.Value())
+	require.Equal(t, int64(0), l2.Remaining())
+
+	// Values are cached, and refreshed in the background
+	require.Equal(t, int64(4), l1.Value())
+	l1.cacheDuration = 0
+	l1.Value()
+	require.Eventually(t, func() bool { return l1.Value() == 5 }, time.Second, 10*time.Millisecond)
+
+	require.True(t, l1.AllowN(-1))
+	require.Equal(t, int64(1), l1.Remaining())
+	l2.Reset()
+	require.Equal(t, int64(0), l2.Value())
+	require.Eventually(t, func() bool { return l1.Value() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestRedisFixedLimiter_InitialValue(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := NewRedisClient(server.Addr())
+	l := NewRedisFixedLimiterWithValue(client, "visitor:1", 5, 3)
+	l.cacheDuration = 0
+
+	// A missing key does not override the initial value before the limiter is used
+	l.Value()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int64(3), l.Value())
+	require.False(t, server.Exists("visitor:1"))
+	require.True(t, l.Allow())
+	value, err := server.Get("visitor:1")
+	require.Nil(t, err)
+	require.Equal(t, "4", value)
+	require.True(t, server.TTL("visitor:1") > 24*time.Hour)
+
+	// Once it was used, a missing key was reset (or expired)
+	server.Del("visitor:1")
+	require.True(t, l.Allow())
+	require.Equal(t, int64(1), l.Value())
+}
+
+func TestRedisFixedLimiter_Concurrent(t *testing.T) {
+	server := miniredis.RunT(t)
+	client1, client2 := NewRedisClient(server.Addr()), NewRedisClient(server.Addr())
+	l1, l2 := NewRedisFixedLimiter(client1, "visitor:1", 50), NewRedisFixedLimiter(client2, "visitor:1", 50)
+
+	// Concurrent processes never reject each other while the pool has room
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(l *RedisFixedLimiter) {
+			defer wg.Done()
+			if l.Allow() {
+				allowed.Add(1)
+			}
+		}([]*RedisFixedLimiter{l1, l2}[i%2])
+	}
+	wg.Wait()
+	require.Equal(t, int64(50), allowed.Load())
+	require.Equal(t, int64(50), l1.Value())
+}
+
+func TestRedisFixedLimiter_FallbackToMemory(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := NewRedisClient(server.Addr())
+	l := NewRedisFixedLimiter(client, "visitor:1", 3)
+	require.True(t, l.AllowN(2))
+
+	// Redis goes away, limiter continues with the last known value
+	server.Close()
+	require.True(t, l.Allow())
+	require.False(t, l.Allow())
+	require.Equal(t, int64(3), l.Value())
+}
@@ -0,0 +1,81 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisDefaultTimeout    = time.Second
+	redisDefaultRetryAfter = 10 * time.Second
+)
+
+// ErrRedisUnavailable is returned by the RedisClient if the server could not be reached recently,
+// and the client is waiting before trying to reconnect
+var ErrRedisUnavailable = errors.New("redis unavailable")
+
+// RedisClient is a client for the Redis server that stores shared limiters (see RedisFixedLimiter). It wraps
+// a go-redis client with short timeouts. If the server is unreachable, commands fail fast with ErrRedisUnavailable
+// for a while, so that callers can fall back to local state without waiting on every call.
+// RedisClient may be used by multiple goroutines.
+type RedisClient struct {
+	client     *redis.Client
+	timeout    time.Duration
+	retryAfter time.Duration
+	downUntil  time.Time
+	mu         sync.Mutex
+}
+
+// NewRedisClient creates a new RedisClient for the given address (host:port). No connection is established
+// until the first command is sent.
+func NewRedisClient(addr string) *RedisClient {
+	return &RedisClient{
+		client: redis.NewClient(&redis.Options{
+			Addr:         addr,
+			DialTimeout:  redisDefaultTimeout,
+			ReadTimeout:  redisDefaultTimeout,
+			WriteTimeout: redisDefaultTimeout,
+			MaxRetries:   -1, // Callers fall back to local state instead
+		}),
+		timeout:    redisDefaultTimeout,
+		retryAfter: redisDefaultRetryAfter,
+	}
+}
+
+// Do calls fn with the underlying client, and a context that is cancelled after the client's timeout. Errors
+// returned by the server itself (e.g. redis.Nil) are passed through. Any other error (e.g. a connection error)
+// makes the client fail fast with ErrRedisUnavailable until the retry interval has passed.
+func (c *RedisClient) Do(fn func(ctx context.Context, client redis.Cmdable) error) error {
+	c.mu.Lock()
+	down := time.Now().Before(c.downUntil)
+	c.mu.Unlock()
+	if down {
+		return ErrRedisUnavailable
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	err := fn(ctx, c.client)
+	var redisErr redis.Error
+	if err != nil && !errors.As(err, &redisErr) {
+		c.mu.Lock()
+		c.downUntil = time.Now().Add(c.retryAfter)
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// Ping checks if the server is reachable
+func (c *RedisClient) Ping() error {
+	return c.Do(func(ctx context.Context, client redis.Cmdable) error {
+		return client.Ping(ctx).Err()
+	})
+}
+
+// Close closes all connections to the server
+func (c *RedisClient) Close() error {
+	return c.client.Close()
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRedisClient_Do(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := NewRedisClient(server.Addr())
+	defer client.Close()
+	require.Nil(t, client.Ping())
+
+	var value int64
+	err := client.Do(func(ctx context.Context, rc redis.Cmdable) error {
+		var err error
+		if err = rc.Set(ctx, "mykey", 5, 0).Err(); err != nil {
+			return err
+		}
+		value, err = rc.IncrBy(ctx, "mykey", 2).Result()
+		return err
+	})
+	require.Nil(t, err)
+	require.Equal(t, int64(7), value)
+
+	err = client.Do(func(ctx context.Context, rc redis.Cmdable) error {
+		return rc.Get(ctx, "doesnotexist").Err()
+	})
+	require.Equal(t, redis.Nil, err)
+	err = client.Do(func(ctx context.Context, rc redis.Cmdable) error {
+		if err := rc.Set(ctx, "mykey", "not a number", 0).Err(); err != nil {
+			return err
+		}
+		return rc.IncrBy(ctx, "mykey", 1).Err()
+	})
+	require.NotNil(t, err)
+	require.Nil(t, client.Ping()) // Server errors do not make the client fail fast
+}
+
+func TestRedisClient_Unavailable(t *testing.T) {
+	server := miniredis.RunT(t)
+	addr := server.Addr()
+	server.Close()
+
+	client := NewRedisClient(addr)
+	require.NotNil(t, client.Ping())
+	require.Equal(t, ErrRedisUnavailable, client.Ping()) // Fails fast until retryAfter has passed
+}
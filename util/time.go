@@ -35,6 +35,12 @@ func NextOccurrenceUTC(timeOfDay, base time.Time) time.Time {
 	return next
 }
 
+// NextMidnight returns the next midnight after base in the given location, i.e. the start of the next calendar day
+func NextMidnight(base time.Time, loc *time.Location) time.Time {
+	now := base.In(loc)
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, loc)
+}
+
 // ParseFutureTime parses a date/time string to a time.Time. It supports unix timestamps, durations
 // and natural language dates
 func ParseFutureTime(s string, now time.Time) (time.Time, error) {
@@ -31,6 +31,16 @@ func TestNextOccurrenceUTC_SameDay(t *testing.T) {
 	require.Equal(t, time.Date(2023, time.January, 11, 4, 0, 0, 0, time.UTC), nextRunTme)
 }
 
+func TestNextMidnight(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	require.Nil(t, err)
+
+	now := time.Date(2023, time.January, 10, 23, 30, 0, 0, time.UTC) // Already Jan 11 in Berlin
+	require.Equal(t, time.Date(2023, time.January, 12, 0, 0, 0, 0, loc), NextMidnight(now, loc))
+	require.Equal(t, time.Date(2023, time.January, 11, 0, 0, 0, 0, time.UTC), NextMidnight(now, time.UTC))
+	require.Equal(t, time.Date(2023, time.March, 26, 0, 0, 0, 0, loc), NextMidnight(time.Date(2023, time.March, 25, 12, 0, 0, 0, loc), loc)) // DST change
+}
+
 func TestParseFutureTime_11am_FutureTime(t *testing.T) {
 	d, err := ParseFutureTime("11am", base)
 	require.Nil(t, err)
@@ -392,7 +392,7 @@ func MinMax[T int | int64](value, min, max T) T {
 }
 
 // Max returns the maximum value of the two given values
-func Max[T int | int64 | rate.Limit](a, b T) T {
+func Max[T int | int64 | rate.Limit | time.Duration](a, b T) T {
 	if a > b {
 		return a
 	}
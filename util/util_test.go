@@ -261,6 +261,7 @@ func TestMax(t *testing.T) {
 	require.Equal(t, 9, Max(1, 9))
 	require.Equal(t, 9, Max(9, 1))
 	require.Equal(t, rate.Every(time.Minute), Max(rate.Every(time.Hour), rate.Every(time.Minute)))
+	require.Equal(t, time.Duration(0), Max(-time.Second, 0))
 }
 
 func TestPointerFunctions(t *testing.T) {
@@ -611,7 +611,7 @@ const Stats = () => {
               {account.stats.messages.toLocaleString()}
             </Typography>
             <Typography variant="body2" sx={{ float: "right" }}>
-              {account.role === Role.USER
+              {account.role === Role.USER && account.limits.messages >= 0
                 ? t("account_usage_of_limit", {
                     limit: account.limits.messages.toLocaleString(),
                   })
@@ -620,7 +620,9 @@ const Stats = () => {
           </div>
           <LinearProgress
             variant="determinate"
-            value={account.role === Role.USER ? normalize(account.stats.messages, account.limits.messages) : 100}
+            value={
+              account.role === Role.USER && account.limits.messages >= 0 ? normalize(account.stats.messages, account.limits.messages) : 100
+            }
           />
         </Pref>
         {config.enable_emails && (
@@ -641,7 +643,7 @@ const Stats = () => {
                 {account.stats.emails.toLocaleString()}
               </Typography>
               <Typography variant="body2" sx={{ float: "right" }}>
-                {account.role === Role.USER
+                {account.role === Role.USER && account.limits.emails >= 0
                   ? t("account_usage_of_limit", {
                       limit: account.limits.emails.toLocaleString(),
                     })
@@ -650,7 +652,9 @@ const Stats = () => {
             </div>
             <LinearProgress
               variant="determinate"
-              value={account.role === Role.USER ? normalize(account.stats.emails, account.limits.emails) : 100}
+              value={
+                account.role === Role.USER && account.limits.emails >= 0 ? normalize(account.stats.emails, account.limits.emails) : 100
+              }
             />
           </Pref>
         )}